@@ -0,0 +1,76 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The Append functions write a single value in 'shell mode' at the end of
+// a byte slice, with the same formatting than Marshal. They allow to build
+// documents manually without extra allocations.
+
+// MarshalAppend appends the 'shell mode' encoding of value to dst, like
+// Marshal, and returns the extended buffer. It allows to reuse the same
+// output buffer across many calls. Encoder.Append does the same for the
+// other formats.
+func MarshalAppend(dst []byte, value interface{}) ([]byte, error) {
+	return NewShellEncoder(nil).Append(dst, value)
+}
+
+// AppendObjectID appends id to dst as ObjectId("5a934e000102030405000000")
+// and returns the extended buffer.
+func AppendObjectID(dst []byte, id primitive.ObjectID) []byte {
+	dst = append(dst, `ObjectId("`...)
+	dst = appendHex(dst, id[:])
+	return append(dst, `")`...)
+}
+
+// AppendISODate appends t to dst as ISODate("2016-05-15T01:02:03.004Z")
+// and returns the extended buffer.
+func AppendISODate(dst []byte, t time.Time) []byte {
+	dst = append(dst, `ISODate("`...)
+	dst = t.AppendFormat(dst, jdateFormat)
+	return append(dst, `")`...)
+}
+
+// AppendBinData appends a binary value to dst as BinData(2,"Zm9v")
+// and returns the extended buffer. Like in the shell, the subtype is
+// written in decimal, so 0x80 is written BinData(128,"Zm9v").
+func AppendBinData(dst []byte, subtype byte, data []byte) []byte {
+	dst = append(dst, `BinData(`...)
+	dst = strconv.AppendUint(dst, uint64(subtype), 10)
+	dst = append(dst, `,"`...)
+	dst = appendBase64(dst, data)
+	return append(dst, `")`...)
+}
+
+// appendHex appends the lowercase hexadecimal encoding of data to dst.
+func appendHex(dst, data []byte) []byte {
+	for _, b := range data {
+		dst = append(dst, hex[b>>4], hex[b&0xF])
+	}
+	return dst
+}
+
+// appendBase64 appends the standard base64 encoding of data to dst.
+func appendBase64(dst, data []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, base64.StdEncoding.EncodedLen(len(data)))...)
+	base64.StdEncoding.Encode(dst[n:], data)
+	return dst
+}
+
+// AppendQuotedString appends s to dst as a double quoted string, escaping
+// it when needed, and returns the extended buffer.
+func AppendQuotedString(dst []byte, s string) []byte {
+	e := newEncodeState()
+	e.string(s, true)
+	dst = append(dst, e.Bytes()...)
+	encodeStatePool.Put(e)
+	return dst
+}
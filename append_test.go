@@ -0,0 +1,71 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAppend(t *testing.T) {
+
+	t.Parallel()
+
+	var b []byte
+	b = append(b, `{"_id":`...)
+	b = mongoextjson.AppendObjectID(b, objectID)
+	b = append(b, `,"date":`...)
+	b = mongoextjson.AppendISODate(b, time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC))
+	b = append(b, `,"bin":`...)
+	b = mongoextjson.AppendBinData(b, 0x80, []byte("foo"))
+	b = append(b, `,"str":`...)
+	b = mongoextjson.AppendQuotedString(b, "a\"b<c>\n")
+	b = append(b, '}')
+
+	want := `{"_id":ObjectId("5a934e000102030405000000"),"date":ISODate("2016-05-15T01:02:03.004Z"),"bin":BinData(128,"Zm9v"),"str":"a\"b\u003cc\u003e\n"}`
+	if string(b) != want {
+		t.Errorf("expected\n%s\nbut got\n%s", want, b)
+	}
+
+	var v map[string]interface{}
+	if err := mongoextjson.Unmarshal(b, &v); err != nil {
+		t.Fatalf("appended document should be valid, but got %v", err)
+	}
+	if want := (primitive.Binary{Subtype: 0x80, Data: []byte("foo")}); !reflect.DeepEqual(want, v["bin"]) {
+		t.Errorf("expected %#v, but got %#v", want, v["bin"])
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+
+	t.Parallel()
+
+	buf := []byte("prefix ")
+	buf, err := mongoextjson.MarshalAppend(buf, map[string]interface{}{"_id": objectID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, '\n')
+	buf, err = mongoextjson.MarshalAppend(buf, []int64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "prefix {\"_id\":ObjectId(\"5a934e000102030405000000\")}\n[NumberLong(1)]"
+	if string(buf) != want {
+		t.Errorf("expected\n%s\nbut got\n%s", want, buf)
+	}
+
+	// dst is returned untouched on error
+	buf, err = mongoextjson.MarshalAppend(buf[:0], make(chan int))
+	if err == nil {
+		t.Error("expected an error for unsupported type")
+	}
+	if len(buf) != 0 {
+		t.Errorf("expected an empty buffer, but got %s", buf)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// benchDoc holds the types found in most exported documents.
+var benchDoc = bson.D{
+	{Key: "_id", Value: objectID},
+	{Key: "created", Value: time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC)},
+	{Key: "updated", Value: primitive.DateTime(1463274123004)},
+	{Key: "count", Value: 42},
+	{Key: "total", Value: int64(1 << 40)},
+	{Key: "rank", Value: int32(7)},
+	{Key: "score", Value: 12.5},
+	{Key: "name", Value: "john doe"},
+	{Key: "data", Value: []byte("some binary data")},
+	{Key: "uuid", Value: primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}},
+	{Key: "tags", Value: bson.A{"a", "b", objectID}},
+}
+
+func benchmarkMarshal(b *testing.B, marshal func(interface{}) ([]byte, error)) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := marshal(benchDoc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	benchmarkMarshal(b, mongoextjson.Marshal)
+}
+
+func BenchmarkMarshalCanonical(b *testing.B) {
+	benchmarkMarshal(b, mongoextjson.MarshalCanonical)
+}
+
+func BenchmarkMarshalCanonicalV2(b *testing.B) {
+	benchmarkMarshal(b, mongoextjson.MarshalCanonicalV2)
+}
+
+func BenchmarkEncoderAppend(b *testing.B) {
+	enc := mongoextjson.NewCanonicalV2Encoder(nil)
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = enc.Append(buf[:0], benchDoc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchJSON is benchDoc in 'shell mode', with a few of the other
+// syntaxes found in exports.
+var benchJSON = []byte(`{
+	"_id": ObjectId("5a934e000102030405000000"),
+	"created": ISODate("2016-05-15T01:02:03.004Z"),
+	"updated": {"$date": {"$numberLong": "1463274123004"}},
+	"count": 42,
+	"total": NumberLong(1099511627776),
+	"rank": NumberInt(7),
+	"score": 12.5,
+	"name": "john doe",
+	"data": BinData(0, "c29tZSBiaW5hcnkgZGF0YQ=="),
+	"uuid": {"$binary": {"base64": "MDEyMzQ1Njc4OWFiY2RlZg==", "subType": "04"}},
+	"tags": ["a", "b", {"$oid": "5a934e000102030405000000"}]
+}`)
+
+func BenchmarkUnmarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var doc bson.M
+		if err := mongoextjson.Unmarshal(benchJSON, &doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUnmarshalCanonicalV2 decodes benchDoc in extended JSON v2
+// 'canonical mode', where every value but strings is a keyed object.
+func BenchmarkUnmarshalCanonicalV2(b *testing.B) {
+	doc := append(bson.D{
+		{Key: "ts", Value: primitive.Timestamp{T: 1463274123, I: 1}},
+		{Key: "old", Value: time.Date(1970, 1, 1, 0, 0, 1, 0, time.UTC)},
+	}, benchDoc...)
+	data, err := mongoextjson.MarshalCanonicalV2(doc)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var doc bson.M
+		if err := mongoextjson.Unmarshal(data, &doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type benchOrder struct {
+	ID       primitive.ObjectID `json:"_id"`
+	Created  time.Time          `json:"created"`
+	Customer string             `json:"customer"`
+	Status   string             `json:"status"`
+	Total    float64            `json:"total"`
+	Quantity int                `json:"quantity"`
+	Paid     bool               `json:"paid"`
+	Tags     []string           `json:"tags"`
+	Address  struct {
+		Street string `json:"street"`
+		City   string `json:"city"`
+		Zip    string `json:"zip"`
+	} `json:"address"`
+}
+
+var benchOrderJSON = []byte(`{"_id": ObjectId("5a934e000102030405000000"), "created": ISODate("2016-05-15T01:02:03.004Z"), "customer": "john doe", "status": "shipped", "total": 125.5, "quantity": 3, "paid": true, "tags": ["a", "b"], "address": {"street": "1 main street", "city": "springfield", "zip": "12345"}}`)
+
+func BenchmarkUnmarshalStruct(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var o benchOrder
+		if err := mongoextjson.Unmarshal(benchOrderJSON, &o); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalStruct(b *testing.B) {
+	var o benchOrder
+	if err := mongoextjson.Unmarshal(benchOrderJSON, &o); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := mongoextjson.Marshal(o); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
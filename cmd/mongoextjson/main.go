@@ -0,0 +1,266 @@
+// Copyright (c) 2020 - Adrien Petel
+
+// Command mongoextjson converts, formats and validates MongoDB extended
+// JSON, reading the files given as arguments or the standard input.
+//
+// Usage:
+//
+//	mongoextjson convert [-to shell|mongosh|canonical|v2] [file ...]
+//	mongoextjson fmt [-compact] [-indent string] [-w] [file ...]
+//	mongoextjson validate [file ...]
+//
+// The input may hold several documents, separated by whitespace, like
+// the files written by mongoexport.
+//
+// convert decodes the documents, in any supported syntax, and writes
+// them one per line with the format given by -to: 'shell mode' of the
+// legacy mongo shell or of mongosh, 'strict mode' of the extended JSON v1,
+// or 'canonical mode' of the extended JSON v2. The order of the keys and
+// the BSON types are kept; plain numbers are doubles, like in the shell.
+//
+// fmt reindents the documents, or compacts them with -compact, without
+// changing their syntax. With -w, the files are rewritten in place
+// instead of being written to the standard output.
+//
+// validate reports the documents that can't be decoded, and exits with
+// status 1 if there is any.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+const usage = `usage: mongoextjson <command> [flags] [file ...]
+
+commands:
+  convert   convert documents between shell, canonical and v2 formats
+  fmt       pretty print or compact documents
+  validate  check that documents are valid
+
+Run 'mongoextjson <command> -h' for the flags of a command.
+`
+
+// run executes the command described by args and returns the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var cmd func(args []string, stdin io.Reader, stdout, stderr io.Writer) error
+	switch args[0] {
+	case "convert":
+		cmd = convert
+	case "fmt":
+		cmd = format
+	case "validate":
+		cmd = validate
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "mongoextjson: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	err := cmd(args[1:], stdin, stdout, stderr)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		fmt.Fprintf(stderr, "mongoextjson: %v\n", err)
+		return 1
+	}
+}
+
+// errUsage is returned by the commands when the flags are invalid, the
+// error being already reported by the flag set.
+var errUsage = errors.New("invalid usage")
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("mongoextjson "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+func parse(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return errUsage
+	}
+	return err
+}
+
+// input is a named source of documents.
+type input struct {
+	name string
+	r    io.Reader
+}
+
+// inputs calls f for each of the files, or for stdin if there is none.
+func inputs(files []string, stdin io.Reader, f func(in input) error) error {
+	if len(files) == 0 {
+		return f(input{name: "<stdin>", r: stdin})
+	}
+	for _, name := range files {
+		// the whole file is read, so that it can be rewritten by f
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := f(input{name: name, r: bytes.NewReader(data)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// each calls f with each document of in, in its raw form.
+func each(in input, f func(doc mongoextjson.RawExtJSON) error) error {
+	dec := mongoextjson.NewExtendedDecoder(in.r)
+	for {
+		var doc mongoextjson.RawExtJSON
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", in.name, err)
+		}
+		if err := f(doc); err != nil {
+			return err
+		}
+	}
+}
+
+func newEncoder(to string, w io.Writer) (*mongoextjson.Encoder, error) {
+	switch to {
+	case "shell":
+		return mongoextjson.NewShellEncoder(w), nil
+	case "mongosh":
+		enc := mongoextjson.NewShellEncoder(w)
+		enc.SetDialect(mongoextjson.DialectMongosh)
+		return enc, nil
+	case "canonical":
+		return mongoextjson.NewCanonicalEncoder(w), nil
+	case "v2":
+		return mongoextjson.NewCanonicalV2Encoder(w), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected shell, mongosh, canonical or v2", to)
+}
+
+func convert(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := newFlagSet("convert", stderr)
+	to := fs.String("to", "v2", "output `format`: shell, mongosh, canonical or v2")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	enc, err := newEncoder(*to, stdout)
+	if err != nil {
+		return err
+	}
+	enc.DisableHTMLEscaping()
+
+	return inputs(fs.Args(), stdin, func(in input) error {
+		dec := mongoextjson.NewExtendedDecoder(in.r)
+		dec.UseOrderedDocuments()
+		for {
+			var doc interface{}
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", in.name, err)
+			}
+			if err := enc.Encode(doc); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(stdout, "\n"); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func format(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := newFlagSet("fmt", stderr)
+	compact := fs.Bool("compact", false, "remove the insignificant whitespace")
+	indent := fs.String("indent", "  ", "indentation `string` of the pretty output")
+	write := fs.Bool("w", false, "rewrite the files in place")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if *write && fs.NArg() == 0 {
+		return errors.New("fmt: -w requires files")
+	}
+
+	return inputs(fs.Args(), stdin, func(in input) error {
+		var buf bytes.Buffer
+		err := each(in, func(doc mongoextjson.RawExtJSON) error {
+			if *compact {
+				err := mongoextjson.Compact(&buf, doc)
+				buf.WriteByte('\n')
+				return err
+			}
+			err := mongoextjson.Indent(&buf, doc, "", *indent)
+			buf.WriteByte('\n')
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if *write {
+			return os.WriteFile(in.name, buf.Bytes(), 0666)
+		}
+		_, err = stdout.Write(buf.Bytes())
+		return err
+	})
+}
+
+func validate(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := newFlagSet("validate", stderr)
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	invalid := 0
+	err := inputs(fs.Args(), stdin, func(in input) error {
+		dec := mongoextjson.NewExtendedDecoder(in.r)
+		for {
+			var doc interface{}
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				// the rest of the input can't be read reliably
+				fmt.Fprintf(stderr, "%s: %v\n", in.name, err)
+				invalid++
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid input(s)", invalid)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sample = `{_id: ObjectId("5a934e000102030405000000"), n: NumberInt(1), d: 2.5}
+{"a": {"$date": {"$numberLong": "1000"}}}`
+
+func TestConvert(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		to   string
+		want string
+	}{
+		{
+			to: "v2",
+			want: `{"_id":{"$oid":"5a934e000102030405000000"},"n":{"$numberInt":"1"},"d":{"$numberDouble":"2.5"}}
+{"a":{"$date":{"$numberLong":"1000"}}}
+`,
+		},
+		{
+			to: "canonical",
+			want: `{"_id":{"$oid":"5a934e000102030405000000"},"n":{"$numberInt":"1"},"d":2.5}
+{"a":{"$date":"1970-01-01T00:00:01Z"}}
+`,
+		},
+		{
+			to: "shell",
+			want: `{"_id":ObjectId("5a934e000102030405000000"),"n":1,"d":2.5}
+{"a":ISODate("1970-01-01T00:00:01Z")}
+`,
+		},
+		{
+			to: "mongosh",
+			want: `{_id:ObjectId('5a934e000102030405000000'),n:Int32(1),d:Double(2.5)}
+{a:ISODate('1970-01-01T00:00:01Z')}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"convert", "-to", tt.to}, strings.NewReader(sample), &stdout, &stderr)
+		if code != 0 {
+			t.Fatalf("convert -to %s: exit status %d: %s", tt.to, code, stderr.String())
+		}
+		if got := stdout.String(); tt.want != got {
+			t.Errorf("convert -to %s: expected\n%s\nbut got\n%s", tt.to, tt.want, got)
+		}
+	}
+}
+
+func TestFmt(t *testing.T) {
+
+	t.Parallel()
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"fmt", "-compact"}, strings.NewReader(sample), &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr.String())
+	}
+	want := `{_id:ObjectId("5a934e000102030405000000"),n:NumberInt(1),d:2.5}
+{"a":{"$date":{"$numberLong":"1000"}}}
+`
+	if got := stdout.String(); want != got {
+		t.Errorf("expected\n%s\nbut got\n%s", want, got)
+	}
+
+	name := filepath.Join(t.TempDir(), "doc.json")
+	if err := os.WriteFile(name, []byte(`{"a": [1,2]}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"fmt", "-w", "-indent", "\t", name}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr.String())
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "{\n\t\"a\": [\n\t\t1,\n\t\t2\n\t]\n}\n"
+	if got := string(b); want != got {
+		t.Errorf("expected\n%s\nbut got\n%s", want, got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		input  string
+		code   int
+		stderr string
+	}{
+		{input: sample, code: 0},
+		{
+			input:  "{a: 1}\n{b: ObjectId(1)}",
+			code:   1,
+			stderr: "<stdin>: json: cannot unmarshal number into Go value of type string in b at line 2, column 5\nmongoextjson: 1 invalid input(s)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"validate"}, strings.NewReader(tt.input), &stdout, &stderr)
+		if code != tt.code {
+			t.Errorf("expected exit status %d, but got %d", tt.code, code)
+		}
+		if got := stderr.String(); tt.stderr != got {
+			t.Errorf("expected %q, but got %q", tt.stderr, got)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+
+	t.Parallel()
+
+	var stdout, stderr bytes.Buffer
+	if code := run(nil, nil, &stdout, &stderr); code != 2 {
+		t.Errorf("expected exit status 2, but got %d", code)
+	}
+	if code := run([]string{"unknown"}, nil, &stdout, &stderr); code != 2 {
+		t.Errorf("expected exit status 2, but got %d", code)
+	}
+	if code := run([]string{"convert", "-to", "xml"}, strings.NewReader(sample), &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit status 1, but got %d", code)
+	}
+	if code := run([]string{"fmt", "-unknown"}, nil, &stdout, &stderr); code != 2 {
+		t.Errorf("expected exit status 2, but got %d", code)
+	}
+}
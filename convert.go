@@ -0,0 +1,275 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bytes"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// ConvertToCanonical rewrites the shell mode constructs of src, like
+// ObjectId("..."), ISODate("...") or NumberLong(1), into their 'strict mode'
+// equivalents, like {"$oid":"..."}. Unquoted keys and strings quoted with
+// single quotes or backticks are rewritten as double quoted strings.
+//
+// Everything else, key order and whitespace included, is copied verbatim,
+// as decoding into a bson.M would lose the key order. Numbers are copied
+// as is, even when they use JavaScript only syntax like 0xFF.
+func ConvertToCanonical(src []byte) ([]byte, error) {
+	var scan scanner
+	scan.reset()
+
+	dst := make([]byte, 0, len(src))
+	start := -1 // start of the shell construct being copied
+	depth := 0
+	isKey := false
+
+	var err error
+	for i, c := range src {
+		scan.bytes++
+		op := scan.step(&scan, c)
+		if op == scanError {
+			return nil, scan.err
+		}
+		if start >= 0 {
+			// function arguments are part of the construct
+			if op == scanContinue || len(scan.parseState) > depth {
+				continue
+			}
+			end := i
+			if op == scanEndParams {
+				end = i + 1
+			}
+			dst, err = appendCanonical(dst, src[start:end], isKey)
+			if err != nil {
+				return nil, err
+			}
+			start = -1
+			if op == scanEndParams {
+				continue
+			}
+		}
+		if op == scanBeginName || op == scanBeginLiteral && (c == '\'' || c == '`' || isSignedSpecialFloat(src[i:])) {
+			start = i
+			depth = len(scan.parseState)
+			isKey = depth > 0 && scan.parseState[depth-1] == parseObjectKey
+			continue
+		}
+		dst = append(dst, c)
+	}
+	if scan.eof() == scanError {
+		return nil, scan.err
+	}
+	if start >= 0 {
+		return appendCanonical(dst, src[start:], false)
+	}
+	return dst, nil
+}
+
+// isSignedSpecialFloat reports whether data starts with a signed special
+// float literal, like -Infinity or +NaN, which has to be rewritten like
+// Infinity and NaN.
+func isSignedSpecialFloat(data []byte) bool {
+	if len(data) < 2 || data[0] != '-' && data[0] != '+' {
+		return false
+	}
+	switch data[1] {
+	case 'I', 'i', 'N', 'n':
+		return true
+	}
+	return false
+}
+
+// appendCanonical appends to dst the 'strict mode' encoding of the
+// shell construct item, which is a key if isKey is true.
+func appendCanonical(dst, item []byte, isKey bool) ([]byte, error) {
+	if isKey {
+		key := string(item)
+		if item[0] == '\'' || item[0] == '`' {
+			if err := Unmarshal(item, &key); err != nil {
+				return nil, err
+			}
+		}
+		return AppendQuotedString(dst, key), nil
+	}
+	if bytes.Equal(item, trueBytes) || bytes.Equal(item, falseBytes) || bytes.Equal(item, nullBytes) {
+		return append(dst, item...), nil
+	}
+
+	var v interface{}
+	if err := Unmarshal(item, &v); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst)
+	enc := NewCanonicalEncoder(buf)
+	enc.encodeValueType(reflect.TypeOf(float64(0)), specialFloatEncoder(EncodeSpecialFloatNumberDouble))
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ConvertToShell is the mirror of ConvertToCanonical: it rewrites the
+// extended JSON objects of src, like {"$oid":"..."} or {"$date":"..."},
+// into their 'shell mode' equivalents, like ObjectId("...") or
+// ISODate("..."). Everything else is copied verbatim.
+func ConvertToShell(src []byte) ([]byte, error) {
+	var scan, sub scanner
+	scan.reset()
+
+	dst := make([]byte, 0, len(src))
+	skip := 0 // bytes before skip have already been converted
+	for i, c := range src {
+		scan.bytes++
+		op := scan.step(&scan, c)
+		if op == scanError {
+			return nil, scan.err
+		}
+		if i < skip {
+			continue
+		}
+		if op == scanBeginObject {
+			if key := firstKey(src[i+1:]); jsonExt.keyed[key] != nil {
+				obj, _, err := nextValue(src[i:], &sub)
+				if err != nil {
+					return nil, err
+				}
+				var converted bool
+				dst, converted, err = appendShell(dst, obj, key)
+				if err != nil {
+					return nil, err
+				}
+				if converted {
+					skip = i + len(obj)
+					continue
+				}
+			}
+		}
+		dst = append(dst, c)
+	}
+	if scan.eof() == scanError {
+		return nil, scan.err
+	}
+	return dst, nil
+}
+
+// firstKey returns the first key of the object data, which starts
+// right after the opening brace, or an empty string if it can't
+// be read without decoding.
+func firstKey(data []byte) string {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 || data[0] != '"' {
+		return ""
+	}
+	end := bytes.IndexByte(data[1:], '"')
+	if end < 0 {
+		return ""
+	}
+	return string(data[1 : end+1])
+}
+
+// keyedFields lists, for the extended JSON objects made of several
+// fields, the fields they may hold besides the first one. The other
+// objects hold a single field.
+var keyedFields = map[string][]string{
+	"$binary": {"$type"},
+	"$code":   {"$scope"},
+	"$ref":    {"$id", "$db"},
+	"$regex":  {"$options"},
+}
+
+// appendShell appends to dst the 'shell mode' encoding of the extended
+// JSON object obj, whose first key is key. It returns false if obj is a
+// regular document, or holds other fields than the ones of the extended
+// JSON object, which would be lost.
+func appendShell(dst, obj []byte, key string) ([]byte, bool, error) {
+	var fields map[string]rawValue
+	if err := jdec(obj, &fields); err != nil {
+		return nil, false, err
+	}
+	for k := range fields {
+		if k != key && !containsString(keyedFields[key], k) {
+			return dst, false, nil
+		}
+	}
+	var v interface{}
+	if err := Unmarshal(obj, &v); err != nil {
+		return nil, false, err
+	}
+	if _, ok := v.(map[string]interface{}); ok {
+		return dst, false, nil
+	}
+	buf := bytes.NewBuffer(dst)
+	enc := NewShellEncoder(buf)
+	enc.encodeValueType(reflect.TypeOf(float64(0)), specialFloatEncoder(EncodeSpecialFloatLiteral))
+	if err := enc.Encode(v); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FromBSON converts the BSON document raw into its 'shell mode' encoding,
+// like Marshal. It walks the BSON bytes directly, so the key order of the
+// documents, which decoding into a bson.M would lose, is preserved.
+func FromBSON(raw []byte) ([]byte, error) {
+	doc := bsoncore.Document(raw)
+	if err := doc.Validate(); err != nil {
+		return nil, err
+	}
+	return appendBSONDocument(make([]byte, 0, 2*len(raw)), doc, false)
+}
+
+// appendBSONDocument appends to dst the 'shell mode' encoding of the BSON
+// document doc, or of the BSON array doc when array is true.
+func appendBSONDocument(dst []byte, doc bsoncore.Document, array bool) ([]byte, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	open, end := byte('{'), byte('}')
+	if array {
+		open, end = '[', ']'
+	}
+	dst = append(dst, open)
+	for i, elem := range elems {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		if !array {
+			dst = AppendQuotedString(dst, elem.Key())
+			dst = append(dst, ':')
+		}
+		dst, err = appendBSONValue(dst, elem.Value())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, end), nil
+}
+
+func appendBSONValue(dst []byte, v bsoncore.Value) ([]byte, error) {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		return appendBSONDocument(dst, v.Document(), false)
+	case bsontype.Array:
+		return appendBSONDocument(dst, bsoncore.Document(v.Array()), true)
+	}
+	var x interface{}
+	if err := (bson.RawValue{Type: v.Type, Value: v.Data}).Unmarshal(&x); err != nil {
+		return nil, err
+	}
+	return MarshalAppend(dst, x)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestConvertToCanonical(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "strict is left untouched",
+			src:  "{ \"b\": 1,\n  \"a\": {\"$oid\": \"5a934e000102030405000000\"} }",
+			want: "{ \"b\": 1,\n  \"a\": {\"$oid\": \"5a934e000102030405000000\"} }",
+		},
+		{
+			name: "functions",
+			src: "{\n  \"z\": ObjectId(\"5a934e000102030405000000\"),\n" +
+				"  \"y\": ISODate(\"2016-05-15T01:02:03.004Z\"),\n" +
+				"  \"x\": [ NumberLong(64), NumberInt( 32 ), new Date(0) ]\n}",
+			want: "{\n  \"z\": {\"$oid\":\"5a934e000102030405000000\"},\n" +
+				"  \"y\": {\"$date\":\"2016-05-15T01:02:03.004Z\"},\n" +
+				"  \"x\": [ {\"$numberLong\":\"64\"}, {\"$numberInt\":\"32\"}, {\"$date\":\"1970-01-01T00:00:00Z\"} ]\n}",
+		},
+		{
+			name: "nested functions",
+			src:  `{"r": DBRef("coll", ObjectId("5a934e000102030405000000"))}`,
+			want: `{"r": {"$ref":"coll","$id":{"$oid":"5a934e000102030405000000"}}}`,
+		},
+		{
+			name: "constants",
+			src:  `{"a": true, "b": null, "c": undefined, "d": MinKey, "e": NaN}`,
+			want: `{"a": true, "b": null, "c": {"$undefined":true}, "d": {"$minKey":1}, "e": {"$numberDouble":"NaN"}}`,
+		},
+		{
+			name: "signed special floats",
+			src:  `{"a": -Infinity, "b": +Infinity, "c": -NaN, "d": [+nan, -1, +1]}`,
+			want: `{"a": {"$numberDouble":"-Infinity"}, "b": {"$numberDouble":"Infinity"}, "c": {"$numberDouble":"NaN"}, "d": [{"$numberDouble":"NaN"}, -1, +1]}`,
+		},
+		{
+			name: "whole doubles",
+			src:  `{"a": Double(2), "b": Code("x", {"c": Double(3), "d": Infinity})}`,
+			want: `{"a": 2.0, "b": {"$code":"x","$scope":{"c":3.0,"d":{"$numberDouble":"Infinity"}}}}`,
+		},
+		{
+			name: "keys and strings",
+			src:  "{_id: 'it\\'s', 'a b': `c`}",
+			want: `{"_id": "it's", "a b": "c"}`,
+		},
+		{
+			name: "top level function",
+			src:  `ObjectId("5a934e000102030405000000")`,
+			want: `{"$oid":"5a934e000102030405000000"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := mongoextjson.ConvertToCanonical([]byte(tt.src))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: expected\n%s\nbut got\n%s", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := mongoextjson.ConvertToCanonical([]byte(`{"a": ObjectId("5a934e00")}`)); err == nil {
+		t.Error("expected an error for an invalid ObjectId")
+	}
+	if _, err := mongoextjson.ConvertToCanonical([]byte(`{"a": 1`)); err == nil {
+		t.Error("expected an error for truncated input")
+	}
+}
+
+func TestConvertToShell(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "keyed objects",
+			src: "{\n  \"z\": {\"$oid\": \"5a934e000102030405000000\"},\n" +
+				"  \"y\": { \"$date\": \"2016-05-15T01:02:03.004Z\" },\n" +
+				"  \"x\": [ {\"$numberLong\": \"64\"}, {\"$numberInt\": \"32\"}, {\"$binary\": \"Zm9v\", \"$type\": \"02\"} ]\n}",
+			want: "{\n  \"z\": ObjectId(\"5a934e000102030405000000\"),\n" +
+				"  \"y\": ISODate(\"2016-05-15T01:02:03.004Z\"),\n" +
+				"  \"x\": [ NumberLong(64), 32, BinData(2,\"Zm9v\") ]\n}",
+		},
+		{
+			name: "nested keyed objects",
+			src:  `{"r": {"$ref": "coll", "$id": {"$oid": "5a934e000102030405000000"}}}`,
+			want: `{"r": DBRef("coll",ObjectId("5a934e000102030405000000"))}`,
+		},
+		{
+			name: "regular documents",
+			src:  `{"$set": {"a": 1}, "b": {"$ref": "coll"}, "c": {"d": {"$numberDouble": "NaN"}}}`,
+			want: `{"$set": {"a": 1}, "b": {"$ref": "coll"}, "c": {"d": NaN}}`,
+		},
+		{
+			name: "keyed objects with other fields",
+			src:  `{"a": {"$oid": "5a934e000102030405000000", "x": {"$numberLong": "1"}}, "b": {"$binary": "Zm9v", "$type": "02", "c": 1}}`,
+			want: `{"a": {"$oid": "5a934e000102030405000000", "x": NumberLong(1)}, "b": {"$binary": "Zm9v", "$type": "02", "c": 1}}`,
+		},
+		{
+			name: "top level",
+			src:  `{"$timestamp": {"t": 1, "i": 2}}`,
+			want: `Timestamp(1,2)`,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := mongoextjson.ConvertToShell([]byte(tt.src))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: expected\n%s\nbut got\n%s", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := mongoextjson.ConvertToShell([]byte(`{"a": {"$oid": "5a934e00"}}`)); err == nil {
+		t.Error("expected an error for an invalid ObjectId")
+	}
+}
+
+func TestFromBSON(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.D{
+		{Key: "z", Value: objectID},
+		{Key: "a", Value: bson.D{{Key: "y", Value: int64(1)}, {Key: "b", Value: "str"}}},
+		{Key: "list", Value: bson.A{int32(1), 2.5, bson.D{{Key: "k", Value: true}}, bson.A{}}},
+		{Key: "date", Value: primitive.DateTime(1136214245000)},
+		{Key: "null", Value: nil},
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := mongoextjson.FromBSON(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"z":ObjectId("5a934e000102030405000000"),"a":{"y":NumberLong(1),"b":"str"},"list":[1,2.5,{"k":true},[]],"date":ISODate("2006-01-02T15:04:05Z"),"null":null}`
+	if string(b) != want {
+		t.Errorf("expected\n%s\nbut got\n%s", want, b)
+	}
+
+	if _, err := mongoextjson.FromBSON(raw[:len(raw)-3]); err == nil {
+		t.Error("expected an error for a truncated document")
+	}
+}
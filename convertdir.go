@@ -0,0 +1,154 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// A ConvertOption configures ConvertDir.
+type ConvertOption func(*convertOptions)
+
+type convertOptions struct {
+	convert     func(src []byte) ([]byte, error)
+	output      string
+	parallelism int
+}
+
+// ConvertFunc sets the function used to convert each document, like
+// ConvertToShell. The default is ConvertToCanonical.
+func ConvertFunc(convert func(src []byte) ([]byte, error)) ConvertOption {
+	return func(o *convertOptions) { o.convert = convert }
+}
+
+// ConvertOutputDir sets the directory where the converted files are
+// written, under the same path as in the input file system. It is
+// required.
+func ConvertOutputDir(dir string) ConvertOption {
+	return func(o *convertOptions) { o.output = dir }
+}
+
+// ConvertParallelism sets the number of files converted at the same time.
+// The default is runtime.GOMAXPROCS(0).
+func ConvertParallelism(n int) ConvertOption {
+	return func(o *convertOptions) { o.parallelism = n }
+}
+
+// ConvertDir converts the files of fsys whose path matches glob, as
+// defined by path.Match, or whose name matches glob if it holds no '/'.
+// So "*.json" matches the JSON files of every directory, and "dump/*.json"
+// only the ones of the dump directory.
+//
+// The files may hold several documents, like the ones written by
+// mongoexport: each document is converted and written on its own line.
+// If the conversion of some files fails, the others are still converted
+// and the error of the first failing file, in lexical order, is returned.
+func ConvertDir(fsys fs.FS, glob string, opts ...ConvertOption) error {
+	o := convertOptions{
+		convert:     ConvertToCanonical,
+		parallelism: runtime.GOMAXPROCS(0),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.output == "" {
+		return errors.New("mongoextjson: ConvertDir requires an output directory")
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return err
+	}
+	if o.parallelism < 1 {
+		o.parallelism = 1
+	}
+
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		subject := name
+		if !strings.Contains(glob, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(glob, subject); ok {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(names))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < o.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				errs[n] = convertFile(fsys, names[n], &o)
+			}
+		}()
+	}
+	for n := range names {
+		work <- n
+	}
+	close(work)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertFile converts the documents of the file name of fsys and writes
+// them in the output directory.
+func convertFile(fsys fs.FS, name string, o *convertOptions) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var out bytes.Buffer
+	dec := NewExtendedDecoder(f)
+	for i := 1; ; i++ {
+		var doc RawExtJSON
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		converted, err := o.convert(doc)
+		if err != nil {
+			return fmt.Errorf("%s: document %d: %v", name, i, err)
+		}
+		out.Write(converted)
+		out.WriteByte('\n')
+	}
+
+	dst := filepath.Join(o.output, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, out.Bytes(), 0666)
+}
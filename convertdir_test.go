@@ -0,0 +1,88 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+func TestConvertDir(t *testing.T) {
+
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"a.json":          {Data: []byte(`{_id: ObjectId("5a934e000102030405000000"), n: NumberLong(1)}` + "\n" + `{_id: 2}`)},
+		"dump/b.json":     {Data: []byte(`{"d": ISODate("2020-01-01T00:00:00Z")}`)},
+		"dump/notes.txt":  {Data: []byte(`not json`)},
+		"dump/sub/c.json": {Data: []byte(`[1, 'x']`)},
+	}
+
+	out := t.TempDir()
+	err := mongoextjson.ConvertDir(fsys, "*.json", mongoextjson.ConvertOutputDir(out), mongoextjson.ConvertParallelism(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"a.json":          "{\"_id\": {\"$oid\":\"5a934e000102030405000000\"}, \"n\": {\"$numberLong\":\"1\"}}\n{\"_id\": 2}\n",
+		"dump/b.json":     "{\"d\": {\"$date\":\"2020-01-01T00:00:00Z\"}}\n",
+		"dump/sub/c.json": "[1, \"x\"]\n",
+	}
+	for name, w := range want {
+		b, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); w != got {
+			t.Errorf("%s: expected %s, but got %s", name, w, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "dump", "notes.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected notes.txt not to be converted, but got %v", err)
+	}
+
+	// only the files of the dump directory
+	out = t.TempDir()
+	err = mongoextjson.ConvertDir(fsys, "dump/*.json", mongoextjson.ConvertOutputDir(out), mongoextjson.ConvertFunc(mongoextjson.ConvertToShell))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(out, "dump"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "b.json" {
+		t.Errorf("expected only dump/b.json, but got %v", entries)
+	}
+}
+
+func TestConvertDirErrors(t *testing.T) {
+
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"a.json": {Data: []byte(`{"a": 1}`)},
+		"b.json": {Data: []byte(`{"b": }`)},
+	}
+
+	err := mongoextjson.ConvertDir(fsys, "*.json")
+	if err == nil || !strings.Contains(err.Error(), "output directory") {
+		t.Errorf("expected a missing output directory error, but got %v", err)
+	}
+
+	out := t.TempDir()
+	err = mongoextjson.ConvertDir(fsys, "*.json", mongoextjson.ConvertOutputDir(out))
+	if err == nil || !strings.HasPrefix(err.Error(), "b.json: ") {
+		t.Errorf("expected an error for b.json, but got %v", err)
+	}
+	// the other files are still converted
+	if _, err := os.Stat(filepath.Join(out, "a.json")); err != nil {
+		t.Error(err)
+	}
+}
@@ -13,12 +13,18 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 	"unicode"
 	"unicode/utf16"
 	"unicode/utf8"
+	"unsafe"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Unmarshaler is the interface implemented by types
@@ -30,16 +36,46 @@ type Unmarshaler interface {
 	UnmarshalJSON([]byte) error
 }
 
+// ExtJSONUnmarshaler is the interface implemented by types that can
+// unmarshal an extended JSON description of themselves. Unlike
+// UnmarshalJSON, UnmarshalExtJSON receives the value as it appears in the
+// input, before any extension is applied: it may be a shell construct
+// like ObjectId("...") or a keyed document like {"$oid": "..."}, in any
+// of the syntaxes accepted by the decoder, so there is no shell variant.
+// UnmarshalExtJSON must copy the data if it wishes to retain the data
+// after returning.
+type ExtJSONUnmarshaler interface {
+	UnmarshalExtJSON([]byte) error
+}
+
+// extUnmarshaler adapts an ExtJSONUnmarshaler to Unmarshaler.
+type extUnmarshaler struct{ u ExtJSONUnmarshaler }
+
+func (u extUnmarshaler) UnmarshalJSON(data []byte) error { return u.u.UnmarshalExtJSON(data) }
+
+// wantsRaw reports whether u must receive the extended JSON values
+// as they appear in the input, instead of their decoded value.
+func wantsRaw(u Unmarshaler) bool {
+	switch u.(type) {
+	case *RawExtJSON, extUnmarshaler:
+		return true
+	}
+	return false
+}
+
 // An UnmarshalTypeError describes a JSON value that was
 // not appropriate for a value of a specific Go type.
 type UnmarshalTypeError struct {
 	Value  string       // description of JSON value - "bool", "array", "number -5"
 	Type   reflect.Type // type of Go value it could not be assigned to
 	Offset int64        // error occurred after reading Offset bytes
+	Path   string       // path of the value in the document, like "orders[3].items[0]._id"
+	Line   int          // line of the error, starting at 1, or 0 if unknown
+	Column int          // column of the error in bytes, starting at 1
 }
 
 func (e *UnmarshalTypeError) Error() string {
-	return "json: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
+	return withContext("json: cannot unmarshal "+e.Value+" into Go value of type "+e.Type.String(), e.Path, e.Line, e.Column)
 }
 
 // An UnmarshalFieldError describes a JSON object key that
@@ -72,6 +108,40 @@ func (e *InvalidUnmarshalError) Error() string {
 	return "json: Unmarshal(nil " + e.Type.String() + ")"
 }
 
+// An ExtensionError describes an extended JSON value, like
+// ObjectId("...") or {"$date": "..."}, that could not be decoded.
+type ExtensionError struct {
+	Name   string // function name or key of the value, like "ObjectId" or "$date"
+	Value  string // the offending value, as found in the input
+	Offset int64  // offset of the value
+	Path   string // path of the value in the document, like "orders[3].items[0]._id"
+	Line   int    // line of the value, starting at 1, or 0 if unknown
+	Column int    // column of the value in bytes, starting at 1
+	Err    error  // error returned by the extension
+}
+
+func (e *ExtensionError) Error() string { return withContext(e.Err.Error(), e.Path, e.Line, e.Column) }
+
+func (e *ExtensionError) Unwrap() error { return e.Err }
+
+// A DuplicateKeyError is returned by a Decoder that disallows duplicate
+// keys when a key appears twice in the same document.
+type DuplicateKeyError struct {
+	Key    string // the duplicated key
+	Offset int64  // offset of the second occurrence of the key
+	Path   string // path of the document holding the key, like "orders[3]"
+	Line   int    // line of the second occurrence, starting at 1, or 0 if unknown
+	Column int    // column of the second occurrence in bytes, starting at 1
+}
+
+func (e *DuplicateKeyError) Error() string {
+	msg := "json: duplicate key " + strconv.Quote(e.Key)
+	if e.Line == 0 {
+		return withContext(msg, e.Path, 0, 0) + " at offset " + strconv.FormatInt(e.Offset, 10)
+	}
+	return withContext(msg, e.Path, e.Line, e.Column)
+}
+
 func (d *decodeState) unmarshal(v interface{}) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -102,6 +172,45 @@ type decodeState struct {
 	nextscan   scanner // for calls to nextValue
 	savedError error
 	ext        Extension
+
+	// noCopy makes strings share the memory of data when possible.
+	noCopy bool
+	// primitiveNull decodes null as primitive.Null{} in interface values.
+	primitiveNull bool
+	// useNumber decodes numbers as Number in interface values.
+	useNumber bool
+	// integers decodes whole numbers as int32 or int64 in interface
+	// values.
+	integers bool
+	// bsonTypes decodes objects and arrays as primitive.M and primitive.A
+	// in interface values.
+	bsonTypes bool
+	// orderedDocuments decodes objects as primitive.D in interface values.
+	orderedDocuments bool
+	// disallowDuplicateKeys fails on keys that appear twice in a document.
+	disallowDuplicateKeys bool
+	// timeZone defines the location of the decoded dates.
+	timeZone TimeZonePolicy
+	// mapper, when set, maps the names of the fields without a json tag.
+	mapper *nameMapper
+	// registry, when set, holds custom codecs of the driver.
+	registry *codecRegistry
+	// decimals holds the functions converting Decimal128 values to the
+	// decimal types of the application, by type.
+	decimals map[reflect.Type]func(primitive.Decimal128) (interface{}, error)
+
+	// path holds the keys and indexes leading to the value being decoded,
+	// to locate errors in the document.
+	path []pathElem
+	// fragment is set when decoding a part of a value on behalf of an
+	// extension, whose paths and positions are meaningless to the caller.
+	fragment bool
+}
+
+// pathElem is an object key or an array index of a path.
+type pathElem struct {
+	key   []byte
+	index int // index in an array, or -1 for an object key
 }
 
 // errPhase is used for errors that should not happen unless
@@ -113,11 +222,13 @@ func (d *decodeState) init(data []byte) *decodeState {
 	d.data = data
 	d.off = 0
 	d.savedError = nil
+	d.path = d.path[:0]
 	return d
 }
 
 // error aborts the decoding by panicking with err.
 func (d *decodeState) error(err error) {
+	d.setPath(err)
 	panic(err)
 }
 
@@ -125,10 +236,50 @@ func (d *decodeState) error(err error) {
 // for reporting at the end of the unmarshal.
 func (d *decodeState) saveError(err error) {
 	if d.savedError == nil {
+		d.setPath(err)
 		d.savedError = err
 	}
 }
 
+// setPath records in err the path of the value being decoded, like
+// orders[3].items[0]._id.
+func (d *decodeState) setPath(err error) {
+	if d.fragment || len(d.path) == 0 {
+		return
+	}
+	switch e := err.(type) {
+	case *UnmarshalTypeError:
+		if e.Path == "" {
+			e.Path = d.pathString()
+		}
+	case *ExtensionError:
+		if e.Path == "" {
+			e.Path = d.pathString()
+		}
+	case *DuplicateKeyError:
+		if e.Path == "" {
+			e.Path = d.pathString()
+		}
+	}
+}
+
+func (d *decodeState) pathString() string {
+	var b []byte
+	for _, e := range d.path {
+		if e.index >= 0 {
+			b = append(b, '[')
+			b = strconv.AppendInt(b, int64(e.index), 10)
+			b = append(b, ']')
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, '.')
+		}
+		b = append(b, e.key...)
+	}
+	return string(b)
+}
+
 // next cuts off and returns the next full JSON value in d.data[d.off:].
 // The next value is known to be an object or array, not a literal.
 func (d *decodeState) next() []byte {
@@ -209,6 +360,10 @@ func (d *decodeState) value(v reflect.Value) {
 		return
 	}
 
+	if d.registry != nil && d.registryValue(v) {
+		return
+	}
+
 	switch op := d.scanWhile(scanSkipSpace); op {
 	default:
 		d.error(errPhase)
@@ -292,6 +447,9 @@ func (d *decodeState) indirect(v reflect.Value, decodingNull bool) (Unmarshaler,
 			v.Set(reflect.New(v.Type().Elem()))
 		}
 		if v.Type().NumMethod() > 0 {
+			if u, ok := v.Interface().(ExtJSONUnmarshaler); ok {
+				return extUnmarshaler{u}, nil, v
+			}
 			if u, ok := v.Interface().(Unmarshaler); ok {
 				return u, nil, v
 			}
@@ -318,7 +476,7 @@ func (d *decodeState) array(v reflect.Value) {
 		return
 	}
 	if ut != nil {
-		d.saveError(&UnmarshalTypeError{"array", v.Type(), int64(d.off)})
+		d.saveError(&UnmarshalTypeError{Value: "array", Type: v.Type(), Offset: int64(d.off)})
 		d.off--
 		d.next()
 		return
@@ -337,7 +495,7 @@ func (d *decodeState) array(v reflect.Value) {
 		// Otherwise it's invalid.
 		fallthrough
 	default:
-		d.saveError(&UnmarshalTypeError{"array", v.Type(), int64(d.off)})
+		d.saveError(&UnmarshalTypeError{Value: "array", Type: v.Type(), Offset: int64(d.off)})
 		d.off--
 		d.next()
 		return
@@ -348,9 +506,13 @@ func (d *decodeState) array(v reflect.Value) {
 
 	i := 0
 	for {
-		// Look ahead for ] - can only happen on first iteration.
+		// Look ahead for ] - can only happen on first iteration,
+		// or after a trailing comma.
 		op := d.scanWhile(scanSkipSpace)
 		if op == scanEndArray {
+			if i > 0 && !d.ext.trailingCommas {
+				d.syntaxError("beginning of value")
+			}
 			break
 		}
 
@@ -375,6 +537,7 @@ func (d *decodeState) array(v reflect.Value) {
 			}
 		}
 
+		d.path = append(d.path, pathElem{index: i})
 		if i < v.Len() {
 			// Decode into element.
 			d.value(v.Index(i))
@@ -382,6 +545,7 @@ func (d *decodeState) array(v reflect.Value) {
 			// Ran out of fixed array: skip.
 			d.value(reflect.Value{})
 		}
+		d.path = d.path[:len(d.path)-1]
 		i++
 
 		// Next token must be , or ].
@@ -418,7 +582,7 @@ var textUnmarshalerType = reflect.TypeOf(new(encoding.TextUnmarshaler)).Elem()
 func (d *decodeState) object(v reflect.Value) {
 	// Check for unmarshaler.
 	u, ut, pv := d.indirect(v, false)
-	if d.storeKeyed(pv) {
+	if !wantsRaw(u) && d.storeKeyed(pv) {
 		return
 	}
 	if u != nil {
@@ -430,7 +594,7 @@ func (d *decodeState) object(v reflect.Value) {
 		return
 	}
 	if ut != nil {
-		d.saveError(&UnmarshalTypeError{"object", v.Type(), int64(d.off)})
+		d.saveError(&UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
 		d.off--
 		d.next() // skip over { } in input
 		return
@@ -452,7 +616,7 @@ func (d *decodeState) object(v reflect.Value) {
 		t := v.Type()
 		if t.Key().Kind() != reflect.String &&
 			!reflect.PtrTo(t.Key()).Implements(textUnmarshalerType) {
-			d.saveError(&UnmarshalTypeError{"object", v.Type(), int64(d.off)})
+			d.saveError(&UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
 			d.off--
 			d.next() // skip over { } in input
 			return
@@ -463,13 +627,14 @@ func (d *decodeState) object(v reflect.Value) {
 	case reflect.Struct:
 
 	default:
-		d.saveError(&UnmarshalTypeError{"object", v.Type(), int64(d.off)})
+		d.saveError(&UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
 		d.off--
 		d.next() // skip over { } in input
 		return
 	}
 
 	var mapElem reflect.Value
+	var seen map[string]bool
 
 	empty := true
 	for {
@@ -501,11 +666,20 @@ func (d *decodeState) object(v reflect.Value) {
 			// TODO Fix code below to quote item when necessary.
 		} else {
 			var ok bool
-			key, ok = unquoteBytes(item)
+			key, ok = d.unquoteString(item)
 			if !ok {
 				d.error(errPhase)
 			}
 		}
+		if d.disallowDuplicateKeys {
+			if seen == nil {
+				seen = make(map[string]bool)
+			}
+			if seen[string(key)] {
+				d.error(&DuplicateKeyError{Key: string(key), Offset: int64(start)})
+			}
+			seen[string(key)] = true
+		}
 
 		// Figure out field corresponding to key.
 		var subv reflect.Value
@@ -520,18 +694,7 @@ func (d *decodeState) object(v reflect.Value) {
 			}
 			subv = mapElem
 		} else {
-			var f *field
-			fields := cachedTypeFields(v.Type())
-			for i := range fields {
-				ff := &fields[i]
-				if bytes.Equal(ff.nameBytes, key) {
-					f = ff
-					break
-				}
-				if f == nil && ff.equalFold(ff.nameBytes, key) {
-					f = ff
-				}
-			}
+			f := d.field(v.Type(), key)
 			if f != nil {
 				subv = v
 				destring = f.quoted
@@ -556,6 +719,7 @@ func (d *decodeState) object(v reflect.Value) {
 		}
 
 		// Read value.
+		d.path = append(d.path, pathElem{key: key, index: -1})
 		if destring {
 			switch qv := d.valueQuoted().(type) {
 			case nil:
@@ -576,16 +740,15 @@ func (d *decodeState) object(v reflect.Value) {
 			var kv reflect.Value
 			switch {
 			case kt.Kind() == reflect.String:
-				kv = reflect.ValueOf(key).Convert(v.Type().Key())
+				kv = reflect.ValueOf(d.bytesString(key)).Convert(v.Type().Key())
 			case reflect.PtrTo(kt).Implements(textUnmarshalerType):
-				kv = reflect.New(v.Type().Key())
-				d.literalStore(item, kv, true)
-				kv = kv.Elem()
+				kv = d.textKey(kt, key)
 			default:
 				panic("json: Unexpected key type") // should never occur
 			}
 			v.SetMapIndex(kv, subv)
 		}
+		d.path = d.path[:len(d.path)-1]
 
 		// Next token must be , or }.
 		op = d.scanWhile(scanSkipSpace)
@@ -598,6 +761,43 @@ func (d *decodeState) object(v reflect.Value) {
 	}
 }
 
+// textKey decodes the unquoted map key into a new value of type kt,
+// which implements encoding.TextUnmarshaler through a pointer.
+func (d *decodeState) textKey(kt reflect.Type, key []byte) reflect.Value {
+	kv := reflect.New(kt)
+	if err := kv.Interface().(encoding.TextUnmarshaler).UnmarshalText(key); err != nil {
+		d.error(err)
+	}
+	return kv.Elem()
+}
+
+// field returns the field of the struct type t that matches key,
+// preferring an exact match to a case-insensitive one.
+func (d *decodeState) field(t reflect.Type, key []byte) *field {
+	var f *field
+	cached := cachedTypeFields(t)
+	if d.mapper == nil {
+		if i, ok := cached.nameIndex[string(key)]; ok {
+			return &cached.list[i]
+		}
+	}
+	fields := cached.list
+	for i := range fields {
+		ff := &fields[i]
+		name, equalFold := ff.nameBytes, ff.equalFold
+		if !ff.tag && d.mapper != nil {
+			name, equalFold = d.mapper.get(ff.name).nameBytes, bytes.EqualFold
+		}
+		if bytes.Equal(name, key) {
+			return ff
+		}
+		if f == nil && equalFold(name, key) {
+			f = ff
+		}
+	}
+	return f
+}
+
 // isNull returns whether there's a null literal at the provided offset.
 func (d *decodeState) isNull(off int) bool {
 	if off+4 >= len(d.data) || d.data[off] != 'n' || d.data[off+1] != 'u' || d.data[off+2] != 'l' || d.data[off+3] != 'l' {
@@ -627,7 +827,7 @@ func (d *decodeState) name(v reflect.Value) {
 
 	// Check for unmarshaler.
 	u, ut, pv := d.indirect(v, false)
-	if d.storeKeyed(pv) {
+	if !wantsRaw(u) && d.storeKeyed(pv) {
 		return
 	}
 	if u != nil {
@@ -639,7 +839,7 @@ func (d *decodeState) name(v reflect.Value) {
 		return
 	}
 	if ut != nil {
-		d.saveError(&UnmarshalTypeError{"object", v.Type(), int64(d.off)})
+		d.saveError(&UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
 		d.off--
 		d.next() // skip over function in input
 		return
@@ -670,13 +870,12 @@ func (d *decodeState) name(v reflect.Value) {
 			d.storeValue(v, l)
 			return
 		}
-		d.error(&SyntaxError{fmt.Sprintf("json: unknown constant %q", name), int64(d.off)})
+		d.error(&SyntaxError{msg: fmt.Sprintf("json: unknown constant %q", name), Offset: int64(d.off)})
 	}
 
-	funcName := string(name)
-	funcData := d.ext.funcs[funcName]
+	funcData := d.ext.funcs[string(name)]
 	if funcData.key == "" {
-		d.error(fmt.Errorf("json: unknown function %q", funcName))
+		d.error(&SyntaxError{msg: fmt.Sprintf("json: unknown function %q", name), Offset: int64(d.off)})
 	}
 
 	// Check type of target:
@@ -688,7 +887,7 @@ func (d *decodeState) name(v reflect.Value) {
 		t := v.Type()
 		if t.Key().Kind() != reflect.String &&
 			!reflect.PtrTo(t.Key()).Implements(textUnmarshalerType) {
-			d.saveError(&UnmarshalTypeError{"object", v.Type(), int64(d.off)})
+			d.saveError(&UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
 			d.off--
 			d.next() // skip over { } in input
 			return
@@ -699,7 +898,7 @@ func (d *decodeState) name(v reflect.Value) {
 	case reflect.Struct:
 
 	default:
-		d.saveError(&UnmarshalTypeError{"object", v.Type(), int64(d.off)})
+		d.saveError(&UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
 		d.off--
 		d.next() // skip over { } in input
 		return
@@ -709,13 +908,13 @@ func (d *decodeState) name(v reflect.Value) {
 	//topv := v
 
 	// Figure out field corresponding to function.
-	key := []byte(funcData.key)
+	key := funcData.keyBytes
 	if v.Kind() == reflect.Map {
 		elemType := v.Type().Elem()
 		v = reflect.New(elemType).Elem()
 	} else {
 		var f *field
-		fields := cachedTypeFields(v.Type())
+		fields := cachedTypeFields(v.Type()).list
 		for i := range fields {
 			ff := &fields[i]
 			if bytes.Equal(ff.nameBytes, key) {
@@ -771,9 +970,9 @@ func (d *decodeState) name(v reflect.Value) {
 		d.scan.undo(op)
 
 		if i >= len(funcData.args) {
-			d.error(fmt.Errorf("json: too many arguments for function %s", funcName))
+			d.error(&SyntaxError{msg: fmt.Sprintf("json: too many arguments for function %s", name), Offset: int64(d.off)})
 		}
-		key := []byte(funcData.args[i])
+		key := funcData.argBytes[i]
 
 		// Figure out field corresponding to key.
 		var subv reflect.Value
@@ -788,18 +987,7 @@ func (d *decodeState) name(v reflect.Value) {
 			}
 			subv = mapElem
 		} else {
-			var f *field
-			fields := cachedTypeFields(v.Type())
-			for i := range fields {
-				ff := &fields[i]
-				if bytes.Equal(ff.nameBytes, key) {
-					f = ff
-					break
-				}
-				if f == nil && ff.equalFold(ff.nameBytes, key) {
-					f = ff
-				}
-			}
+			f := d.field(v.Type(), key)
 			if f != nil {
 				subv = v
 				destring = f.quoted
@@ -838,9 +1026,7 @@ func (d *decodeState) name(v reflect.Value) {
 			case kt.Kind() == reflect.String:
 				kv = reflect.ValueOf(key).Convert(v.Type().Key())
 			case reflect.PtrTo(kt).Implements(textUnmarshalerType):
-				kv = reflect.New(v.Type().Key())
-				d.literalStore(key, kv, true)
-				kv = kv.Elem()
+				kv = d.textKey(kt, key)
 			default:
 				panic("json: Unexpected key type") // should never occur
 			}
@@ -868,19 +1054,25 @@ func (d *decodeState) keyed() (interface{}, bool) {
 	unquote := false
 
 	// Look-ahead first key to check for a keyed document extension.
-	d.nextscan.reset()
 	var start, end int
-	for i, c := range d.data[d.off-1:] {
-		switch op := d.nextscan.step(&d.nextscan, c); op {
-		case scanSkipSpace, scanContinue, scanBeginObject:
-			continue
-		case scanBeginLiteral, scanBeginName:
-			unquote = op == scanBeginLiteral
-			start = i
-			continue
+	if d.data[d.off-1] == '{' {
+		d.nextscan.reset()
+		for i, c := range d.data[d.off-1:] {
+			switch op := d.nextscan.step(&d.nextscan, c); op {
+			case scanSkipSpace, scanContinue, scanBeginObject:
+				continue
+			case scanBeginLiteral, scanBeginName:
+				unquote = op == scanBeginLiteral
+				start = i
+				continue
+			}
+			end = i
+			break
 		}
-		end = i
-		break
+	} else {
+		// the scanner would fail, and allocate an error, after
+		// constants like true
+		end = funcNameEnd(d.data[d.off-1:])
 	}
 
 	name := bytes.Trim(d.data[d.off-1+start:d.off-1+end], " \n\t")
@@ -888,7 +1080,7 @@ func (d *decodeState) keyed() (interface{}, bool) {
 	var key []byte
 	var ok bool
 	if unquote {
-		key, ok = unquoteBytes(name)
+		key, ok = d.unquoteString(name)
 		if !ok {
 			d.error(errPhase)
 		}
@@ -906,22 +1098,76 @@ func (d *decodeState) keyed() (interface{}, bool) {
 	}
 
 	d.off--
-	out, err := decode(d.next())
+	offset := int64(d.off)
+	item := d.next()
+	out, err := decode(item)
 	if err != nil {
-		d.error(err)
+		extName := string(key)
+		if !unquote {
+			extName = string(name)
+		}
+		d.error(&ExtensionError{Name: extName, Value: string(item), Offset: offset, Err: err})
+	}
+	if t, ok := out.(time.Time); ok && d.timeZone == NormalizeToUTC {
+		out = t.UTC()
 	}
 	return out, true
 }
 
+// funcNameEnd returns the offset of the '(' following the function name
+// at the start of data, like ObjectId or new Date, or 0 if data doesn't
+// start with a function call.
+func funcNameEnd(data []byte) int {
+	i := 0
+	if bytes.HasPrefix(data, newPrefix) {
+		i = len(newPrefix)
+	}
+	for i < len(data) && (isName(data[i]) || data[i] == '.') {
+		i++
+	}
+	if i < len(data) && data[i] == '(' {
+		return i
+	}
+	return 0
+}
+
+var newPrefix = []byte("new ")
+
 func (d *decodeState) storeKeyed(v reflect.Value) bool {
+	start := d.off - 1
 	keyed, ok := d.keyed()
 	if !ok {
 		return false
 	}
+	if n, ok := keyed.(primitive.Decimal128); ok && d.decimals != nil {
+		keyed = d.convertDecimal(v, n, start)
+	}
 	d.storeValue(v, keyed)
 	return true
 }
 
+// convertDecimal converts n with the function registered for the type of
+// v, if any. start is the offset of the decimal value in d.data.
+func (d *decodeState) convertDecimal(v reflect.Value, n primitive.Decimal128, start int) interface{} {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	convert, ok := d.decimals[v.Type()]
+	if !ok {
+		return n
+	}
+	out, err := convert(n)
+	if err != nil {
+		item := d.data[start:d.off]
+		name := "$numberDecimal"
+		if i := bytes.IndexByte(item, '('); item[0] != '{' && i > 0 {
+			name = string(item[:i])
+		}
+		d.error(&ExtensionError{Name: name, Value: string(item), Offset: int64(start), Err: err})
+	}
+	return out
+}
+
 var (
 	trueBytes  = []byte("true")
 	falseBytes = []byte("false")
@@ -954,7 +1200,7 @@ func (d *decodeState) storeValue(v reflect.Value, from interface{}) {
 	} else if fromt.ConvertibleTo(vt) {
 		v.Set(fromv.Convert(vt))
 	} else {
-		d.saveError(&UnmarshalTypeError{"object", v.Type(), int64(d.off)})
+		d.saveError(&UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
 	}
 }
 
@@ -979,9 +1225,73 @@ func (d *decodeState) convertLiteral(name []byte) (interface{}, bool) {
 	if l, ok := d.ext.consts[string(name)]; ok {
 		return l, true
 	}
+	if d.ext.specialFloats && isSpecialFloat(name) {
+		f, err := strconv.ParseFloat(string(name), 64)
+		return f, err == nil
+	}
 	return nil, false
 }
 
+// isSpecialFloat returns whether item is an optionally signed
+// NaN or infinity literal, like 'NaN', '-Infinity' or '+inf'.
+func isSpecialFloat(item []byte) bool {
+	if len(item) > 0 && (item[0] == '-' || item[0] == '+') {
+		item = item[1:]
+	}
+	s := string(item)
+	return strings.EqualFold(s, "nan") || strings.EqualFold(s, "inf") || strings.EqualFold(s, "infinity")
+}
+
+// checkSpecialFloat aborts the decoding if item is a NaN or infinity
+// literal and the extension doesn't accept them.
+func (d *decodeState) checkSpecialFloat(item []byte) {
+	if !d.ext.specialFloats && isSpecialFloat(item) {
+		d.error(&SyntaxError{msg: fmt.Sprintf("invalid numeric literal %q", item), Offset: int64(d.off)})
+	}
+}
+
+// jsNumber returns the number literal item in JSON syntax. Numbers using
+// JavaScript only syntax, like '0xFF', '+1', '.5' or '5.', are converted
+// if the extension accepts them.
+func (d *decodeState) jsNumber(item []byte) string {
+	s := string(item)
+	if isSpecialFloat(item) {
+		// the sign of NaN is not significant, and ParseFloat rejects it
+		if (s[0] == '-' || s[0] == '+') && (s[1] == 'N' || s[1] == 'n') {
+			return s[1:]
+		}
+		return s
+	}
+	sign := ""
+	if s[0] == '-' || s[0] == '+' {
+		sign, s = s[:1], s[1:]
+	}
+	js := sign == "+"
+	switch {
+	case len(s) > 1 && (s[1] == 'x' || s[1] == 'X'):
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		if err != nil {
+			d.error(&SyntaxError{msg: fmt.Sprintf("invalid numeric literal %q", item), Offset: int64(d.off)})
+		}
+		js, s = true, strconv.FormatUint(n, 10)
+	case s[0] == '.':
+		js, s = true, "0"+s
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 && (i == len(s)-1 || s[i+1] == 'e' || s[i+1] == 'E') {
+		js, s = true, s[:i]+s[i+1:]
+	}
+	if !js {
+		return string(item)
+	}
+	if !d.ext.jsNumbers {
+		d.error(&SyntaxError{msg: fmt.Sprintf("invalid numeric literal %q", item), Offset: int64(d.off)})
+	}
+	if sign == "-" {
+		return sign + s
+	}
+	return s
+}
+
 // literal consumes a literal from d.data[d.off-1:], decoding into the value v.
 // The first byte of the literal has been read already
 // (that's how the caller knows it's a literal).
@@ -997,12 +1307,43 @@ func (d *decodeState) literal(v reflect.Value) {
 	d.literalStore(d.data[start:d.off], v, false)
 }
 
+// A Number represents a JSON number literal. Numbers using JavaScript
+// only syntax, like 0x10, are stored in JSON syntax.
+type Number string
+
+// String returns the literal text of the number.
+func (n Number) String() string { return string(n) }
+
+// Float64 returns the number as a float64.
+func (n Number) Float64() (float64, error) {
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// Int64 returns the number as an int64.
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+var numberType = reflect.TypeOf(Number(""))
+
 // convertNumber converts the number literal s to a float64 or a Number
-// depending on the setting of d.useNumber.
+// depending on the setting of d.useNumber, or to an int32 or an int64 if
+// d.integers is set and s is a whole number that fits.
 func (d *decodeState) convertNumber(s string) (interface{}, error) {
+	if d.useNumber {
+		return Number(s), nil
+	}
+	if d.integers && s != "-0" && !strings.ContainsAny(s, ".eE") {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int32(n), nil
+			}
+			return n, nil
+		}
+	}
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
-		return nil, &UnmarshalTypeError{"number " + s, reflect.TypeOf(0.0), int64(d.off)}
+		return nil, &UnmarshalTypeError{Value: "number " + s, Type: reflect.TypeOf(0.0), Offset: int64(d.off)}
 	}
 	return f, nil
 }
@@ -1029,15 +1370,15 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 		return
 	}
 	if ut != nil {
-		if item[0] != '"' {
+		if item[0] != '"' && item[0] != '`' && item[0] != '\'' {
 			if fromQuoted {
 				d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
 			} else {
-				d.saveError(&UnmarshalTypeError{"string", v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.off)})
 			}
 			return
 		}
-		s, ok := unquoteBytes(item)
+		s, ok := d.unquoteString(item)
 		if !ok {
 			if fromQuoted {
 				d.error(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
@@ -1058,6 +1399,10 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 	case 'n': // null
 		switch v.Kind() {
 		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			if d.primitiveNull && v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+				v.Set(reflect.ValueOf(primitive.Null{}))
+				break
+			}
 			v.Set(reflect.Zero(v.Type()))
 			// otherwise, ignore null for primitives/string
 		}
@@ -1068,7 +1413,7 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 			if fromQuoted {
 				d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
 			} else {
-				d.saveError(&UnmarshalTypeError{"bool", v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "bool", Type: v.Type(), Offset: int64(d.off)})
 			}
 		case reflect.Bool:
 			v.SetBool(value)
@@ -1076,12 +1421,12 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 			if v.NumMethod() == 0 {
 				v.Set(reflect.ValueOf(value))
 			} else {
-				d.saveError(&UnmarshalTypeError{"bool", v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "bool", Type: v.Type(), Offset: int64(d.off)})
 			}
 		}
 
-	case '"': // string
-		s, ok := unquoteBytes(item)
+	case '"', '`', '\'': // string
+		s, ok := d.unquoteString(item)
 		if !ok {
 			if fromQuoted {
 				d.error(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
@@ -1091,10 +1436,10 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 		}
 		switch v.Kind() {
 		default:
-			d.saveError(&UnmarshalTypeError{"string", v.Type(), int64(d.off)})
+			d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.off)})
 		case reflect.Slice:
 			if v.Type().Elem().Kind() != reflect.Uint8 {
-				d.saveError(&UnmarshalTypeError{"string", v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.off)})
 				break
 			}
 			b := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
@@ -1105,31 +1450,38 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 			}
 			v.SetBytes(b[:n])
 		case reflect.String:
-			v.SetString(string(s))
+			v.SetString(d.bytesString(s))
 		case reflect.Interface:
 			if v.NumMethod() == 0 {
-				v.Set(reflect.ValueOf(string(s)))
+				v.Set(reflect.ValueOf(d.bytesString(s)))
 			} else {
-				d.saveError(&UnmarshalTypeError{"string", v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.off)})
 			}
 		}
 
 	default: // number
-		if c != '-' && (c < '0' || c > '9') {
+		if c != '-' && c != '+' && c != '.' && (c < '0' || c > '9') {
 			if fromQuoted {
 				d.error(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
 			} else {
 				d.error(errPhase)
 			}
 		}
-		s := string(item)
+		d.checkSpecialFloat(item)
+		s := d.jsNumber(item)
 		switch v.Kind() {
 		default:
 			if fromQuoted {
 				d.error(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
 			} else {
-				d.error(&UnmarshalTypeError{"number", v.Type(), int64(d.off)})
+				d.error(&UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.off)})
 			}
+		case reflect.String:
+			if v.Type() != numberType {
+				d.error(&UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.off)})
+			}
+			v.SetString(s)
+
 		case reflect.Interface:
 			n, err := d.convertNumber(s)
 			if err != nil {
@@ -1137,7 +1489,7 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 				break
 			}
 			if v.NumMethod() != 0 {
-				d.saveError(&UnmarshalTypeError{"number", v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.off)})
 				break
 			}
 			v.Set(reflect.ValueOf(n))
@@ -1145,7 +1497,7 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 			n, err := strconv.ParseInt(s, 10, 64)
 			if err != nil || v.OverflowInt(n) {
-				d.saveError(&UnmarshalTypeError{"number " + s, v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.off)})
 				break
 			}
 			v.SetInt(n)
@@ -1153,7 +1505,7 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 			n, err := strconv.ParseUint(s, 10, 64)
 			if err != nil || v.OverflowUint(n) {
-				d.saveError(&UnmarshalTypeError{"number " + s, v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.off)})
 				break
 			}
 			v.SetUint(n)
@@ -1161,7 +1513,7 @@ func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool
 		case reflect.Float32, reflect.Float64:
 			n, err := strconv.ParseFloat(s, v.Type().Bits())
 			if err != nil || v.OverflowFloat(n) {
-				d.saveError(&UnmarshalTypeError{"number " + s, v.Type(), int64(d.off)})
+				d.saveError(&UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.off)})
 				break
 			}
 			v.SetFloat(n)
@@ -1192,11 +1544,11 @@ func (d *decodeState) valueInterface() interface{} {
 
 func (d *decodeState) syntaxError(expected string) {
 	msg := fmt.Sprintf("invalid character '%c' looking for %s", d.data[d.off-1], expected)
-	d.error(&SyntaxError{msg, int64(d.off)})
+	d.error(&SyntaxError{msg: msg, Offset: int64(d.off)})
 }
 
 // arrayInterface is like array but returns []interface{}.
-func (d *decodeState) arrayInterface() []interface{} {
+func (d *decodeState) arrayInterface() interface{} {
 	var v = make([]interface{}, 0)
 	for {
 		// Look ahead for ] - can only happen on first iteration.
@@ -1212,7 +1564,9 @@ func (d *decodeState) arrayInterface() []interface{} {
 		d.off--
 		d.scan.undo(op)
 
+		d.path = append(d.path, pathElem{index: len(v)})
 		v = append(v, d.valueInterface())
+		d.path = d.path[:len(d.path)-1]
 
 		// Next token must be , or ].
 		op = d.scanWhile(scanSkipSpace)
@@ -1223,6 +1577,9 @@ func (d *decodeState) arrayInterface() []interface{} {
 			d.error(errPhase)
 		}
 	}
+	if d.bsonTypes {
+		return primitive.A(v)
+	}
 	return v
 }
 
@@ -1233,12 +1590,16 @@ func (d *decodeState) objectInterface() interface{} {
 		return v
 	}
 
-	m := make(map[string]interface{})
+	var m map[string]interface{}
+	var doc primitive.D
+	if !d.orderedDocuments {
+		m = make(map[string]interface{})
+	}
 	for {
 		// Read opening " of string key or closing }.
 		op := d.scanWhile(scanSkipSpace)
 		if op == scanEndObject {
-			if len(m) > 0 && !d.ext.trailingCommas {
+			if len(m)+len(doc) > 0 && !d.ext.trailingCommas {
 				d.syntaxError("beginning of object key string")
 			}
 			break
@@ -1256,16 +1617,25 @@ func (d *decodeState) objectInterface() interface{} {
 		start := d.off - 1
 		op = d.scanWhile(scanContinue)
 		item := d.data[start : d.off-1]
-		var key string
-		if unquotedKey {
-			key = string(item)
-		} else {
+		k := item
+		if !unquotedKey {
 			var ok bool
-			key, ok = unquote(item)
+			k, ok = d.unquoteString(item)
 			if !ok {
 				d.error(errPhase)
 			}
 		}
+		key := d.bytesString(k)
+		i, dup := -1, false
+		if d.orderedDocuments {
+			i = indexOfKey(doc, key)
+			dup = i >= 0
+		} else {
+			_, dup = m[key]
+		}
+		if dup && d.disallowDuplicateKeys {
+			d.error(&DuplicateKeyError{Key: key, Offset: int64(start)})
+		}
 
 		// Read : before value.
 		if op == scanSkipSpace {
@@ -1276,7 +1646,18 @@ func (d *decodeState) objectInterface() interface{} {
 		}
 
 		// Read value.
-		m[key] = d.valueInterface()
+		d.path = append(d.path, pathElem{key: k, index: -1})
+		value := d.valueInterface()
+		d.path = d.path[:len(d.path)-1]
+		switch {
+		case !d.orderedDocuments:
+			m[key] = value
+		case dup:
+			// like for maps, the last value wins
+			doc[i].Value = value
+		default:
+			doc = append(doc, primitive.E{Key: key, Value: value})
+		}
 
 		// Next token must be , or }.
 		op = d.scanWhile(scanSkipSpace)
@@ -1287,9 +1668,29 @@ func (d *decodeState) objectInterface() interface{} {
 			d.error(errPhase)
 		}
 	}
+	if d.orderedDocuments {
+		if doc == nil {
+			doc = primitive.D{}
+		}
+		return doc
+	}
+	if d.bsonTypes {
+		return primitive.M(m)
+	}
 	return m
 }
 
+// indexOfKey returns the index of the element of doc with the given key,
+// or -1.
+func indexOfKey(doc primitive.D, key string) int {
+	for i := range doc {
+		if doc[i].Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
 // literalInterface is like literal but returns an interface value.
 func (d *decodeState) literalInterface() interface{} {
 	// All bytes inside literal return scanContinue op code.
@@ -1303,23 +1704,27 @@ func (d *decodeState) literalInterface() interface{} {
 
 	switch c := item[0]; c {
 	case 'n': // null
+		if d.primitiveNull {
+			return primitive.Null{}
+		}
 		return nil
 
 	case 't', 'f': // true, false
 		return c == 't'
 
-	case '"': // string
-		s, ok := unquote(item)
+	case '"', '`', '\'': // string
+		s, ok := d.unquoteString(item)
 		if !ok {
 			d.error(errPhase)
 		}
-		return s
+		return d.bytesString(s)
 
 	default: // number
-		if c != '-' && (c < '0' || c > '9') {
+		if c != '-' && c != '+' && c != '.' && (c < '0' || c > '9') {
 			d.error(errPhase)
 		}
-		n, err := d.convertNumber(string(item))
+		d.checkSpecialFloat(item)
+		n, err := d.convertNumber(d.jsNumber(item))
 		if err != nil {
 			d.saveError(err)
 		}
@@ -1344,15 +1749,17 @@ func (d *decodeState) nameInterface() interface{} {
 		d.off--
 		d.scan.undo(op)
 		if l, ok := d.convertLiteral(name); ok {
+			if l == nil && d.primitiveNull {
+				return primitive.Null{}
+			}
 			return l
 		}
-		d.error(&SyntaxError{fmt.Sprintf("json: unknown constant %q", name), int64(d.off)})
+		d.error(&SyntaxError{msg: fmt.Sprintf("json: unknown constant %q", name), Offset: int64(d.off)})
 	}
 
-	funcName := string(name)
-	funcData := d.ext.funcs[funcName]
+	funcData := d.ext.funcs[string(name)]
 	if funcData.key == "" {
-		d.error(fmt.Errorf("json: unknown function %q", funcName))
+		d.error(&SyntaxError{msg: fmt.Sprintf("json: unknown function %q", name), Offset: int64(d.off)})
 	}
 
 	m := make(map[string]interface{})
@@ -1368,7 +1775,7 @@ func (d *decodeState) nameInterface() interface{} {
 		d.scan.undo(op)
 
 		if i >= len(funcData.args) {
-			d.error(fmt.Errorf("json: too many arguments for function %s", funcName))
+			d.error(&SyntaxError{msg: fmt.Sprintf("json: too many arguments for function %s", name), Offset: int64(d.off)})
 		}
 		m[funcData.args[i]] = d.valueInterface()
 
@@ -1384,6 +1791,174 @@ func (d *decodeState) nameInterface() interface{} {
 	return map[string]interface{}{funcData.key: m}
 }
 
+// bytesString returns s as a string. When decoding without copy,
+// if s is a part of the input data, the string points to its memory.
+func (d *decodeState) bytesString(s []byte) string {
+	if !d.noCopy || len(s) == 0 {
+		return string(s)
+	}
+	start := uintptr(unsafe.Pointer(&d.data[0]))
+	p := uintptr(unsafe.Pointer(&s[0]))
+	if p < start || p+uintptr(len(s)) > start+uintptr(len(d.data)) {
+		return string(s)
+	}
+	return *(*string)(unsafe.Pointer(&s))
+}
+
+// unquoteString unquotes a string literal, that may be quoted with backticks
+// or single quotes if the extension allows it.
+func (d *decodeState) unquoteString(item []byte) ([]byte, bool) {
+	switch item[0] {
+	case '`':
+		if !d.ext.backtickStrings {
+			d.error(&SyntaxError{msg: "invalid character '`' looking for beginning of value", Offset: int64(d.off)})
+		}
+		item = backtickToQuoted(item)
+	case '\'':
+		if !d.ext.singleQuotes {
+			d.error(&SyntaxError{msg: "invalid character '\\'' looking for beginning of value", Offset: int64(d.off)})
+		}
+		item = singleQuotedToQuoted(item)
+	}
+	if bytes.IndexByte(item, '\\') >= 0 {
+		if js, ok := jsToJSONEscapes(item); ok {
+			if !d.ext.jsEscapes {
+				d.error(&SyntaxError{msg: fmt.Sprintf("invalid escape sequence in string %s", item), Offset: int64(d.off)})
+			}
+			item = js
+		}
+	}
+	return unquoteBytes(item)
+}
+
+// backtickToQuoted rewrites the template literal s as a double
+// quoted string.
+func backtickToQuoted(s []byte) []byte {
+	if len(s) < 2 || s[0] != '`' || s[len(s)-1] != '`' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '`' || s[i+1] == '$'):
+			i++
+			b = append(b, s[i])
+		case c == '\\' && i+1 < len(s):
+			i++
+			b = append(b, c, s[i])
+		case c == '"':
+			b = append(b, '\\', '"')
+		case c < ' ':
+			b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// singleQuotedToQuoted rewrites the single quoted string s as a double
+// quoted string.
+func singleQuotedToQuoted(s []byte) []byte {
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+			b = append(b, s[i])
+		case c == '\\' && i+1 < len(s):
+			i++
+			b = append(b, c, s[i])
+		case c == '"':
+			b = append(b, '\\', '"')
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// jsToJSONEscapes rewrites the JavaScript only escape sequences of the
+// quoted string s, like '\x41', '\v', '\0', '\u{1F600}' or a backslash
+// at the end of a line, as JSON escape sequences. It returns false if s
+// doesn't hold any of them.
+func jsToJSONEscapes(s []byte) ([]byte, bool) {
+	var b []byte
+	last := 0
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] != '\\' {
+			continue
+		}
+		start := i
+		i++
+		var repl []byte
+		switch c := s[i]; {
+		case c == '"', c == '\\', c == '/', c == 'b', c == 'f', c == 'n', c == 'r', c == 't':
+			continue
+		case c == 'u':
+			if s[i+1] != '{' {
+				continue
+			}
+			end := bytes.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, false
+			}
+			r, err := strconv.ParseUint(string(s[i+2:i+end]), 16, 32)
+			if err != nil || r > unicode.MaxRune {
+				return nil, false
+			}
+			i += end
+			if r1, r2 := utf16.EncodeRune(rune(r)); r1 != unicode.ReplacementChar {
+				repl = appendEscapeU(appendEscapeU(nil, r1), r2)
+			} else {
+				repl = appendEscapeU(nil, rune(r))
+			}
+		case c == 'x':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return nil, false
+			}
+			repl = []byte{'\\', 'u', '0', '0', s[i+1], s[i+2]}
+			i += 2
+		case c == 'v':
+			repl = []byte(`\u000b`)
+		case c == '0':
+			repl = []byte(`\u0000`)
+		case c == '\r':
+			// line continuation
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+		case c == '\n':
+			// line continuation
+		case c < ' ':
+			return nil, false
+		default:
+			// other characters are escaped as themselves
+			repl = s[i : i+1]
+		}
+		b = append(b, s[last:start]...)
+		b = append(b, repl...)
+		last = i + 1
+	}
+	if b == nil {
+		return nil, false
+	}
+	return append(b, s[last:]...), true
+}
+
+func appendEscapeU(b []byte, r rune) []byte {
+	return append(b, '\\', 'u', hex[r>>12&0xF], hex[r>>8&0xF], hex[r>>4&0xF], hex[r&0xF])
+}
+
 // getu4 decodes \uXXXX from the beginning of s, returning the hex value,
 // or it returns -1.
 func getu4(s []byte) rune {
@@ -0,0 +1,587 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChangeKind is the kind of a Change.
+type ChangeKind int
+
+const (
+	// Added means that the value is only present in the second document.
+	Added ChangeKind = iota
+	// Removed means that the value is only present in the first document.
+	Removed
+	// Modified means that the value is different in the two documents.
+	Modified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	}
+	return "ChangeKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// A Change describes a difference between two documents.
+type Change struct {
+	// Key is the value of the key field of the document, when
+	// comparing streams of documents.
+	Key interface{}
+	// Path is the dotted path of the value within the document, like
+	// "orders.3.items.0._id". It is empty when a whole document was
+	// added or removed.
+	Path string
+	Kind ChangeKind
+	// Old is the value in the first document, nil if the value was added.
+	Old interface{}
+	// New is the value in the second document, nil if the value was removed.
+	New interface{}
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("%s %v: %v", c.Kind, c.location(), c.New)
+	case Removed:
+		return fmt.Sprintf("%s %v: %v", c.Kind, c.location(), c.Old)
+	}
+	return fmt.Sprintf("%s %v: %v -> %v", c.Kind, c.location(), c.Old, c.New)
+}
+
+func (c Change) location() string {
+	if c.Key == nil {
+		return c.Path
+	}
+	if c.Path == "" {
+		return fmt.Sprintf("[%v]", c.Key)
+	}
+	return fmt.Sprintf("[%v].%s", c.Key, c.Path)
+}
+
+// CompareOptions relaxes the comparison of EqualWithOptions and
+// DiffWithOptions, for example to compare the data of two systems that
+// don't store numbers or dates the same way.
+//
+// There is no option for the order of the keys of documents: it is never
+// significant, as documents are compared as sets of keys, like in Equal.
+// Only the order of array elements can be ignored, with IgnoreArrayOrder.
+type CompareOptions struct {
+	// IgnoreArrayOrder compares arrays as sets of elements, so [1, 2]
+	// and [2, 1] are the same. The number of occurrences of each element
+	// still matters.
+	IgnoreArrayOrder bool
+	// IgnoreNumericTypes makes numbers of different BSON types, int32,
+	// int64 or double, the same if they hold the same value, so
+	// NumberInt(1), NumberLong(1) and 1.0 are the same.
+	IgnoreNumericTypes bool
+	// DateTolerance is the maximum duration between two dates that are
+	// still the same.
+	DateTolerance time.Duration
+}
+
+// Equal reports whether a and b represent the same BSON value, in any
+// syntax supported by Unmarshal. Whitespace, the order of the keys of
+// documents and the spelling of the values, like ObjectId("...") or
+// {"$oid": "..."}, are not significant, but the BSON types are, so
+// NumberInt(1) and NumberLong(1) are different.
+func Equal(a, b []byte) (bool, error) {
+	return EqualWithOptions(a, b, nil)
+}
+
+// EqualWithOptions is like Equal, but compares the values with the
+// tolerance given by opts. A nil opts is the same as Equal.
+func EqualWithOptions(a, b []byte, opts *CompareOptions) (bool, error) {
+	changes, err := DiffWithOptions(a, b, opts)
+	return err == nil && len(changes) == 0, err
+}
+
+// Diff compares two values, in any syntax supported by Unmarshal, and
+// returns a Change for each value added, removed or modified between a
+// and b, in the order of the keys. Like with Equal, the syntax and the
+// order of the keys are not significant. Arrays are compared element by
+// element.
+func Diff(a, b []byte) ([]Change, error) {
+	return DiffWithOptions(a, b, nil)
+}
+
+// DiffWithOptions is like Diff, but compares the values with the
+// tolerance given by opts. A nil opts is the same as Diff.
+//
+// When arrays are compared regardless of order, each element of a is
+// paired with an equal element of b, and the elements left over are
+// reported as removed from a or added to b, at their own index.
+func DiffWithOptions(a, b []byte, opts *CompareOptions) ([]Change, error) {
+	va, err := decodeValue(a, "a")
+	if err != nil {
+		return nil, err
+	}
+	vb, err := decodeValue(b, "b")
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &CompareOptions{}
+	}
+	return opts.diffValues("", va, vb, nil), nil
+}
+
+// decodeValue decodes data, which must hold a single value, like
+// Unmarshal.
+func decodeValue(data []byte, name string) (interface{}, error) {
+	dec := NewExtendedDecoder(bytes.NewReader(data))
+	var v interface{}
+	err := dec.Decode(&v)
+	if err == nil && dec.More() {
+		err = errTrailingData
+	}
+	if err != nil {
+		return nil, fmt.Errorf("value %s: %v", name, err)
+	}
+	return v, nil
+}
+
+// DiffStreams compares two streams of documents, like the ones produced
+// by mongoexport, and calls fn for each document added, removed or
+// modified between a and b. Documents are paired by the value of the
+// field at keyPath, like "_id" or "meta.id", and for modified documents
+// fn is called for each differing value.
+//
+// Both streams must be sorted by key like MongoDB sorts values, keys of
+// different types in the BSON comparison order, for example using
+// mongoexport --sort '{_id: 1}'. This allows to compare the streams
+// one document at a time, without loading them in memory. If fn returns
+// an error, DiffStreams stops and returns that error.
+func DiffStreams(a, b io.Reader, keyPath string, fn func(Change) error) error {
+
+	da := newStreamDocs(a, "a", keyPath)
+	db := newStreamDocs(b, "b", keyPath)
+
+	if err := da.next(); err != nil {
+		return err
+	}
+	if err := db.next(); err != nil {
+		return err
+	}
+
+	for !da.done || !db.done {
+		cmp := 0
+		switch {
+		case da.done:
+			cmp = 1
+		case db.done:
+			cmp = -1
+		default:
+			cmp = compareKeys(da.key, db.key)
+		}
+
+		switch {
+		case cmp < 0:
+			if err := fn(Change{Key: da.key, Kind: Removed, Old: da.doc}); err != nil {
+				return err
+			}
+			if err := da.next(); err != nil {
+				return err
+			}
+		case cmp > 0:
+			if err := fn(Change{Key: db.key, Kind: Added, New: db.doc}); err != nil {
+				return err
+			}
+			if err := db.next(); err != nil {
+				return err
+			}
+		default:
+			for _, c := range exactCompare.diffValues("", da.doc, db.doc, nil) {
+				c.Key = da.key
+				if err := fn(c); err != nil {
+					return err
+				}
+			}
+			if err := da.next(); err != nil {
+				return err
+			}
+			if err := db.next(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// streamDocs reads documents one by one from a stream.
+type streamDocs struct {
+	dec     *Decoder
+	name    string
+	keyPath []string
+
+	n    int
+	doc  interface{}
+	key  interface{}
+	done bool
+}
+
+func newStreamDocs(r io.Reader, name, keyPath string) *streamDocs {
+	d := NewDecoder(r)
+	d.Extend(&jsonExt)
+	return &streamDocs{dec: d, name: name, keyPath: strings.Split(keyPath, ".")}
+}
+
+// next reads the next document of the stream, and checks that
+// the stream is still sorted by key.
+func (s *streamDocs) next() error {
+	if s.done {
+		return nil
+	}
+	var doc interface{}
+	err := s.dec.Decode(&doc)
+	if err == io.EOF {
+		s.done = true
+		return nil
+	}
+	s.n++
+	if err != nil {
+		return fmt.Errorf("stream %s, document %d: %v", s.name, s.n, err)
+	}
+	key, ok := lookupPath(doc, s.keyPath)
+	if !ok {
+		return fmt.Errorf("stream %s, document %d: missing key %q", s.name, s.n, strings.Join(s.keyPath, "."))
+	}
+	if s.n > 1 && compareKeys(s.key, key) >= 0 {
+		return fmt.Errorf("stream %s, document %d: stream is not sorted by key (%v after %v)", s.name, s.n, key, s.key)
+	}
+	s.doc, s.key = doc, key
+	return nil
+}
+
+func lookupPath(doc interface{}, path []string) (interface{}, bool) {
+	for _, p := range path {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		doc, ok = m[p]
+		if !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// compareKeys orders keys like MongoDB sorts values: by type, in the
+// BSON comparison order, then by value.
+func compareKeys(a, b interface{}) int {
+	if ta, tb := bsonTypeOrder(a), bsonTypeOrder(b); ta != tb {
+		return compareInts(int64(ta), int64(tb))
+	}
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case primitive.ObjectID:
+		if b, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(a[:], b[:])
+		}
+	case bool:
+		if b, ok := b.(bool); ok && a != b {
+			if a {
+				return 1
+			}
+			return -1
+		}
+	case time.Time, primitive.DateTime:
+		ta, tb := toTime(a), toTime(b)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	case primitive.Timestamp:
+		if b, ok := b.(primitive.Timestamp); ok {
+			return primitive.CompareTimestamp(a, b)
+		}
+	}
+	if c, ok := compareNumbers(a, b); ok {
+		return c
+	}
+	return strings.Compare(fmt.Sprintf("%T %v", a, a), fmt.Sprintf("%T %v", b, b))
+}
+
+// bsonTypeOrder returns the rank of the type of v in the order used by
+// MongoDB to compare values of different types. Numbers share the same
+// rank, and so do the dates.
+func bsonTypeOrder(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 0
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int, int32, int64, float64, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case map[string]interface{}, primitive.M, primitive.D:
+		return 4
+	case []interface{}, primitive.A:
+		return 5
+	case []byte, primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case time.Time, primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.MaxKey:
+		return 13
+	}
+	return 12
+}
+
+func toTime(v interface{}) time.Time {
+	if d, ok := v.(primitive.DateTime); ok {
+		return d.Time()
+	}
+	return v.(time.Time)
+}
+
+// compareNumbers compares a and b if they are both integers or float64.
+// Integers are compared exactly, even above 2^53.
+func compareNumbers(a, b interface{}) (int, bool) {
+	ia, aInt := toInt64(a)
+	ib, bInt := toInt64(b)
+	fa, aFloat := a.(float64)
+	fb, bFloat := b.(float64)
+	switch {
+	case aInt && bInt:
+		return compareInts(ia, ib), true
+	case aFloat && bFloat:
+		return compareFloats(fa, fb), true
+	case aFloat && bInt:
+		return -compareIntFloat(ib, fa), true
+	case aInt && bFloat:
+		return compareIntFloat(ia, fb), true
+	}
+	return 0, false
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareFloats orders NaN before every other number, like MongoDB.
+func compareFloats(a, b float64) int {
+	switch {
+	case math.IsNaN(a) && math.IsNaN(b):
+		return 0
+	case math.IsNaN(a) || a < b:
+		return -1
+	case math.IsNaN(b) || a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareIntFloat compares the integer n and the float f without
+// rounding n to a float64.
+func compareIntFloat(n int64, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return 1
+	case f >= math.MaxInt64: // 2^63, above every int64
+		return -1
+	case f < math.MinInt64:
+		return 1
+	}
+	if c := compareInts(n, int64(f)); c != 0 {
+		return c
+	}
+	// same integer part, f may still have a fractional part
+	return compareFloats(math.Trunc(f), f)
+}
+
+// exactCompare compares values without any tolerance.
+var exactCompare = &CompareOptions{}
+
+// diffValues appends to changes the differences between a and b,
+// found at path.
+func (o *CompareOptions) diffValues(path string, a, b interface{}, changes []Change) []Change {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			va, inA := a[k]
+			vb, inB := b[k]
+			switch {
+			case !inA:
+				changes = append(changes, Change{Path: joinPath(path, k), Kind: Added, New: vb})
+			case !inB:
+				changes = append(changes, Change{Path: joinPath(path, k), Kind: Removed, Old: va})
+			default:
+				changes = o.diffValues(joinPath(path, k), va, vb, changes)
+			}
+		}
+		return changes
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if o.IgnoreArrayOrder {
+			return o.diffUnordered(path, a, b, changes)
+		}
+		for i := 0; i < len(a) || i < len(b); i++ {
+			p := joinPath(path, strconv.Itoa(i))
+			switch {
+			case i >= len(a):
+				changes = append(changes, Change{Path: p, Kind: Added, New: b[i]})
+			case i >= len(b):
+				changes = append(changes, Change{Path: p, Kind: Removed, Old: a[i]})
+			default:
+				changes = o.diffValues(p, a[i], b[i], changes)
+			}
+		}
+		return changes
+	}
+	if !o.equalLeaves(a, b) {
+		changes = append(changes, Change{Path: path, Kind: Modified, Old: a, New: b})
+	}
+	return changes
+}
+
+// diffUnordered appends to changes the elements of a and b that can't
+// be paired with an equal element of the other array.
+func (o *CompareOptions) diffUnordered(path string, a, b []interface{}, changes []Change) []Change {
+	paired := make([]bool, len(b))
+	var removed []int
+	for i, va := range a {
+		found := false
+		for j, vb := range b {
+			if !paired[j] && len(o.diffValues("", va, vb, nil)) == 0 {
+				paired[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			removed = append(removed, i)
+		}
+	}
+	for _, i := range removed {
+		changes = append(changes, Change{Path: joinPath(path, strconv.Itoa(i)), Kind: Removed, Old: a[i]})
+	}
+	for j, ok := range paired {
+		if !ok {
+			changes = append(changes, Change{Path: joinPath(path, strconv.Itoa(j)), Kind: Added, New: b[j]})
+		}
+	}
+	return changes
+}
+
+// equalLeaves reports whether a and b, values that are neither documents
+// nor arrays, are the same BSON value. Dates are the same if they are
+// the same instant, whatever their time zone, and NaN is the same as NaN.
+func (o *CompareOptions) equalLeaves(a, b interface{}) bool {
+	if o.IgnoreNumericTypes {
+		if eq, ok := equalNumbers(a, b); ok {
+			return eq
+		}
+	}
+	switch a := a.(type) {
+	case time.Time:
+		b, ok := b.(time.Time)
+		if !ok {
+			return false
+		}
+		d := a.Sub(b)
+		if d < 0 {
+			d = -d
+		}
+		return d <= o.DateTolerance
+	case float64:
+		b, ok := b.(float64)
+		return ok && (a == b || math.IsNaN(a) && math.IsNaN(b))
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// equalNumbers reports whether a and b hold the same number, whatever
+// their type. ok is false if a or b isn't an integer or a float64.
+func equalNumbers(a, b interface{}) (eq, ok bool) {
+	ia, aInt := toInt64(a)
+	ib, bInt := toInt64(b)
+	if aInt && bInt {
+		return ia == ib, true
+	}
+	fa, aFloat := a.(float64)
+	fb, bFloat := b.(float64)
+	switch {
+	case aFloat && bFloat:
+		return fa == fb || math.IsNaN(fa) && math.IsNaN(fb), true
+	case aFloat && bInt:
+		return fa == float64(ib) && int64(fa) == ib, true
+	case aInt && bFloat:
+		return fb == float64(ia) && int64(fb) == ia, true
+	}
+	return false, false
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+func TestDiffStreams(t *testing.T) {
+
+	t.Parallel()
+
+	a := strings.NewReader(`{"_id": 1, "name": "a", "tags": ["x", "y"]}
+{"_id": 2, "name": "b"}
+{"_id": 3, "name": "c", "meta": {"n": NumberInt(1)}}
+`)
+	b := strings.NewReader(`{"_id": 1, "name": "a", "tags": ["x", "z", "w"]}
+{"_id": 3, "name": "c", "meta": {"n": NumberInt(2)}, "new": true}
+{"_id": 4, "name": "d"}
+`)
+
+	var changes []mongoextjson.Change
+	err := mongoextjson.DiffStreams(a, b, "_id", func(c mongoextjson.Change) error {
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`modified [1].tags.1: y -> z`,
+		`added [1].tags.2: w`,
+		`removed [2]: map[_id:2 name:b]`,
+		`modified [3].meta.n: 1 -> 2`,
+		`added [3].new: true`,
+		`added [4]: map[_id:4 name:d]`,
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, but got %d: %v", len(want), len(changes), changes)
+	}
+	for i, c := range changes {
+		if got := c.String(); want[i] != got {
+			t.Errorf("change %d: expected %s, but got %s", i, want[i], got)
+		}
+	}
+}
+
+func TestDiffStreamsUnsorted(t *testing.T) {
+
+	t.Parallel()
+
+	a := strings.NewReader(`{"_id": 2} {"_id": 1}`)
+	b := strings.NewReader(`{"_id": 1} {"_id": 2}`)
+
+	err := mongoextjson.DiffStreams(a, b, "_id", func(mongoextjson.Change) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Errorf("expected an error for unsorted stream, but got %v", err)
+	}
+}
+
+func TestDiffStreamsKeyOrder(t *testing.T) {
+
+	t.Parallel()
+
+	// sorted like mongoexport --sort '{_id: 1}' does
+	a := `{"_id": MinKey}
+{"_id": null}
+{"_id": NumberLong("9007199254740992")}
+{"_id": NumberLong("9007199254740993")}
+{"_id": 1e16}
+{"_id": "b"}
+{"_id": {"x": 1}}
+{"_id": ObjectId("5a934e000102030405000000")}
+{"_id": false}
+{"_id": true}
+{"_id": ISODate("2020-01-01T00:00:00Z")}
+{"_id": MaxKey}
+`
+	var changes []mongoextjson.Change
+	err := mongoextjson.DiffStreams(strings.NewReader(a), strings.NewReader(a), "_id", func(c mongoextjson.Change) error {
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no change, but got %v", changes)
+	}
+
+	// int64 keys above 2^53 are compared exactly
+	b := `{"_id": NumberLong("9007199254740992")}
+{"_id": NumberLong("9007199254740994")}
+`
+	err = mongoextjson.DiffStreams(strings.NewReader(a), strings.NewReader(b), "_id", func(c mongoextjson.Change) error {
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 12 || changes[2].Key != int64(9007199254740993) || changes[2].Kind != mongoextjson.Removed {
+		t.Errorf("expected the document 9007199254740993 to be removed, but got %v", changes)
+	}
+	if len(changes) == 12 && (changes[3].Key != int64(9007199254740994) || changes[3].Kind != mongoextjson.Added) {
+		t.Errorf("expected the document 9007199254740994 to be added, but got %v", changes[3])
+	}
+}
+
+func TestDiffStreamsStop(t *testing.T) {
+
+	t.Parallel()
+
+	a := strings.NewReader(`{"_id": 1} {"_id": 2} {"_id": 3}`)
+	b := strings.NewReader(``)
+
+	stop := errors.New("stop")
+	n := 0
+	err := mongoextjson.DiffStreams(a, b, "_id", func(c mongoextjson.Change) error {
+		n++
+		return stop
+	})
+	if err != stop {
+		t.Errorf("expected the error of the callback, but got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 call before stopping, but got %d", n)
+	}
+}
+
+func TestEqual(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{
+			a:     `{_id: ObjectId("5a934e000102030405000000"), n: NumberInt(1), d: ISODate("2020-01-01T00:00:00Z")}`,
+			b:     `{"d": {"$date": {"$numberLong": "1577836800000"}}, "_id": {"$oid": "5a934e000102030405000000"}, "n": {"$numberInt": "1"}}`,
+			equal: true,
+		},
+		{
+			a:     `{"a": [1, {"b": "c"}]}`,
+			b:     "{\n  a: [ 1.0, { 'b': `c` } ],\n}",
+			equal: true,
+		},
+		{
+			a:     `{"n": NumberInt(1)}`,
+			b:     `{"n": NumberLong(1)}`,
+			equal: false,
+		},
+		{
+			a:     `{"a": [1, 2]}`,
+			b:     `{"a": [2, 1]}`,
+			equal: false,
+		},
+		{
+			a:     `{"a": 1}`,
+			b:     `{"a": 1, "b": null}`,
+			equal: false,
+		},
+		{
+			a:     `{"a": NaN, "b": [NaN]}`,
+			b:     `{"a": {"$numberDouble": "NaN"}, "b": [NaN]}`,
+			equal: true,
+		},
+		{
+			a:     `{"a": NaN}`,
+			b:     `{"a": 1}`,
+			equal: false,
+		},
+		{
+			a:     `{"d": ISODate("2020-01-01T01:00:00+01:00")}`,
+			b:     `{"d": ISODate("2020-01-01T00:00:00Z")}`,
+			equal: true,
+		},
+		{
+			a:     `{"d": ISODate("2020-01-01T01:00:00+01:00")}`,
+			b:     `{"d": ISODate("2020-01-01T01:00:00Z")}`,
+			equal: false,
+		},
+	}
+
+	for _, tt := range tests {
+		equal, err := mongoextjson.Equal([]byte(tt.a), []byte(tt.b))
+		if err != nil {
+			t.Fatalf("%s == %s: %v", tt.a, tt.b, err)
+		}
+		if tt.equal != equal {
+			t.Errorf("%s == %s: expected %v, but got %v", tt.a, tt.b, tt.equal, equal)
+		}
+	}
+
+	if _, err := mongoextjson.Equal([]byte(`{"a": 1} {}`), []byte(`{"a": 1}`)); err == nil {
+		t.Error("expected an error for trailing data")
+	}
+}
+
+func TestEqualWithOptions(t *testing.T) {
+
+	t.Parallel()
+
+	unordered := &mongoextjson.CompareOptions{IgnoreArrayOrder: true}
+	numeric := &mongoextjson.CompareOptions{IgnoreNumericTypes: true}
+	second := &mongoextjson.CompareOptions{DateTolerance: time.Second}
+
+	tests := []struct {
+		a, b  string
+		opts  *mongoextjson.CompareOptions
+		equal bool
+	}{
+		{a: `{"a": [1, 2]}`, b: `{"a": [2, 1]}`, opts: nil, equal: false},
+		{a: `{"a": [1, 2]}`, b: `{"a": [2, 1]}`, opts: unordered, equal: true},
+		{a: `{"a": [{"b": [1, 2]}, 3]}`, b: `{"a": [3, {"b": [2, 1]}]}`, opts: unordered, equal: true},
+		{a: `{"a": [1, 1, 2]}`, b: `{"a": [1, 2, 2]}`, opts: unordered, equal: false},
+		{a: `{"n": NumberInt(1)}`, b: `{"n": NumberLong(1)}`, opts: numeric, equal: true},
+		{a: `{"n": NumberLong(1)}`, b: `{"n": 1.0}`, opts: numeric, equal: true},
+		{a: `{"n": NumberInt(1)}`, b: `{"n": 1.5}`, opts: numeric, equal: false},
+		{a: `{"n": NumberInt(1)}`, b: `{"n": "1"}`, opts: numeric, equal: false},
+		{a: `{"n": NumberLong(1)}`, b: `{"n": 1.0}`, opts: unordered, equal: false},
+		{a: `{"d": ISODate("2020-01-01T00:00:00Z")}`, b: `{"d": ISODate("2020-01-01T00:00:00.999Z")}`, opts: nil, equal: false},
+		{a: `{"d": ISODate("2020-01-01T00:00:00Z")}`, b: `{"d": ISODate("2020-01-01T00:00:00.999Z")}`, opts: second, equal: true},
+		{a: `{"d": ISODate("2020-01-01T00:00:01Z")}`, b: `{"d": ISODate("2020-01-01T00:00:00Z")}`, opts: second, equal: true},
+		{a: `{"d": ISODate("2020-01-01T00:00:01.001Z")}`, b: `{"d": ISODate("2020-01-01T00:00:00Z")}`, opts: second, equal: false},
+	}
+
+	for _, tt := range tests {
+		equal, err := mongoextjson.EqualWithOptions([]byte(tt.a), []byte(tt.b), tt.opts)
+		if err != nil {
+			t.Fatalf("%s == %s: %v", tt.a, tt.b, err)
+		}
+		if tt.equal != equal {
+			t.Errorf("%s == %s with %+v: expected %v, but got %v", tt.a, tt.b, tt.opts, tt.equal, equal)
+		}
+	}
+}
+
+func TestDiffWithOptions(t *testing.T) {
+
+	t.Parallel()
+
+	a := `{"tags": ["x", "y", "y"], "n": NumberInt(1)}`
+	b := `{"tags": ["z", "y", "x"], "n": 1.0}`
+
+	changes, err := mongoextjson.DiffWithOptions([]byte(a), []byte(b), &mongoextjson.CompareOptions{IgnoreArrayOrder: true, IgnoreNumericTypes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mongoextjson.Change{
+		{Path: "tags.2", Kind: mongoextjson.Removed, Old: "y"},
+		{Path: "tags.0", Kind: mongoextjson.Added, New: "z"},
+	}
+	if !reflect.DeepEqual(want, changes) {
+		t.Errorf("expected %v, but got %v", want, changes)
+	}
+}
+
+func TestDiff(t *testing.T) {
+
+	t.Parallel()
+
+	a := `{_id: 1, name: "a", orders: [{items: [{_id: ObjectId("5a934e000102030405000000"), n: NumberInt(1)}]}], old: true}`
+	b := `{"_id": 1, "name": "b", "orders": [{"items": [{"_id": {"$oid": "5a934e000102030405000000"}, "n": {"$numberInt": "2"}}]}, {}], "new": null}`
+
+	changes, err := mongoextjson.Diff([]byte(a), []byte(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []mongoextjson.Change{
+		{Path: "name", Kind: mongoextjson.Modified, Old: "a", New: "b"},
+		{Path: "new", Kind: mongoextjson.Added},
+		{Path: "old", Kind: mongoextjson.Removed, Old: true},
+		{Path: "orders.0.items.0.n", Kind: mongoextjson.Modified, Old: int32(1), New: int32(2)},
+		{Path: "orders.1", Kind: mongoextjson.Added, New: map[string]interface{}{}},
+	}
+	if !reflect.DeepEqual(want, changes) {
+		t.Errorf("expected %v, but got %v", want, changes)
+	}
+
+	changes, err = mongoextjson.Diff([]byte(a), []byte(a))
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no change, but got %v, %v", changes, err)
+	}
+
+	if _, err := mongoextjson.Diff([]byte(a), []byte(`{`)); err == nil {
+		t.Error("expected an error for invalid value")
+	}
+}
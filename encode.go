@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding"
 	"encoding/base64"
+	"io"
 	"math"
 	"reflect"
 	"runtime"
@@ -15,8 +16,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Marshaler is the interface implemented by types that
@@ -25,6 +29,24 @@ type Marshaler interface {
 	MarshalJSON() ([]byte, error)
 }
 
+// ExtJSONMarshaler is the interface implemented by types that can marshal
+// themselves into extended JSON. Unlike MarshalJSON, which is often
+// defined for encoding/json, MarshalExtJSON is only called by this
+// package, and its output, which may contain shell constructs like
+// ObjectId("..."), is written as is.
+type ExtJSONMarshaler interface {
+	MarshalExtJSON() ([]byte, error)
+}
+
+// ShellMarshaler is implemented by types that need a different
+// representation in 'shell mode': MarshalShell is called instead of
+// MarshalExtJSON by the encoders of Marshal, MarshalShellPretty and the
+// mongosh dialect.
+type ShellMarshaler interface {
+	ExtJSONMarshaler
+	MarshalShell() ([]byte, error)
+}
+
 // An UnsupportedTypeError is returned by Marshal when attempting
 // to encode an unsupported value type.
 type UnsupportedTypeError struct {
@@ -71,6 +93,9 @@ func (e *MarshalerError) Error() string {
 	return "json: error calling MarshalJSON for type " + e.Type.String() + ": " + e.Err.Error()
 }
 
+// Unwrap returns the underlying error.
+func (e *MarshalerError) Unwrap() error { return e.Err }
+
 var hex = "0123456789abcdef"
 
 // An encodeState encodes JSON into a bytes.Buffer.
@@ -78,7 +103,39 @@ type encodeState struct {
 	bytes.Buffer // accumulated output
 	scratch      [64]byte
 	ext          Extension
-}
+
+	// w, when set, receives the accumulated output each time it grows
+	// past flushSize, so that large values are not held in memory.
+	w    io.Writer
+	werr error
+	// flushed is set once part of the output is written to w
+	flushed bool
+
+	// mapper, when set, maps the names of the fields without a json tag
+	mapper *nameMapper
+	// registry, when set, holds custom codecs of the driver
+	registry *codecRegistry
+	// sortKeys writes the keys of bson.D values in sorted order
+	sortKeys bool
+	// idFirst writes the "_id" key first in the next encoded document
+	idFirst bool
+	// subMillis defines how dates finer than the millisecond are written
+	subMillis SubMillisecondPolicy
+	// floatPoint writes whole floats with a decimal part, like 3.0
+	floatPoint bool
+	// shellFloats writes floats like the mongo shell
+	shellFloats bool
+	// uintOverflow defines how unsigned integers above math.MaxInt64
+	// are written
+	uintOverflow UintOverflowPolicy
+	// intQuoting defines when integers are written as $numberInt or
+	// $numberLong
+	intQuoting IntegerQuoting
+}
+
+// flushSize is the size of the accumulated output above which it is
+// written to the encodeState writer.
+const flushSize = 32 << 10
 
 var encodeStatePool sync.Pool
 
@@ -86,11 +143,37 @@ func newEncodeState() *encodeState {
 	if v := encodeStatePool.Get(); v != nil {
 		e := v.(*encodeState)
 		e.Reset()
+		e.w = nil
+		e.werr = nil
+		e.flushed = false
+		e.mapper = nil
+		e.registry = nil
+		e.sortKeys = false
+		e.idFirst = false
+		e.subMillis = TruncateSubMilliseconds
+		e.floatPoint = false
+		e.shellFloats = false
+		e.uintOverflow = RejectUintOverflow
+		e.intQuoting = QuoteLargeIntegers
 		return e
 	}
 	return new(encodeState)
 }
 
+// flush writes the accumulated output to e.w if it is large enough.
+// It is called between the elements of arrays and documents.
+func (e *encodeState) flush() {
+	if e.w == nil || e.Len() < flushSize {
+		return
+	}
+	e.flushed = true
+	if _, err := e.w.Write(e.Bytes()); err != nil {
+		e.werr = err
+		e.error(err)
+	}
+	e.Reset()
+}
+
 func (e *encodeState) marshal(v interface{}, opts encOpts) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -111,7 +194,21 @@ func (e *encodeState) error(err error) {
 	panic(err)
 }
 
+// zeroer is implemented by the BSON types whose zero value is not
+// the zero value of their kind, like primitive.ObjectID or time.Time.
+type zeroer interface {
+	IsZero() bool
+}
+
+// isEmptyValue reports whether v must be omitted by the omitempty option.
+// Like the MongoDB driver, it honors the IsZero method of values that
+// implement it.
 func isEmptyValue(v reflect.Value) bool {
+	if v.CanInterface() && (v.Kind() != reflect.Ptr || !v.IsNil()) {
+		if z, ok := v.Interface().(zeroer); ok {
+			return z.IsZero()
+		}
+	}
 	switch v.Kind() {
 	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
 		return v.Len() == 0
@@ -182,11 +279,27 @@ func typeEncoder(t reflect.Type) encoderFunc {
 	// Might duplicate effort but won't hold other computations back.
 	innerf := newTypeEncoder(t, true)
 	f = func(e *encodeState, v reflect.Value, opts encOpts) {
+		if e.registry != nil && e.registry.encodes(v.Type()) {
+			e.registryValue(v, opts)
+			return
+		}
+		if e.intQuoting != QuoteLargeIntegers && !e.ext.shell && e.ext.encode != nil {
+			if v = e.quotedInt(v, opts); !v.IsValid() {
+				return
+			}
+		}
 		encode, ok := e.ext.encode[v.Type()]
 		if !ok {
+			if encode, ok := e.ext.encodeValue[v.Type()]; ok {
+				encode(e, v, opts)
+				return
+			}
 			innerf(e, v, opts)
 			return
 		}
+		if v.Type() == timeType && e.subMillis != TruncateSubMilliseconds {
+			v = e.millisecondTime(v)
+		}
 
 		b, err := encode(v.Interface())
 		if err != nil {
@@ -201,14 +314,66 @@ func typeEncoder(t reflect.Type) encoderFunc {
 	return f
 }
 
+var timeType = reflect.TypeOf(time.Time{})
+
+// quotedInt applies the integer quoting policy of e to v if it is a
+// value of a predeclared integer type. It returns the value to encode,
+// or the zero Value if v has already been written as a plain number.
+func (e *encodeState) quotedInt(v reflect.Value, opts encOpts) reflect.Value {
+	if v.Type().PkgPath() != "" {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		return v
+	}
+	if e.intQuoting == QuoteNoIntegers {
+		intEncoder(e, v, opts)
+		return reflect.Value{}
+	}
+	// int32 and int64 values are always quoted by the extensions
+	switch n := v.Int(); v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16:
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			return reflect.ValueOf(int32(n))
+		}
+		return reflect.ValueOf(n)
+	}
+	return v
+}
+
+// millisecondTime applies the sub-millisecond policy of e to the
+// time.Time v, as BSON dates only hold milliseconds.
+func (e *encodeState) millisecondTime(v reflect.Value) reflect.Value {
+	t := v.Interface().(time.Time)
+	if t.Nanosecond()%int(time.Millisecond) == 0 {
+		return v
+	}
+	if e.subMillis == RejectSubMilliseconds {
+		e.error(&UnsupportedValueError{v, "date with sub-millisecond precision " + t.Format(time.RFC3339Nano)})
+	}
+	return reflect.ValueOf(t.Round(time.Millisecond))
+}
+
 var (
 	marshalerType     = reflect.TypeOf(new(Marshaler)).Elem()
+	extMarshalerType  = reflect.TypeOf(new(ExtJSONMarshaler)).Elem()
 	textMarshalerType = reflect.TypeOf(new(encoding.TextMarshaler)).Elem()
 )
 
 // newTypeEncoder constructs an encoderFunc for a type.
 // The returned encoder only checks CanAddr when allowAddr is true.
 func newTypeEncoder(t reflect.Type, allowAddr bool) encoderFunc {
+	if t.Implements(extMarshalerType) {
+		return extMarshalerEncoder
+	}
+	if t.Kind() != reflect.Ptr && allowAddr {
+		if reflect.PtrTo(t).Implements(extMarshalerType) {
+			return newCondAddrEncoder(addrExtMarshalerEncoder, newTypeEncoder(t, false))
+		}
+	}
+
 	if t.Implements(marshalerType) {
 		return marshalerEncoder
 	}
@@ -227,6 +392,10 @@ func newTypeEncoder(t reflect.Type, allowAddr bool) encoderFunc {
 		}
 	}
 
+	if t.Kind() == reflect.Slice && t.Elem() == elemType {
+		return docEncoder
+	}
+
 	switch t.Kind() {
 	case reflect.Bool:
 		return boolEncoder
@@ -261,6 +430,39 @@ func invalidValueEncoder(e *encodeState, v reflect.Value, _ encOpts) {
 	e.WriteString("null")
 }
 
+func extMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		e.WriteString("null")
+		return
+	}
+	e.marshalExt(v, v.Interface().(ExtJSONMarshaler))
+}
+
+func addrExtMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	va := v.Addr()
+	if va.IsNil() {
+		e.WriteString("null")
+		return
+	}
+	e.marshalExt(v, va.Interface().(ExtJSONMarshaler))
+}
+
+// marshalExt writes the encoding of m, using MarshalShell in shell mode
+// when m implements it.
+func (e *encodeState) marshalExt(v reflect.Value, m ExtJSONMarshaler) {
+	var b []byte
+	var err error
+	if sm, ok := m.(ShellMarshaler); ok && e.ext.shell {
+		b, err = sm.MarshalShell()
+	} else {
+		b, err = m.MarshalExtJSON()
+	}
+	if err != nil {
+		e.error(&MarshalerError{v.Type(), err})
+	}
+	e.Buffer.Write(b)
+}
+
 func marshalerEncoder(e *encodeState, v reflect.Value, opts encOpts) {
 	if v.Kind() == reflect.Ptr && v.IsNil() {
 		e.WriteString("null")
@@ -341,6 +543,10 @@ func intEncoder(e *encodeState, v reflect.Value, opts encOpts) {
 }
 
 func uintEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if e.ext.encode != nil && !opts.quoted && v.Kind() != reflect.Uintptr {
+		e.reflectValue(e.signedValue(v), opts)
+		return
+	}
 	b := strconv.AppendUint(e.scratch[:0], v.Uint(), 10)
 	if opts.quoted {
 		e.WriteByte('"')
@@ -351,14 +557,48 @@ func uintEncoder(e *encodeState, v reflect.Value, opts encOpts) {
 	}
 }
 
+// signedValue converts the unsigned integer v to the smallest signed type
+// of BSON holding it, int32 or int64, or to an int for a uint, so that it
+// is written by the extension like the other integers. The uint and
+// uint64 values above math.MaxInt64 follow the overflow policy of e.
+func (e *encodeState) signedValue(v reflect.Value) reflect.Value {
+	n := v.Uint()
+	switch {
+	case v.Kind() == reflect.Uint && n <= math.MaxInt:
+		return reflect.ValueOf(int(n))
+	case v.Kind() != reflect.Uint && v.Kind() != reflect.Uint64 && n <= math.MaxInt32:
+		return reflect.ValueOf(int32(n))
+	case n <= math.MaxInt64:
+		return reflect.ValueOf(int64(n))
+	}
+	switch e.uintOverflow {
+	case DecimalUintOverflow:
+		d, _ := primitive.ParseDecimal128(strconv.FormatUint(n, 10))
+		return reflect.ValueOf(d)
+	case WrapUintOverflow:
+		return reflect.ValueOf(int64(n))
+	}
+	e.error(&UnsupportedValueError{v, "unsigned integer overflowing int64 " + strconv.FormatUint(n, 10)})
+	return v
+}
+
 type floatEncoder int // number of bits
 
 func (bits floatEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
 	f := v.Float()
-	if math.IsInf(f, 0) || math.IsNaN(f) {
-		e.error(&UnsupportedValueError{v, strconv.FormatFloat(f, 'g', -1, int(bits))})
+	var b []byte
+	if e.shellFloats {
+		b = appendShellFloat(e.scratch[:0], f, int(bits))
+	} else {
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			e.error(&UnsupportedValueError{v, strconv.FormatFloat(f, 'g', -1, int(bits))})
+		}
+		b = strconv.AppendFloat(e.scratch[:0], f, 'g', -1, int(bits))
+	}
+	if e.floatPoint && !math.IsInf(f, 0) && !math.IsNaN(f) && bytes.IndexAny(b, ".e") < 0 {
+		// keep the value a double when it is decoded again
+		b = append(b, ".0"...)
 	}
-	b := strconv.AppendFloat(e.scratch[:0], f, 'g', -1, int(bits))
 	if opts.quoted {
 		e.WriteByte('"')
 	}
@@ -368,12 +608,93 @@ func (bits floatEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
 	}
 }
 
+// appendShellFloat appends f to dst the way the mongo shell prints
+// numbers, which is the JavaScript Number.prototype.toString algorithm:
+// the shortest digits that represent f, without exponent from 1e-7 to
+// 1e21 excluded, and NaN, Infinity and -Infinity literals.
+func appendShellFloat(dst []byte, f float64, bits int) []byte {
+	switch {
+	case math.IsNaN(f):
+		return append(dst, "NaN"...)
+	case math.IsInf(f, 1):
+		return append(dst, "Infinity"...)
+	case math.IsInf(f, -1):
+		return append(dst, "-Infinity"...)
+	case f == 0:
+		// -0 is printed as 0
+		return append(dst, '0')
+	}
+	if f < 0 {
+		dst = append(dst, '-')
+		f = -f
+	}
+
+	// the shortest digits d.ddde±n, so that f = 0.dddd × 10^n
+	var buf [32]byte
+	b := strconv.AppendFloat(buf[:0], f, 'e', -1, bits)
+	mark := bytes.IndexByte(b, 'e')
+	exp, _ := strconv.Atoi(string(b[mark+1:]))
+	digits := make([]byte, 0, len(buf))
+	for _, c := range b[:mark] {
+		if c != '.' {
+			digits = append(digits, c)
+		}
+	}
+	k, n := len(digits), exp+1
+
+	switch {
+	case k <= n && n <= 21:
+		dst = append(dst, digits...)
+		for i := k; i < n; i++ {
+			dst = append(dst, '0')
+		}
+	case 0 < n && n <= 21:
+		dst = append(dst, digits[:n]...)
+		dst = append(dst, '.')
+		dst = append(dst, digits[n:]...)
+	case -6 < n && n <= 0:
+		dst = append(dst, "0."...)
+		for i := n; i < 0; i++ {
+			dst = append(dst, '0')
+		}
+		dst = append(dst, digits...)
+	default:
+		dst = append(dst, digits[0])
+		if k > 1 {
+			dst = append(dst, '.')
+			dst = append(dst, digits[1:]...)
+		}
+		dst = append(dst, 'e')
+		if n-1 >= 0 {
+			dst = append(dst, '+')
+		}
+		dst = strconv.AppendInt(dst, int64(n-1), 10)
+	}
+	return dst
+}
+
 var (
 	float32Encoder = (floatEncoder(32)).encode
 	float64Encoder = (floatEncoder(64)).encode
 )
 
 func stringEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if v.Type() == numberType {
+		numStr := v.String()
+		// A Number with an empty string is encoded as 0,
+		// as it is the zero value of the type.
+		if numStr == "" {
+			numStr = "0"
+		}
+		if opts.quoted {
+			e.WriteByte('"')
+		}
+		e.WriteString(numStr)
+		if opts.quoted {
+			e.WriteByte('"')
+		}
+		return
+	}
 
 	if opts.quoted {
 		sb, err := Marshal(v.String())
@@ -404,9 +725,25 @@ type structEncoder struct {
 }
 
 func (se *structEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	var order []int
+	if e.idFirst {
+		e.idFirst = false
+		order = moveIDFirst(nil, len(se.fields), func(i int) string {
+			f := se.fields[i]
+			if !f.tag && e.mapper != nil {
+				return e.mapper.get(f.name).name
+			}
+			return f.name
+		})
+	}
 	e.WriteByte('{')
 	first := true
-	for i, f := range se.fields {
+	for j := range se.fields {
+		i := j
+		if order != nil {
+			i = order[j]
+		}
+		f := se.fields[i]
 		fv := fieldByIndex(v, f.index)
 		if !fv.IsValid() || f.omitEmpty && isEmptyValue(fv) {
 			continue
@@ -415,8 +752,13 @@ func (se *structEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
 			first = false
 		} else {
 			e.WriteByte(',')
+			e.flush()
+		}
+		if !f.tag && e.mapper != nil {
+			e.string(e.mapper.get(f.name).name, opts.escapeHTML)
+		} else {
+			e.string(f.name, opts.escapeHTML)
 		}
-		e.string(f.name, opts.escapeHTML)
 		e.WriteByte(':')
 		opts.quoted = f.quoted
 		se.fieldEncs[i](e, fv, opts)
@@ -425,7 +767,7 @@ func (se *structEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
 }
 
 func newStructEncoder(t reflect.Type) encoderFunc {
-	fields := cachedTypeFields(t)
+	fields := cachedTypeFields(t).list
 	se := &structEncoder{
 		fields:    fields,
 		fieldEncs: make([]encoderFunc, len(fields)),
@@ -457,10 +799,22 @@ func (me *mapEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
 		}
 	}
 	sort.Sort(byString(sv))
+	if e.idFirst {
+		e.idFirst = false
+		for i := range sv {
+			if sv[i].s == "_id" {
+				id := sv[i]
+				copy(sv[1:i+1], sv[:i])
+				sv[0] = id
+				break
+			}
+		}
+	}
 
 	for i, kv := range sv {
 		if i > 0 {
 			e.WriteByte(',')
+			e.flush()
 		}
 		e.string(kv.s, opts.escapeHTML)
 		e.WriteByte(':')
@@ -469,6 +823,79 @@ func (me *mapEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
 	e.WriteByte('}')
 }
 
+var elemType = reflect.TypeOf(primitive.E{})
+
+// docEncoder encodes a bson.D, or any []primitive.E, as a document whose
+// keys are written in the order of the slice, or sorted if e.sortKeys is
+// set.
+func docEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if v.IsNil() {
+		e.WriteString("null")
+		return
+	}
+	var order []int
+	if e.sortKeys {
+		order = make([]int, v.Len())
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return v.Index(order[i]).Field(0).String() < v.Index(order[j]).Field(0).String()
+		})
+	}
+	if e.idFirst {
+		e.idFirst = false
+		order = moveIDFirst(order, v.Len(), func(i int) string {
+			return v.Index(i).Field(0).String()
+		})
+	}
+	e.WriteByte('{')
+	opts.quoted = false
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			e.WriteByte(',')
+			e.flush()
+		}
+		elem := v.Index(i)
+		if order != nil {
+			elem = v.Index(order[i])
+		}
+		e.string(elem.Field(0).String(), opts.escapeHTML)
+		e.WriteByte(':')
+		e.reflectValue(elem.Field(1), opts)
+	}
+	e.WriteByte('}')
+}
+
+// moveIDFirst returns the order in which to write the n keys of a
+// document, named by key, so that the "_id" key comes first. order is
+// the current order, nil meaning the natural one, and is returned as is
+// if there is nothing to move.
+func moveIDFirst(order []int, n int, key func(i int) string) []int {
+	for i := 0; i < n; i++ {
+		k := i
+		if order != nil {
+			k = order[i]
+		}
+		if key(k) != "_id" {
+			continue
+		}
+		if i == 0 {
+			return order
+		}
+		if order == nil {
+			order = make([]int, n)
+			for j := range order {
+				order[j] = j
+			}
+		}
+		copy(order[1:i+1], order[:i])
+		order[0] = k
+		return order
+	}
+	return order
+}
+
 func newMapEncoder(t reflect.Type) encoderFunc {
 	if t.Key().Kind() != reflect.String && !t.Key().Implements(textMarshalerType) {
 		return unsupportedTypeEncoder
@@ -533,6 +960,7 @@ func (ae *arrayEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
 	for i := 0; i < n; i++ {
 		if i > 0 {
 			e.WriteByte(',')
+			e.flush()
 		}
 		ae.elemEnc(e, v.Index(i), opts)
 	}
@@ -864,7 +1292,8 @@ func (x byIndex) Less(i, j int) bool {
 
 // typeFields returns a list of fields that JSON should recognize for the given type.
 // The algorithm is breadth-first search over the set of structs to include - the top struct
-// and then any reachable anonymous structs.
+// and then any reachable anonymous structs, or struct fields tagged with ",inline", which
+// are flattened into the parent document like with bson.Marshal.
 func typeFields(t reflect.Type) []field {
 	// Anonymous fields to explore at the current level and the next.
 	current := []field{}
@@ -928,7 +1357,8 @@ func typeFields(t reflect.Type) []field {
 				}
 
 				// Record found field and index sequence.
-				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+				inline := opts.Contains("inline") && ft.Kind() == reflect.Struct
+				if !inline && (name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct) {
 					tagged := name != ""
 					if name == "" {
 						name = sf.Name
@@ -1034,13 +1464,21 @@ func dominantField(fields []field) (field, bool) {
 	return fields[0], true
 }
 
+// structFields holds the fields of a struct type, as found by
+// typeFields, and an index of their names for the decoder.
+type structFields struct {
+	list []field
+	// nameIndex maps the exact name of a field to its index in list
+	nameIndex map[string]int
+}
+
 var fieldCache struct {
 	sync.RWMutex
-	m map[reflect.Type][]field
+	m map[reflect.Type]*structFields
 }
 
 // cachedTypeFields is like typeFields but uses a cache to avoid repeated work.
-func cachedTypeFields(t reflect.Type) []field {
+func cachedTypeFields(t reflect.Type) *structFields {
 	fieldCache.RLock()
 	f := fieldCache.m[t]
 	fieldCache.RUnlock()
@@ -1050,14 +1488,17 @@ func cachedTypeFields(t reflect.Type) []field {
 
 	// Compute fields without lock.
 	// Might duplicate effort but won't hold other computations back.
-	f = typeFields(t)
-	if f == nil {
-		f = []field{}
+	list := typeFields(t)
+	f = &structFields{list: list, nameIndex: make(map[string]int, len(list))}
+	for i, field := range list {
+		if _, ok := f.nameIndex[field.name]; !ok {
+			f.nameIndex[field.name] = i
+		}
 	}
 
 	fieldCache.Lock()
 	if fieldCache.m == nil {
-		fieldCache.m = map[reflect.Type][]field{}
+		fieldCache.m = map[reflect.Type]*structFields{}
 	}
 	fieldCache.m[t] = f
 	fieldCache.Unlock()
@@ -0,0 +1,39 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// ResponseEnvelope holds the fields that a MongoDB server adds to
+// every command response, like
+//
+//	{
+//		"ok": 1,
+//		"$clusterTime": {
+//			"clusterTime": Timestamp(1654159261, 1),
+//			"signature": {"hash": BinData(0,"AAAAAAAAAAAAAAAAAAAAAAAAAAA="), "keyId": NumberLong(0)}
+//		},
+//		"operationTime": Timestamp(1654159261, 1)
+//	}
+//
+// It can be embedded in a struct describing the rest of a response.
+type ResponseEnvelope struct {
+	OK            float64              `json:"ok"`
+	ErrMsg        string               `json:"errmsg,omitempty"`
+	Code          int32                `json:"code,omitempty"`
+	CodeName      string               `json:"codeName,omitempty"`
+	ClusterTime   *ClusterTime         `json:"$clusterTime,omitempty"`
+	OperationTime *primitive.Timestamp `json:"operationTime,omitempty"`
+}
+
+// ClusterTime is the $clusterTime document of a server response.
+type ClusterTime struct {
+	ClusterTime primitive.Timestamp  `json:"clusterTime"`
+	Signature   ClusterTimeSignature `json:"signature"`
+}
+
+// ClusterTimeSignature is the signature of a $clusterTime document.
+type ClusterTimeSignature struct {
+	Hash  []byte `json:"hash"`
+	KeyID int64  `json:"keyId"`
+}
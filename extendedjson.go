@@ -8,6 +8,9 @@
 //
 //	https://docs.mongodb.com/manual/reference/mongodb-extended-json-v1/
 //
+// Values can also be encoded in extended JSON v2 canonical mode with
+// MarshalCanonicalV2.
+//
 // This package is compatible with the official go driver (https://github.com/mongodb/mongo-go-driver)
 //
 // Limitations:
@@ -18,20 +21,60 @@ package mongoextjson
 import (
 	"bytes"
 	"encoding/base64"
+	enchex "encoding/hex"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Unmarshal unmarshals a slice of byte that may hold non-standard
 // syntax as defined in MonogDB extended JSON v1 specification.
 func Unmarshal(data []byte, value interface{}) error {
-	d := NewDecoder(bytes.NewBuffer(data))
+	dec := getDecoder(bytes.NewReader(data), &jsonExt)
+	err := dec.Decode(value)
+	putDecoder(dec)
+	return err
+}
+
+// NewExtendedDecoder returns a decoder that reads values from r
+// like Unmarshal.
+func NewExtendedDecoder(r io.Reader) *Decoder {
+	d := NewDecoder(r)
 	d.Extend(&jsonExt)
-	return d.Decode(value)
+	return d
+}
+
+// UnmarshalNoCopy is like Unmarshal, but decodes data in place.
+// To avoid allocations, decoded strings, including map keys, point
+// to the memory of data when they don't contain escape sequences.
+//
+// data must therefore not be modified for as long as the decoded
+// values are in use. It is meant for read-only inputs, like a
+// memory-mapped file.
+func UnmarshalNoCopy(data []byte, value interface{}) error {
+	var d decodeState
+	pos := Decoder{buf: data}
+	if err := checkValid(data, &d.scan); err != nil {
+		pos.setPosition(err)
+		return err
+	}
+	d.init(data)
+	d.ext = jsonExt
+	d.noCopy = true
+	err := d.unmarshal(value)
+	pos.setPosition(err)
+	return err
 }
 
 // Marshal return the MongoDB extended JSON v1 encoding of value
@@ -40,14 +83,22 @@ func Unmarshal(data []byte, value interface{}) error {
 //
 // { "_id": ObjectId("5a934e000102030405000000")}
 func Marshal(value interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	e := NewEncoder(&buf)
-	e.Extend(&jsonExtendedExt)
-	err := e.Encode(value)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return NewShellEncoder(nil).Append(nil, value)
+}
+
+// MarshalShellPretty return the MongoDB extended JSON v1 encoding of
+// value in 'shell mode', formatted exactly like the tojson() function
+// of the mongo shell, so the output will look like
+//
+//	{
+//		"_id" : ObjectId("5a934e000102030405000000"),
+//		"int32" : 32,
+//		"timestamp" : Timestamp(2334, 33)
+//	}
+//
+// As in the shell, int32 values are written as plain numbers.
+func MarshalShellPretty(value interface{}) ([]byte, error) {
+	return NewShellPrettyEncoder(nil).Append(nil, value)
 }
 
 // MarshalCanonical return the MongoDB extended JSON v1 of value
@@ -56,19 +107,330 @@ func Marshal(value interface{}) ([]byte, error) {
 //
 // { "_id": {"$oid": "5a934e000102030405000000"}}
 func MarshalCanonical(value interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	e := NewEncoder(&buf)
+	return NewCanonicalEncoder(nil).Append(nil, value)
+}
+
+// MarshalCanonicalV2 return the MongoDB extended JSON v2 encoding of
+// value in 'canonical mode', as defined here:
+//
+//	https://docs.mongodb.com/manual/reference/mongodb-extended-json/
+//
+// The output is a valid JSON that preserves the BSON type of each value,
+// and will look like
+//
+// { "_id": {"$oid": "5a934e000102030405000000"}, "n": {"$numberDouble": "2.2"}}
+func MarshalCanonicalV2(value interface{}) ([]byte, error) {
+	return NewCanonicalV2Encoder(nil).Append(nil, value)
+}
+
+// NewShellEncoder returns an encoder that writes values to w
+// in 'shell mode', like Marshal.
+func NewShellEncoder(w io.Writer) *Encoder {
+	e := NewEncoder(w)
+	e.Extend(&jsonExtendedExt)
+	return e
+}
+
+// NewShellPrettyEncoder returns an encoder that writes values to w
+// in 'shell mode', like MarshalShellPretty.
+func NewShellPrettyEncoder(w io.Writer) *Encoder {
+	e := NewEncoder(w)
+	e.Extend(&jsonShellPrettyExt)
+	e.tojson = true
+	e.shellFloat = true
+	return e
+}
+
+// NewCanonicalEncoder returns an encoder that writes values to w
+// in 'strict mode', like MarshalCanonical.
+func NewCanonicalEncoder(w io.Writer) *Encoder {
+	e := NewEncoder(w)
 	e.Extend(&jsonExt)
-	err := e.Encode(value)
+	e.floatPoint = true
+	return e
+}
+
+// NewCanonicalV2Encoder returns an encoder that writes values to w
+// in extended JSON v2 'canonical mode', like MarshalCanonicalV2.
+func NewCanonicalV2Encoder(w io.Writer) *Encoder {
+	e := NewEncoder(w)
+	e.Extend(&jsonCanonicalV2Ext)
+	return e
+}
+
+// EncodeNewDate encodes a time.Time or a primitive.DateTime as
+// new Date("2016-05-15T01:02:03.004Z"). It can be registered on an
+// encoder with Encoder.EncodeType.
+func EncodeNewDate(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return appendNewDate(t), nil
+	case primitive.DateTime:
+		return appendNewDate(t.Time().UTC()), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T as a date", v)
+}
+
+func appendNewDate(t time.Time) []byte {
+	b := append(make([]byte, 0, 40), `new Date("`...)
+	b = t.AppendFormat(b, jdateFormat)
+	return append(b, `")`...)
+}
+
+// EncodeDatesAsMillis makes the encoder write time.Time and
+// primitive.DateTime values as a number of milliseconds since the Unix
+// epoch, like new Date(1463274123004) in 'shell mode' and
+// {"$date":{"$numberLong":"1463274123004"}} otherwise, instead of an ISO
+// string. This is more compact, and keeps the dates whose year doesn't
+// fit in an ISO string. Like EncodeType, it must be called after Extend.
+func (enc *Encoder) EncodeDatesAsMillis() {
+	encode := jencDateMillis
+	if enc.ext.shell {
+		encode = jencNewDateMillis
+	}
+	enc.EncodeType(time.Time{}, encode)
+	enc.EncodeType(primitive.DateTime(0), encode)
+}
+
+// dateMillis returns the number of milliseconds since the Unix epoch of
+// a time.Time or a primitive.DateTime.
+func dateMillis(v interface{}) int64 {
+	if t, ok := v.(time.Time); ok {
+		return int64(primitive.NewDateTimeFromTime(t))
+	}
+	return int64(v.(primitive.DateTime))
+}
+
+func jencDateMillis(v interface{}) ([]byte, error) {
+	return wrapInt(`{"$date":{"$numberLong":"`, dateMillis(v), `"}}`), nil
+}
+
+func jencNewDateMillis(v interface{}) ([]byte, error) {
+	return wrapInt(`new Date(`, dateMillis(v), `)`), nil
+}
+
+// EncodeQuotedNumberLong encodes an int64 as NumberLong("64"). It can be
+// registered on an encoder with Encoder.EncodeType.
+func EncodeQuotedNumberLong(v interface{}) ([]byte, error) {
+	n, ok := v.(int64)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as a NumberLong", v)
+	}
+	return wrapInt(`NumberLong("`, n, `")`), nil
+}
+
+// EncodeHexData encodes a primitive.Binary or a []byte as HexData(0,"666f6f").
+// It can be registered on an encoder with Encoder.EncodeType.
+func EncodeHexData(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return fbytes(`HexData(0,"%x")`, b), nil
+	case primitive.Binary:
+		return fbytes(`HexData(%d,"%x")`, b.Subtype, b.Data), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T as HexData", v)
+}
+
+// EncodeHexDataUnprintable encodes a primitive.Binary or a []byte as
+// HexData when its payload is not printable text, and as BinData otherwise.
+// It can be registered on an encoder with Encoder.EncodeType.
+func EncodeHexDataUnprintable(v interface{}) ([]byte, error) {
+	var data []byte
+	var subtype byte
+	switch b := v.(type) {
+	case []byte:
+		data = b
+	case primitive.Binary:
+		data, subtype = b.Data, b.Subtype
+	default:
+		return nil, fmt.Errorf("cannot encode %T as HexData", v)
+	}
+	if isPrintable(data) {
+		return AppendBinData(nil, subtype, data), nil
+	}
+	return EncodeHexData(v)
+}
+
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeCanonicalUUID encodes a primitive.Binary of subtype 4 as
+// {"$uuid":"87654321-abcd-ef01-2345-6789abcdef01"}, as allowed by extended
+// JSON v2. Binaries of other subtypes are encoded as {"$binary": ...}.
+// It can be registered on a canonical encoder with Encoder.EncodeType.
+func EncodeCanonicalUUID(v interface{}) ([]byte, error) {
+	b, ok := v.(primitive.Binary)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as an UUID", v)
+	}
+	if b.Subtype != bsontype.BinaryUUID || len(b.Data) != 16 {
+		return jencV2BinaryType(b)
+	}
+	return fbytes(`{"$uuid":"%x-%x-%x-%x-%x"}`, b.Data[0:4], b.Data[4:6], b.Data[6:8], b.Data[8:10], b.Data[10:16]), nil
+}
+
+// EncodeMD5 encodes a primitive.Binary of subtype 5 as
+// MD5("d41d8cd98f00b204e9800998ecf8427e"), as printed by the mongo shell.
+// Binaries of other subtypes are encoded as BinData. It can be registered
+// on an encoder with Encoder.EncodeType.
+func EncodeMD5(v interface{}) ([]byte, error) {
+	b, ok := v.(primitive.Binary)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as MD5", v)
+	}
+	if b.Subtype != bsontype.BinaryMD5 {
+		return AppendBinData(nil, b.Subtype, b.Data), nil
+	}
+	return fbytes(`MD5("%x")`, b.Data), nil
+}
+
+// EncodeSpecialFloatLiteral encodes a float64 or a float32 with the
+// shortest representation of its value, and NaN and infinite values as
+// NaN, Infinity and -Infinity instead of failing. It can be registered
+// on a shell encoder with Encoder.EncodeType. As it has no access to the
+// options of the encoder, the floats it writes ignore KeepFloatDecimalPoint.
+func EncodeSpecialFloatLiteral(v interface{}) ([]byte, error) {
+	f, bits, err := floatValue(v)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	switch {
+	case math.IsNaN(f):
+		return []byte("NaN"), nil
+	case math.IsInf(f, 1):
+		return []byte("Infinity"), nil
+	case math.IsInf(f, -1):
+		return []byte("-Infinity"), nil
+	}
+	return strconv.AppendFloat(nil, f, 'g', -1, bits), nil
+}
+
+// EncodeSpecialFloatNumberDouble encodes a float64 or a float32 with the
+// shortest representation of its value, and NaN and infinite values as
+// {"$numberDouble":"NaN"} instead of failing. It can be registered on a
+// canonical encoder with Encoder.EncodeType. As it has no access to the
+// options of the encoder, whole floats are written without decimal part,
+// like 3, even when KeepFloatDecimalPoint is set.
+func EncodeSpecialFloatNumberDouble(v interface{}) ([]byte, error) {
+	f, bits, err := floatValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return jencV2Double(f)
+	}
+	return strconv.AppendFloat(nil, f, 'g', -1, bits), nil
+}
+
+// specialFloatEncoder returns an encoder writing the NaN and infinite
+// floats with special, and the finite ones like the float encoder, so that
+// the float options of the encoder still apply to them.
+func specialFloatEncoder(special func(v interface{}) ([]byte, error)) encoderFunc {
+	return func(e *encodeState, v reflect.Value, opts encOpts) {
+		f := v.Float()
+		if !math.IsNaN(f) && !math.IsInf(f, 0) {
+			floatEncoder(v.Type().Bits()).encode(e, v, opts)
+			return
+		}
+		b, err := special(v.Interface())
+		if err != nil {
+			e.error(&MarshalerError{v.Type(), err})
+		}
+		e.Write(b)
+	}
+}
+
+func floatValue(v interface{}) (float64, int, error) {
+	switch f := v.(type) {
+	case float64:
+		return f, 64, nil
+	case float32:
+		return float64(f), 32, nil
+	}
+	return 0, 0, fmt.Errorf("cannot encode %T as a float", v)
+}
+
+// EncodeRegexLiteral encodes a primitive.Regex or a *regexp.Regexp as a
+// shell literal like /^a/i, as printed by tojson() in the mongo shell. It
+// can be registered on an encoder with Encoder.EncodeType.
+//
+// Note that such literals can't be decoded by Unmarshal.
+func EncodeRegexLiteral(v interface{}) ([]byte, error) {
+	var re primitive.Regex
+	switch r := v.(type) {
+	case primitive.Regex:
+		re = r
+	case *regexp.Regexp:
+		if r == nil {
+			return []byte("null"), nil
+		}
+		re = regexpToRegex(r)
+	default:
+		return nil, fmt.Errorf("cannot encode %T as a regular expression", v)
+	}
+	if re.Pattern == "" {
+		// like the shell, as // would start a comment
+		re.Pattern = "(?:)"
+	}
+	b := make([]byte, 0, len(re.Pattern)+len(re.Options)+2)
+	b = append(b, '/')
+	escaped := false
+	for i := 0; i < len(re.Pattern); i++ {
+		c := re.Pattern[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '/':
+			// an unescaped slash would end the literal
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	b = append(b, '/')
+	return append(b, re.Options...), nil
+}
+
+// EncodeUUID encodes a primitive.Binary of subtype 4 as
+// UUID("87654321-abcd-ef01-2345-6789abcdef01"), as printed by the mongo
+// shell. Binaries of other subtypes are encoded as BinData. It can be
+// registered on an encoder with Encoder.EncodeType.
+func EncodeUUID(v interface{}) ([]byte, error) {
+	b, ok := v.(primitive.Binary)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as an UUID", v)
+	}
+	if b.Subtype != bsontype.BinaryUUID || len(b.Data) != 16 {
+		return AppendBinData(nil, b.Subtype, b.Data), nil
+	}
+	return fbytes(`UUID("%x-%x-%x-%x-%x")`, b.Data[0:4], b.Data[4:6], b.Data[6:8], b.Data[8:10], b.Data[10:16]), nil
+}
+
+// DBRef is a reference to a document in a collection, and optionally
+// in another database. A $ref document with other fields than $ref, $id
+// and $db is decoded as a plain document, so that no field is lost.
+type DBRef struct {
+	Collection string      `json:"$ref"`
+	ID         interface{} `json:"$id"`
+	DB         string      `json:"$db,omitempty"`
 }
 
 var jsonExt Extension
 var funcExt Extension
 var jsonExtendedExt Extension
+var jsonCanonicalV2Ext Extension
+var jsonShellPrettyExt Extension
+var jsonMongoshExt Extension
 
 // TODO
 // - Shell regular expressions ("/regexp/opts")
@@ -79,6 +441,16 @@ var jsonExtendedExt Extension
 func init() {
 	jsonExt.DecodeUnquotedKeys(true)
 	jsonExt.DecodeTrailingCommas(true)
+	jsonExt.DecodeBacktickStrings(true)
+	jsonExt.DecodeSpecialFloats(true)
+	jsonExt.DecodeJSNumbers(true)
+	funcExt.DecodeJSNumbers(true)
+	jsonExt.DecodeJSEscapes(true)
+	funcExt.DecodeJSEscapes(true)
+	funcExt.DecodeBacktickStrings(true)
+	jsonExt.DecodeSingleQuotes(true)
+	funcExt.DecodeSingleQuotes(true)
+	funcExt.DecodeUnquotedKeys(true)
 
 	funcExt.DecodeFunc("BinData", "$binaryFunc", "$type", "$binary")
 	jsonExt.DecodeKeyed("$binary", jdecBinary)
@@ -88,8 +460,29 @@ func init() {
 	jsonExtendedExt.EncodeType([]byte(nil), jencExtendedBinarySlice)
 	jsonExtendedExt.EncodeType(primitive.Binary{}, jencExtendedBinaryType)
 
+	funcExt.DecodeFunc("HexData", "$hexDataFunc", "$type", "$hex")
+	jsonExt.DecodeKeyed("$hexDataFunc", jdecHexData)
+
+	funcExt.DecodeFunc("MD5", "$md5Func", "S")
+	jsonExt.DecodeKeyed("$md5Func", jdecMD5)
+
+	funcExt.DecodeFunc("UUID", "$uuidFunc", "S")
+	jsonExt.DecodeKeyed("$uuid", jdecUUID)
+	jsonExt.DecodeKeyed("$uuidFunc", jdecUUID)
+
+	// legacy UUIDs, as defined by the uuidhelpers.js script
+	funcExt.DecodeFunc("LUUID", "$luuidFunc", "S")
+	funcExt.DecodeFunc("PYUUID", "$pyuuidFunc", "S")
+	funcExt.DecodeFunc("CSUUID", "$csuuidFunc", "S")
+	funcExt.DecodeFunc("JUUID", "$juuidFunc", "S")
+	jsonExt.DecodeKeyed("$luuidFunc", jdecUUID)
+	jsonExt.DecodeKeyed("$pyuuidFunc", jdecUUID)
+	jsonExt.DecodeKeyed("$csuuidFunc", jdecUUID)
+	jsonExt.DecodeKeyed("$juuidFunc", jdecUUID)
+
 	funcExt.DecodeFunc("ISODate", "$dateFunc", "S")
 	funcExt.DecodeFunc("new Date", "$dateFunc", "S")
+	funcExt.DecodeFunc("Date", "$dateFunc", "S")
 	jsonExt.DecodeKeyed("$date", jdecDate)
 	jsonExt.DecodeKeyed("$dateFunc", jdecDate)
 	jsonExt.EncodeType(time.Time{}, jencDate)
@@ -111,6 +504,8 @@ func init() {
 	jsonExt.EncodeType(primitive.Regex{}, jencRegularExpression)
 	jsonExtendedExt.EncodeType(primitive.Regex{}, jencRegularExpression)
 	jsonExt.DecodeKeyed("$regularExpression", jdecRegularExpression)
+	jsonExt.EncodeType((*regexp.Regexp)(nil), jencRegexp)
+	jsonExtendedExt.EncodeType((*regexp.Regexp)(nil), jencRegexp)
 
 	funcExt.DecodeFunc("ObjectId", "$oidFunc", "Id")
 	jsonExt.DecodeKeyed("$oid", jdecObjectID)
@@ -118,8 +513,11 @@ func init() {
 	jsonExt.EncodeType(primitive.ObjectID{}, jencObjectID)
 	jsonExtendedExt.EncodeType(primitive.ObjectID{}, jencExtendedObjectID)
 
-	funcExt.DecodeFunc("DBRef", "$dbrefFunc", "$ref", "$id")
+	funcExt.DecodeFunc("DBRef", "$dbrefFunc", "$ref", "$id", "$db")
+	jsonExt.DecodeKeyed("$ref", jdecDBRef)
 	jsonExt.DecodeKeyed("$dbrefFunc", jdecDBRef)
+	jsonExt.encodeValueType(reflect.TypeOf(DBRef{}), jencDBRef)
+	jsonExtendedExt.encodeValueType(reflect.TypeOf(DBRef{}), jencExtendedDBRef)
 
 	funcExt.DecodeFunc("NumberLong", "$numberLongFunc", "N")
 	jsonExt.DecodeKeyed("$numberLong", jdecNumberLong)
@@ -141,15 +539,44 @@ func init() {
 	jsonExt.DecodeKeyed("$numberDecimalFunc", jdecNumberDecimal)
 	jsonExt.EncodeType(primitive.NewDecimal128(0, 0), jencNumberDecimal)
 	jsonExtendedExt.EncodeType(primitive.NewDecimal128(0, 0), jencExtendedNumberDecimal)
+	jsonExt.EncodeType((*big.Int)(nil), jencBigDecimal(jencNumberDecimal))
+	jsonExt.EncodeType((*big.Float)(nil), jencBigDecimal(jencNumberDecimal))
+	jsonExtendedExt.EncodeType((*big.Int)(nil), jencBigDecimal(jencExtendedNumberDecimal))
+	jsonExtendedExt.EncodeType((*big.Float)(nil), jencBigDecimal(jencExtendedNumberDecimal))
+
+	jsonExt.DecodeKeyed("$numberDouble", jdecNumberDouble)
+
+	funcExt.DecodeFunc("Code", "$codeFunc", "S", "Scope")
+	jsonExt.DecodeKeyed("$code", jdecCode)
+	jsonExt.DecodeKeyed("$codeFunc", jdecCode)
+	jsonExt.EncodeType(primitive.JavaScript(""), jencCode)
+	jsonExtendedExt.EncodeType(primitive.JavaScript(""), jencExtendedCode)
+	jsonExt.encodeValueType(reflect.TypeOf(primitive.CodeWithScope{}), jencCodeWithScope)
+	jsonExtendedExt.encodeValueType(reflect.TypeOf(primitive.CodeWithScope{}), jencExtendedCodeWithScope)
+
+	funcExt.DecodeFunc("DBPointer", "$dbPointerFunc", "$ref", "$id")
+	jsonExt.DecodeKeyed("$dbPointer", jdecDBPointer)
+	jsonExt.DecodeKeyed("$dbPointerFunc", jdecDBPointer)
+	jsonExt.EncodeType(primitive.DBPointer{}, jencDBPointer)
+	jsonExtendedExt.EncodeType(primitive.DBPointer{}, jencExtendedDBPointer)
+
+	jsonExt.DecodeKeyed("$symbol", jdecSymbol)
+	jsonExt.EncodeType(primitive.Symbol(""), jencSymbol)
+	jsonExtendedExt.EncodeType(primitive.Symbol(""), jencSymbol)
 
 	funcExt.DecodeConst("MinKey", primitive.MinKey{})
 	funcExt.DecodeConst("MaxKey", primitive.MaxKey{})
 	jsonExt.DecodeKeyed("$minKey", jdecMinKey)
 	jsonExt.DecodeKeyed("$maxKey", jdecMaxKey)
+	// mongosh prints them as function calls
+	funcExt.DecodeFunc("MinKey", "$minKeyFunc")
+	funcExt.DecodeFunc("MaxKey", "$maxKeyFunc")
+	jsonExt.DecodeKeyed("$minKeyFunc", jdecMinKeyFunc)
+	jsonExt.DecodeKeyed("$maxKeyFunc", jdecMaxKeyFunc)
 	jsonExt.EncodeType(primitive.MinKey{}, jencMinKey)
 	jsonExt.EncodeType(primitive.MaxKey{}, jencMaxKey)
-	jsonExtendedExt.EncodeType(primitive.MinKey{}, jencMinKey)
-	jsonExtendedExt.EncodeType(primitive.MaxKey{}, jencMaxKey)
+	jsonExtendedExt.EncodeType(primitive.MinKey{}, jencExtendedMinKey)
+	jsonExtendedExt.EncodeType(primitive.MaxKey{}, jencExtendedMaxKey)
 
 	jsonExt.DecodeConst("null", primitive.Null{})
 	jsonExt.EncodeType(primitive.Null{}, jencNull)
@@ -159,7 +586,50 @@ func init() {
 	jsonExt.EncodeType(primitive.Undefined{}, jencUndefined)
 	jsonExtendedExt.EncodeType(primitive.Undefined{}, jencExtendedUndefined)
 
+	// mongosh constructors
+	funcExt.DecodeFunc("Long", "$numberLongFunc", "N")
+	funcExt.DecodeFunc("Int32", "$numberIntFunc", "N")
+	funcExt.DecodeFunc("Double", "$numberDoubleFunc", "N")
+	funcExt.DecodeFunc("Decimal128", "$numberDecimalFunc", "N")
+	funcExt.DecodeFunc("Binary.createFromBase64", "$binaryFunc", "$binary", "$type")
+	jsonExt.DecodeKeyed("$numberDoubleFunc", jdecNumberDouble)
+
 	jsonExt.Extend(&funcExt)
+
+	// v2 canonical mode shares the strict mode spelling of most types
+	jsonCanonicalV2Ext.Extend(&jsonExt)
+	jsonCanonicalV2Ext.EncodeType([]byte(nil), jencV2BinarySlice)
+	jsonCanonicalV2Ext.EncodeType(primitive.Binary{}, jencV2BinaryType)
+	jsonCanonicalV2Ext.EncodeType(time.Time{}, jencV2Date)
+	jsonCanonicalV2Ext.EncodeType(primitive.DateTime(0), jencDateTime)
+	jsonCanonicalV2Ext.EncodeType(int(0), jencV2Int)
+	jsonCanonicalV2Ext.EncodeType(float64(0), jencV2Double)
+	jsonCanonicalV2Ext.EncodeType(float32(0), jencV2Double)
+	jsonCanonicalV2Ext.EncodeType((*regexp.Regexp)(nil), jencV2Regexp)
+
+	// tojson() of the mongo shell
+	jsonShellPrettyExt.Extend(&jsonExtendedExt)
+	jsonShellPrettyExt.EncodeType(primitive.Timestamp{}, jencShellPrettyTimestamp)
+	jsonShellPrettyExt.EncodeType(int32(0), jencShellPrettyNumberInt)
+
+	jsonMongoshExt.Extend(&jsonExtendedExt)
+	jsonMongoshExt.EncodeType(int64(0), jencMongoshNumberLong)
+	jsonMongoshExt.EncodeType(int(0), jencMongoshInt)
+	jsonMongoshExt.EncodeType(int32(0), jencMongoshNumberInt)
+	jsonMongoshExt.EncodeType(float64(0), jencMongoshDouble)
+	jsonMongoshExt.EncodeType(float32(0), jencMongoshDouble)
+	jsonMongoshExt.EncodeType(primitive.NewDecimal128(0, 0), jencMongoshNumberDecimal)
+	jsonMongoshExt.EncodeType((*big.Int)(nil), jencBigDecimal(jencMongoshNumberDecimal))
+	jsonMongoshExt.EncodeType((*big.Float)(nil), jencBigDecimal(jencMongoshNumberDecimal))
+	jsonMongoshExt.EncodeType([]byte(nil), jencMongoshBinarySlice)
+	jsonMongoshExt.EncodeType(primitive.Binary{}, jencMongoshBinaryType)
+	jsonMongoshExt.EncodeType(primitive.Timestamp{}, jencMongoshTimestamp)
+	jsonMongoshExt.EncodeType(primitive.MinKey{}, jencMongoshMinKey)
+	jsonMongoshExt.EncodeType(primitive.MaxKey{}, jencMongoshMaxKey)
+
+	jsonExtendedExt.shell = true
+	jsonShellPrettyExt.shell = true
+	jsonMongoshExt.shell = true
 }
 
 func fbytes(format string, args ...interface{}) []byte {
@@ -168,48 +638,121 @@ func fbytes(format string, args ...interface{}) []byte {
 	return buf.Bytes()
 }
 
+// wrapInt returns n between prefix and suffix. The encoders of the most
+// common types build their output with it, or with the append functions,
+// rather than with fbytes, which is much slower.
+func wrapInt(prefix string, n int64, suffix string) []byte {
+	b := make([]byte, 0, len(prefix)+20+len(suffix))
+	b = append(b, prefix...)
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, suffix...)
+}
+
 // jdec is used internally by the JSON decoding functions
 // so they may unmarshal functions without getting into endless
 // recursion due to keyed objects.
 func jdec(data []byte, value interface{}) error {
-	d := NewDecoder(bytes.NewBuffer(data))
-	d.Extend(&funcExt)
-	return d.Decode(value)
+	return decodeFragment(data, &funcExt, value)
+}
+
+// jdecExt decodes data, a value found by a keyed decoder, like the $id
+// of a DBRef, with all the extensions.
+func jdecExt(data []byte, value interface{}) error {
+	return decodeFragment(data, &jsonExt, value)
+}
+
+// decodeFragment decodes data, a value handed to an extension, with ext.
+// data is decoded in place, without being copied in the buffer of a
+// Decoder, as it is only used during the call.
+func decodeFragment(data []byte, ext *Extension, value interface{}) error {
+	dec := getDecoder(nil, ext)
+	d := &dec.d
+	d.fragment = true
+	err := checkValid(data, &d.scan)
+	if err == nil {
+		d.init(data)
+		err = d.unmarshal(value)
+	}
+	putDecoder(dec)
+	return err
+}
+
+// rawValue holds a value found by a keyed decoder as it appears in the
+// input, without copying it, to be decoded later with jdecExt. It is nil
+// for null.
+type rawValue []byte
+
+func (r *rawValue) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, nullLiteral) {
+		*r = nil
+		return nil
+	}
+	*r = data
+	return nil
+}
+
+// isString reports whether r is a string literal.
+func (r rawValue) isString() bool {
+	return len(r) > 0 && (r[0] == '"' || r[0] == '\'' || r[0] == '`')
+}
+
+// string returns the string held by r, a string literal.
+func (r rawValue) string() (string, error) {
+	// most strings are double quoted, without JavaScript escapes
+	if s, ok := unquote(r); ok {
+		return s, nil
+	}
+	var s string
+	err := jdec(r, &s)
+	return s, err
+}
+
+// decode decodes r with all the extensions into value, or sets value to
+// nil if r is nil.
+func (r rawValue) decode(value *interface{}) error {
+	if r == nil {
+		*value = nil
+		return nil
+	}
+	return jdecExt(r, value)
 }
 
 func jdecBinary(data []byte) (interface{}, error) {
 	var v struct {
-		Binary []byte `json:"$binary"`
-		Type   string `json:"$type"`
+		Binary rawValue `json:"$binary"`
+		Type   string   `json:"$type"`
 		Func   struct {
 			Binary []byte `json:"$binary"`
 			Type   int64  `json:"$type"`
 		} `json:"$binaryFunc"`
 	}
-
-	var binData []byte
-	var binKind int64
-
-    // v1 decoding
 	err := jdec(data, &v)
-	if err == nil {
-		if v.Type == "" && v.Binary == nil {
-			binData = v.Func.Binary
-			binKind = v.Func.Type
-		} else if v.Type == "" {
-			return v.Binary, nil
-		} else {
-			binData = v.Binary
-			binKind, err = strconv.ParseInt(v.Type, 0, 64)
-			if err != nil {
-				binKind = -1
-			}
+	if err != nil {
+		return nil, err
+	}
+
+	binData, binKind := v.Func.Binary, v.Func.Type
+	switch {
+	case v.Binary == nil:
+	case v.Binary[0] == '{':
+		// v2 decoding
+		binData, binKind, err = jdecBinaryV2(v.Binary)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		binData, binKind, err = jdecBinaryV2(data)
+	default:
+		// v1 decoding
+		err = jdec(v.Binary, &binData)
 		if err != nil {
 			return nil, err
 		}
+		if v.Type == "" {
+			return binData, nil
+		}
+		binKind, err = strconv.ParseInt(v.Type, 0, 64)
+		if err != nil {
+			binKind = -1
+		}
 	}
 
 	if binKind == 0 {
@@ -222,12 +765,12 @@ func jdecBinary(data []byte) (interface{}, error) {
 	return primitive.Binary{Subtype: byte(binKind), Data: binData}, nil
 }
 
+// jdecBinaryV2 decodes the value of $binary in extended JSON v2, like
+// {"base64": "Zm9v", "subType": "04"}.
 func jdecBinaryV2(data []byte) ([]byte, int64, error) {
 	var v struct {
-		Func struct {
 		Binary []byte `json:"base64"`
 		Type   string `json:"subType"`
-		} `json:"$binary"`
 	}
 
 	err := jdec(data, &v)
@@ -235,119 +778,271 @@ func jdecBinaryV2(data []byte) ([]byte, int64, error) {
 		return nil, 0, err
 	}
 
-	subType, err := strconv.ParseInt(v.Func.Type, 0, 64)
-	return v.Func.Binary, subType, err
+	// subType is a one or two hex digits string, like "04" or "80"
+	subType, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(v.Type), "0x"), 16, 8)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid subType in binary object: %q", v.Type)
+	}
+	return v.Binary, int64(subType), nil
 }
 
 func jencBinarySlice(v interface{}) ([]byte, error) {
 	in := v.([]byte)
-	out := make([]byte, base64.StdEncoding.EncodedLen(len(in)))
-	base64.StdEncoding.Encode(out, in)
-	return fbytes(`{"$binary":{"base64":"%s","subType":"0x0"}}`, out), nil
+	b := append(make([]byte, 0, 48+base64.StdEncoding.EncodedLen(len(in))), `{"$binary":{"base64":"`...)
+	b = appendBase64(b, in)
+	return append(b, `","subType":"0x0"}}`...), nil
 }
 
 func jencBinaryType(v interface{}) ([]byte, error) {
 	in := v.(primitive.Binary)
-	out := make([]byte, base64.StdEncoding.EncodedLen(len(in.Data)))
-	base64.StdEncoding.Encode(out, in.Data)
-	return fbytes(`{"$binary":{"base64":"%s","subType":"%x"}}`, out, in.Subtype), nil
+	b := append(make([]byte, 0, 48+base64.StdEncoding.EncodedLen(len(in.Data))), `{"$binary":{"base64":"`...)
+	b = appendBase64(b, in.Data)
+	b = append(b, `","subType":"`...)
+	b = strconv.AppendUint(b, uint64(in.Subtype), 16)
+	return append(b, `"}}`...), nil
+}
+
+func jencV2BinarySlice(v interface{}) ([]byte, error) {
+	return jencV2BinaryType(primitive.Binary{Data: v.([]byte)})
+}
+
+func jencV2BinaryType(v interface{}) ([]byte, error) {
+	in := v.(primitive.Binary)
+	b := append(make([]byte, 0, 48+base64.StdEncoding.EncodedLen(len(in.Data))), `{"$binary":{"base64":"`...)
+	b = appendBase64(b, in.Data)
+	b = append(b, `","subType":"`...)
+	b = append(b, hex[in.Subtype>>4], hex[in.Subtype&0xF])
+	return append(b, `"}}`...), nil
 }
 
 func jencExtendedBinarySlice(v interface{}) ([]byte, error) {
-	in := v.([]byte)
-	out := make([]byte, base64.StdEncoding.EncodedLen(len(in)))
-	base64.StdEncoding.Encode(out, in)
-	return fbytes(`BinData(0,"%s")`, out), nil
+	return AppendBinData(nil, 0, v.([]byte)), nil
 }
 
 func jencExtendedBinaryType(v interface{}) ([]byte, error) {
 	in := v.(primitive.Binary)
-	out := make([]byte, base64.StdEncoding.EncodedLen(len(in.Data)))
-	base64.StdEncoding.Encode(out, in.Data)
-	return fbytes(`BinData(%x,"%s")`, in.Subtype, out), nil
+	return AppendBinData(nil, in.Subtype, in.Data), nil
+}
+
+func jdecHexData(data []byte) (interface{}, error) {
+	var v struct {
+		Func struct {
+			Type int64  `json:"$type"`
+			Hex  string `json:"$hex"`
+		} `json:"$hexDataFunc"`
+	}
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := enchex.DecodeString(v.Func.Hex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex in HexData: %q", v.Func.Hex)
+	}
+	if v.Func.Type == 0 {
+		return b, nil
+	}
+	if v.Func.Type < 0 || v.Func.Type > 255 {
+		return nil, fmt.Errorf("invalid type in HexData: %d", v.Func.Type)
+	}
+	return primitive.Binary{Subtype: byte(v.Func.Type), Data: b}, nil
+}
+
+func jdecMD5(data []byte) (interface{}, error) {
+	var v struct {
+		Func struct {
+			S string
+		} `json:"$md5Func"`
+	}
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := enchex.DecodeString(v.Func.S)
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("invalid MD5: %q", v.Func.S)
+	}
+	return primitive.Binary{Subtype: bsontype.BinaryMD5, Data: b}, nil
+}
+
+func jdecUUID(data []byte) (interface{}, error) {
+	type uuidFunc struct {
+		S string
+	}
+	var v struct {
+		S      string   `json:"$uuid"`
+		UUID   uuidFunc `json:"$uuidFunc"`
+		LUUID  uuidFunc `json:"$luuidFunc"`
+		PYUUID uuidFunc `json:"$pyuuidFunc"`
+		CSUUID uuidFunc `json:"$csuuidFunc"`
+		JUUID  uuidFunc `json:"$juuidFunc"`
+	}
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	// legacy UUIDs of some drivers were stored with a different byte order
+	s, subtype, reorder := v.UUID.S, bsontype.BinaryUUID, func([]byte) {}
+	switch {
+	case v.S != "":
+		s = v.S
+	case v.LUUID.S != "":
+		s, subtype = v.LUUID.S, bsontype.BinaryUUIDOld
+	case v.PYUUID.S != "":
+		s, subtype = v.PYUUID.S, bsontype.BinaryUUIDOld
+	case v.CSUUID.S != "":
+		s, subtype, reorder = v.CSUUID.S, bsontype.BinaryUUIDOld, csharpUUIDOrder
+	case v.JUUID.S != "":
+		s, subtype, reorder = v.JUUID.S, bsontype.BinaryUUIDOld, javaUUIDOrder
+	}
+
+	b, err := enchex.DecodeString(strings.NewReplacer("-", "", "{", "", "}", "").Replace(s))
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("invalid UUID: %q", s)
+	}
+	reorder(b)
+	return primitive.Binary{Subtype: subtype, Data: b}, nil
+}
+
+// csharpUUIDOrder converts a UUID to/from the byte order of the legacy C# driver.
+func csharpUUIDOrder(b []byte) {
+	reverseBytes(b[0:4])
+	reverseBytes(b[4:6])
+	reverseBytes(b[6:8])
+}
+
+// javaUUIDOrder converts a UUID to/from the byte order of the legacy Java driver.
+func javaUUIDOrder(b []byte) {
+	reverseBytes(b[0:8])
+	reverseBytes(b[8:16])
+}
+
+func reverseBytes(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
 }
 
 const jdateFormat = "2006-01-02T15:04:05.999Z07:00"
 
 func jdecDate(data []byte) (interface{}, error) {
 
-	if string(data) == "new Date()" {
+	if string(data) == "new Date()" || string(data) == "Date()" {
 		return time.Now().UTC(), nil
 	}
 
 	var v struct {
-		S    string `json:"$date"`
+		Date rawValue `json:"$date"`
 		Func struct {
-			S string
+			S rawValue
 		} `json:"$dateFunc"`
 	}
-	_ = jdec(data, &v)
-	if v.S == "" {
-		v.S = v.Func.S
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse date: %q", data)
 	}
-	if v.S != "" {
+
+	date, keyed := v.Date, true
+	if date == nil {
+		date, keyed = v.Func.S, false
+	}
+	var n int64
+	switch {
+	case date == nil:
+		// null, which is the Unix epoch like new Date(null) in the shell
+	case date.isString():
+		s, err := date.string()
+		if err != nil || s == "" {
+			return nil, fmt.Errorf("cannot parse date: %q", data)
+		}
 		var errs []string
 		for _, format := range []string{jdateFormat, "2006-01-02"} {
-			t, err := time.Parse(format, v.S)
+			// parsed in UTC rather than in the local location, so
+			// that an offset is kept in a fixed zone regardless of
+			// the location of the machine
+			t, err := time.ParseInLocation(format, s, time.UTC)
 			if err == nil {
 				return t, nil
 			}
 			errs = append(errs, err.Error())
 		}
-		return nil, fmt.Errorf("cannot parse date: %q [%s]", v.S, strings.Join(errs, ", "))
-	}
-
-	var vn struct {
-		Date struct {
+		return nil, fmt.Errorf("cannot parse date: %q [%s]", s, strings.Join(errs, ", "))
+	case keyed:
+		// {"$date": {"$numberLong": "1463274123004"}}
+		var vn struct {
 			N int64 `json:"$numberLong,string"`
-		} `json:"$date"`
-		Func struct {
-			S int64
-		} `json:"$dateFunc"`
+		}
+		err = jdec(date, &vn)
+		n = vn.N
+	default:
+		// new Date(1463274123004)
+		var ms int64
+		err = jdec(date, &ms)
+		n = ms
 	}
-	err := jdec(data, &vn)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse date: %q", data)
 	}
-	n := vn.Date.N
-	if n == 0 {
-		n = vn.Func.S
-	}
 	return time.Unix(n/1000, n%1000*1e6).UTC(), nil
 }
 
 func jencDate(v interface{}) ([]byte, error) {
 	t := v.(time.Time)
-	return fbytes(`{"$date":%q}`, t.Format(jdateFormat)), nil
+	b := append(make([]byte, 0, 40), `{"$date":"`...)
+	b = t.AppendFormat(b, jdateFormat)
+	return append(b, `"}`...), nil
 }
 
 func jencExtendedDate(v interface{}) ([]byte, error) {
+	return AppendISODate(nil, v.(time.Time)), nil
+}
+
+func jencV2Date(v interface{}) ([]byte, error) {
 	t := v.(time.Time)
-	return fbytes(`ISODate("%s")`, t.Format(jdateFormat)), nil
+	return jencDateTime(primitive.NewDateTimeFromTime(t))
 }
 
 func jencDateTime(v interface{}) ([]byte, error) {
 	t := v.(primitive.DateTime).Time().UTC().UnixMilli()
-	return fbytes(`{"$date":{"$numberLong":"%d"}}`, t), nil
+	return wrapInt(`{"$date":{"$numberLong":"`, t, `"}}`), nil
 }
 
 func jencExtendedDateTime(v interface{}) ([]byte, error) {
-	t := v.(primitive.DateTime).Time().UTC()
-	return fbytes(`ISODate("%s")`, t.Format(jdateFormat)), nil
+	return AppendISODate(nil, v.(primitive.DateTime).Time().UTC()), nil
 }
 
+// jdecTimestamp decodes missing arguments as zero, so Timestamp() is the
+// zero timestamp, which the server replaces by the current time on insert.
 func jdecTimestamp(data []byte) (interface{}, error) {
 	var v struct {
 		Func struct {
-			T int32 `json:"t"`
-			I int32 `json:"i"`
+			T rawValue `json:"t"`
+			I uint32   `json:"i"`
 		} `json:"$timestamp"`
 	}
 	err := jdec(data, &v)
 	if err != nil {
 		return nil, err
 	}
-	return primitive.Timestamp{T: uint32(v.Func.T), I: uint32(v.Func.I)}, nil
+	if t := v.Func.T; len(t) > 0 && t[0] == '{' {
+		// mongosh passes a single document: Timestamp({t:2334,i:33})
+		var doc struct {
+			T uint32 `json:"t"`
+			I uint32 `json:"i"`
+		}
+		if err := jdec(t, &doc); err != nil {
+			return nil, err
+		}
+		return primitive.Timestamp{T: doc.T, I: doc.I}, nil
+	}
+	ts := primitive.Timestamp{I: v.Func.I}
+	if v.Func.T != nil {
+		if err := jdec(v.Func.T, &ts.T); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
 }
 
 func jencTimestamp(v interface{}) ([]byte, error) {
@@ -360,6 +1055,11 @@ func jencExtendedTimestamp(v interface{}) ([]byte, error) {
 	return fbytes(`Timestamp(%d,%d)`, ts.T, ts.I), nil
 }
 
+func jencShellPrettyTimestamp(v interface{}) ([]byte, error) {
+	ts := v.(primitive.Timestamp)
+	return fbytes(`Timestamp(%d, %d)`, ts.T, ts.I), nil
+}
+
 func jdecRegEx(data []byte) (interface{}, error) {
 	var v struct {
 		Regex   string `json:"$regex"`
@@ -377,6 +1077,56 @@ func jencRegularExpression(v interface{}) ([]byte, error) {
 	return fbytes(`{"$regularExpression":{"pattern":"%v","options":"%v"}}`, re.Pattern, re.Options), nil
 }
 
+// regexpToRegex converts the Go regular expression re into a
+// primitive.Regex, moving the flags set at the start of the expression,
+// like in (?i)^a, to the options when the server supports them.
+func regexpToRegex(re *regexp.Regexp) primitive.Regex {
+	pattern := re.String()
+	if !strings.HasPrefix(pattern, "(?") {
+		return primitive.Regex{Pattern: pattern}
+	}
+	end := strings.IndexByte(pattern, ')')
+	if end < 0 {
+		return primitive.Regex{Pattern: pattern}
+	}
+	flags := pattern[2:end]
+	if flags == "" || strings.Trim(flags, "ims") != "" {
+		return primitive.Regex{Pattern: pattern}
+	}
+	// the server expects the options in alphabetical order
+	var options []byte
+	for _, f := range []byte("ims") {
+		if strings.IndexByte(flags, f) >= 0 {
+			options = append(options, f)
+		}
+	}
+	return primitive.Regex{Pattern: pattern[end+1:], Options: string(options)}
+}
+
+func jencRegexp(v interface{}) ([]byte, error) {
+	r := v.(*regexp.Regexp)
+	if r == nil {
+		return []byte("null"), nil
+	}
+	re := regexpToRegex(r)
+	b := append([]byte(`{"$regex":`), AppendQuotedString(nil, re.Pattern)...)
+	b = append(b, `,"$options":`...)
+	b = AppendQuotedString(b, re.Options)
+	return append(b, '}'), nil
+}
+
+func jencV2Regexp(v interface{}) ([]byte, error) {
+	r := v.(*regexp.Regexp)
+	if r == nil {
+		return []byte("null"), nil
+	}
+	re := regexpToRegex(r)
+	b := append([]byte(`{"$regularExpression":{"pattern":`), AppendQuotedString(nil, re.Pattern)...)
+	b = append(b, `,"options":`...)
+	b = AppendQuotedString(b, re.Options)
+	return append(b, "}}"...), nil
+}
+
 func jdecRegularExpression(data []byte) (interface{}, error) {
 	var v struct {
 		Func struct {
@@ -405,136 +1155,261 @@ func jdecObjectID(data []byte) (interface{}, error) {
 	if v.ID == "" {
 		v.ID = v.Func.ID
 	}
-	return primitive.ObjectIDFromHex(v.ID)
+	// some tools emit uppercase ids, or pad them with spaces
+	id, err := primitive.ObjectIDFromHex(strings.TrimSpace(v.ID))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ObjectId: %q", v.ID)
+	}
+	return id, nil
 }
 
 func jencObjectID(v interface{}) ([]byte, error) {
-	return fbytes(`{"$oid":"%s"}`, v.(primitive.ObjectID).Hex()), nil
+	id := v.(primitive.ObjectID)
+	b := append(make([]byte, 0, 35), `{"$oid":"`...)
+	b = appendHex(b, id[:])
+	return append(b, `"}`...), nil
 }
 
 func jencExtendedObjectID(v interface{}) ([]byte, error) {
-	return fbytes(`ObjectId("%s")`, v.(primitive.ObjectID).Hex()), nil
+	return AppendObjectID(nil, v.(primitive.ObjectID)), nil
 }
 
 func jdecDBRef(data []byte) (interface{}, error) {
-	// TODO Support unmarshaling $ref and $id into the input value.
 	var v struct {
-		Obj map[string]interface{} `json:"$dbrefFunc"`
+		Ref  *string  `json:"$ref"`
+		ID   rawValue `json:"$id"`
+		DB   string   `json:"$db"`
+		Func struct {
+			Ref string   `json:"$ref"`
+			ID  rawValue `json:"$id"`
+			DB  string   `json:"$db"`
+		} `json:"$dbrefFunc"`
 	}
-	// TODO Fix this. Must not be required.
-	v.Obj = make(map[string]interface{})
 	err := jdec(data, &v)
 	if err != nil {
 		return nil, err
 	}
-	return v.Obj, nil
+	ref := DBRef{Collection: v.Func.Ref, DB: v.Func.DB}
+	id := v.Func.ID
+	if v.Ref != nil {
+		var raw map[string]rawValue
+		err = jdec(data, &raw)
+		if err != nil {
+			return nil, err
+		}
+		if v.ID == nil || hasExtraDBRefFields(raw) {
+			// not a DBRef, or a DBRef with fields that DBRef can't
+			// hold, so keep it as a document to not lose them
+			return decodeRawDoc(raw)
+		}
+		ref = DBRef{Collection: *v.Ref, DB: v.DB}
+		id = v.ID
+	}
+	err = id.decode(&ref.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $id in DBRef: %v", err)
+	}
+	return ref, nil
+}
+
+// hasExtraDBRefFields reports whether a document with a $ref key has
+// other fields than $ref, $id and $db.
+func hasExtraDBRefFields(raw map[string]rawValue) bool {
+	for k := range raw {
+		if k != "$ref" && k != "$id" && k != "$db" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeRawDoc decodes the values of raw one by one, as decoding the
+// whole document would end up in jdecDBRef again.
+func decodeRawDoc(raw map[string]rawValue) (map[string]interface{}, error) {
+	doc := make(map[string]interface{}, len(raw))
+	for k, r := range raw {
+		var val interface{}
+		err := r.decode(&val)
+		if err != nil {
+			return nil, err
+		}
+		doc[k] = val
+	}
+	return doc, nil
+}
+
+// jencDBRef writes the $id with e, so that it is written like the other
+// values of the document.
+func jencDBRef(e *encodeState, v reflect.Value, opts encOpts) {
+	ref := v.Interface().(DBRef)
+	e.WriteString(`{"$ref":`)
+	e.Write(AppendQuotedString(e.scratch[:0], ref.Collection))
+	e.WriteString(`,"$id":`)
+	e.reflectValue(reflect.ValueOf(ref.ID), opts)
+	if ref.DB != "" {
+		e.WriteString(`,"$db":`)
+		e.Write(AppendQuotedString(e.scratch[:0], ref.DB))
+	}
+	e.WriteByte('}')
+}
+
+func jencExtendedDBRef(e *encodeState, v reflect.Value, opts encOpts) {
+	ref := v.Interface().(DBRef)
+	e.WriteString(`DBRef(`)
+	e.Write(AppendQuotedString(e.scratch[:0], ref.Collection))
+	e.WriteByte(',')
+	e.reflectValue(reflect.ValueOf(ref.ID), opts)
+	if ref.DB != "" {
+		e.WriteByte(',')
+		e.Write(AppendQuotedString(e.scratch[:0], ref.DB))
+	}
+	e.WriteByte(')')
 }
 
 func jdecNumberLong(data []byte) (interface{}, error) {
 	var v struct {
-		N    int64 `json:"$numberLong,string"`
-		Func struct {
-			N int64 `json:",string"`
-		} `json:"$numberLongFunc"`
-	}
-	var vn struct {
-		N    int64 `json:"$numberLong"`
+		N    intArg `json:"$numberLong"`
 		Func struct {
-			N int64
+			N intArg
 		} `json:"$numberLongFunc"`
 	}
 	err := jdec(data, &v)
-	if err != nil {
-		err = jdec(data, &vn)
-		v.N = vn.N
-		v.Func.N = vn.Func.N
-	}
 	if err != nil {
 		return nil, err
 	}
-	if v.N != 0 {
-		return v.N, nil
+	return parseIntArgs("NumberLong", 64, v.N, v.Func.N)
+}
+
+// intArg holds the value of a NumberInt or a NumberLong, which may be a
+// quoted string or a number, and whether it is set, so that NumberLong(0)
+// is not mistaken for an absent value.
+type intArg struct {
+	s   string
+	set bool
+}
+
+func (a *intArg) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, nullLiteral) {
+		return nil
+	}
+	a.set = true
+	if s, ok := unquote(singleQuotedToQuoted(data)); ok {
+		a.s = s
+		return nil
 	}
-	return v.Func.N, nil
+	// numbers are kept as written, once converted from the JavaScript
+	// syntax, like 0x10, so that their range is checked
+	var n Number
+	if err := jdec(data, &n); err != nil {
+		return err
+	}
+	a.s = string(n)
+	return nil
+}
+
+// parseIntArgs parses the first set argument of args, or returns 0 if
+// none is set, like NumberLong() in the shell.
+func parseIntArgs(funcName string, bitSize int, args ...intArg) (int64, error) {
+	for _, a := range args {
+		if a.set {
+			return parseIntArg(funcName, a.s, bitSize)
+		}
+	}
+	return 0, nil
+}
+
+// An IntegerError is returned by the extensions when the value of a
+// NumberInt or a NumberLong, like NumberInt(3000000000), is not an
+// integer or is out of the range of its type, instead of being silently
+// truncated.
+type IntegerError struct {
+	Type    string // "NumberInt" or "NumberLong"
+	Literal string // the offending literal, as found in the input
+	Err     error  // strconv.ErrRange or strconv.ErrSyntax
+}
+
+func (e *IntegerError) Error() string {
+	return "invalid " + e.Type + " " + strconv.Quote(e.Literal) + ": " + e.Err.Error()
+}
+
+func (e *IntegerError) Unwrap() error { return e.Err }
+
+// parseIntArg parses the argument of a function like NumberLong,
+// reporting values that overflow instead of silently truncating them.
+func parseIntArg(funcName, s string, bitSize int) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, bitSize)
+	if err != nil {
+		return 0, &IntegerError{Type: funcName, Literal: s, Err: err.(*strconv.NumError).Err}
+	}
+	return n, nil
 }
 
 func jencNumberLong(v interface{}) ([]byte, error) {
-	n := v.(int64)
-	f := `{"$numberLong":"%d"}`
-	return fbytes(f, n), nil
+	return wrapInt(`{"$numberLong":"`, v.(int64), `"}`), nil
 }
 
 func jencExtendedNumberLong(v interface{}) ([]byte, error) {
-	n := v.(int64)
-	return fbytes("NumberLong(%d)", n), nil
+	return wrapInt("NumberLong(", v.(int64), ")"), nil
 }
 
 func jdecNumberInt(data []byte) (interface{}, error) {
 	var v struct {
-		N    int32 `json:"$numberInt,string"`
-		Func struct {
-			N int32 `json:",string"`
-		} `json:"$numberIntFunc"`
-	}
-	var vn struct {
-		N    int32 `json:"$numberInt"`
+		N    intArg `json:"$numberInt"`
 		Func struct {
-			N int32
+			N intArg
 		} `json:"$numberIntFunc"`
 	}
 	err := jdec(data, &v)
-	if err != nil {
-		err = jdec(data, &vn)
-		v.N = vn.N
-		v.Func.N = vn.Func.N
-	}
 	if err != nil {
 		return nil, err
 	}
-	if v.N != 0 {
-		return v.N, nil
-	}
-	return v.Func.N, nil
+	n, err := parseIntArgs("NumberInt", 32, v.N, v.Func.N)
+	return int32(n), err
 }
 
 func jencNumberInt(v interface{}) ([]byte, error) {
-	n := v.(int32)
-	f := `{"$numberInt":"%d"}`
-	return fbytes(f, n), nil
+	return wrapInt(`{"$numberInt":"`, int64(v.(int32)), `"}`), nil
 }
 
 func jencExtendedNumberInt(v interface{}) ([]byte, error) {
-	n := v.(int32)
-	return fbytes("%d", n), nil
+	return strconv.AppendInt(nil, int64(v.(int32)), 10), nil
+}
+
+func jencShellPrettyNumberInt(v interface{}) ([]byte, error) {
+	return strconv.AppendInt(nil, int64(v.(int32)), 10), nil
 }
 
 func jdecNumberDecimal(data []byte) (interface{}, error) {
 	var v struct {
-		N    string `json:"$numberDecimal,string"`
-		Func struct {
-			N string `json:",string"`
-		} `json:"$numberDecimalFunc"`
-	}
-	var vn struct {
-		N    string `json:"$numberDecimal"`
+		N    decimalArg `json:"$numberDecimal"`
 		Func struct {
-			N string
+			N decimalArg
 		} `json:"$numberDecimalFunc"`
 	}
 	err := jdec(data, &v)
-	if err != nil {
-		err = jdec(data, &vn)
-		v.N = vn.N
-		v.Func.N = vn.Func.N
-	}
 	if err != nil {
 		return nil, err
 	}
-	decimal128, err := primitive.ParseDecimal128(v.N)
-	if err != nil {
-		return primitive.ParseDecimal128(v.Func.N)
+	if v.N == "" {
+		v.N = v.Func.N
 	}
-	return decimal128, err
+	return primitive.ParseDecimal128(string(v.N))
+}
+
+// decimalArg holds the argument of NumberDecimal, which may be a quoted
+// string or a number, read like the argument of NumberLong. Numbers are
+// kept as written, without going through a float64, and constants like
+// Infinity or NaN are left to the parser of the value.
+type decimalArg string
+
+func (a *decimalArg) UnmarshalJSON(data []byte) error {
+	var n intArg
+	if err := n.UnmarshalJSON(data); err != nil {
+		*a = decimalArg(data)
+		return nil
+	}
+	*a = decimalArg(n.s)
+	return nil
 }
 
 func jencNumberDecimal(v interface{}) ([]byte, error) {
@@ -547,13 +1422,228 @@ func jencExtendedNumberDecimal(v interface{}) ([]byte, error) {
 	return fbytes(`NumberDecimal("%s")`, n.String()), nil
 }
 
+// A DecimalOverflowError is returned when encoding a *big.Int or a
+// *big.Float that can't be held by a Decimal128 without losing digits,
+// because it has more than 34 significant digits or an exponent out of
+// the range of Decimal128.
+type DecimalOverflowError struct {
+	Value string // the value in decimal notation
+}
+
+func (e *DecimalOverflowError) Error() string {
+	return "value " + e.Value + " overflows Decimal128"
+}
+
+// jencBigDecimal returns an encoder converting a *big.Int or a *big.Float
+// to a Decimal128 written by encode.
+func jencBigDecimal(encode func(v interface{}) ([]byte, error)) func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		var d primitive.Decimal128
+		switch n := v.(type) {
+		case *big.Int:
+			if n == nil {
+				return []byte("null"), nil
+			}
+			var ok bool
+			if d, ok = primitive.ParseDecimal128FromBigInt(n, 0); !ok {
+				return nil, &DecimalOverflowError{Value: n.String()}
+			}
+		case *big.Float:
+			if n == nil {
+				return []byte("null"), nil
+			}
+			// the shortest decimal holding the same value at the
+			// precision of n, so that 0.1 is not written as
+			// 0.1000000000000000055511151231257827
+			s := n.Text('e', -1)
+			var err error
+			if d, err = primitive.ParseDecimal128(s); err != nil {
+				return nil, &DecimalOverflowError{Value: s}
+			}
+		}
+		return encode(d)
+	}
+}
+
+func jdecNumberDouble(data []byte) (interface{}, error) {
+	var v struct {
+		N    string `json:"$numberDouble"`
+		Func struct {
+			N decimalArg
+		} `json:"$numberDoubleFunc"`
+	}
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	if v.N == "" {
+		v.N = string(v.Func.N)
+	}
+	// ParseFloat also accepts "Infinity", "-Infinity" and "NaN"
+	f, err := strconv.ParseFloat(v.N, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $numberDouble object: %s", data)
+	}
+	return f, nil
+}
+
 func jencInt(v interface{}) ([]byte, error) {
+	n := int64(v.(int))
+	if n <= 1<<53 {
+		return strconv.AppendInt(nil, n, 10), nil
+	}
+	return wrapInt(`{"$numberLong":"`, n, `"}`), nil
+}
+
+func jencV2Int(v interface{}) ([]byte, error) {
 	n := v.(int)
-	f := `{"$numberLong":"%d"}`
-	if int64(n) <= 1<<53 {
-		f = `%d`
+	if int64(n) >= math.MinInt32 && int64(n) <= math.MaxInt32 {
+		return jencNumberInt(int32(n))
+	}
+	return jencNumberLong(int64(n))
+}
+
+func jencV2Double(v interface{}) ([]byte, error) {
+	var f float64
+	switch n := v.(type) {
+	case float64:
+		f = n
+	case float32:
+		f = float64(n)
+	}
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	case math.IsNaN(f):
+		s = "NaN"
+	default:
+		// integral values keep a decimal part, so that they are
+		// not confused with integers by other tools
+		s = strconv.FormatFloat(f, 'G', -1, 64)
+		if !strings.ContainsAny(s, ".E") {
+			s += ".0"
+		}
+	}
+	return fbytes(`{"$numberDouble":"%s"}`, s), nil
+}
+
+func jdecCode(data []byte) (interface{}, error) {
+	var v struct {
+		Code  *string  `json:"$code"`
+		Scope rawValue `json:"$scope"`
+		Func  struct {
+			S     string
+			Scope rawValue
+		} `json:"$codeFunc"`
+	}
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	code, scope := v.Func.S, v.Func.Scope
+	if v.Code != nil {
+		code, scope = *v.Code, v.Scope
+	}
+	if scope == nil {
+		return primitive.JavaScript(code), nil
+	}
+	var decoded map[string]interface{}
+	err = jdecExt(scope, &decoded)
+	if err != nil {
+		return nil, err
+	}
+	return primitive.CodeWithScope{Code: primitive.JavaScript(code), Scope: decoded}, nil
+}
+
+func jencCode(v interface{}) ([]byte, error) {
+	b := append([]byte(`{"$code":`), AppendQuotedString(nil, string(v.(primitive.JavaScript)))...)
+	return append(b, '}'), nil
+}
+
+func jencExtendedCode(v interface{}) ([]byte, error) {
+	b := append([]byte(`Code(`), AppendQuotedString(nil, string(v.(primitive.JavaScript)))...)
+	return append(b, ')'), nil
+}
+
+// jencCodeWithScope writes the scope with e, so that its values are
+// written like the other values of the document.
+func jencCodeWithScope(e *encodeState, v reflect.Value, opts encOpts) {
+	c := v.Interface().(primitive.CodeWithScope)
+	e.WriteString(`{"$code":`)
+	e.Write(AppendQuotedString(e.scratch[:0], string(c.Code)))
+	e.WriteString(`,"$scope":`)
+	e.reflectValue(reflect.ValueOf(c.Scope), opts)
+	e.WriteByte('}')
+}
+
+func jencExtendedCodeWithScope(e *encodeState, v reflect.Value, opts encOpts) {
+	c := v.Interface().(primitive.CodeWithScope)
+	e.WriteString(`Code(`)
+	e.Write(AppendQuotedString(e.scratch[:0], string(c.Code)))
+	e.WriteByte(',')
+	e.reflectValue(reflect.ValueOf(c.Scope), opts)
+	e.WriteByte(')')
+}
+
+func jdecDBPointer(data []byte) (interface{}, error) {
+	type pointer struct {
+		Ref string   `json:"$ref"`
+		ID  rawValue `json:"$id"`
+	}
+	var v struct {
+		Pointer *pointer `json:"$dbPointer"`
+		Func    pointer  `json:"$dbPointerFunc"`
 	}
-	return fbytes(f, n), nil
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	p := v.Func
+	if v.Pointer != nil {
+		p = *v.Pointer
+	}
+	var id primitive.ObjectID
+	err = jdecExt(p.ID, &id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $id in DBPointer: %v", err)
+	}
+	return primitive.DBPointer{DB: p.Ref, Pointer: id}, nil
+}
+
+func jencDBPointer(v interface{}) ([]byte, error) {
+	p := v.(primitive.DBPointer)
+	b := append([]byte(`{"$dbPointer":{"$ref":`), AppendQuotedString(nil, p.DB)...)
+	b = append(b, `,"$id":{"$oid":"`...)
+	b = appendHex(b, p.Pointer[:])
+	return append(b, `"}}}`...), nil
+}
+
+func jencExtendedDBPointer(v interface{}) ([]byte, error) {
+	p := v.(primitive.DBPointer)
+	b := append([]byte(`DBPointer(`), AppendQuotedString(nil, p.DB)...)
+	b = append(b, ',')
+	b = AppendObjectID(b, p.Pointer)
+	return append(b, ')'), nil
+}
+
+func jdecSymbol(data []byte) (interface{}, error) {
+	var v struct {
+		S string `json:"$symbol"`
+	}
+	err := jdec(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return primitive.Symbol(v.S), nil
+}
+
+// jencSymbol is used in both modes, as the shell has no syntax for symbols
+func jencSymbol(v interface{}) ([]byte, error) {
+	b := append([]byte(`{"$symbol":`), AppendQuotedString(nil, string(v.(primitive.Symbol)))...)
+	return append(b, '}'), nil
 }
 
 func jdecMinKey(data []byte) (interface{}, error) {
@@ -570,6 +1660,28 @@ func jdecMinKey(data []byte) (interface{}, error) {
 	return primitive.MinKey{}, nil
 }
 
+// jdecMinKeyFunc decodes MinKey(), which takes no argument.
+func jdecMinKeyFunc(data []byte) (interface{}, error) {
+	var v struct {
+		Func struct{} `json:"$minKeyFunc"`
+	}
+	if err := jdec(data, &v); err != nil {
+		return nil, err
+	}
+	return primitive.MinKey{}, nil
+}
+
+// jdecMaxKeyFunc decodes MaxKey(), which takes no argument.
+func jdecMaxKeyFunc(data []byte) (interface{}, error) {
+	var v struct {
+		Func struct{} `json:"$maxKeyFunc"`
+	}
+	if err := jdec(data, &v); err != nil {
+		return nil, err
+	}
+	return primitive.MaxKey{}, nil
+}
+
 func jdecMaxKey(data []byte) (interface{}, error) {
 	var v struct {
 		N int64 `json:"$maxKey"`
@@ -592,6 +1704,14 @@ func jencMaxKey(v interface{}) ([]byte, error) {
 	return []byte(`{"$maxKey":1}`), nil
 }
 
+func jencExtendedMinKey(v interface{}) ([]byte, error) {
+	return []byte(`MinKey`), nil
+}
+
+func jencExtendedMaxKey(v interface{}) ([]byte, error) {
+	return []byte(`MaxKey`), nil
+}
+
 func jencNull(v interface{}) ([]byte, error) {
 	return []byte("null"), nil
 }
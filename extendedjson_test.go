@@ -4,11 +4,15 @@ package mongoextjson_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"os"
 	"os/exec"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -43,6 +47,13 @@ func TestMarshalUnmarshal(t *testing.T) {
 			data:      `ObjectId("5a934e000102030405000000")`,
 			canonical: `{"$oid":"5a934e000102030405000000"}`,
 		},
+		{
+			name:        "objectID uppercase with spaces",
+			value:       objectID,
+			data:        `ObjectId( " 5A934E000102030405000000 " )`,
+			canonical:   `{"$oid": "5A934E000102030405000000 "}`,
+			skipMarshal: true,
+		},
 		{
 			name:          "DateTime",
 			value:         primitive.DateTime(778846633334),
@@ -56,6 +67,26 @@ func TestMarshalUnmarshal(t *testing.T) {
 			data:      `Timestamp(1,2)`,
 			canonical: `{"$timestamp":{"t":1,"i":2}}`,
 		},
+		{
+			name:      "Timestamp above max int32",
+			value:     primitive.Timestamp{T: 4294967295, I: 2147483648},
+			data:      `Timestamp(4294967295,2147483648)`,
+			canonical: `{"$timestamp":{"t":4294967295,"i":2147483648}}`,
+		},
+		{
+			name:        "Timestamp without arguments",
+			value:       primitive.Timestamp{},
+			data:        `Timestamp()`,
+			canonical:   `{"$timestamp":{}}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "Timestamp with t only",
+			value:       primitive.Timestamp{T: 123},
+			data:        `Timestamp(123)`,
+			canonical:   `{"$timestamp":{"t":123}}`,
+			skipMarshal: true,
+		},
 		{
 			name:      "time.Date UTC",
 			value:     time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC),
@@ -63,11 +94,10 @@ func TestMarshalUnmarshal(t *testing.T) {
 			canonical: `{"$date":"2016-05-15T01:02:03.004Z"}`,
 		},
 		{
-			name:          "time.Date with zone",
-			value:         time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.FixedZone("CET", 60*60)),
-			data:          `ISODate("2016-05-15T01:02:03.004+01:00")`,
-			canonical:     `{"$date":"2016-05-15T01:02:03.004+01:00"}`,
-			skipUnmarshal: true, // TODO: why this doesn't work ?
+			name:      "time.Date with zone",
+			value:     time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.FixedZone("", 60*60)),
+			data:      `ISODate("2016-05-15T01:02:03.004+01:00")`,
+			canonical: `{"$date":"2016-05-15T01:02:03.004+01:00"}`,
 		},
 		{
 			name:        "new Date() from string",
@@ -90,12 +120,38 @@ func TestMarshalUnmarshal(t *testing.T) {
 			canonical:   `{"$date":"1970-01-01T00:00:00.000Z"}`,
 			skipMarshal: true,
 		},
+		{
+			name:        "Date() from string",
+			value:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			data:        `Date("2020-01-01")`,
+			canonical:   `{"$date":"2020-01-01T00:00:00Z"}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "Date() from millisecond",
+			value:       time.Date(1970, 1, 1, 0, 18, 36, 374000000, time.UTC),
+			data:        `Date(1116374)`,
+			canonical:   `{"$date":"1970-01-01T00:18:36.374Z"}`,
+			skipMarshal: true,
+		},
 		{
 			name:      "Binary",
 			value:     primitive.Binary{Subtype: 2, Data: []byte("foo")},
 			data:      `BinData(2,"Zm9v")`,
 			canonical: `{"$binary":{"base64":"Zm9v","subType":"2"}}`,
 		},
+		{
+			name:      "Binary with a subtype above 9",
+			value:     primitive.Binary{Subtype: 10, Data: []byte("foo")},
+			data:      `BinData(10,"Zm9v")`,
+			canonical: `{"$binary":{"base64":"Zm9v","subType":"a"}}`,
+		},
+		{
+			name:      "Binary with a user defined subtype",
+			value:     primitive.Binary{Subtype: 0x80, Data: []byte("foo")},
+			data:      `BinData(128,"Zm9v")`,
+			canonical: `{"$binary":{"base64":"Zm9v","subType":"80"}}`,
+		},
 		{
 			name:      "Undefined",
 			value:     primitive.Undefined{},
@@ -108,6 +164,41 @@ func TestMarshalUnmarshal(t *testing.T) {
 			data:      `NumberDecimal("6.2458066851535814488338301193477E-6145")`,
 			canonical: `{"$numberDecimal":"6.2458066851535814488338301193477E-6145"}`,
 		},
+		{
+			name:        "Decimal 128 unquoted",
+			value:       primitive.NewDecimal128(0x3040000000000000, 12345678901234567890),
+			data:        `NumberDecimal(12345678901234567890)`,
+			canonical:   `{"$numberDecimal":12345678901234567890}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "Decimal 128 unquoted with fraction",
+			value:       primitive.NewDecimal128(0x303c000000000000, 999),
+			data:        `NumberDecimal(9.99)`,
+			canonical:   `{"$numberDecimal":9.99}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "Decimal 128 backquoted",
+			value:       primitive.NewDecimal128(0x303c000000000000, 999),
+			data:        "NumberDecimal(`9.99`)",
+			canonical:   `{"$numberDecimal":"9.99"}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "Decimal 128 hexadecimal",
+			value:       primitive.NewDecimal128(0x3040000000000000, 16),
+			data:        `NumberDecimal(0x10)`,
+			canonical:   `{"$numberDecimal":"16"}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "Decimal 128 infinity",
+			value:       primitive.NewDecimal128(0xf800000000000000, 0),
+			data:        `NumberDecimal(-Infinity)`,
+			canonical:   `{"$numberDecimal":"-Infinity"}`,
+			skipMarshal: true,
+		},
 		{
 			name:      "string",
 			value:     bson.M{"str": "hello"},
@@ -133,12 +224,91 @@ func TestMarshalUnmarshal(t *testing.T) {
 			data:      `{"str":"\"he\n\t\t\tllo\""}`,
 			canonical: `{"str":"\"he\n\t\t\tllo\""}`,
 		},
+		{
+			name:      "JavaScript",
+			value:     primitive.JavaScript(`function() { return "a"; }`),
+			data:      `Code("function() { return \"a\"; }")`,
+			canonical: `{"$code":"function() { return \"a\"; }"}`,
+		},
+		{
+			name:      "CodeWithScope",
+			value:     primitive.CodeWithScope{Code: "function() { return x; }", Scope: map[string]interface{}{"id": objectID, "x": int64(3)}},
+			data:      `Code("function() { return x; }",{"id":ObjectId("5a934e000102030405000000"),"x":NumberLong(3)})`,
+			canonical: `{"$code":"function() { return x; }","$scope":{"id":{"$oid":"5a934e000102030405000000"},"x":{"$numberLong":"3"}}}`,
+		},
+		{
+			name:      "DBRef",
+			value:     mongoextjson.DBRef{Collection: "users", ID: objectID},
+			data:      `DBRef("users",ObjectId("5a934e000102030405000000"))`,
+			canonical: `{"$ref":"users","$id":{"$oid":"5a934e000102030405000000"}}`,
+		},
+		{
+			name:      "DBRef with db",
+			value:     mongoextjson.DBRef{Collection: "users", ID: int64(5), DB: "test"},
+			data:      `DBRef("users",NumberLong(5),"test")`,
+			canonical: `{"$ref":"users","$id":{"$numberLong":"5"},"$db":"test"}`,
+		},
+		{
+			name:        "document starting with $ref",
+			value:       bson.M{"$ref": "#/definitions/id", "title": "id"},
+			data:        `{"$ref":"#/definitions/id","title":"id"}`,
+			canonical:   `{"$ref":"#/definitions/id","title":"id"}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "DBRef with extra fields",
+			value:       bson.M{"$ref": "users", "$id": objectID, "$db": "test", "name": "alice"},
+			data:        `{"$ref":"users","$id":ObjectId("5a934e000102030405000000"),"$db":"test","name":"alice"}`,
+			canonical:   `{"$ref":"users","$id":{"$oid":"5a934e000102030405000000"},"$db":"test","name":"alice"}`,
+			skipMarshal: true,
+		},
+		{
+			name:      "Symbol",
+			value:     bson.M{"s": primitive.Symbol("foo")},
+			data:      `{"s":{"$symbol":"foo"}}`,
+			canonical: `{"s":{"$symbol":"foo"}}`,
+		},
+		{
+			name:        "HexData",
+			value:       primitive.Binary{Subtype: 2, Data: []byte("foo")},
+			data:        `HexData(2, "666f6f")`,
+			canonical:   `{"$binary":{"base64":"Zm9v","subType":"02"}}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "UUID",
+			value:       primitive.Binary{Subtype: 4, Data: []byte{0x87, 0x65, 0x43, 0x21, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01}},
+			data:        `UUID("87654321-abcd-ef01-2345-6789abcdef01")`,
+			canonical:   `{"$binary":{"base64":"h2VDIavN7wEjRWeJq83vAQ==","subType":"04"}}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "backtick string",
+			value:       bson.M{"str": "he said \"hi\"\n`$5`"},
+			data:        "{\"str\":`he said \"hi\"\n\\`$5\\``}",
+			canonical:   `{"str":"he said \"hi\"\n` + "`$5`" + `"}`,
+			skipMarshal: true,
+		},
+		{
+			name:        "backtick ObjectId",
+			value:       objectID,
+			data:        "ObjectId(`5a934e000102030405000000`)",
+			canonical:   "{\"$oid\":`5a934e000102030405000000`}",
+			skipMarshal: true,
+		},
 		{
 			name:      "int64",
 			value:     int64(10),
 			data:      `NumberLong(10)`,
 			canonical: `{"$numberLong":"10"}`,
 		},
+		{
+			name:        "int64 quoted",
+			value:       int64(9223372036854775807),
+			data:        `NumberLong("9223372036854775807")`,
+			canonical:   `{"$numberLong":"9223372036854775807"}`,
+			skipMarshal: true,
+		},
 		{
 			name:      "int",
 			value:     int(1),
@@ -151,6 +321,13 @@ func TestMarshalUnmarshal(t *testing.T) {
 			data:      `26`,
 			canonical: `{"$numberInt":"26"}`,
 		},
+		{
+			name:        "int32 quoted",
+			value:       int32(42),
+			data:        `NumberInt("42")`,
+			canonical:   `{"$numberInt":"42"}`,
+			skipMarshal: true,
+		},
 		{
 			name:      "float32",
 			value:     float32(2.32),
@@ -163,6 +340,13 @@ func TestMarshalUnmarshal(t *testing.T) {
 			data:      `2.6464`,
 			canonical: `2.6464`,
 		},
+		{
+			name:        "special floats",
+			value:       bson.A{math.NaN(), math.Inf(1), math.Inf(-1), math.Inf(1), math.NaN()},
+			data:        `[NaN, Infinity, -Infinity, +Infinity, nan]`,
+			canonical:   `[nan, infinity, -INFINITY, +inf, NAN]`,
+			skipMarshal: true,
+		},
 		{
 			name:      "regex",
 			value:     primitive.Regex{Pattern: "/test/", Options: "i"},
@@ -226,25 +410,22 @@ func TestMarshalUnmarshal(t *testing.T) {
 			canonical: `[{"k":"v1"},{"k":"v2"}]`,
 		},
 		{
-			name:          "min key",
-			value:         bson.M{"k": primitive.MinKey{}},
-			data:          `{"k":{"$minKey":1}}`,
-			canonical:     `{"k":{"$minKey":1}}`,
-			skipUnmarshal: true,
+			name:      "min key",
+			value:     bson.M{"k": primitive.MinKey{}},
+			data:      `{"k":MinKey}`,
+			canonical: `{"k":{"$minKey":1}}`,
 		},
 		{
-			name:          "max key",
-			value:         bson.M{"k": primitive.MaxKey{}},
-			data:          `{"k":{"$maxKey":1}}`,
-			canonical:     `{"k":{"$maxKey":1}}`,
-			skipUnmarshal: true,
+			name:      "max key",
+			value:     bson.M{"k": primitive.MaxKey{}},
+			data:      `{"k":MaxKey}`,
+			canonical: `{"k":{"$maxKey":1}}`,
 		},
 		{
-			name:          "DBRef",
-			value:         primitive.DBPointer{DB: "test", Pointer: objectID},
-			data:          `{"DB":"test","Pointer":ObjectId("5a934e000102030405000000")}`,
-			canonical:     `{"DB":"test","Pointer":{"$oid":"5a934e000102030405000000"}}`,
-			skipUnmarshal: true,
+			name:      "DBPointer",
+			value:     primitive.DBPointer{DB: "test", Pointer: objectID},
+			data:      `DBPointer("test",ObjectId("5a934e000102030405000000"))`,
+			canonical: `{"$dbPointer":{"$ref":"test","$id":{"$oid":"5a934e000102030405000000"}}}`,
 		},
 		{
 			name:        "data with space",
@@ -332,177 +513,1308 @@ func TestMarshalUnmarshal(t *testing.T) {
 func TestEmptyNewDate(t *testing.T) {
 
 	now := time.Now().UTC()
-	data := "new Date()"
-	value := time.Date(0, 0, 0, 0, 0, 0, 0, time.UTC)
 
-	err := mongoextjson.Unmarshal([]byte(data), &value)
-	if err != nil {
-		t.Errorf("fail to unmarshal %s: %v", data, err)
+	for _, data := range []string{"new Date()", "Date()"} {
+
+		value := time.Date(0, 0, 0, 0, 0, 0, 0, time.UTC)
+
+		err := mongoextjson.Unmarshal([]byte(data), &value)
+		if err != nil {
+			t.Errorf("fail to unmarshal %s: %v", data, err)
+		}
+
+		if now.Year() != value.Year() {
+			t.Errorf("different year: %d vs %d", now.Year(), value.Year())
+		}
+		if now.Month() != value.Month() {
+			t.Errorf("different month: %d vs %d", now.Month(), value.Month())
+		}
+		if now.Day() != value.Day() {
+			t.Errorf("different day: %d vs %d", now.Day(), value.Day())
+		}
+		if now.Hour() != value.Hour() {
+			t.Errorf("different hour: %d vs %d", now.Hour(), value.Hour())
+		}
+		if now.Minute() != value.Minute() {
+			t.Errorf("different minute: %d vs %d", now.Minute(), value.Minute())
+		}
 	}
+}
+
+func TestBacktickStrings(t *testing.T) {
+
+	t.Parallel()
 
-	if now.Year() != value.Year() {
-		t.Errorf("different year: %d vs %d", now.Year(), value.Year())
+	var v interface{}
+	err := mongoextjson.Unmarshal([]byte("{\"str\": `hello ${name}`}"), &v)
+	if err == nil || !strings.Contains(err.Error(), "interpolation is not supported") {
+		t.Errorf("expected interpolation to be rejected, but got %v", err)
 	}
-	if now.Month() != value.Month() {
-		t.Errorf("different month: %d vs %d", now.Month(), value.Month())
+
+	err = mongoextjson.NewDecoder(strings.NewReader("`hello`")).Decode(&v)
+	if err == nil {
+		t.Errorf("backtick strings should be rejected without extension, but got %v", v)
+	}
+}
+
+func TestSpecialFloatsTyped(t *testing.T) {
+
+	t.Parallel()
+
+	var v struct {
+		NaN float64
+		Inf float32
+		Neg *float64
+		Any interface{}
 	}
-	if now.Day() != value.Day() {
-		t.Errorf("different day: %d vs %d", now.Day(), value.Day())
+	data := `{"NaN": NaN, "Inf": Infinity, "Neg": -Infinity, "Any": NaN}`
+	if err := mongoextjson.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
 	}
-	if now.Hour() != value.Hour() {
-		t.Errorf("different hour: %d vs %d", now.Hour(), value.Hour())
+	if !math.IsNaN(v.NaN) || !math.IsInf(float64(v.Inf), 1) || v.Neg == nil || !math.IsInf(*v.Neg, -1) {
+		t.Errorf("expected NaN, +Inf and -Inf, but got %v, %v and %v", v.NaN, v.Inf, v.Neg)
 	}
-	if now.Minute() != value.Minute() {
-		t.Errorf("different minute: %d vs %d", now.Minute(), value.Minute())
+	if f, ok := v.Any.(float64); !ok || !math.IsNaN(f) {
+		t.Errorf("expected NaN, but got %#v", v.Any)
 	}
 }
 
-func TestValidExtendedJSONv2(t *testing.T) {
+func TestSpecialFloatsStrict(t *testing.T) {
 
-	doc := bson.M{
-		"_id":        objectID,
-		"binary":     primitive.Binary{Subtype: 2, Data: []byte("foo")},
-		"date":       primitive.DateTime(123615253712),
-		"decimal128": primitive.NewDecimal128(1, 1),
-		"double":     2.2,
-		"int32":      int32(32),
-		"int64":      int64(64),
-		"false":      false,
-		"true":       true,
-		"min":        primitive.MinKey{},
-		"max":        primitive.MaxKey{},
-		"regex":      primitive.Regex{Pattern: "/[a-z]+/", Options: "gi"},
-		"string":     "string",
-		"timestamp":  primitive.Timestamp{T: 2334, I: 33},
-		"undefined":  primitive.Undefined{},
-		"nil":        nil,
+	t.Parallel()
+
+	for _, data := range []string{`NaN`, `Infinity`, `-Infinity`, `+Infinity`, `[1, -inf]`} {
+		var v interface{}
+		err := mongoextjson.NewDecoder(strings.NewReader(data)).Decode(&v)
+		if err == nil {
+			t.Errorf("%s should be rejected without extension, but got %v", data, v)
+		}
 	}
+}
 
-	docStr, err := mongoextjson.MarshalCanonical(doc)
-	if err != nil {
-		t.Error(err)
+func TestTrailingCommasInArrays(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"ints": [1, 2, ], "fixed": [1, ], "any": [
+		"a",
+		"b",
+	], }`
+
+	var v struct {
+		Ints  []int
+		Fixed [2]int
+		Any   interface{}
+	}
+	if err := mongoextjson.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+	if len(v.Ints) != 2 || v.Fixed != [2]int{1, 0} || !reflect.DeepEqual(v.Any, []interface{}{"a", "b"}) {
+		t.Errorf("unexpected result %+v", v)
 	}
 
-	var result bson.M
-	err = bson.UnmarshalExtJSON(docStr, true, &result)
-	if err != nil {
-		t.Error(err)
+	for _, data := range []string{`[1, ]`, `{"ints": [1, 2, ]}`} {
+		err := mongoextjson.NewDecoder(strings.NewReader(data)).Decode(&v)
+		if err == nil {
+			t.Errorf("%s should be rejected without extension", data)
+		}
 	}
+}
 
-	for key, want := range doc {
+func TestJSEscapes(t *testing.T) {
 
-		got, ok := result[key]
-		if !ok {
-			t.Errorf("Missing key %s in result", key)
+	t.Parallel()
+
+	escapeTests := []struct {
+		data string
+		want string
+	}{
+		{data: `"\x41\x7a"`, want: "Az"},
+		{data: `"a\vb\0c"`, want: "a\vb\x00c"},
+		{data: `"it\'s"`, want: "it's"},
+		{data: `"\u{1F600} \u{e9}"`, want: "\U0001F600 é"},
+		{data: "\"line \\\ncontinued\"", want: "line continued"},
+		{data: `"\q\%"`, want: "q%"},
+		{data: `"\n\t\u00e9\x41"`, want: "\n\té" + "A"},
+		{data: "`\\x41`", want: "A"},
+	}
+
+	for _, tt := range escapeTests {
+		var v string
+		if err := mongoextjson.Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Errorf("fail to unmarshal %s: %v", tt.data, err)
+			continue
+		}
+		if v != tt.want {
+			t.Errorf("for %s, expected %q, but got %q", tt.data, tt.want, v)
 		}
+	}
 
-		if !reflect.DeepEqual(want, got) {
-			t.Errorf("For key %s, expected %v but got %v", key, want, got)
+	var m map[string]interface{}
+	if err := mongoextjson.Unmarshal([]byte(`{"\x61": "\x62"}`), &m); err != nil || m["a"] != "b" {
+		t.Errorf("expected escapes in keys to be decoded, but got %v (%v)", m, err)
+	}
+
+	for _, data := range []string{`"\x41"`, `"\v"`, `"it\'s"`, `"\u{41}"`, `{"\x61": 1}`} {
+		var v interface{}
+		err := mongoextjson.NewDecoder(strings.NewReader(data)).Decode(&v)
+		if err == nil {
+			t.Errorf("%s should be rejected without extension, but got %v", data, v)
+		}
+	}
+
+	for _, data := range []string{`"\x4"`, `"\u{110000}"`, `"\u{}"`} {
+		var v interface{}
+		if err := mongoextjson.Unmarshal([]byte(data), &v); err == nil {
+			t.Errorf("invalid escape in %s should be rejected, but got %v", data, v)
 		}
 	}
 }
 
-func TestMongoDBShell(t *testing.T) {
+func TestJSNumbers(t *testing.T) {
 
-	_, err := exec.LookPath("mongo")
-	if err != nil {
-		t.Skip("mongo binary not present in PATH")
+	t.Parallel()
+
+	numberTests := []struct {
+		data string
+		want interface{}
+	}{
+		{data: `0xFF`, want: float64(255)},
+		{data: `-0x10`, want: float64(-16)},
+		{data: `+42`, want: float64(42)},
+		{data: `.5`, want: 0.5},
+		{data: `-.5`, want: -0.5},
+		{data: `5.`, want: float64(5)},
+		{data: `5.e2`, want: float64(500)},
+		{data: `{"a":+.25}`, want: map[string]interface{}{"a": 0.25}},
+		{data: `[0x1F,3.]`, want: []interface{}{float64(31), float64(3)}},
+		{data: `NumberLong(0x10)`, want: int64(16)},
 	}
 
-	doc := bson.M{
-		"_id":             objectID,
-		"binary":          primitive.Binary{Subtype: 2, Data: []byte("foo")},
-		"date":            time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC),
-		"date_new_millis": time.Date(1970, 1, 21, 2, 24, 23, 734000000, time.UTC),
-		"date_new_string": time.Date(1993, 6, 26, 0, 0, 0, 0, time.UTC),
-		"decimal128":      primitive.NewDecimal128(1, 1),
-		"double":          2.2,
-		"false":           false,
-		"int32":           int32(32),
-		"int64":           int64(64),
-		"string":          "string",
-		"timestamp":       primitive.Timestamp{T: 2334, I: 33},
-		"true":            true,
-		"undefined":       primitive.Undefined{},
+	for _, tt := range numberTests {
+		var v interface{}
+		if err := mongoextjson.Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Errorf("fail to unmarshal %s: %v", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(tt.want, v) {
+			t.Errorf("for %s, expected %v, but got %v", tt.data, tt.want, v)
+		}
 	}
 
-	shellTest := struct {
-		input  string
-		output string
-	}{
-		// doc as string to insert
-		input: `{
-			"_id": ObjectId("5a934e000102030405000000"),
-			"binary": BinData(2,"Zm9v"),
-			"date": ISODate("2016-05-15T01:02:03.004Z"),
-			"date_new_millis": new Date(1736663734),
-			"date_new_string": new Date("1993-06-26T00:00:00Z"),
-			"decimal128": NumberDecimal("1.8446744073709551617E-6157"),
-			"double": 2.2,
-			"false": false,
-			"int32": NumberInt(32),
-			"int64": NumberLong(64),
-			"string": "string",
-			"timestamp": Timestamp(2334,33),
-			"true": true,
-			"undefined": undefined
-		}`,
-		// expected result from MongoDB shell
-		output: `{
-	"_id" : ObjectId("5a934e000102030405000000"),
-	"binary" : BinData(2,"Zm9v"),
-	"date" : ISODate("2016-05-15T01:02:03.004Z"),
-	"date_new_millis" : ISODate("1970-01-21T02:24:23.734Z"),
-	"date_new_string" : ISODate("1993-06-26T00:00:00Z"),
-	"decimal128" : NumberDecimal("1.8446744073709551617E-6157"),
-	"double" : 2.2,
-	"false" : false,
-	"int32" : 32,
-	"int64" : NumberLong(64),
-	"string" : "string",
-	"timestamp" : Timestamp(2334, 33),
-	"true" : true,
-	"undefined" : undefined
-}`,
+	var n struct{ N int }
+	if err := mongoextjson.Unmarshal([]byte(`{"N":0x7f}`), &n); err != nil || n.N != 127 {
+		t.Errorf("expected 127, but got %d (%v)", n.N, err)
 	}
 
-	// first, insert a document into mongodb, and check the corresponding shell output
-	buffer := bytes.NewBuffer(nil)
-	fmt.Fprintf(buffer, `
+	for _, data := range []string{`0xFF`, `+1`, `.5`, `5.`, `0x`, `.`} {
+		var v interface{}
+		err := mongoextjson.NewDecoder(strings.NewReader(data)).Decode(&v)
+		if err == nil {
+			t.Errorf("%s should be rejected without extension, but got %v", data, v)
+		}
+	}
+}
 
-	db.test.remove({})
-	db.test.insert(%s)
-	
-	var result = tojson(db.test.findOne())
+func TestEncodeSpecialFloats(t *testing.T) {
 
-	if (result != %s) {
-		print("shell test failed, expected: \n" + %s +  "\nbut got: \n" + result)
-	}`,
-		shellTest.input,
-		strconv.Quote(shellTest.output),
-		strconv.Quote(shellTest.output))
+	t.Parallel()
 
-	runJsTest(t, buffer, "mongoshell.js")
+	doc := bson.M{"nan": math.NaN(), "inf": math.Inf(1), "neg": float32(math.Inf(-1)), "f": 2.5}
 
-	// then, marshal an equivalent bson.M document, and make sure
-	// that the output is the same than the mongodb shell output
-	b, err := mongoextjson.Marshal(doc)
-	if err != nil {
-		t.Errorf("fail to unmarshal %s: %v", doc, err)
+	if _, err := mongoextjson.Marshal(doc); err == nil {
+		t.Errorf("NaN should not be encoded by default")
 	}
 
-	want := strings.ReplaceAll(shellTest.output, "\t", "")
-	want = strings.ReplaceAll(want, "\n", "")
-	want = strings.ReplaceAll(want, " ", "")
+	encodeTests := []struct {
+		encoder func(io.Writer) *mongoextjson.Encoder
+		encode  func(interface{}) ([]byte, error)
+		want    string
+	}{
+		{
+			encoder: mongoextjson.NewShellEncoder,
+			encode:  mongoextjson.EncodeSpecialFloatLiteral,
+			want:    `{"f":2.5,"inf":Infinity,"nan":NaN,"neg":-Infinity}`,
+		},
+		{
+			encoder: mongoextjson.NewCanonicalEncoder,
+			encode:  mongoextjson.EncodeSpecialFloatNumberDouble,
+			want:    `{"f":2.5,"inf":{"$numberDouble":"Infinity"},"nan":{"$numberDouble":"NaN"},"neg":{"$numberDouble":"-Infinity"}}`,
+		},
+	}
 
-	if got := string(b); want != got {
-		t.Errorf("unmarshal failed: expected \n%s, but got \n%s", want, got)
+	for _, tt := range encodeTests {
+		var buf bytes.Buffer
+		enc := tt.encoder(&buf)
+		enc.EncodeType(float64(0), tt.encode)
+		enc.EncodeType(float32(0), tt.encode)
+		if err := enc.Encode(doc); err != nil {
+			t.Fatalf("fail to encode %v: %v", doc, err)
+		}
+		if want, got := tt.want, buf.String(); want != got {
+			t.Errorf("expected %s, but got %s", want, got)
+		}
+
+		var v map[string]interface{}
+		if err := mongoextjson.Unmarshal(buf.Bytes(), &v); err != nil {
+			t.Errorf("fail to unmarshal %s: %v", buf.Bytes(), err)
+		}
 	}
 }
 
-func runJsTest(t *testing.T, buffer *bytes.Buffer, filename string) {
+func TestEncoderEncodeType(t *testing.T) {
 
-	testFile, err := os.Create(filename)
+	t.Parallel()
+
+	doc := bson.M{
+		"bin":  primitive.Binary{Subtype: 2, Data: []byte("foo")},
+		"date": time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC),
+		"long": int64(64),
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.EncodeType(primitive.Binary{}, mongoextjson.EncodeHexData)
+	enc.EncodeType(time.Time{}, mongoextjson.EncodeNewDate)
+	enc.EncodeType(int64(0), mongoextjson.EncodeQuotedNumberLong)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("fail to encode %v: %v", doc, err)
+	}
+	if want, got := `{"bin":HexData(2,"666f6f"),"date":new Date("2016-05-15T01:02:03.004Z"),"long":NumberLong("64")}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	// overrides must not leak into other encoders
+	b, err := mongoextjson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("fail to marshal %v: %v", doc, err)
+	}
+	if want, got := `{"bin":BinData(2,"Zm9v"),"date":ISODate("2016-05-15T01:02:03.004Z"),"long":NumberLong(64)}`, string(b); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestEncodeDatesAsMillis(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.D{
+		{Key: "date", Value: time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC)},
+		{Key: "far", Value: time.Date(12000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Key: "dt", Value: primitive.DateTime(-1000)},
+	}
+
+	tests := []struct {
+		name   string
+		newEnc func(io.Writer) *mongoextjson.Encoder
+		want   string
+	}{
+		{
+			name:   "shell",
+			newEnc: mongoextjson.NewShellEncoder,
+			want:   `{"date":new Date(1463274123004),"far":new Date(316516204800000),"dt":new Date(-1000)}`,
+		},
+		{
+			name:   "canonical",
+			newEnc: mongoextjson.NewCanonicalEncoder,
+			want:   `{"date":{"$date":{"$numberLong":"1463274123004"}},"far":{"$date":{"$numberLong":"316516204800000"}},"dt":{"$date":{"$numberLong":"-1000"}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		enc := tt.newEnc(&buf)
+		enc.EncodeDatesAsMillis()
+		if err := enc.Encode(doc); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := buf.String(); tt.want != got {
+			t.Errorf("%s: expected %s, but got %s", tt.name, tt.want, got)
+		}
+
+		var m bson.M
+		if err := mongoextjson.Unmarshal(buf.Bytes(), &m); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if want, got := time.Date(12000, 1, 1, 0, 0, 0, 0, time.UTC), m["far"]; want != got {
+			t.Errorf("%s: expected %v, but got %v", tt.name, want, got)
+		}
+	}
+}
+
+func TestEncodeRegexLiteral(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.M{
+		"re":    primitive.Regex{Pattern: "^a", Options: "i"},
+		"slash": primitive.Regex{Pattern: `a/b\/c`, Options: ""},
+		"empty": primitive.Regex{Pattern: "", Options: "g"},
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.EncodeType(primitive.Regex{}, mongoextjson.EncodeRegexLiteral)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("fail to encode %v: %v", doc, err)
+	}
+	if want, got := `{"empty":/(?:)/g,"re":/^a/i,"slash":/a\/b\/c/}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestMarshalRegexp(t *testing.T) {
+
+	t.Parallel()
+
+	type query struct {
+		Name  *regexp.Regexp `json:"name"`
+		Email *regexp.Regexp `json:"email"`
+		Nil   *regexp.Regexp `json:"nil"`
+	}
+	q := query{
+		Name:  regexp.MustCompile(`(?i)^"a`),
+		Email: regexp.MustCompile(`(?U)@b\.com$`),
+	}
+
+	tests := []struct {
+		name    string
+		marshal func(interface{}) ([]byte, error)
+		want    string
+	}{
+		{
+			name:    "shell",
+			marshal: mongoextjson.Marshal,
+			want:    `{"name":{"$regex":"^\"a","$options":"i"},"email":{"$regex":"(?U)@b\\.com$","$options":""},"nil":null}`,
+		},
+		{
+			name:    "canonical",
+			marshal: mongoextjson.MarshalCanonical,
+			want:    `{"name":{"$regex":"^\"a","$options":"i"},"email":{"$regex":"(?U)@b\\.com$","$options":""},"nil":null}`,
+		},
+		{
+			name:    "canonical v2",
+			marshal: mongoextjson.MarshalCanonicalV2,
+			want:    `{"name":{"$regularExpression":{"pattern":"^\"a","options":"i"}},"email":{"$regularExpression":{"pattern":"(?U)@b\\.com$","options":""}},"nil":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		b, err := tt.marshal(q)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := string(b); tt.want != got {
+			t.Errorf("%s: expected %s, but got %s", tt.name, tt.want, got)
+		}
+	}
+
+	// the output is decoded as a primitive.Regex
+	b, _ := mongoextjson.MarshalCanonical(q)
+	var m bson.M
+	if err := mongoextjson.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := (primitive.Regex{Pattern: `^"a`, Options: "i"}), m["name"]; want != got {
+		t.Errorf("expected %v, but got %v", want, got)
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.EncodeType((*regexp.Regexp)(nil), mongoextjson.EncodeRegexLiteral)
+	if err := enc.Encode(bson.M{"re": regexp.MustCompile(`(?ms)a/b`)}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"re":/a\/b/ms}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestMarshalBigNumbers(t *testing.T) {
+
+	t.Parallel()
+
+	price, _ := new(big.Float).SetString("19.99")
+	type order struct {
+		Quantity *big.Int   `json:"quantity"`
+		Price    *big.Float `json:"price"`
+		Discount *big.Float `json:"discount"`
+	}
+	o := order{
+		Quantity: new(big.Int).Exp(big.NewInt(10), big.NewInt(20), nil),
+		Price:    price,
+	}
+
+	tests := []struct {
+		name    string
+		marshal func(interface{}) ([]byte, error)
+		want    string
+	}{
+		{
+			name:    "shell",
+			marshal: mongoextjson.Marshal,
+			want:    `{"quantity":NumberDecimal("100000000000000000000"),"price":NumberDecimal("19.99"),"discount":null}`,
+		},
+		{
+			name:    "canonical",
+			marshal: mongoextjson.MarshalCanonical,
+			want:    `{"quantity":{"$numberDecimal":"100000000000000000000"},"price":{"$numberDecimal":"19.99"},"discount":null}`,
+		},
+		{
+			name:    "canonical v2",
+			marshal: mongoextjson.MarshalCanonicalV2,
+			want:    `{"quantity":{"$numberDecimal":"100000000000000000000"},"price":{"$numberDecimal":"19.99"},"discount":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		b, err := tt.marshal(o)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := string(b); tt.want != got {
+			t.Errorf("%s: expected %s, but got %s", tt.name, tt.want, got)
+		}
+	}
+
+	// 35 significant digits don't fit in a Decimal128
+	tooLong := new(big.Int).Add(o.Quantity, new(big.Int).Exp(big.NewInt(10), big.NewInt(34), nil))
+	_, err := mongoextjson.Marshal(bson.M{"n": tooLong.Add(tooLong, big.NewInt(1))})
+	var overflow *mongoextjson.DecimalOverflowError
+	if !errors.As(err, &overflow) {
+		t.Fatalf("expected a *DecimalOverflowError, but got %v", err)
+	}
+	if want, got := "10000000000000100000000000000000001", overflow.Value; want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestEncodeHexDataUnprintable(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.M{
+		"text":  []byte("héllo\n"),
+		"bytes": primitive.Binary{Subtype: 2, Data: []byte{0xde, 0xad, 0xbe, 0xef}},
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.EncodeType([]byte(nil), mongoextjson.EncodeHexDataUnprintable)
+	enc.EncodeType(primitive.Binary{}, mongoextjson.EncodeHexDataUnprintable)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("fail to encode %v: %v", doc, err)
+	}
+	if want, got := `{"bytes":HexData(2,"deadbeef"),"text":BinData(0,"aMOpbGxvCg==")}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	var got map[string]interface{}
+	if err := mongoextjson.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", buf.Bytes(), err)
+	}
+	if !reflect.DeepEqual(bson.M(got), doc) {
+		t.Errorf("expected %v, but got %v", doc, got)
+	}
+}
+
+func TestEncodeUUID(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"bin":BinData(2,"Zm9v"),"uuid":UUID("87654321-abcd-ef01-2345-6789abcdef01")}`
+
+	var doc map[string]interface{}
+	if err := mongoextjson.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.EncodeType(primitive.Binary{}, mongoextjson.EncodeUUID)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("fail to encode %v: %v", doc, err)
+	}
+	if want, got := data, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	var v interface{}
+	if err := mongoextjson.Unmarshal([]byte(`UUID("1234")`), &v); err == nil {
+		t.Errorf("expected an error for an invalid UUID, but got %v", v)
+	}
+}
+
+func TestEncodeCanonicalUUID(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"bin":{"$binary":{"base64":"Zm9v","subType":"02"}},"uuid":{"$uuid":"c8edabc3-f738-4ca3-b68d-ab92a91478a3"}}`
+
+	var doc map[string]interface{}
+	if err := mongoextjson.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+	if b, ok := doc["uuid"].(primitive.Binary); !ok || b.Subtype != 4 || len(b.Data) != 16 {
+		t.Errorf("expected a BinData(4), but got %#v", doc["uuid"])
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewCanonicalV2Encoder(&buf)
+	enc.EncodeType(primitive.Binary{}, mongoextjson.EncodeCanonicalUUID)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("fail to encode %v: %v", doc, err)
+	}
+	if want, got := data, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestEncodeMD5(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"bin":BinData(2,"Zm9v"),"md5":MD5("d41d8cd98f00b204e9800998ecf8427e")}`
+
+	var doc map[string]interface{}
+	if err := mongoextjson.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+	if b, ok := doc["md5"].(primitive.Binary); !ok || b.Subtype != 5 || len(b.Data) != 16 {
+		t.Errorf("expected a BinData(5), but got %#v", doc["md5"])
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.EncodeType(primitive.Binary{}, mongoextjson.EncodeMD5)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("fail to encode %v: %v", doc, err)
+	}
+	if want, got := data, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	var v interface{}
+	if err := mongoextjson.Unmarshal([]byte(`MD5("d41d")`), &v); err == nil {
+		t.Errorf("expected an error for an invalid MD5, but got %v", v)
+	}
+}
+
+func TestLegacyUUID(t *testing.T) {
+
+	t.Parallel()
+
+	legacyTests := []struct {
+		data string
+		want string
+	}{
+		{data: `LUUID("00112233-4455-6677-8899-aabbccddeeff")`, want: "00112233445566778899aabbccddeeff"},
+		{data: `PYUUID("00112233-4455-6677-8899-aabbccddeeff")`, want: "00112233445566778899aabbccddeeff"},
+		{data: `CSUUID("00112233-4455-6677-8899-aabbccddeeff")`, want: "33221100554477668899aabbccddeeff"},
+		{data: `JUUID("00112233-4455-6677-8899-aabbccddeeff")`, want: "7766554433221100ffeeddccbbaa9988"},
+		{data: `JUUID("{00112233-4455-6677-8899-aabbccddeeff}")`, want: "7766554433221100ffeeddccbbaa9988"},
+	}
+
+	for _, tt := range legacyTests {
+		var v interface{}
+		if err := mongoextjson.Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Errorf("fail to unmarshal %s: %v", tt.data, err)
+			continue
+		}
+		b, ok := v.(primitive.Binary)
+		if !ok || b.Subtype != 3 || fmt.Sprintf("%x", b.Data) != tt.want {
+			t.Errorf("for %s, expected BinData(3) %s, but got %#v", tt.data, tt.want, v)
+		}
+	}
+}
+
+func TestUsePrimitiveNull(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"a":null,"b":[null,1],"c":{"d":null}}`
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.UsePrimitiveNull()
+
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatalf("fail to decode %s: %v", data, err)
+	}
+	want := map[string]interface{}{
+		"a": primitive.Null{},
+		"b": []interface{}{primitive.Null{}, float64(1)},
+		"c": map[string]interface{}{"d": primitive.Null{}},
+	}
+	if !reflect.DeepEqual(want, doc) {
+		t.Errorf("expected %v, but got %v", want, doc)
+	}
+
+	b, err := mongoextjson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("fail to marshal %v: %v", doc, err)
+	}
+	if string(b) != data {
+		t.Errorf("expected %s, but got %s", data, b)
+	}
+
+	var s struct {
+		A interface{}
+		B *int
+	}
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`{"A":null,"B":null}`))
+	dec.UsePrimitiveNull()
+	if err := dec.Decode(&s); err != nil {
+		t.Fatalf("fail to decode: %v", err)
+	}
+	if s.A != (primitive.Null{}) || s.B != nil {
+		t.Errorf("expected primitive.Null{} and nil, but got %v and %v", s.A, s.B)
+	}
+}
+
+func TestMinMaxKeyRoundTrip(t *testing.T) {
+
+	t.Parallel()
+
+	doc := map[string]interface{}{"min": primitive.MinKey{}, "max": primitive.MaxKey{}}
+
+	for _, marshal := range []func(interface{}) ([]byte, error){mongoextjson.Marshal, mongoextjson.MarshalCanonical} {
+		b, err := marshal(doc)
+		if err != nil {
+			t.Fatalf("fail to marshal %v: %v", doc, err)
+		}
+		var got map[string]interface{}
+		if err := mongoextjson.Unmarshal(b, &got); err != nil {
+			t.Fatalf("fail to unmarshal %s: %v", b, err)
+		}
+		if !reflect.DeepEqual(doc, got) {
+			t.Errorf("expected %#v, but got %#v", doc, got)
+		}
+	}
+}
+
+func TestNumberOutOfRange(t *testing.T) {
+
+	t.Parallel()
+
+	rangeTests := []struct {
+		data string
+		err  string
+	}{
+		{data: `NumberLong("9223372036854775808")`, err: `invalid NumberLong "9223372036854775808": value out of range at line 1, column 1`},
+		{data: `{"$numberLong":"-9223372036854775809"}`, err: `invalid NumberLong "-9223372036854775809": value out of range at line 1, column 1`},
+		{data: `NumberLong("12a")`, err: `invalid NumberLong "12a": invalid syntax at line 1, column 1`},
+		{data: `NumberInt("2147483648")`, err: `invalid NumberInt "2147483648": value out of range at line 1, column 1`},
+		{data: `{"$numberInt":"4.2"}`, err: `invalid NumberInt "4.2": invalid syntax at line 1, column 1`},
+		{data: `NumberInt(3000000000)`, err: `invalid NumberInt "3000000000": value out of range at line 1, column 1`},
+		{data: `{"$numberInt":-2147483649}`, err: `invalid NumberInt "-2147483649": value out of range at line 1, column 1`},
+		{data: `NumberLong(9223372036854775808)`, err: `invalid NumberLong "9223372036854775808": value out of range at line 1, column 1`},
+		{data: `NumberInt(1.5)`, err: `invalid NumberInt "1.5": invalid syntax at line 1, column 1`},
+		{data: `{"$numberLong":""}`, err: `invalid NumberLong "": invalid syntax at line 1, column 1`},
+	}
+
+	for _, tt := range rangeTests {
+		var v interface{}
+		err := mongoextjson.Unmarshal([]byte(tt.data), &v)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("for %s, expected error %q, but got %v", tt.data, tt.err, err)
+		}
+	}
+
+	var v interface{}
+	err := mongoextjson.Unmarshal([]byte(`{"n": NumberInt(0x80000000)}`), &v)
+	var intErr *mongoextjson.IntegerError
+	if !errors.As(err, &intErr) {
+		t.Fatalf("expected an *IntegerError, but got %v", err)
+	}
+	if want := (mongoextjson.IntegerError{Type: "NumberInt", Literal: "2147483648", Err: strconv.ErrRange}); want != *intErr {
+		t.Errorf("expected %#v, but got %#v", want, *intErr)
+	}
+}
+
+func TestNumberQuotedArgument(t *testing.T) {
+
+	t.Parallel()
+
+	quotedTests := []struct {
+		data string
+		want interface{}
+	}{
+		{data: `NumberLong("9223372036854775807")`, want: int64(math.MaxInt64)},
+		{data: `NumberLong("-9223372036854775808")`, want: int64(math.MinInt64)},
+		{data: `NumberLong('42')`, want: int64(42)},
+		{data: `NumberLong(42)`, want: int64(42)},
+		{data: `{"$numberLong":"9223372036854775807"}`, want: int64(math.MaxInt64)},
+		{data: `NumberInt("2147483647")`, want: int32(math.MaxInt32)},
+		{data: `NumberInt('-2147483648')`, want: int32(math.MinInt32)},
+	}
+
+	for _, tt := range quotedTests {
+		var v interface{}
+		if err := mongoextjson.Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Fatalf("fail to unmarshal %s: %v", tt.data, err)
+		}
+		if v != tt.want {
+			t.Errorf("for %s, expected %#v, but got %#v", tt.data, tt.want, v)
+		}
+	}
+
+	var doc bson.M
+	err := mongoextjson.Unmarshal([]byte(`{"n": NumberLong("9223372036854775808")}`), &doc)
+	var intErr *mongoextjson.IntegerError
+	if !errors.As(err, &intErr) {
+		t.Fatalf("expected an *IntegerError, but got %v", err)
+	}
+	if want := (mongoextjson.IntegerError{Type: "NumberLong", Literal: "9223372036854775808", Err: strconv.ErrRange}); want != *intErr {
+		t.Errorf("expected %#v, but got %#v", want, *intErr)
+	}
+}
+
+func TestNumberZero(t *testing.T) {
+
+	t.Parallel()
+
+	zeroTests := []struct {
+		data string
+		want interface{}
+	}{
+		{data: `NumberLong(0)`, want: int64(0)},
+		{data: `NumberLong("0")`, want: int64(0)},
+		{data: `NumberLong()`, want: int64(0)},
+		{data: `{"$numberLong":"0"}`, want: int64(0)},
+		{data: `{"$numberLong":0}`, want: int64(0)},
+		{data: `NumberInt(0)`, want: int32(0)},
+		{data: `NumberInt('0')`, want: int32(0)},
+		{data: `Int32(0)`, want: int32(0)},
+		{data: `{"$numberInt":"0"}`, want: int32(0)},
+		{data: `{"$numberInt":0}`, want: int32(0)},
+	}
+
+	for _, tt := range zeroTests {
+		var v interface{}
+		if err := mongoextjson.Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Fatalf("fail to unmarshal %s: %v", tt.data, err)
+		}
+		if v != tt.want {
+			t.Errorf("for %s, expected %#v, but got %#v", tt.data, tt.want, v)
+		}
+	}
+
+	// the shell mode writes int32 values as plain numbers
+	doc := bson.M{"l": int64(0), "i": int32(0)}
+	for _, marshal := range []func(interface{}) ([]byte, error){mongoextjson.MarshalCanonical, mongoextjson.MarshalCanonicalV2} {
+		b, err := marshal(doc)
+		if err != nil {
+			t.Fatalf("fail to marshal %v: %v", doc, err)
+		}
+		var got bson.M
+		if err := mongoextjson.Unmarshal(b, &got); err != nil {
+			t.Fatalf("fail to unmarshal %s: %v", b, err)
+		}
+		if !reflect.DeepEqual(doc, got) {
+			t.Errorf("for %s, expected %#v, but got %#v", b, doc, got)
+		}
+	}
+}
+
+func TestUnmarshalNoCopy(t *testing.T) {
+
+	t.Parallel()
+
+	data := []byte(`{"_id": ObjectId("5a934e000102030405000000"), "name": "john", "escaped": "a\tb", "tags": ["x"]}`)
+
+	var doc map[string]interface{}
+	err := mongoextjson.UnmarshalNoCopy(data, &doc)
+	if err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+	if want, got := "map[_id:ObjectID(\"5a934e000102030405000000\") escaped:a\tb name:john tags:[x]]", fmt.Sprintf("%v", doc); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	// strings without escape sequences share the memory of data
+	copy(data[bytes.Index(data, []byte("john")):], "jane")
+	if want, got := "jane", doc["name"]; want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+	if want, got := "a\tb", doc["escaped"]; want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	err = mongoextjson.UnmarshalNoCopy([]byte(`{"a": 1} {"b": 2}`), &doc)
+	if err == nil {
+		t.Errorf("expected an error for invalid input")
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{
+		"ok": 1,
+		"$clusterTime": {
+			"clusterTime": Timestamp(1654159261, 1),
+			"signature": {"hash": BinData(0,"AAECAwQFBgcICQoLDA0ODxAREhM="), "keyId": NumberLong(7104762526358585348)}
+		},
+		"operationTime": Timestamp(1654159261, 2)
+	}`
+
+	var envelope mongoextjson.ResponseEnvelope
+	err := mongoextjson.Unmarshal([]byte(data), &envelope)
+	if err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+	if envelope.OK != 1 || envelope.ClusterTime == nil || envelope.OperationTime == nil {
+		t.Fatalf("missing fields in decoded envelope: %+v", envelope)
+	}
+	if want, got := (primitive.Timestamp{T: 1654159261, I: 1}), envelope.ClusterTime.ClusterTime; want != got {
+		t.Errorf("expected cluster time %v, but got %v", want, got)
+	}
+	if want, got := int64(7104762526358585348), envelope.ClusterTime.Signature.KeyID; want != got {
+		t.Errorf("expected key id %d, but got %d", want, got)
+	}
+
+	want := `{"ok":1,"$clusterTime":{"clusterTime":Timestamp(1654159261,1),"signature":{"hash":BinData(0,"AAECAwQFBgcICQoLDA0ODxAREhM="),"keyId":NumberLong(7104762526358585348)}},"operationTime":Timestamp(1654159261,2)}`
+	b, err := mongoextjson.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("fail to marshal %+v: %v", envelope, err)
+	}
+	if got := string(b); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	var generic interface{}
+	err = mongoextjson.Unmarshal([]byte(data), &generic)
+	if err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+	b, err = mongoextjson.Marshal(generic)
+	if err != nil {
+		t.Fatalf("fail to marshal %+v: %v", generic, err)
+	}
+	if want, got := `{"$clusterTime":{"clusterTime":Timestamp(1654159261,1),"signature":{"hash":BinData(0,"AAECAwQFBgcICQoLDA0ODxAREhM="),"keyId":NumberLong(7104762526358585348)}},"ok":1,"operationTime":Timestamp(1654159261,2)}`, string(b); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestValidExtendedJSONv2(t *testing.T) {
+
+	doc := bson.M{
+		"_id":        objectID,
+		"binary":     primitive.Binary{Subtype: 2, Data: []byte("foo")},
+		"date":       primitive.DateTime(123615253712),
+		"decimal128": primitive.NewDecimal128(1, 1),
+		"double":     2.2,
+		"int32":      int32(32),
+		"int64":      int64(64),
+		"false":      false,
+		"true":       true,
+		"min":        primitive.MinKey{},
+		"max":        primitive.MaxKey{},
+		"regex":      primitive.Regex{Pattern: "/[a-z]+/", Options: "gi"},
+		"string":     "string",
+		"timestamp":  primitive.Timestamp{T: 2334, I: 33},
+		"undefined":  primitive.Undefined{},
+		"nil":        nil,
+	}
+
+	docStr, err := mongoextjson.MarshalCanonical(doc)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var result bson.M
+	err = bson.UnmarshalExtJSON(docStr, true, &result)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for key, want := range doc {
+
+		got, ok := result[key]
+		if !ok {
+			t.Errorf("Missing key %s in result", key)
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("For key %s, expected %v but got %v", key, want, got)
+		}
+	}
+}
+
+func TestMarshalCanonicalV2(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.M{
+		"_id":        objectID,
+		"binary":     primitive.Binary{Subtype: 0x80, Data: []byte("foo")},
+		"bytes":      []byte("foo"),
+		"date":       time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC),
+		"datetime":   primitive.DateTime(123615253712),
+		"decimal128": primitive.NewDecimal128(1, 1),
+		"double":     2.2,
+		"whole":      float64(3),
+		"inf":        math.Inf(-1),
+		"int":        12,
+		"bigint":     1 << 40,
+		"int32":      int32(32),
+		"int64":      int64(64),
+		"timestamp":  primitive.Timestamp{T: 2334, I: 33},
+	}
+
+	b, err := mongoextjson.MarshalCanonicalV2(doc)
+	if err != nil {
+		t.Fatalf("fail to marshal %v: %v", doc, err)
+	}
+	want := `{"_id":{"$oid":"5a934e000102030405000000"},` +
+		`"bigint":{"$numberLong":"1099511627776"},` +
+		`"binary":{"$binary":{"base64":"Zm9v","subType":"80"}},` +
+		`"bytes":{"$binary":{"base64":"Zm9v","subType":"00"}},` +
+		`"date":{"$date":{"$numberLong":"1463274123004"}},` +
+		`"datetime":{"$date":{"$numberLong":"123615253712"}},` +
+		`"decimal128":{"$numberDecimal":"1.8446744073709551617E-6157"},` +
+		`"double":{"$numberDouble":"2.2"},` +
+		`"inf":{"$numberDouble":"-Infinity"},` +
+		`"int":{"$numberInt":"12"},` +
+		`"int32":{"$numberInt":"32"},` +
+		`"int64":{"$numberLong":"64"},` +
+		`"timestamp":{"$timestamp":{"t":2334,"i":33}},` +
+		`"whole":{"$numberDouble":"3.0"}}`
+	if string(b) != want {
+		t.Errorf("expected\n%s\nbut got\n%s", want, b)
+	}
+
+	var result bson.M
+	if err := bson.UnmarshalExtJSON(b, true, &result); err != nil {
+		t.Fatalf("output is not valid extended JSON v2: %v", err)
+	}
+	if got, ok := result["whole"].(float64); !ok || got != 3 {
+		t.Errorf("expected a double for key whole, but got %T %v", result["whole"], result["whole"])
+	}
+	if got, ok := result["int"].(int32); !ok || got != 12 {
+		t.Errorf("expected an int32 for key int, but got %T %v", result["int"], result["int"])
+	}
+}
+
+func TestMarshalDBRefID(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.M{"ref": mongoextjson.DBRef{Collection: "c", ID: int64(5)}}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewEncoder(&buf)
+	enc.SetDialect(mongoextjson.DialectMongosh)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{ref:DBRef('c',Long('5'))}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	b, err := mongoextjson.MarshalCanonicalV2(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"ref":{"$ref":"c","$id":{"$numberLong":"5"}}}`, string(b); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	buf.Reset()
+	enc = mongoextjson.NewCanonicalEncoder(&buf)
+	enc.SetIntegerQuoting(mongoextjson.QuoteNoIntegers)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"ref":{"$ref":"c","$id":5}}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	// the extra fields of a $ref document are written like its $id
+	var extra interface{}
+	if err := mongoextjson.Unmarshal([]byte(`{"$ref":"c","$id":NumberLong(5),"n":NumberLong(6)}`), &extra); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	enc = mongoextjson.NewEncoder(&buf)
+	enc.SetDialect(mongoextjson.DialectMongosh)
+	enc.SortDocumentKeys(true)
+	if err := enc.Encode(extra); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{'$id':Long('5'),'$ref':'c',n:Long('6')}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestMarshalCodeWithScopeValues(t *testing.T) {
+
+	t.Parallel()
+
+	code := primitive.CodeWithScope{
+		Code:  "function() { return d; }",
+		Scope: bson.D{{Key: "d", Value: time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC)}, {Key: "f", Value: 2.5}, {Key: "n", Value: int64(5)}},
+	}
+
+	b, err := mongoextjson.MarshalCanonicalV2(bson.M{"code": code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"code":{"$code":"function() { return d; }","$scope":{"d":{"$date":{"$numberLong":"1463274123004"}},"f":{"$numberDouble":"2.5"},"n":{"$numberLong":"5"}}}}`
+	if string(b) != want {
+		t.Errorf("expected\n%s\nbut got\n%s", want, b)
+	}
+	var result bson.M
+	if err := bson.UnmarshalExtJSON(b, true, &result); err != nil {
+		t.Fatalf("output is not valid extended JSON v2: %v", err)
+	}
+	got, ok := result["code"].(primitive.CodeWithScope)
+	if !ok || got.Code != code.Code {
+		t.Fatalf("expected a CodeWithScope, but got %#v", result["code"])
+	}
+	wantScope := bson.D{{Key: "d", Value: primitive.DateTime(1463274123004)}, {Key: "f", Value: 2.5}, {Key: "n", Value: int64(5)}}
+	if !reflect.DeepEqual(wantScope, got.Scope) {
+		t.Errorf("expected scope %v, but got %v", wantScope, got.Scope)
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewEncoder(&buf)
+	enc.SetDialect(mongoextjson.DialectMongosh)
+	if err := enc.Encode(bson.M{"code": code}); err != nil {
+		t.Fatal(err)
+	}
+	want = `{code:Code('function() { return d; }',{d:ISODate('2016-05-15T01:02:03.004Z'),f:Double(2.5),n:Long('5')})}`
+	if got := buf.String(); want != got {
+		t.Errorf("expected\n%s\nbut got\n%s", want, got)
+	}
+}
+
+func TestUnmarshalExtendedJSONv2(t *testing.T) {
+
+	t.Parallel()
+
+	// as exported by mongoexport from a MongoDB 4.2+ server
+	data := `{"_id":{"$oid":"5a934e000102030405000000"},` +
+		`"date":{"$date":{"$numberLong":"1136239445000"}},` +
+		`"double":{"$numberDouble":"1.5"},` +
+		`"inf":{"$numberDouble":"-Infinity"},` +
+		`"int32":{"$numberInt":"32"},` +
+		`"int64":{"$numberLong":"64"},` +
+		`"uuid":{"$binary":{"base64":"Zm9v","subType":"04"}},` +
+		`"user":{"$binary":{"base64":"Zm9v","subType":"80"}},` +
+		`"regex":{"$regularExpression":{"pattern":"^a","options":"i"}}}`
+
+	want := map[string]interface{}{
+		"_id":    objectID,
+		"date":   time.Date(2006, 1, 2, 22, 4, 5, 0, time.UTC),
+		"double": 1.5,
+		"inf":    math.Inf(-1),
+		"int32":  int32(32),
+		"int64":  int64(64),
+		"uuid":   primitive.Binary{Subtype: 4, Data: []byte("foo")},
+		"user":   primitive.Binary{Subtype: 0x80, Data: []byte("foo")},
+		"regex":  primitive.Regex{Pattern: "^a", Options: "i"},
+	}
+
+	var got map[string]interface{}
+	if err := mongoextjson.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatalf("fail to unmarshal %s: %v", data, err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expected\n%v\nbut got\n%v", want, got)
+	}
+
+	var v interface{}
+	err := mongoextjson.Unmarshal([]byte(`{"$binary":{"base64":"Zm9v","subType":"zz"}}`), &v)
+	if err == nil {
+		t.Errorf("expected an error for an invalid subType")
+	}
+}
+
+func TestMongoDBShell(t *testing.T) {
+
+	_, err := exec.LookPath("mongo")
+	if err != nil {
+		t.Skip("mongo binary not present in PATH")
+	}
+
+	doc := bson.M{
+		"_id":             objectID,
+		"binary":          primitive.Binary{Subtype: 2, Data: []byte("foo")},
+		"date":            time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC),
+		"date_new_millis": time.Date(1970, 1, 21, 2, 24, 23, 734000000, time.UTC),
+		"date_new_string": time.Date(1993, 6, 26, 0, 0, 0, 0, time.UTC),
+		"decimal128":      primitive.NewDecimal128(1, 1),
+		"double":          2.2,
+		"false":           false,
+		"int32":           int32(32),
+		"int64":           int64(64),
+		"string":          "string",
+		"timestamp":       primitive.Timestamp{T: 2334, I: 33},
+		"true":            true,
+		"undefined":       primitive.Undefined{},
+	}
+
+	shellTest := struct {
+		input  string
+		output string
+	}{
+		// doc as string to insert
+		input: `{
+			"_id": ObjectId("5a934e000102030405000000"),
+			"binary": BinData(2,"Zm9v"),
+			"date": ISODate("2016-05-15T01:02:03.004Z"),
+			"date_new_millis": new Date(1736663734),
+			"date_new_string": new Date("1993-06-26T00:00:00Z"),
+			"decimal128": NumberDecimal("1.8446744073709551617E-6157"),
+			"double": 2.2,
+			"false": false,
+			"int32": NumberInt(32),
+			"int64": NumberLong(64),
+			"string": "string",
+			"timestamp": Timestamp(2334,33),
+			"true": true,
+			"undefined": undefined
+		}`,
+		// expected result from MongoDB shell
+		output: `{
+	"_id" : ObjectId("5a934e000102030405000000"),
+	"binary" : BinData(2,"Zm9v"),
+	"date" : ISODate("2016-05-15T01:02:03.004Z"),
+	"date_new_millis" : ISODate("1970-01-21T02:24:23.734Z"),
+	"date_new_string" : ISODate("1993-06-26T00:00:00Z"),
+	"decimal128" : NumberDecimal("1.8446744073709551617E-6157"),
+	"double" : 2.2,
+	"false" : false,
+	"int32" : 32,
+	"int64" : NumberLong(64),
+	"string" : "string",
+	"timestamp" : Timestamp(2334, 33),
+	"true" : true,
+	"undefined" : undefined
+}`,
+	}
+
+	// first, insert a document into mongodb, and check the corresponding shell output
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, `
+
+	db.test.remove({})
+	db.test.insert(%s)
+	
+	var result = tojson(db.test.findOne())
+
+	if (result != %s) {
+		print("shell test failed, expected: \n" + %s +  "\nbut got: \n" + result)
+	}`,
+		shellTest.input,
+		strconv.Quote(shellTest.output),
+		strconv.Quote(shellTest.output))
+
+	runJsTest(t, buffer, "mongoshell.js")
+
+	// then, marshal an equivalent bson.M document, and make sure
+	// that the output is the same than the mongodb shell output
+	b, err := mongoextjson.Marshal(doc)
+	if err != nil {
+		t.Errorf("fail to unmarshal %s: %v", doc, err)
+	}
+
+	want := strings.ReplaceAll(shellTest.output, "\t", "")
+	want = strings.ReplaceAll(want, "\n", "")
+	want = strings.ReplaceAll(want, " ", "")
+
+	if got := string(b); want != got {
+		t.Errorf("unmarshal failed: expected \n%s, but got \n%s", want, got)
+	}
+
+	// the pretty mode output can be compared verbatim
+	b, err = mongoextjson.MarshalShellPretty(doc)
+	if err != nil {
+		t.Errorf("fail to marshal %s: %v", doc, err)
+	}
+	if got := string(b); shellTest.output != got {
+		t.Errorf("pretty marshal failed: expected \n%s, but got \n%s", shellTest.output, got)
+	}
+}
+
+func TestMarshalShellPretty(t *testing.T) {
+
+	t.Parallel()
+
+	doc := struct {
+		ID         primitive.ObjectID     `json:"_id"`
+		Int32      int32                  `json:"int32"`
+		Timestamp  primitive.Timestamp    `json:"timestamp"`
+		Ref        mongoextjson.DBRef     `json:"ref"`
+		Sub        map[string]interface{} `json:"sub"`
+		EmptyDoc   struct{}               `json:"emptyDoc"`
+		EmptyArray []interface{}          `json:"emptyArray"`
+	}{
+		ID:         objectID,
+		Int32:      32,
+		Timestamp:  primitive.Timestamp{T: 2334, I: 33},
+		Ref:        mongoextjson.DBRef{Collection: "coll", ID: objectID},
+		Sub:        map[string]interface{}{"a": []interface{}{1, "b,c:{"}},
+		EmptyArray: []interface{}{},
+	}
+	want := `{
+	"_id" : ObjectId("5a934e000102030405000000"),
+	"int32" : 32,
+	"timestamp" : Timestamp(2334, 33),
+	"ref" : DBRef("coll",ObjectId("5a934e000102030405000000")),
+	"sub" : {
+		"a" : [
+			1,
+			"b,c:{"
+		]
+	},
+	"emptyDoc" : { },
+	"emptyArray" : [ ]
+}`
+
+	b, err := mongoextjson.MarshalShellPretty(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); want != got {
+		t.Errorf("expected \n%s, but got \n%s", want, got)
+	}
+}
+
+func TestMarshalShellPrettyRegexLiteral(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.D{
+		{Key: "paren", Value: primitive.Regex{Pattern: "a(b", Options: "i"}},
+		{Key: "chars", Value: primitive.Regex{Pattern: `[{,:]\)`}},
+		{Key: "ref", Value: mongoextjson.DBRef{Collection: "c(", ID: int32(1)}},
+		{Key: "n", Value: int32(1)},
+	}
+	want := `{
+	"paren" : /a(b/i,
+	"chars" : /[{,:]\)/,
+	"ref" : DBRef("c(",1),
+	"n" : 1
+}`
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellPrettyEncoder(&buf)
+	enc.EncodeType(primitive.Regex{}, mongoextjson.EncodeRegexLiteral)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSuffix(buf.String(), "\n"); want != got {
+		t.Errorf("expected \n%s, but got \n%s", want, got)
+	}
+}
+
+func runJsTest(t *testing.T, buffer *bytes.Buffer, filename string) {
+
+	testFile, err := os.Create(filename)
 	if err != nil {
 		t.Error(err)
 	}
@@ -527,3 +1839,153 @@ func runJsTest(t *testing.T, buffer *bytes.Buffer, filename string) {
 		os.Remove(filename)
 	}
 }
+
+func TestInline(t *testing.T) {
+
+	t.Parallel()
+
+	type base struct {
+		ID   primitive.ObjectID `json:"_id" bson:"_id"`
+		Name string             `json:"name" bson:"name"`
+	}
+	type audit struct {
+		By string `json:"by" bson:"by"`
+	}
+	type doc struct {
+		Base  base   `json:",inline" bson:",inline"`
+		Audit *audit `json:",inline" bson:",inline"`
+		Qty   int    `json:"qty" bson:"qty"`
+	}
+
+	v := doc{Base: base{ID: objectID, Name: "a"}, Audit: &audit{By: "me"}, Qty: 3}
+
+	b, err := mongoextjson.MarshalCanonical(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"_id":{"$oid":"5a934e000102030405000000"},"name":"a","by":"me","qty":3}`
+	if string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elems, _ := bson.Raw(raw).Elements()
+	var keys []string
+	for _, e := range elems {
+		keys = append(keys, e.Key())
+	}
+	if got := strings.Join(keys, ","); got != "_id,name,by,qty" {
+		t.Errorf("expected the same keys as bson.Marshal, but got %s", got)
+	}
+
+	var got doc
+	if err := mongoextjson.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Base != v.Base || got.Audit == nil || *got.Audit != *v.Audit || got.Qty != v.Qty {
+		t.Errorf("expected %+v, but got %+v", v, got)
+	}
+}
+
+func TestOmitEmptyBSONZeroValues(t *testing.T) {
+
+	t.Parallel()
+
+	type doc struct {
+		ID        primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
+		Date      time.Time            `json:"date,omitempty" bson:"date,omitempty"`
+		DatePtr   *time.Time           `json:"datePtr,omitempty" bson:"datePtr,omitempty"`
+		Decimal   primitive.Decimal128 `json:"decimal,omitempty" bson:"decimal,omitempty"`
+		Timestamp primitive.Timestamp  `json:"ts,omitempty" bson:"ts,omitempty"`
+		Binary    primitive.Binary     `json:"bin,omitempty" bson:"bin,omitempty"`
+		Regex     primitive.Regex      `json:"regex,omitempty" bson:"regex,omitempty"`
+		N         int                  `json:"n"`
+	}
+
+	var zero time.Time
+	b, err := mongoextjson.MarshalCanonical(doc{DatePtr: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"n":0}`; string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+
+	raw, err := bson.Marshal(doc{DatePtr: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elems, _ := bson.Raw(raw).Elements(); len(elems) != 1 {
+		t.Errorf("expected the same fields as bson.Marshal, but got %v", bson.Raw(raw))
+	}
+
+	b, err = mongoextjson.MarshalCanonical(doc{ID: objectID, Timestamp: primitive.Timestamp{T: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"_id":{"$oid":"5a934e000102030405000000"},"ts":{"$timestamp":{"t":1,"i":0}},"n":0}`; string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+}
+
+func TestMarshalBsonD(t *testing.T) {
+
+	t.Parallel()
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "z", Value: 1}, {Key: "a", Value: objectID}}},
+		{Key: "$inc", Value: bson.M{"n": int64(2)}},
+		{Key: "$push", Value: []primitive.E{{Key: "list", Value: nil}}},
+	}
+
+	b, err := mongoextjson.Marshal(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"$set":{"z":1,"a":ObjectId("5a934e000102030405000000")},"$inc":{"n":NumberLong(2)},"$push":{"list":null}}`
+	if string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+
+	b, err = mongoextjson.MarshalCanonical(struct {
+		Filter bson.D `json:"filter"`
+		Empty  bson.D `json:"empty"`
+	}{Filter: bson.D{{Key: "b", Value: "x"}, {Key: "a", Value: true}}, Empty: bson.D{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"filter":{"b":"x","a":true},"empty":{}}`; string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+}
+
+func TestSortDocumentKeys(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.D{
+		{Key: "z", Value: 1},
+		{Key: "a", Value: bson.D{{Key: "y", Value: true}, {Key: "b", Value: bson.M{"d": 1, "c": 2}}}},
+	}
+
+	for _, tt := range []struct {
+		sort bool
+		want string
+	}{
+		{sort: false, want: `{"z":1,"a":{"y":true,"b":{"c":2,"d":1}}}`},
+		{sort: true, want: `{"a":{"b":{"c":2,"d":1},"y":true},"z":1}`},
+	} {
+		var buf bytes.Buffer
+		enc := mongoextjson.NewCanonicalEncoder(&buf)
+		enc.SortDocumentKeys(tt.sort)
+		if err := enc.Encode(doc); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("sort %v: expected %s, but got %s", tt.sort, tt.want, buf.String())
+		}
+	}
+}
@@ -14,14 +14,32 @@ type Extension struct {
 	consts map[string]interface{}
 	keyed  map[string]func([]byte) (interface{}, error)
 	encode map[reflect.Type]func(v interface{}) ([]byte, error)
+	// encodeValue holds the encoders of the types holding other values,
+	// like the scope of a CodeWithScope, that are written with the
+	// encodeState of the whole value so that they follow its spelling
+	// and options. The ones of encode take precedence.
+	encodeValue map[reflect.Type]encoderFunc
 
-	unquotedKeys   bool
-	trailingCommas bool
+	unquotedKeys    bool
+	trailingCommas  bool
+	backtickStrings bool
+	specialFloats   bool
+	jsNumbers       bool
+	jsEscapes       bool
+	singleQuotes    bool
+
+	// shell is set for the extensions encoding values in 'shell mode'
+	shell bool
 }
 
 type funcExtension struct {
 	key  string
 	args []string
+
+	// keyBytes and argBytes hold key and args as byte slices, to look
+	// up the fields they are decoded into without allocating
+	keyBytes []byte
+	argBytes [][]byte
 }
 
 // Extend changes the decoder behavior to consider the provided extension.
@@ -30,6 +48,45 @@ func (dec *Decoder) Extend(ext *Extension) { dec.d.ext = *ext }
 // Extend changes the encoder behavior to consider the provided extension.
 func (enc *Encoder) Extend(ext *Extension) { enc.ext = *ext }
 
+// DecodeJSNumbers defines whether to accept numbers using JavaScript only
+// syntax: hexadecimal numbers like 0xFF, leading '+' signs, and leading
+// or trailing decimal points like .5 or 5.
+func (e *Extension) DecodeJSNumbers(accept bool) {
+	e.jsNumbers = accept
+}
+
+// DecodeJSEscapes defines whether to accept the escape sequences of
+// JavaScript strings that are not valid in JSON, like \x41, \v, \0,
+// \u{1F600}, \' or a backslash at the end of a line.
+func (e *Extension) DecodeJSEscapes(accept bool) {
+	e.jsEscapes = accept
+}
+
+// EncodeType registers a function to encode values with the same type of the
+// provided sample with this encoder only, overriding the spelling defined by
+// the extension. It must be called after Extend.
+func (enc *Encoder) EncodeType(sample interface{}, encode func(v interface{}) ([]byte, error)) {
+	// copy the registered encoders so that the extension itself,
+	// which may be shared by other encoders, is left untouched
+	m := make(map[reflect.Type]func(v interface{}) ([]byte, error), len(enc.ext.encode)+1)
+	for typ, f := range enc.ext.encode {
+		m[typ] = f
+	}
+	m[reflect.TypeOf(sample)] = encode
+	enc.ext.encode = m
+}
+
+// encodeValueType registers an encoder writing the values of type typ
+// with the encodeState, without altering the extension of enc.
+func (enc *Encoder) encodeValueType(typ reflect.Type, encode encoderFunc) {
+	m := make(map[reflect.Type]encoderFunc, len(enc.ext.encodeValue)+1)
+	for t, f := range enc.ext.encodeValue {
+		m[t] = f
+	}
+	m[typ] = encode
+	enc.ext.encodeValue = m
+}
+
 // Extend includes in e the extensions defined in ext.
 func (e *Extension) Extend(ext *Extension) {
 	for name, fext := range ext.funcs {
@@ -47,6 +104,9 @@ func (e *Extension) Extend(ext *Extension) {
 		}
 		e.encode[typ] = encode
 	}
+	for typ, encode := range ext.encodeValue {
+		e.encodeValueType(typ, encode)
+	}
 }
 
 // DecodeFunc defines a function call that may be observed inside JSON content.
@@ -56,7 +116,11 @@ func (e *Extension) DecodeFunc(name string, key string, args ...string) {
 	if e.funcs == nil {
 		e.funcs = make(map[string]funcExtension)
 	}
-	e.funcs[name] = funcExtension{key, args}
+	argBytes := make([][]byte, len(args))
+	for i, arg := range args {
+		argBytes[i] = []byte(arg)
+	}
+	e.funcs[name] = funcExtension{key: key, args: args, keyBytes: []byte(key), argBytes: argBytes}
 }
 
 // DecodeConst defines a constant name that may be observed inside JSON content
@@ -88,6 +152,25 @@ func (e *Extension) DecodeTrailingCommas(accept bool) {
 	e.trailingCommas = accept
 }
 
+// DecodeBacktickStrings defines whether to accept strings quoted with
+// backticks, like JavaScript template literals. Interpolation with `${...}`
+// is not supported and is always rejected.
+func (e *Extension) DecodeBacktickStrings(accept bool) {
+	e.backtickStrings = accept
+}
+
+// DecodeSingleQuotes defines whether to accept strings and map keys quoted
+// with single quotes, like 'foo', as printed by mongosh.
+func (e *Extension) DecodeSingleQuotes(accept bool) {
+	e.singleQuotes = accept
+}
+
+// DecodeSpecialFloats defines whether to accept the NaN and Infinity
+// literals, optionally signed and regardless of their case, as float values.
+func (e *Extension) DecodeSpecialFloats(accept bool) {
+	e.specialFloats = accept
+}
+
 // EncodeType registers a function to encode values with the same type of the
 // provided sample.
 func (e *Extension) EncodeType(sample interface{}, encode func(v interface{}) ([]byte, error)) {
@@ -96,3 +179,12 @@ func (e *Extension) EncodeType(sample interface{}, encode func(v interface{}) ([
 	}
 	e.encode[reflect.TypeOf(sample)] = encode
 }
+
+// encodeValueType registers an encoder writing the values of type typ
+// with the encodeState of the value being encoded.
+func (e *Extension) encodeValueType(typ reflect.Type, encode encoderFunc) {
+	if e.encodeValue == nil {
+		e.encodeValue = make(map[reflect.Type]encoderFunc)
+	}
+	e.encodeValue[typ] = encode
+}
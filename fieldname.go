@@ -0,0 +1,65 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"sync"
+	"unicode"
+)
+
+// nameMapper maps the names of the struct fields without a json tag,
+// caching the results since the same fields are met again and again.
+type nameMapper struct {
+	fn    func(string) string
+	cache sync.Map // Go name to *mappedName
+}
+
+type mappedName struct {
+	name      string
+	nameBytes []byte
+}
+
+func newNameMapper(fn func(string) string) *nameMapper {
+	if fn == nil {
+		return nil
+	}
+	return &nameMapper{fn: fn}
+}
+
+func (m *nameMapper) get(name string) *mappedName {
+	if v, ok := m.cache.Load(name); ok {
+		return v.(*mappedName)
+	}
+	s := m.fn(name)
+	v, _ := m.cache.LoadOrStore(name, &mappedName{name: s, nameBytes: []byte(s)})
+	return v.(*mappedName)
+}
+
+// SnakeCase converts a Go field name to snake case, the convention of
+// most MongoDB collections: UserID becomes user_id, and HTTPStatus
+// becomes http_status. It can be used with SetFieldNameMapper.
+func SnakeCase(name string) string {
+	runes := []rune(name)
+	out := make([]rune, 0, len(runes)+4)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && startsWord(runes, i) {
+				out = append(out, '_')
+			}
+			r = unicode.ToLower(r)
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// startsWord reports whether the upper case rune at index i starts a new
+// word: it follows a lower case letter or a digit, or it is the last
+// letter of an acronym followed by a lower case letter, like S in HTTPStatus.
+func startsWord(runes []rune, i int) bool {
+	prev := runes[i-1]
+	if unicode.IsLower(prev) || unicode.IsDigit(prev) {
+		return true
+	}
+	return unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+}
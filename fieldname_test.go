@@ -0,0 +1,81 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+func TestSnakeCase(t *testing.T) {
+
+	t.Parallel()
+
+	snakeTests := map[string]string{
+		"Name":        "name",
+		"ID":          "id",
+		"UserID":      "user_id",
+		"HTTPStatus":  "http_status",
+		"CreatedAt":   "created_at",
+		"Address2Zip": "address2_zip",
+		"Already_Set": "already_set",
+		"Été":         "été",
+	}
+
+	for name, want := range snakeTests {
+		if got := mongoextjson.SnakeCase(name); got != want {
+			t.Errorf("SnakeCase(%q): expected %q, but got %q", name, want, got)
+		}
+	}
+}
+
+func TestFieldNameMapper(t *testing.T) {
+
+	t.Parallel()
+
+	type item struct {
+		ItemID   int
+		Quantity int `json:"qty"`
+	}
+	type order struct {
+		ID        int `json:"_id"`
+		UserID    string
+		LineItems []item
+		Comment   string `json:",omitempty"`
+	}
+
+	v := order{ID: 1, UserID: "u1", LineItems: []item{{ItemID: 2, Quantity: 3}}}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewCanonicalEncoder(&buf)
+	enc.SetFieldNameMapper(mongoextjson.SnakeCase)
+	if err := enc.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"_id":1,"user_id":"u1","line_items":[{"item_id":2,"qty":3}]}`
+	if buf.String() != want {
+		t.Errorf("expected %s, but got %s", want, buf.String())
+	}
+
+	// without a mapper, the Go names are kept
+	b, err := mongoextjson.MarshalCanonical(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"UserID":"u1"`) {
+		t.Errorf("expected Go field names, but got %s", b)
+	}
+
+	var got order
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(`{"_id":1,"user_id":"u1","line_items":[{"item_id":2,"qty":3}]}`))
+	dec.SetFieldNameMapper(mongoextjson.SnakeCase)
+	if err := dec.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != "u1" || len(got.LineItems) != 1 || got.LineItems[0] != (item{ItemID: 2, Quantity: 3}) {
+		t.Errorf("unexpected decoded value %+v", got)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LoadFixtures reads the documents stored in path and calls fn on each of
+// them, in order.
+//
+// path can either be a single file or a directory, in which case every file
+// with a .json or .js extension is loaded, in lexical order. A file may hold
+// a single document, an array of documents, or several documents one after
+// the other, using any syntax accepted by Unmarshal.
+//
+// The string values of the documents may be placeholders, resolved when the
+// documents are loaded:
+//
+//	"{{now}}"           the time of the call, the same for every document
+//	"{{oid \"user1\"}}"  an ObjectId generated from the label user1, the
+//	                    same for every file and every call
+//
+// so that fixtures can reference each other without hard-coded ids.
+//
+// The error returned by fn stops the loading and is returned as is.
+func LoadFixtures(path string, fn func(doc interface{}) error) error {
+	files, err := fixtureFiles(path)
+	if err != nil {
+		return err
+	}
+	tmpl := &fixtureTemplate{now: time.Now().UTC().Truncate(time.Millisecond)}
+	for _, file := range files {
+		if err := readFixture(file, tmpl, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fixtureFiles returns the list of files to load from path.
+func fixtureFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".json", ".js":
+			if !d.IsDir() {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// readFixture decodes each document of file, resolves its placeholders
+// with tmpl and calls fn on it. The elements of a top-level array are
+// decoded one at a time, so that the array isn't held in memory as a
+// whole.
+func readFixture(file string, tmpl *fixtureTemplate, fn func(doc interface{}) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := NewDecoder(f)
+	d.Extend(&jsonExt)
+
+	// fnErr is the last error returned by fn, which is returned as is
+	var fnErr error
+	next := func() error {
+		var doc interface{}
+		if err := d.Decode(&doc); err != nil {
+			return err
+		}
+		if _, ok := doc.(map[string]interface{}); !ok {
+			return fmt.Errorf("expected a document but got %T", doc)
+		}
+		doc, err := tmpl.resolve(doc)
+		if err != nil {
+			return err
+		}
+		fnErr = fn(doc)
+		return fnErr
+	}
+
+	for {
+		d.skipSemicolons()
+		c, err := d.peek()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			if c == '[' {
+				err = d.ArrayElements(next)
+			} else {
+				err = next()
+			}
+		}
+		if err != nil {
+			if err == fnErr {
+				return err
+			}
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+}
+
+// fixtureTemplate resolves the placeholders of the fixtures, the string
+// values like "{{now}}" or "{{oid \"user1\"}}".
+type fixtureTemplate struct {
+	now time.Time
+}
+
+// resolve replaces the placeholders found in v, and returns the
+// resulting value.
+func (ft *fixtureTemplate) resolve(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			r, err := ft.resolve(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = r
+		}
+	case []interface{}:
+		for i, e := range v {
+			r, err := ft.resolve(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = r
+		}
+	case string:
+		return ft.placeholder(v)
+	}
+	return v, nil
+}
+
+// placeholder returns the value of s if it is a placeholder, or s itself.
+func (ft *fixtureTemplate) placeholder(s string) (interface{}, error) {
+	if !strings.HasPrefix(s, "{{") || !strings.HasSuffix(s, "}}") {
+		return s, nil
+	}
+	name, arg, _ := strings.Cut(strings.TrimSpace(s[2:len(s)-2]), " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "now":
+		if arg != "" {
+			return nil, fmt.Errorf("invalid placeholder %s: now takes no argument", s)
+		}
+		return ft.now, nil
+	case "oid":
+		label, err := strconv.Unquote(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid placeholder %s: expected a quoted label", s)
+		}
+		return labelObjectID(label), nil
+	}
+	return s, nil
+}
+
+// labelObjectID returns the ObjectId generated for label, derived from
+// its hash so that it is the same every time.
+func labelObjectID(label string) primitive.ObjectID {
+	sum := sha1.Sum([]byte(label))
+	var id primitive.ObjectID
+	copy(id[:], sum[:])
+	return id
+}
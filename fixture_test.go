@@ -0,0 +1,125 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func writeFixtures(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// loadFixtures returns the documents loaded from path.
+func loadFixtures(t *testing.T, path string) []map[string]interface{} {
+	var docs []map[string]interface{}
+	err := mongoextjson.LoadFixtures(path, func(doc interface{}) error {
+		docs = append(docs, doc.(map[string]interface{}))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return docs
+}
+
+func TestLoadFixtures(t *testing.T) {
+
+	t.Parallel()
+
+	dir := writeFixtures(t, map[string]string{
+		"a.json":     `[{"_id": ObjectId("5a934e000102030405000000"), n: NumberInt(1)}, {n: 2}]`,
+		"b.js":       `{n: 3} {n: NumberLong(4)}`,
+		"README.txt": `not a fixture`,
+	})
+
+	var ns []interface{}
+	for _, doc := range loadFixtures(t, dir) {
+		ns = append(ns, doc["n"])
+	}
+	if want := []interface{}{int32(1), 2.0, 3.0, int64(4)}; !reflect.DeepEqual(want, ns) {
+		t.Errorf("expected documents %v, but got %v", want, ns)
+	}
+
+	// the error of fn stops the loading
+	errStop := errors.New("stop")
+	calls := 0
+	err := mongoextjson.LoadFixtures(dir, func(doc interface{}) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("expected a single call and the error of fn, but got %d calls and %v", calls, err)
+	}
+
+	// the elements of an array must be documents
+	dir = writeFixtures(t, map[string]string{"c.json": `[{n: 1}, 2]`})
+	err = mongoextjson.LoadFixtures(dir, func(doc interface{}) error { return nil })
+	if want := filepath.Join(dir, "c.json") + ": expected a document but got float64"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, but got %v", want, err)
+	}
+}
+
+func TestLoadFixturesPlaceholders(t *testing.T) {
+
+	t.Parallel()
+
+	dir := writeFixtures(t, map[string]string{
+		"users.json": `[{_id: "{{oid \"alice\"}}", created: "{{now}}"}, {_id: "{{ oid \"bob\" }}", created: "{{now}}"}]`,
+		"posts.json": `{author: "{{oid \"alice\"}}", tags: ["{{oid \"bob\"}}", "{{other}}", "now"]}`,
+	})
+
+	before := time.Now()
+	docs := loadFixtures(t, dir)
+	if len(docs) != 3 {
+		t.Fatalf("expected 3 documents, but got %v", docs)
+	}
+	// files are loaded in lexical order
+	post, alice, bob := docs[0], docs[1], docs[2]
+
+	aliceID, ok := alice["_id"].(primitive.ObjectID)
+	if !ok {
+		t.Fatalf("expected an ObjectId, but got %T", alice["_id"])
+	}
+	if post["author"] != aliceID {
+		t.Errorf("expected the same ObjectId %v for the same label, but got %v", aliceID, post["author"])
+	}
+	if bob["_id"] == aliceID {
+		t.Errorf("expected different ObjectIds for different labels")
+	}
+	if want := []interface{}{bob["_id"], "{{other}}", "now"}; !reflect.DeepEqual(want, post["tags"]) {
+		t.Errorf("expected tags %v, but got %v", want, post["tags"])
+	}
+	created, ok := alice["created"].(time.Time)
+	if !ok || created != bob["created"] {
+		t.Errorf("expected the same date for every {{now}}, but got %v and %v", alice["created"], bob["created"])
+	}
+	if created.Before(before.Add(-time.Millisecond)) || created.After(time.Now()) {
+		t.Errorf("expected {{now}} to be the time of the load, but got %v", created)
+	}
+
+	// ids don't change from one load to the other
+	if id := loadFixtures(t, dir)[1]["_id"]; id != aliceID {
+		t.Errorf("expected ObjectId %v on the second load, but got %v", aliceID, id)
+	}
+
+	dir = writeFixtures(t, map[string]string{"bad.json": `{_id: "{{oid alice}}"}`})
+	err := mongoextjson.LoadFixtures(dir, func(doc interface{}) error { return nil })
+	if want := filepath.Join(dir, "bad.json") + ": invalid placeholder {{oid alice}}: expected a quoted label"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, but got %v", want, err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+func TestCompact(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "strict",
+			src:  "{ \"a\" : [ 1, 2 ],\n\t\"b\": { \"$oid\": \"5a934e000102030405000000\" } }\n",
+			want: `{"a":[1,2],"b":{"$oid":"5a934e000102030405000000"}}`,
+		},
+		{
+			name: "shell",
+			src:  "{\n\t_id : ObjectId( \"5a934e000102030405000000\" ),\n\td: new Date( 10 ),\n\tts: Timestamp(1, 2),\n}",
+			want: `{_id:ObjectId("5a934e000102030405000000"),d:new Date(10),ts:Timestamp(1,2),}`,
+		},
+		{
+			name: "spaces in strings",
+			src:  `{ "a b" : 'c d', "e": ` + "` f `" + ` }`,
+			want: `{"a b":'c d',"e":` + "` f `" + `}`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := mongoextjson.Compact(&buf, []byte(tt.src)); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("expected %s, but got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCompactInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	buf := bytes.NewBufferString("prefix")
+	err := mongoextjson.Compact(buf, []byte(`{"a": ObjectId("5a934e000102030405000000"`))
+	if err == nil {
+		t.Fatal("expected an error for truncated input")
+	}
+	if buf.String() != "prefix" {
+		t.Errorf("dst should be left untouched on error, but got %s", buf.String())
+	}
+}
+
+func TestIndent(t *testing.T) {
+
+	t.Parallel()
+
+	src := `{"_id":ObjectId( "5a934e000102030405000000" ),"d":new Date(10),` +
+		`"ts":Timestamp({t:1, i:2}),"a":[1,{"b":NumberLong(2)}],"e":{},"f":[],"s":"x, {y}: z"}`
+	want := `{
+>	"_id": ObjectId("5a934e000102030405000000"),
+>	"d": new Date(10),
+>	"ts": Timestamp({t:1,i:2}),
+>	"a": [
+>		1,
+>		{
+>			"b": NumberLong(2)
+>		}
+>	],
+>	"e": {},
+>	"f": [],
+>	"s": "x, {y}: z"
+>}`
+
+	var buf bytes.Buffer
+	if err := mongoextjson.Indent(&buf, []byte(src), ">", "\t"); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("expected \n%s\n but got \n%s", want, got)
+	}
+
+	buf.Reset()
+	if err := mongoextjson.Indent(&buf, []byte(`{"a": ObjectId(`), "", "\t"); err == nil {
+		t.Errorf("expected an error for truncated input, but got %s", buf.String())
+	}
+	if buf.Len() != 0 {
+		t.Errorf("dst should be left untouched on error, but got %s", buf.String())
+	}
+}
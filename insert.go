@@ -0,0 +1,71 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InsertOptions holds the options used by LoadAndInsert.
+type InsertOptions struct {
+	// BatchSize is the maximum number of documents sent to the server
+	// in a single InsertMany call. Defaults to 1000.
+	BatchSize int
+	// Unordered lets the server keep inserting the remaining documents
+	// of a batch after one of them failed.
+	Unordered bool
+}
+
+const defaultInsertBatchSize = 1000
+
+// An Inserter inserts batches of documents, like a *mongo.Collection.
+type Inserter interface {
+	InsertMany(ctx context.Context, docs []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+}
+
+// LoadAndInsert reads the documents stored in path, like LoadFixtures, and
+// inserts them in coll, usually a *mongo.Collection.
+//
+// Documents are streamed and sent by batches, so files don't need to fit in
+// memory. It returns the number of documents inserted.
+func LoadAndInsert(ctx context.Context, coll Inserter, path string, opts *InsertOptions) (int, error) {
+
+	batchSize := defaultInsertBatchSize
+	ordered := true
+	if opts != nil {
+		if opts.BatchSize > 0 {
+			batchSize = opts.BatchSize
+		}
+		ordered = !opts.Unordered
+	}
+
+	inserted := 0
+	batch := make([]interface{}, 0, batchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := coll.InsertMany(ctx, batch, options.InsertMany().SetOrdered(ordered))
+		if res != nil {
+			inserted += len(res.InsertedIDs)
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	err := LoadFixtures(path, func(doc interface{}) error {
+		batch = append(batch, doc)
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return inserted, err
+	}
+	return inserted, flush()
+}
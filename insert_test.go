@@ -0,0 +1,130 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeInserter records the batches of documents it is asked to insert.
+type fakeInserter struct {
+	batches [][]interface{}
+	ordered []bool
+	fail    int // number of the batch that fails, starting at 1
+}
+
+func (f *fakeInserter) InsertMany(ctx context.Context, docs []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	f.batches = append(f.batches, append([]interface{}(nil), docs...))
+	f.ordered = append(f.ordered, *options.MergeInsertManyOptions(opts...).Ordered)
+	if len(f.batches) == f.fail {
+		return &mongo.InsertManyResult{InsertedIDs: docs[:1]}, errors.New("insert failed")
+	}
+	return &mongo.InsertManyResult{InsertedIDs: docs}, nil
+}
+
+func TestLoadAndInsertBatches(t *testing.T) {
+
+	t.Parallel()
+
+	dir := writeFixtures(t, map[string]string{
+		"a.json":     `[{"_id": ObjectId("5a934e000102030405000000"), n: NumberInt(1)}, {n: 2}, {n: 3}]`,
+		"b.js":       `{n: 4} {n: NumberLong(5)}`,
+		"README.txt": `not a fixture`,
+	})
+
+	ctx := context.Background()
+	inserter := &fakeInserter{}
+	n, err := mongoextjson.LoadAndInsert(ctx, inserter, dir, &mongoextjson.InsertOptions{BatchSize: 2, Unordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 inserted documents, but got %d", n)
+	}
+	var sizes []int
+	var ns []interface{}
+	for i, batch := range inserter.batches {
+		sizes = append(sizes, len(batch))
+		for _, doc := range batch {
+			ns = append(ns, doc.(map[string]interface{})["n"])
+		}
+		if inserter.ordered[i] {
+			t.Errorf("expected batch %d to be unordered", i)
+		}
+	}
+	if want := []int{2, 2, 1}; !intsEqual(want, sizes) {
+		t.Errorf("expected batches of %v documents, but got %v", want, sizes)
+	}
+	if want := []interface{}{int32(1), 2.0, 3.0, 4.0, int64(5)}; !reflect.DeepEqual(want, ns) {
+		t.Errorf("expected documents %v, but got %v", want, ns)
+	}
+
+	// the error of the inserter stops the loading
+	inserter = &fakeInserter{fail: 1}
+	n, err = mongoextjson.LoadAndInsert(ctx, inserter, dir, &mongoextjson.InsertOptions{BatchSize: 2})
+	if err == nil || err.Error() != "insert failed" {
+		t.Errorf("expected the error of the inserter, but got %v", err)
+	}
+	if n != 1 || len(inserter.batches) != 1 || !inserter.ordered[0] {
+		t.Errorf("expected a single ordered batch with 1 inserted document, but got %d batches and %d documents", len(inserter.batches), n)
+	}
+
+	// the elements of an array must be documents
+	dir = writeFixtures(t, map[string]string{"c.json": `[{n: 1}, 2]`})
+	_, err = mongoextjson.LoadAndInsert(ctx, &fakeInserter{}, dir, nil)
+	if want := filepath.Join(dir, "c.json") + ": expected a document but got float64"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, but got %v", want, err)
+	}
+}
+
+func TestLoadAndInsert(t *testing.T) {
+
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	coll := client.Database("mongoextjson").Collection("fixtures")
+	if err := coll.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := writeFixtures(t, map[string]string{
+		"a.json":     `[{"_id": ObjectId("5a934e000102030405000000"), n: NumberInt(1)}, {n: 2}]`,
+		"b.js":       `{n: 3} {n: NumberLong(4)}`,
+		"README.txt": `not a fixture`,
+	})
+
+	n, err := mongoextjson.LoadAndInsert(ctx, coll, dir, &mongoextjson.InsertOptions{BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 inserted documents, but got %d", n)
+	}
+
+	count, err := coll.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 documents in collection, but got %d", count)
+	}
+}
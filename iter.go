@@ -0,0 +1,48 @@
+// Copyright (c) 2020 - Adrien Petel
+
+//go:build go1.23
+
+package mongoextjson
+
+import (
+	"errors"
+	"io"
+	"iter"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// All returns an iterator over the documents of the stream, so that they
+// can be read with
+//
+//	for doc, err := range dec.All() {
+//		...
+//	}
+//
+// A line that can't be decoded is yielded with a *LineError, and the
+// iteration goes on with the next line unless the loop is stopped. Any
+// other error ends the iteration.
+func (sd *StreamDecoder) All() iter.Seq2[primitive.M, error] {
+	return Values[primitive.M](sd)
+}
+
+// Values returns an iterator over the documents of the stream of sd,
+// decoded as values of type T. It behaves like StreamDecoder.All.
+func Values[T any](sd *StreamDecoder) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for {
+			var v T
+			err := sd.Decode(&v)
+			if err == io.EOF {
+				return
+			}
+			if !yield(v, err) {
+				return
+			}
+			var lineErr *LineError
+			if err != nil && !errors.As(err, &lineErr) {
+				return
+			}
+		}
+	}
+}
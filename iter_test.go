@@ -0,0 +1,70 @@
+// Copyright (c) 2020 - Adrien Petel
+
+//go:build go1.23
+
+package mongoextjson_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+func TestStreamDecoderAll(t *testing.T) {
+
+	t.Parallel()
+
+	dec := mongoextjson.NewStreamDecoder(strings.NewReader("{_id: 1}\n{_id: }\n{_id: 3}\n"))
+
+	var ids []interface{}
+	var lines []int
+	for doc, err := range dec.All() {
+		var lineErr *mongoextjson.LineError
+		if errors.As(err, &lineErr) {
+			lines = append(lines, lineErr.Line)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc["_id"])
+	}
+	if len(ids) != 2 || ids[0] != 1.0 || ids[1] != 3.0 {
+		t.Errorf("expected _id 1 and 3, but got %v", ids)
+	}
+	if len(lines) != 1 || lines[0] != 2 {
+		t.Errorf("expected an error on line 2, but got %v", lines)
+	}
+}
+
+func TestValues(t *testing.T) {
+
+	t.Parallel()
+
+	type doc struct {
+		ID int `json:"_id"`
+	}
+	dec := mongoextjson.NewStreamDecoder(strings.NewReader("{_id: 1}\n{_id: 2}\n{_id: 3}\n"))
+
+	sum := 0
+	for d, err := range mongoextjson.Values[doc](dec) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum += d.ID
+		if d.ID == 2 {
+			break
+		}
+	}
+	if sum != 3 {
+		t.Errorf("expected to stop after _id 2, but got a sum of %d", sum)
+	}
+	// the iteration can be resumed
+	for d, err := range mongoextjson.Values[doc](dec) {
+		if err != nil || d.ID != 3 {
+			t.Errorf("expected _id 3, but got %v, %v", d, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+// sku is stored as a plain string, but exposed as a function call in
+// the shell.
+type sku string
+
+func (s sku) MarshalExtJSON() ([]byte, error) {
+	return []byte(`{"$sku":"` + string(s) + `"}`), nil
+}
+
+func (s sku) MarshalShell() ([]byte, error) {
+	return []byte(`SKU("` + string(s) + `")`), nil
+}
+
+func (s *sku) UnmarshalExtJSON(data []byte) error {
+	str := string(data)
+	switch {
+	case strings.HasPrefix(str, `{"$sku":"`):
+		str = strings.TrimPrefix(str, `{"$sku":"`)
+		str = strings.TrimSuffix(str, `"}`)
+	case strings.HasPrefix(str, `SKU("`):
+		str = strings.TrimPrefix(str, `SKU("`)
+		str = strings.TrimSuffix(str, `")`)
+	default:
+		return errors.New("invalid sku " + str)
+	}
+	*s = sku(str)
+	return nil
+}
+
+// objectIDString holds an ObjectId as its hexadecimal string, and takes
+// precedence over the decoding of the $oid extension.
+type objectIDString string
+
+func (o *objectIDString) UnmarshalExtJSON(data []byte) error {
+	*o = objectIDString(data)
+	return nil
+}
+
+func TestExtJSONMarshaler(t *testing.T) {
+
+	t.Parallel()
+
+	v := struct {
+		SKU sku `json:"sku"`
+	}{SKU: "AB-12"}
+
+	b, err := mongoextjson.MarshalCanonical(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"sku":{"$sku":"AB-12"}}`; string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+
+	b, err = mongoextjson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"sku":SKU("AB-12")}`; string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+
+	for _, data := range []string{`{"sku":{"$sku":"CD-34"}}`, `{"sku":SKU("CD-34")}`} {
+		v.SKU = ""
+		if err := mongoextjson.Unmarshal([]byte(data), &v); err != nil {
+			t.Errorf("fail to unmarshal %s: %v", data, err)
+		}
+		if v.SKU != "CD-34" {
+			t.Errorf("expected sku CD-34 from %s, but got %s", data, v.SKU)
+		}
+	}
+
+	var o struct {
+		ID objectIDString `json:"_id"`
+	}
+	err = mongoextjson.Unmarshal([]byte(`{"_id":ObjectId("5a934e000102030405000000")}`), &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `ObjectId("5a934e000102030405000000")`; string(o.ID) != want {
+		t.Errorf("expected UnmarshalExtJSON to receive %s, but got %s", want, o.ID)
+	}
+}
+
+// uuid is an array type encoded as text, like the UUID of most libraries.
+type uuid [4]byte
+
+func (u uuid) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(u[:])), nil
+}
+
+func (u *uuid) UnmarshalText(text []byte) error {
+	_, err := hex.Decode(u[:], text)
+	return err
+}
+
+func TestTextMarshaler(t *testing.T) {
+
+	t.Parallel()
+
+	type doc struct {
+		ID   uuid         `json:"id"`
+		Addr netip.Addr   `json:"addr"`
+		Ptr  *netip.Addr  `json:"ptr"`
+		Keys map[uuid]int `json:"keys"`
+		Any  interface{}  `json:"any"`
+	}
+	addr := netip.MustParseAddr("10.0.0.1")
+	v := doc{
+		ID:   uuid{0x01, 0x02, 0x0a, 0xff},
+		Addr: addr,
+		Ptr:  &addr,
+		Keys: map[uuid]int{{0xab}: 1},
+		Any:  addr,
+	}
+
+	want := `{"id":"01020aff","addr":"10.0.0.1","ptr":"10.0.0.1","keys":{"ab000000":1},"any":"10.0.0.1"}`
+	b, err := mongoextjson.MarshalCanonical(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("expected %s, but got %s", want, b)
+	}
+
+	var got doc
+	err = mongoextjson.Unmarshal([]byte(`{id: '01020aff', addr: "10.0.0.1", ptr: `+"`10.0.0.1`"+`, keys: {ab000000: 1}}`), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != v.ID || got.Addr != addr || got.Ptr == nil || *got.Ptr != addr || got.Keys[uuid{0xab}] != 1 {
+		t.Errorf("unexpected decoded value: %+v", got)
+	}
+
+	err = mongoextjson.Unmarshal([]byte(`{"keys": {"not hex": 1}}`), &got)
+	if err == nil {
+		t.Error("expected an error for an invalid text key")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bytes"
+	"encoding/base64"
+	"math"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Dialect is the flavor of 'shell mode' written by an Encoder.
+type Dialect int
+
+const (
+	// DialectLegacyShell writes values like the legacy mongo shell, for
+	// example NumberLong(64) or BinData(2,"Zm9v"). This is the default.
+	DialectLegacyShell Dialect = iota
+	// DialectMongosh writes values like mongosh, for example Long('64'),
+	// Int32(32), Double(2.2) or Binary.createFromBase64('Zm9v',2), with
+	// unquoted keys and single quoted strings.
+	DialectMongosh
+)
+
+// SetDialect switches the encoder to 'shell mode' with the provided
+// dialect. As it resets the encoder extension, it has to be called
+// before Encoder.EncodeType.
+func (enc *Encoder) SetDialect(d Dialect) {
+	enc.dialect = d
+	if d == DialectMongosh {
+		enc.Extend(&jsonMongoshExt)
+		return
+	}
+	enc.Extend(&jsonExtendedExt)
+}
+
+// mongoshQuote appends to dst the compact 'shell mode' encoding src,
+// with strings quoted with single quotes and keys that are valid
+// identifiers left unquoted, the way mongosh prints documents.
+func mongoshQuote(dst *bytes.Buffer, src []byte) {
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if c != '"' {
+			dst.WriteByte(c)
+			continue
+		}
+		end := i + 1
+		for ; end < len(src) && src[end] != '"'; end++ {
+			if src[end] == '\\' {
+				end++
+			}
+		}
+		s := src[i+1 : end]
+		i = end
+
+		isKey := i+1 < len(src) && src[i+1] == ':'
+		if isKey && isIdentifier(s) {
+			dst.Write(s)
+			continue
+		}
+		dst.WriteByte('\'')
+		for j := 0; j < len(s); j++ {
+			switch s[j] {
+			case '\\':
+				if s[j+1] != '"' {
+					dst.WriteByte('\\')
+				}
+				j++
+				dst.WriteByte(s[j])
+			case '\'':
+				dst.WriteString(`\'`)
+			default:
+				dst.WriteByte(s[j])
+			}
+		}
+		dst.WriteByte('\'')
+	}
+}
+
+// isIdentifier returns whether s can be written as an unquoted key
+// by mongosh.
+func isIdentifier(s []byte) bool {
+	if len(s) == 0 || '0' <= s[0] && s[0] <= '9' {
+		return false
+	}
+	for _, c := range s {
+		if c != '_' && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func jencMongoshNumberLong(v interface{}) ([]byte, error) {
+	return wrapInt(`Long("`, v.(int64), `")`), nil
+}
+
+func jencMongoshInt(v interface{}) ([]byte, error) {
+	n := v.(int)
+	if int64(n) <= 1<<53 {
+		return strconv.AppendInt(nil, int64(n), 10), nil
+	}
+	return jencMongoshNumberLong(int64(n))
+}
+
+func jencMongoshNumberInt(v interface{}) ([]byte, error) {
+	return wrapInt("Int32(", int64(v.(int32)), ")"), nil
+}
+
+func jencMongoshDouble(v interface{}) ([]byte, error) {
+	f, bits, err := floatValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return EncodeSpecialFloatLiteral(v)
+	}
+	b := append([]byte("Double("), strconv.FormatFloat(f, 'g', -1, bits)...)
+	return append(b, ')'), nil
+}
+
+func jencMongoshNumberDecimal(v interface{}) ([]byte, error) {
+	n := v.(primitive.Decimal128)
+	return fbytes(`Decimal128("%s")`, n.String()), nil
+}
+
+func jencMongoshBinarySlice(v interface{}) ([]byte, error) {
+	return appendMongoshBinary(nil, 0, v.([]byte)), nil
+}
+
+func jencMongoshBinaryType(v interface{}) ([]byte, error) {
+	b := v.(primitive.Binary)
+	return appendMongoshBinary(nil, b.Subtype, b.Data), nil
+}
+
+func appendMongoshBinary(dst []byte, subtype byte, data []byte) []byte {
+	dst = append(dst, `Binary.createFromBase64("`...)
+	n := len(dst)
+	dst = append(dst, make([]byte, base64.StdEncoding.EncodedLen(len(data)))...)
+	base64.StdEncoding.Encode(dst[n:], data)
+	dst = append(dst, `",`...)
+	dst = strconv.AppendUint(dst, uint64(subtype), 10)
+	return append(dst, ')')
+}
+
+func jencMongoshTimestamp(v interface{}) ([]byte, error) {
+	ts := v.(primitive.Timestamp)
+	return fbytes(`Timestamp({"t":%d,"i":%d})`, ts.T, ts.I), nil
+}
+
+func jencMongoshMinKey(v interface{}) ([]byte, error) {
+	return []byte(`MinKey()`), nil
+}
+
+func jencMongoshMaxKey(v interface{}) ([]byte, error) {
+	return []byte(`MaxKey()`), nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMongoshDialect(t *testing.T) {
+
+	t.Parallel()
+
+	doc := struct {
+		ID        primitive.ObjectID   `json:"_id"`
+		Binary    primitive.Binary     `json:"binary"`
+		Date      time.Time            `json:"date"`
+		Decimal   primitive.Decimal128 `json:"decimal128"`
+		Double    float64              `json:"double"`
+		Int32     int32                `json:"int32"`
+		Int64     int64                `json:"int64"`
+		String    string               `json:"string"`
+		Timestamp primitive.Timestamp  `json:"timestamp"`
+		Dashed    string               `json:"a-b"`
+		Regex     primitive.Regex      `json:"regex"`
+		MinKey    primitive.MinKey     `json:"minKey"`
+		MaxKey    primitive.MaxKey     `json:"maxKey"`
+	}{
+		ID:        objectID,
+		Binary:    primitive.Binary{Subtype: 2, Data: []byte("foo")},
+		Date:      time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC),
+		Decimal:   primitive.NewDecimal128(1, 1),
+		Double:    2.2,
+		Int32:     32,
+		Int64:     64,
+		String:    `it's a "string"`,
+		Timestamp: primitive.Timestamp{T: 2334, I: 33},
+		Dashed:    "dashed",
+		Regex:     primitive.Regex{Pattern: "^a", Options: "i"},
+	}
+	want := `{_id:ObjectId('5a934e000102030405000000'),` +
+		`binary:Binary.createFromBase64('Zm9v',2),` +
+		`date:ISODate('2016-05-15T01:02:03.004Z'),` +
+		`decimal128:Decimal128('1.8446744073709551617E-6157'),` +
+		`double:Double(2.2),` +
+		`int32:Int32(32),` +
+		`int64:Long('64'),` +
+		`string:'it\'s a "string"',` +
+		`timestamp:Timestamp({t:2334,i:33}),` +
+		`'a-b':'dashed',` +
+		`regex:{'$regularExpression':{pattern:'^a',options:'i'}},` +
+		`minKey:MinKey(),` +
+		`maxKey:MaxKey()}`
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.SetDialect(mongoextjson.DialectMongosh)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); want != got {
+		t.Errorf("expected \n%s\n but got \n%s", want, got)
+	}
+
+	// mongosh output can be decoded back
+	decoded := doc
+	decoded.Date = time.Time{}
+	if err := mongoextjson.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", doc) != fmt.Sprintf("%v", decoded) {
+		t.Errorf("round trip failed: expected %v but got %v", doc, decoded)
+	}
+
+	buf.Reset()
+	enc.SetDialect(mongoextjson.DialectLegacyShell)
+	if err := enc.Encode(primitive.Timestamp{T: 1, I: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "Timestamp(1,2)" {
+		t.Errorf("expected legacy shell output, but got %s", got)
+	}
+}
+
+func TestUnmarshalMongosh(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		data string
+		want interface{}
+	}{
+		{data: `{n:Long('64')}`, want: int64(64)},
+		{data: `{n:Long("64")}`, want: int64(64)},
+		{data: `{n:Int32(32)}`, want: int32(32)},
+		{data: `{n:Double(2.2)}`, want: 2.2},
+		{data: `{n:Double('2.2')}`, want: 2.2},
+		{data: `{n:Decimal128('1.5')}`, want: primitive.NewDecimal128(0x303e000000000000, 15)},
+		{data: `{n:Binary.createFromBase64('Zm9v',2)}`, want: primitive.Binary{Subtype: 2, Data: []byte("foo")}},
+		{data: `{n:Binary.createFromBase64('Zm9v')}`, want: []byte("foo")},
+		{data: `{n:Timestamp({ t: 2334, i: 33 })}`, want: primitive.Timestamp{T: 2334, I: 33}},
+		{data: `{n:ObjectId('5a934e000102030405000000')}`, want: objectID},
+		{data: `{'n':'it\'s "quoted"'}`, want: `it's "quoted"`},
+		{data: `{n:MinKey()}`, want: primitive.MinKey{}},
+		{data: `{n:MaxKey( )}`, want: primitive.MaxKey{}},
+	}
+
+	for _, tt := range tests {
+		var v map[string]interface{}
+		if err := mongoextjson.Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Errorf("fail to unmarshal %s: %v", tt.data, err)
+			continue
+		}
+		if fmt.Sprintf("%#v", tt.want) != fmt.Sprintf("%#v", v["n"]) {
+			t.Errorf("%s: expected %#v, but got %#v", tt.data, tt.want, v["n"])
+		}
+	}
+}
+
+func TestUnmarshalMongoshInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []string{
+		// dots are only allowed in function names
+		`{a.b: 1}`,
+		`{n: Binary.createFromBase64}`,
+		`{n: MinKey(1)}`,
+	}
+
+	for _, data := range tests {
+		var v map[string]interface{}
+		if err := mongoextjson.Unmarshal([]byte(data), &v); err == nil {
+			t.Errorf("%s: expected an error, but got %v", data, v)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A StreamDecoder reads documents written one per line, like the files of
+// mongoexport or any newline delimited JSON stream. Blank lines are
+// ignored. Streams compressed with gzip, like .json.gz files, are
+// detected and decompressed as they are read.
+type StreamDecoder struct {
+	r       *bufio.Reader
+	dec     *Decoder
+	line    int
+	err     error
+	started bool
+}
+
+// NewStreamDecoder returns a StreamDecoder that reads from r and decodes
+// the documents like Unmarshal.
+func NewStreamDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{
+		r:   bufio.NewReader(r),
+		dec: NewExtendedDecoder(nil),
+	}
+}
+
+// Decoder returns the Decoder used for each line, so that its options,
+// like UseNumber or DisallowDuplicateKeys, can be set.
+func (sd *StreamDecoder) Decoder() *Decoder { return sd.dec }
+
+// Line returns the number of the line of the last decoded document,
+// starting at 1.
+func (sd *StreamDecoder) Line() int { return sd.line }
+
+// A LineError describes a line of a stream that could not be decoded.
+// The stream is still usable: the next call to Decode reads the next
+// line, so that bad lines can be skipped.
+type LineError struct {
+	Line int   // number of the line, starting at 1
+	Err  error // error of the decoding of the line
+}
+
+func (e *LineError) Error() string {
+	if positioned(e.Err, e.Line) {
+		return e.Err.Error()
+	}
+	return "json: line " + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+func (e *LineError) Unwrap() error { return e.Err }
+
+// positioned sets the line of err, positioned in a single line input, to
+// line, and reports whether err has a position.
+func positioned(err error, line int) bool {
+	var pos *int
+	switch e := err.(type) {
+	case *SyntaxError:
+		pos = &e.Line
+	case *UnmarshalTypeError:
+		pos = &e.Line
+	case *ExtensionError:
+		pos = &e.Line
+	case *DuplicateKeyError:
+		pos = &e.Line
+	}
+	if pos == nil || *pos == 0 {
+		return false
+	}
+	*pos = line
+	return true
+}
+
+var errTrailingData = errors.New("invalid data after the document")
+
+// Decode reads the next document of the stream and stores it in the
+// value pointed to by v. It returns io.EOF at the end of the stream, and
+// a *LineError if the line can't be decoded.
+func (sd *StreamDecoder) Decode(v interface{}) error {
+	line, err := sd.readLine()
+	if err != nil {
+		return err
+	}
+	if err := decodeLine(sd.dec, line, v); err != nil {
+		return &LineError{Line: sd.line, Err: err}
+	}
+	return nil
+}
+
+// readLine returns the next line of the stream that is not blank,
+// without its line feed, or the error of the stream, like io.EOF, once
+// every line is read.
+func (sd *StreamDecoder) readLine() ([]byte, error) {
+	if !sd.started {
+		sd.started = true
+		sd.detectGzip()
+	}
+	for sd.err == nil {
+		line, err := sd.r.ReadBytes('\n')
+		if err != nil {
+			// keep the error for the next call, once the last
+			// line is decoded
+			sd.err = err
+		}
+		if len(line) == 0 {
+			break
+		}
+		sd.line++
+		line = bytes.TrimRight(line, "\r\n")
+		if nonSpace(line) {
+			return line, nil
+		}
+	}
+	return nil, sd.err
+}
+
+// decodeLine decodes with dec the document held by line into v.
+func decodeLine(dec *Decoder, line []byte, v interface{}) error {
+	dec.Reset(bytes.NewReader(line))
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errTrailingData
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// DecodeParallel reads the documents of r, written one per line like with
+// a StreamDecoder, decodes them like Unmarshal with a pool of workers
+// goroutines, and calls fn with each of them. fn is called concurrently
+// and in no particular order. If workers is less than 1, the number of
+// workers is runtime.GOMAXPROCS(0).
+//
+// When a line can't be decoded, or when fn returns an error for the
+// document of a line, no more lines are read and, once the lines being
+// decoded are done, the error of the first failing line of the input is
+// returned as a *LineError.
+func DecodeParallel(r io.Reader, workers int, fn func(bson.M) error) error {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	type job struct {
+		line int
+		data []byte
+	}
+
+	var mu sync.Mutex
+	var failed *LineError
+	// failedBefore reports whether a line before line, or line itself,
+	// failed, so that the later lines can be skipped
+	failedBefore := func(line int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed != nil && failed.Line <= line
+	}
+
+	jobs := make(chan job, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dec := NewExtendedDecoder(nil)
+			for j := range jobs {
+				if failedBefore(j.line) {
+					continue
+				}
+				var doc bson.M
+				err := decodeLine(dec, j.data, &doc)
+				if err == nil {
+					err = fn(doc)
+				}
+				if err != nil {
+					mu.Lock()
+					if failed == nil || j.line < failed.Line {
+						failed = &LineError{Line: j.line, Err: err}
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	sd := NewStreamDecoder(r)
+	var err error
+	for {
+		var line []byte
+		line, err = sd.readLine()
+		if err != nil || failedBefore(sd.line) {
+			break
+		}
+		jobs <- job{line: sd.line, data: line}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failed != nil {
+		return failed
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// detectGzip makes the decoder decompress the stream if it starts like a
+// gzip stream.
+func (sd *StreamDecoder) detectGzip() {
+	b, _ := sd.r.Peek(len(gzipMagic))
+	if !bytes.Equal(b, gzipMagic) {
+		return
+	}
+	zr, err := gzip.NewReader(sd.r)
+	if err != nil {
+		sd.err = err
+		return
+	}
+	sd.r = bufio.NewReader(zr)
+}
+
+// A StreamEncoder writes documents one per line, like mongoexport.
+type StreamEncoder struct {
+	w   io.Writer
+	enc *Encoder
+	zw  *gzip.Writer
+}
+
+// NewStreamEncoder returns a StreamEncoder that writes to w the documents
+// in 'canonical mode' of the extended JSON v2, like MarshalCanonicalV2.
+func NewStreamEncoder(w io.Writer) *StreamEncoder {
+	return &StreamEncoder{w: w, enc: NewCanonicalV2Encoder(w)}
+}
+
+// NewMongoexportEncoder returns a StreamEncoder that writes to w the
+// documents exactly like mongoexport with --jsonFormat=canonical, so that
+// the output can be imported with mongoimport: one document in 'canonical
+// mode' of the extended JSON v2 per line, with the "_id" key first, dates
+// as UTC milliseconds and no HTML escaping.
+func NewMongoexportEncoder(w io.Writer) *StreamEncoder {
+	se := NewStreamEncoder(w)
+	se.enc.WriteIDFirst(true)
+	se.enc.DisableHTMLEscaping()
+	return se
+}
+
+// Encoder returns the Encoder used for each document, so that its
+// options, like SetDialect or SetFieldNameMapper, can be set.
+func (se *StreamEncoder) Encoder() *Encoder { return se.enc }
+
+// SetGzip makes the encoder compress the stream with gzip, at a level
+// like gzip.DefaultCompression. It must be called before the first call
+// to Encode, and Close must be called to flush the compressed stream.
+func (se *StreamEncoder) SetGzip(level int) error {
+	zw, err := gzip.NewWriterLevel(se.w, level)
+	if err != nil {
+		return err
+	}
+	se.zw = zw
+	se.w = zw
+	se.enc.Reset(zw)
+	return nil
+}
+
+// Close flushes the compressed stream if SetGzip was called. It does not
+// close the underlying writer.
+func (se *StreamEncoder) Close() error {
+	if se.zw == nil {
+		return nil
+	}
+	return se.zw.Close()
+}
+
+// Encode writes the encoding of v to the stream, followed by a newline.
+// A document that can't be encoded is not written, so that it can be
+// skipped, unless its encoding fails after part of it was written, which
+// may only happen for documents larger than 32KB: the error is then a
+// *PartialWriteError, and the stream can't be written anymore.
+func (se *StreamEncoder) Encode(v interface{}) error {
+	if err := se.enc.Encode(v); err != nil {
+		return err
+	}
+	if _, err := se.w.Write(lineFeed); err != nil {
+		se.enc.err = err
+		return err
+	}
+	return nil
+}
+
+var lineFeed = []byte{'\n'}
@@ -0,0 +1,320 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStreamDecoder(t *testing.T) {
+
+	t.Parallel()
+
+	input := `{"_id": {"$oid": "5a934e000102030405000000"}, "n": 1}
+{"_id": 2, "n": }
+
+{"_id": 3, "n": 3} {"_id": 4}
+{"_id": 5, "n": {"$numberLong": "5"}}`
+
+	dec := mongoextjson.NewStreamDecoder(strings.NewReader(input))
+
+	var docs []bson.M
+	var lines []int
+	var errs []string
+	for {
+		var doc bson.M
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		var lineErr *mongoextjson.LineError
+		if errors.As(err, &lineErr) {
+			// skip the bad line
+			lines = append(lines, lineErr.Line)
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	if len(docs) != 2 || docs[0]["_id"] != objectID || docs[1]["n"] != int64(5) {
+		t.Errorf("unexpected documents %v", docs)
+	}
+	if want, got := []int{2, 4}, lines; !intsEqual(want, got) {
+		t.Errorf("expected errors on lines %v, but got %v", want, got)
+	}
+	wantErrs := []string{
+		"invalid character '}' looking for beginning of value at line 2, column 17",
+		"json: line 4: invalid data after the document",
+	}
+	for i := range wantErrs {
+		if i >= len(errs) || errs[i] != wantErrs[i] {
+			t.Errorf("expected errors %q, but got %q", wantErrs, errs)
+			break
+		}
+	}
+	if want, got := 5, dec.Line(); want != got {
+		t.Errorf("expected last line %d, but got %d", want, got)
+	}
+}
+
+func TestDecodeParallel(t *testing.T) {
+
+	t.Parallel()
+
+	var input strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&input, "{\"_id\": %d, \"n\": NumberLong(%d)}\n", i, i)
+		if i%10 == 0 {
+			input.WriteString("\n")
+		}
+	}
+
+	var mu sync.Mutex
+	sum := int64(0)
+	err := mongoextjson.DecodeParallel(strings.NewReader(input.String()), 4, func(doc bson.M) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sum += doc["n"].(int64)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(5050); sum != want {
+		t.Errorf("expected a sum of %d, but got %d", want, sum)
+	}
+
+	errTooBig := errors.New("too big")
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+		line    int
+	}{
+		{
+			name:    "invalid lines",
+			input:   "{\"n\": 1}\n\n{\"n\": }\n{\"n\": 2}\n{\"n\": 3} {}\n",
+			wantErr: "invalid character '}' looking for beginning of value at line 3, column 7",
+			line:    3,
+		},
+		{
+			name:    "error of fn",
+			input:   "{\"n\": 1}\n{\"n\": 20}\n{\"n\": 2}\n{\"n\": 30}\n",
+			wantErr: "json: line 2: too big",
+			line:    2,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, workers := range []int{0, 1, 3} {
+			err := mongoextjson.DecodeParallel(strings.NewReader(tt.input), workers, func(doc bson.M) error {
+				if doc["n"].(float64) > 10 {
+					return errTooBig
+				}
+				return nil
+			})
+			var lineErr *mongoextjson.LineError
+			if !errors.As(err, &lineErr) {
+				t.Fatalf("%s: expected a *LineError, but got %v", tt.name, err)
+			}
+			if lineErr.Line != tt.line || err.Error() != tt.wantErr {
+				t.Errorf("%s: expected error %q on line %d, but got %q on line %d", tt.name, tt.wantErr, tt.line, err, lineErr.Line)
+			}
+		}
+	}
+}
+
+func intsEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStreamEncoder(t *testing.T) {
+
+	t.Parallel()
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewStreamEncoder(&buf)
+	for _, doc := range []bson.D{
+		{{Key: "_id", Value: objectID}, {Key: "n", Value: int32(1)}},
+		{{Key: "_id", Value: 2}},
+	} {
+		if err := enc.Encode(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `{"_id":{"$oid":"5a934e000102030405000000"},"n":{"$numberInt":"1"}}
+{"_id":{"$numberInt":"2"}}
+`
+	if got := buf.String(); want != got {
+		t.Errorf("expected\n%s\nbut got\n%s", want, got)
+	}
+
+	// the output can be read back line by line
+	dec := mongoextjson.NewStreamDecoder(&buf)
+	n := 0
+	for {
+		var doc bson.M
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("expected 2 documents, but got %d", n)
+	}
+}
+
+func TestStreamEncoderFailingDocument(t *testing.T) {
+
+	t.Parallel()
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewStreamEncoder(&buf)
+
+	// a small document is not written when its encoding fails
+	if err := enc.Encode(bson.M{"a": make(chan int)}); err == nil {
+		t.Fatal("expected an error for an unsupported type")
+	}
+	if err := enc.Encode(bson.M{"n": int32(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "{\"n\":{\"$numberInt\":\"1\"}}\n", buf.String(); want != got {
+		t.Errorf("expected %q, but got %q", want, got)
+	}
+
+	// a large document is written as it is encoded, so it can't be
+	// skipped once its encoding fails at its end
+	large := bson.A{}
+	for i := 0; i < 1000; i++ {
+		large = append(large, strings.Repeat("x", 100))
+	}
+	large = append(large, make(chan int))
+	err := enc.Encode(bson.D{{Key: "a", Value: large}})
+	var partialErr *mongoextjson.PartialWriteError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("expected a *PartialWriteError, but got %v", err)
+	}
+	var typeErr *mongoextjson.UnsupportedTypeError
+	if !errors.As(err, &typeErr) {
+		t.Errorf("expected the error to wrap an *UnsupportedTypeError, but got %v", err)
+	}
+	n := buf.Len()
+	if err := enc.Encode(bson.M{"b": int32(2)}); !errors.As(err, &partialErr) {
+		t.Errorf("expected the error to be returned again, but got %v", err)
+	}
+	if buf.Len() != n {
+		t.Errorf("expected nothing to be written after the partial document")
+	}
+}
+
+func TestMongoexportEncoder(t *testing.T) {
+
+	t.Parallel()
+
+	date := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.FixedZone("", 3600))
+	type doc struct {
+		Name string             `json:"name"`
+		ID   primitive.ObjectID `json:"_id"`
+	}
+	docs := []interface{}{
+		doc{Name: "<a&b>", ID: objectID},
+		map[string]interface{}{"a": 1.0, "_id": int64(2), "z": date},
+		bson.D{{Key: "n", Value: bson.D{{Key: "x", Value: 1}, {Key: "_id", Value: 1}}}, {Key: "_id", Value: 3}},
+	}
+	// documents as returned by the server
+	exported := []bson.D{
+		{{Key: "_id", Value: objectID}, {Key: "name", Value: "<a&b>"}},
+		{{Key: "_id", Value: int64(2)}, {Key: "a", Value: 1.0}, {Key: "z", Value: date}},
+		{{Key: "_id", Value: 3}, {Key: "n", Value: bson.D{{Key: "x", Value: 1}, {Key: "_id", Value: 1}}}},
+	}
+
+	var buf, want bytes.Buffer
+	enc := mongoextjson.NewMongoexportEncoder(&buf)
+	for i := range docs {
+		if err := enc.Encode(docs[i]); err != nil {
+			t.Fatal(err)
+		}
+		// what mongoexport writes
+		b, err := bson.MarshalExtJSON(exported[i], true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.Write(b)
+		want.WriteByte('\n')
+	}
+	if want, got := want.String(), buf.String(); want != got {
+		t.Errorf("expected\n%s\nbut got\n%s", want, got)
+	}
+}
+
+func TestStreamGzip(t *testing.T) {
+
+	t.Parallel()
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewStreamEncoder(&buf)
+	if err := enc.SetGzip(gzip.BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := enc.Encode(bson.M{"_id": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b := buf.Bytes(); len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		t.Fatalf("expected a gzip stream, but got %q", b)
+	}
+
+	// the compression is detected
+	dec := mongoextjson.NewStreamDecoder(&buf)
+	for i := 0; ; i++ {
+		var doc struct {
+			ID int `json:"_id"`
+		}
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			if i != 3 {
+				t.Errorf("expected 3 documents, but got %d", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.ID != i {
+			t.Errorf("expected _id %d, but got %d", i, doc.ID)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A StageError describes a stage of an aggregation pipeline that could
+// not be decoded by UnmarshalPipeline.
+type StageError struct {
+	Stage    int    // number of the stage, starting at 1
+	Operator string // operator of the stage, like "$group", if known
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	msg := "stage " + strconv.Itoa(e.Stage)
+	if e.Operator != "" {
+		msg += " (" + e.Operator + ")"
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error { return e.Err }
+
+var (
+	errPipelineArray = errors.New("a pipeline must be an array of stages")
+	errStageDocument = errors.New("a stage must be a document")
+	errStageOperator = errors.New("a stage must hold a single operator, like {$match: {...}}")
+)
+
+// UnmarshalPipeline decodes an aggregation pipeline, an array of stages
+// in any syntax supported by Unmarshal. The stages are decoded as bson.D
+// values, so the order of the keys of the operators, like in $sort or
+// $project, is kept.
+//
+// The errors about a stage are returned as a *StageError, like
+//
+//	stage 3 ($group): invalid character '}' looking for beginning of value at line 5, column 12
+func UnmarshalPipeline(data []byte) (mongo.Pipeline, error) {
+	dec := NewExtendedDecoder(bytes.NewReader(data))
+	dec.UseOrderedDocuments()
+
+	tok, err := dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if tok != Delim('[') {
+		return nil, errPipelineArray
+	}
+
+	pipeline := mongo.Pipeline{}
+	for dec.More() {
+		start := dec.InputOffset()
+		var stage interface{}
+		err := dec.Decode(&stage)
+		if err == nil {
+			err = checkStage(stage)
+		}
+		if err != nil {
+			return nil, &StageError{
+				Stage:    len(pipeline) + 1,
+				Operator: stageOperator(data[start:]),
+				Err:      err,
+			}
+		}
+		pipeline = append(pipeline, stage.(primitive.D))
+	}
+
+	if _, err := dec.Token(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errTrailingData
+	}
+	return pipeline, nil
+}
+
+// checkStage returns an error if stage is not a document with a single
+// operator.
+func checkStage(stage interface{}) error {
+	doc, ok := stage.(primitive.D)
+	if !ok {
+		return errStageDocument
+	}
+	if len(doc) != 1 || len(doc[0].Key) == 0 || doc[0].Key[0] != '$' {
+		return errStageOperator
+	}
+	return nil
+}
+
+// stageOperator returns the first key of the document at the start of
+// data, if it starts with a '$', so that it can be reported even if the
+// stage can't be decoded.
+func stageOperator(data []byte) string {
+	data = bytes.TrimLeft(data, " \t\r\n,")
+	if len(data) == 0 || data[0] != '{' {
+		return ""
+	}
+	data = bytes.TrimLeft(data[1:], " \t\r\n")
+	if len(data) > 0 && (data[0] == '"' || data[0] == '\'') {
+		end := bytes.IndexByte(data[1:], data[0])
+		if end < 0 {
+			return ""
+		}
+		data = data[1 : end+1]
+	} else {
+		end := bytes.IndexAny(data, " \t\r\n:")
+		if end < 0 {
+			return ""
+		}
+		data = data[:end]
+	}
+	if len(data) == 0 || data[0] != '$' {
+		return ""
+	}
+	return string(data)
+}
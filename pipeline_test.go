@@ -0,0 +1,88 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestUnmarshalPipeline(t *testing.T) {
+
+	t.Parallel()
+
+	data := `[
+	{$match: {_id: ObjectId("5a934e000102030405000000")}},
+	{"$group": {"_id": "$k", "n": {"$sum": 1}}},
+	{$sort: {n: -1, _id: 1}}
+]`
+	pipeline, err := mongoextjson.UnmarshalPipeline([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: objectID}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$k"}, {Key: "n", Value: bson.D{{Key: "$sum", Value: 1.0}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "n", Value: -1.0}, {Key: "_id", Value: 1.0}}}},
+	}
+	if !reflect.DeepEqual(want, pipeline) {
+		t.Errorf("expected %v, but got %v", want, pipeline)
+	}
+
+	pipeline, err = mongoextjson.UnmarshalPipeline([]byte(`[]`))
+	if err != nil || pipeline == nil || len(pipeline) != 0 {
+		t.Errorf("expected an empty pipeline, but got %v, %v", pipeline, err)
+	}
+}
+
+func TestUnmarshalPipelineErrors(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		data  string
+		err   string
+		stage int
+	}{
+		{
+			data:  "[\n  {$match: {}},\n  {$limit: 1},\n  {'$group': {_id: \"$k\", n: {$sum: }}}\n]",
+			err:   "stage 3 ($group): invalid character '}' looking for beginning of value at line 4, column 36",
+			stage: 3,
+		},
+		{
+			data:  `[{$match: {}}, {$limit: 1, $skip: 2}]`,
+			err:   "stage 2 ($limit): a stage must hold a single operator, like {$match: {...}}",
+			stage: 2,
+		},
+		{
+			data:  `[{$match: {}}, "$limit"]`,
+			err:   "stage 2: a stage must be a document",
+			stage: 2,
+		},
+		{
+			data: `{$match: {}}`,
+			err:  "a pipeline must be an array of stages",
+		},
+		{
+			data: `[{$match: {}}`,
+			err:  "unexpected EOF",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := mongoextjson.UnmarshalPipeline([]byte(tt.data))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: expected error %q, but got %v", tt.data, tt.err, err)
+			continue
+		}
+		var stageErr *mongoextjson.StageError
+		if errors.As(err, &stageErr) != (tt.stage > 0) || tt.stage > 0 && stageErr.Stage != tt.stage {
+			t.Errorf("%s: expected an error for stage %d, but got %#v", tt.data, tt.stage, err)
+		}
+	}
+}
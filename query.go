@@ -0,0 +1,258 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A ShellQuery is a query statement of the mongo shell, like
+//
+//	db.orders.find({status: "A"}, {_id: 0}).sort({x: 1}).limit(5)
+type ShellQuery struct {
+	// Collection is the name of the queried collection, given as
+	// db.name, db["name"] or db.getCollection("name").
+	Collection string
+	// Method is "find" or "findOne".
+	Method string
+	// Filter is the first argument of the method, nil if there is none.
+	Filter primitive.D
+	// Projection is the second argument of the method, nil if there is
+	// none.
+	Projection primitive.D
+	// Modifiers are the methods chained to the query, like sort or
+	// limit, in order.
+	Modifiers []QueryModifier
+}
+
+// A QueryModifier is a method chained to a query, like sort({x: 1}).
+type QueryModifier struct {
+	Name string
+	// Args are decoded like with Decoder.UseOrderedDocuments, so
+	// documents are primitive.D values and numbers are float64 values.
+	Args []interface{}
+}
+
+// ParseShellQuery parses a find or findOne statement of the mongo shell,
+// like db.orders.find({status: "A"}).sort({x: 1}).limit(5), optionally
+// terminated by a semicolon. The arguments may use any syntax supported
+// by Unmarshal.
+func ParseShellQuery(query string) (*ShellQuery, error) {
+	p := queryParser{data: []byte(query)}
+	q, err := p.parse()
+	if err != nil {
+		pos := Decoder{buf: p.data}
+		pos.setPosition(err)
+		return nil, err
+	}
+	return q, nil
+}
+
+type queryParser struct {
+	data []byte
+	off  int
+}
+
+func (p *queryParser) parse() (*ShellQuery, error) {
+	p.skipSpace()
+	if start := p.off; p.ident() != "db" {
+		p.off = start
+		return nil, p.error("expected db")
+	}
+	q := &ShellQuery{}
+	if err := p.collection(q); err != nil {
+		return nil, err
+	}
+
+	start := p.off
+	q.Method = p.ident()
+	if q.Method != "find" && q.Method != "findOne" {
+		p.off = start
+		return nil, p.error("expected find or findOne")
+	}
+	args, err := p.args()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 2 {
+		p.off = start
+		return nil, p.error(q.Method + " takes at most 2 arguments")
+	}
+	for i, arg := range args {
+		doc, ok := arg.(primitive.D)
+		if !ok && arg != nil {
+			p.off = start
+			return nil, p.error("argument " + strconv.Itoa(i+1) + " of " + q.Method + " must be a document")
+		}
+		if i == 0 {
+			q.Filter = doc
+		} else {
+			q.Projection = doc
+		}
+	}
+
+	for {
+		p.skipSpace()
+		if !p.consume('.') {
+			break
+		}
+		p.skipSpace()
+		m := QueryModifier{Name: p.ident()}
+		if m.Name == "" {
+			return nil, p.error("expected a method name")
+		}
+		if m.Args, err = p.args(); err != nil {
+			return nil, err
+		}
+		q.Modifiers = append(q.Modifiers, m)
+	}
+
+	p.consume(';')
+	p.skipSpace()
+	if p.off < len(p.data) {
+		return nil, p.error("unexpected " + strconv.QuoteRune(rune(p.data[p.off])))
+	}
+	return q, nil
+}
+
+// error returns a SyntaxError about the byte at the current offset.
+func (p *queryParser) error(msg string) error {
+	return &SyntaxError{msg: "invalid shell query: " + msg, Offset: int64(p.off) + 1}
+}
+
+func (p *queryParser) skipSpace() {
+	for p.off < len(p.data) && isSpace(p.data[p.off]) {
+		p.off++
+	}
+}
+
+func (p *queryParser) consume(c byte) bool {
+	if p.off < len(p.data) && p.data[p.off] == c {
+		p.off++
+		return true
+	}
+	return false
+}
+
+// ident reads a JavaScript identifier.
+func (p *queryParser) ident() string {
+	start := p.off
+	for p.off < len(p.data) {
+		c := p.data[p.off]
+		if c != '_' && c != '$' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !(p.off > start && '0' <= c && c <= '9') {
+			break
+		}
+		p.off++
+	}
+	return string(p.data[start:p.off])
+}
+
+// collection reads the collection part of a query, right after db, up to
+// the dot before the method. As collection names may hold dots, like
+// db.system.users.find(), the method is the last name before a '('.
+func (p *queryParser) collection(q *ShellQuery) error {
+	p.skipSpace()
+	switch {
+	case p.consume('['):
+		name, err := p.stringArg(']')
+		if err != nil {
+			return err
+		}
+		q.Collection = name
+	case p.consume('.'):
+		start := p.off
+		if p.ident() == "getCollection" {
+			p.skipSpace()
+			if p.consume('(') {
+				name, err := p.stringArg(')')
+				if err != nil {
+					return err
+				}
+				q.Collection = name
+				break
+			}
+		}
+		p.off = start
+		end := bytes.IndexByte(p.data[start:], '(')
+		if end < 0 {
+			return p.error("expected a collection name")
+		}
+		dot := bytes.LastIndexByte(p.data[start:start+end], '.')
+		if dot <= 0 {
+			return p.error("expected a collection name")
+		}
+		q.Collection = string(bytes.TrimSpace(p.data[start : start+dot]))
+		p.off = start + dot
+	default:
+		return p.error("expected a collection")
+	}
+	p.skipSpace()
+	if !p.consume('.') {
+		return p.error("expected '.'")
+	}
+	p.skipSpace()
+	return nil
+}
+
+// stringArg reads a string followed by end.
+func (p *queryParser) stringArg(end byte) (string, error) {
+	start := p.off
+	v, err := p.value()
+	if err != nil {
+		return "", err
+	}
+	name, ok := v.(string)
+	p.skipSpace()
+	if !ok || !p.consume(end) {
+		p.off = start
+		return "", p.error("expected a collection name")
+	}
+	return name, nil
+}
+
+// args reads the arguments of a method call, parentheses included.
+func (p *queryParser) args() ([]interface{}, error) {
+	p.skipSpace()
+	if !p.consume('(') {
+		return nil, p.error("expected '('")
+	}
+	var args []interface{}
+	p.skipSpace()
+	if p.consume(')') {
+		return args, nil
+	}
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+		p.skipSpace()
+		if p.consume(')') {
+			return args, nil
+		}
+		if !p.consume(',') {
+			return nil, p.error("expected ',' or ')'")
+		}
+	}
+}
+
+// value reads and decodes the value at the current offset.
+func (p *queryParser) value() (interface{}, error) {
+	dec := NewExtendedDecoder(bytes.NewReader(p.data[p.off:]))
+	dec.UseOrderedDocuments()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		shiftOffset(err, int64(p.off))
+		return nil, err
+	}
+	p.off += int(dec.InputOffset())
+	return v, nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseShellQuery(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		query string
+		want  mongoextjson.ShellQuery
+	}{
+		{
+			query: `db.orders.find({status: "A", _id: ObjectId("5a934e000102030405000000")}, {_id: 0}).sort({x: 1, y: -1}).limit(5);`,
+			want: mongoextjson.ShellQuery{
+				Collection: "orders",
+				Method:     "find",
+				Filter:     bson.D{{Key: "status", Value: "A"}, {Key: "_id", Value: objectID}},
+				Projection: bson.D{{Key: "_id", Value: 0.0}},
+				Modifiers: []mongoextjson.QueryModifier{
+					{Name: "sort", Args: []interface{}{bson.D{{Key: "x", Value: 1.0}, {Key: "y", Value: -1.0}}}},
+					{Name: "limit", Args: []interface{}{5.0}},
+				},
+			},
+		},
+		{
+			query: ` db.system.users.findOne() `,
+			want: mongoextjson.ShellQuery{
+				Collection: "system.users",
+				Method:     "findOne",
+			},
+		},
+		{
+			query: `db.getCollection("my-coll").find({}).skip(10).pretty()`,
+			want: mongoextjson.ShellQuery{
+				Collection: "my-coll",
+				Method:     "find",
+				Filter:     bson.D{},
+				Modifiers: []mongoextjson.QueryModifier{
+					{Name: "skip", Args: []interface{}{10.0}},
+					{Name: "pretty"},
+				},
+			},
+		},
+		{
+			query: "db['orders']\n\t.find({n: NumberLong(2)})\n\t.hint('n_1')",
+			want: mongoextjson.ShellQuery{
+				Collection: "orders",
+				Method:     "find",
+				Filter:     bson.D{{Key: "n", Value: int64(2)}},
+				Modifiers: []mongoextjson.QueryModifier{
+					{Name: "hint", Args: []interface{}{"n_1"}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		q, err := mongoextjson.ParseShellQuery(tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(&tt.want, q) {
+			t.Errorf("%s: expected %+v, but got %+v", tt.query, tt.want, *q)
+		}
+	}
+}
+
+func TestParseShellQueryErrors(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `orders.find()`,
+			err:   "invalid shell query: expected db at line 1, column 1",
+		},
+		{
+			query: `db.orders.aggregate([])`,
+			err:   "invalid shell query: expected find or findOne at line 1, column 11",
+		},
+		{
+			query: `db.orders.find("A")`,
+			err:   "invalid shell query: argument 1 of find must be a document at line 1, column 11",
+		},
+		{
+			query: `db.orders.find({a: })`,
+			err:   "invalid character '}' looking for beginning of value at line 1, column 20",
+		},
+		{
+			query: "db.orders.find({})\n.limit(5",
+			err:   "invalid shell query: expected ',' or ')' at line 2, column 9",
+		},
+		{
+			query: `db.orders.find({}) db`,
+			err:   "invalid shell query: unexpected 'd' at line 1, column 20",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := mongoextjson.ParseShellQuery(tt.query)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: expected error %q, but got %v", tt.query, tt.err, err)
+		}
+	}
+}
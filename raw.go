@@ -0,0 +1,29 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import "errors"
+
+// RawExtJSON is a raw encoded extended JSON value. It implements Marshaler
+// and Unmarshaler, and can be used to delay the decoding of a part of a
+// document, or to pass it through untouched: shell constructs like
+// ObjectId("...") and keyed documents like {"$oid": "..."} are stored as
+// they appear in the input instead of being decoded.
+type RawExtJSON []byte
+
+// MarshalJSON returns m as the encoding of m.
+func (m RawExtJSON) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	return m, nil
+}
+
+// UnmarshalJSON sets *m to a copy of data.
+func (m *RawExtJSON) UnmarshalJSON(data []byte) error {
+	if m == nil {
+		return errors.New("mongoextjson.RawExtJSON: UnmarshalJSON on nil pointer")
+	}
+	*m = append((*m)[0:0], data...)
+	return nil
+}
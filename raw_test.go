@@ -0,0 +1,49 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+func TestRawExtJSON(t *testing.T) {
+
+	t.Parallel()
+
+	rawTests := []struct {
+		name string
+		data string
+		raw  string
+	}{
+		{name: "shell construct", data: `{"a":1,"b":ObjectId("5a934e000102030405000000")}`, raw: `ObjectId("5a934e000102030405000000")`},
+		{name: "keyed document", data: `{"a":1,"b":{"$oid":"5a934e000102030405000000"}}`, raw: `{"$oid":"5a934e000102030405000000"}`},
+		{name: "sub document", data: `{"a":1,"b":{"c":NumberLong(12),"d":[1,2]}}`, raw: `{"c":NumberLong(12),"d":[1,2]}`},
+		{name: "literal", data: `{"a":1,"b":"str"}`, raw: `"str"`},
+		{name: "null", data: `{"a":1,"b":null}`, raw: `null`},
+	}
+
+	for _, tt := range rawTests {
+		var v struct {
+			A int                     `json:"a"`
+			B mongoextjson.RawExtJSON `json:"b"`
+		}
+		if err := mongoextjson.Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Errorf("%s: fail to unmarshal %s: %v", tt.name, tt.data, err)
+			continue
+		}
+		if string(v.B) != tt.raw {
+			t.Errorf("%s: expected raw value %s, but got %s", tt.name, tt.raw, v.B)
+		}
+
+		b, err := mongoextjson.MarshalCanonical(v)
+		if err != nil {
+			t.Errorf("%s: fail to marshal: %v", tt.name, err)
+			continue
+		}
+		if string(b) != tt.data {
+			t.Errorf("%s: expected %s, but got %s", tt.name, tt.data, b)
+		}
+	}
+}
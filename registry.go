@@ -0,0 +1,128 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"reflect"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+)
+
+// codecRegistry wraps a bsoncodec.Registry to find the types for which it
+// holds a custom codec, that is a codec that differs from the one of the
+// default registry of the driver. Values of these types are converted
+// with the codec to a BSON value, which is then encoded as extended JSON,
+// and the other way around.
+type codecRegistry struct {
+	r        *bsoncodec.Registry
+	encoders sync.Map // reflect.Type to bool
+	decoders sync.Map // reflect.Type to bool
+}
+
+func newCodecRegistry(r *bsoncodec.Registry) *codecRegistry {
+	if r == nil {
+		return nil
+	}
+	return &codecRegistry{r: r}
+}
+
+// encodes reports whether the registry has a custom encoder for t.
+func (c *codecRegistry) encodes(t reflect.Type) bool {
+	if custom, ok := c.encoders.Load(t); ok {
+		return custom.(bool)
+	}
+	enc, err := c.r.LookupEncoder(t)
+	custom := err == nil
+	if custom {
+		if def, err := bson.DefaultRegistry.LookupEncoder(t); err == nil {
+			custom = !sameCodec(enc, def)
+		}
+	}
+	c.encoders.Store(t, custom)
+	return custom
+}
+
+// decodes reports whether the registry has a custom decoder for t.
+func (c *codecRegistry) decodes(t reflect.Type) bool {
+	if custom, ok := c.decoders.Load(t); ok {
+		return custom.(bool)
+	}
+	dec, err := c.r.LookupDecoder(t)
+	custom := err == nil
+	if custom {
+		if def, err := bson.DefaultRegistry.LookupDecoder(t); err == nil {
+			custom = !sameCodec(dec, def)
+		}
+	}
+	c.decoders.Store(t, custom)
+	return custom
+}
+
+// sameCodec reports whether the codecs a and b are the same. The default
+// codecs are either functions, or structs that each registry builds anew,
+// so codecs of the same struct type are considered the same.
+func sameCodec(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() {
+		return false
+	}
+	if va.Kind() == reflect.Func {
+		return va.Pointer() == vb.Pointer()
+	}
+	return true
+}
+
+// registryValue encodes v with the custom encoder of the registry.
+func (e *encodeState) registryValue(v reflect.Value, opts encOpts) {
+	typ, data, err := bson.MarshalValueWithRegistry(e.registry.r, v.Interface())
+	if err != nil {
+		e.error(&MarshalerError{v.Type(), err})
+	}
+	var x interface{}
+	err = bson.RawValue{Type: typ, Value: data}.Unmarshal(&x)
+	if err != nil {
+		e.error(&MarshalerError{v.Type(), err})
+	}
+	// the converted value must not go through the registry again
+	r := e.registry
+	e.registry = nil
+	e.reflectValue(reflect.ValueOf(x), opts)
+	e.registry = r
+}
+
+// registryValue decodes the next value into v with the custom decoder of
+// the registry, if it has one for the type of v, and reports whether it
+// did so.
+func (d *decodeState) registryValue(v reflect.Value) bool {
+	t := v.Type()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Interface || !d.registry.decodes(t) {
+		return false
+	}
+
+	x := d.valueInterface()
+	if x == nil {
+		if v.CanSet() {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return true
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	typ, data, err := bson.MarshalValue(x)
+	if err == nil {
+		err = bson.RawValue{Type: typ, Value: data}.UnmarshalWithRegistry(d.registry.r, v.Addr().Interface())
+	}
+	if err != nil {
+		d.saveError(err)
+	}
+	return true
+}
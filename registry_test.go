@@ -0,0 +1,121 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// status is an enum stored as a string in the database.
+type status int
+
+const (
+	statusActive status = iota + 1
+	statusDeleted
+)
+
+var statusNames = map[status]string{statusActive: "active", statusDeleted: "deleted"}
+
+// userID is a hexadecimal string stored as an ObjectId in the database.
+type userID string
+
+func newTestRegistry() *bsoncodec.Registry {
+	rb := bson.NewRegistryBuilder()
+	rb.RegisterTypeEncoder(reflect.TypeOf(status(0)), bsoncodec.ValueEncoderFunc(
+		func(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+			return vw.WriteString(statusNames[status(val.Int())])
+		}))
+	rb.RegisterTypeDecoder(reflect.TypeOf(status(0)), bsoncodec.ValueDecoderFunc(
+		func(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+			s, err := vr.ReadString()
+			if err != nil {
+				return err
+			}
+			for st, name := range statusNames {
+				if name == s {
+					val.SetInt(int64(st))
+					return nil
+				}
+			}
+			return fmt.Errorf("unknown status %q", s)
+		}))
+	rb.RegisterTypeEncoder(reflect.TypeOf(userID("")), bsoncodec.ValueEncoderFunc(
+		func(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+			id, err := primitive.ObjectIDFromHex(val.String())
+			if err != nil {
+				return err
+			}
+			return vw.WriteObjectID(id)
+		}))
+	rb.RegisterTypeDecoder(reflect.TypeOf(userID("")), bsoncodec.ValueDecoderFunc(
+		func(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+			id, err := vr.ReadObjectID()
+			if err != nil {
+				return err
+			}
+			val.SetString(id.Hex())
+			return nil
+		}))
+	return rb.Build()
+}
+
+func TestRegistry(t *testing.T) {
+
+	t.Parallel()
+
+	type user struct {
+		ID     userID  `json:"_id" bson:"_id"`
+		Status status  `json:"status" bson:"status"`
+		Prev   *status `json:"prev" bson:"prev"`
+		Name   string  `json:"name" bson:"name"`
+	}
+
+	prev := statusActive
+	v := user{ID: userID(objectID.Hex()), Status: statusDeleted, Prev: &prev, Name: "a"}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	enc.SetRegistry(newTestRegistry())
+	if err := enc.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"_id":ObjectId("5a934e000102030405000000"),"status":"deleted","prev":"active","name":"a"}`
+	if buf.String() != want {
+		t.Errorf("expected %s, but got %s", want, buf.String())
+	}
+
+	var got user
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(want))
+	dec.SetRegistry(newTestRegistry())
+	if err := dec.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != v.ID || got.Status != v.Status || got.Prev == nil || *got.Prev != prev || got.Name != v.Name {
+		t.Errorf("expected %+v, but got %+v", v, got)
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`{"status": "unknown"}`))
+	dec.SetRegistry(newTestRegistry())
+	if err := dec.Decode(&got); err == nil || !strings.Contains(err.Error(), `unknown status "unknown"`) {
+		t.Errorf("expected the error of the codec, but got %v", err)
+	}
+
+	// without a registry, the Go representation is used
+	b, err := mongoextjson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"status":2`) {
+		t.Errorf("expected the status as an int, but got %s", b)
+	}
+}
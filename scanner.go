@@ -13,7 +13,10 @@ package mongoextjson
 // This file starts with two simple examples using the scanner
 // before diving into the scanner itself.
 
-import "strconv"
+import (
+	"io"
+	"strconv"
+)
 
 // nextValue splits data after the next whole JSON value,
 // returning that value and the bytes that follow it as separate slices.
@@ -44,13 +47,79 @@ func nextValue(data []byte, scan *scanner) (value, rest []byte, err error) {
 	return data, nil, nil
 }
 
+// Valid reports whether data is a valid extended JSON encoding, shell
+// syntax included. Only the syntax is checked: functions and keyed
+// documents are not decoded, so Valid doesn't allocate any value.
+func Valid(data []byte) bool {
+	var scan scanner
+	return checkValid(data, &scan) == nil
+}
+
+// ValidReader is like Valid, but reads the extended JSON from r. It
+// returns nil if r holds a single valid value, a *SyntaxError if it is
+// malformed, or the error returned by r.
+func ValidReader(r io.Reader) error {
+	var scan scanner
+	scan.reset()
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			scan.bytes++
+			if scan.step(&scan, c) == scanError {
+				return scan.err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if scan.eof() == scanError {
+		return scan.err
+	}
+	return nil
+}
+
+// checkValid verifies that data is valid JSON-encoded data.
+// scan is passed in for use by checkValid to avoid an allocation.
+func checkValid(data []byte, scan *scanner) error {
+	scan.reset()
+	for _, c := range data {
+		scan.bytes++
+		if scan.step(scan, c) == scanError {
+			return scan.err
+		}
+	}
+	if scan.eof() == scanError {
+		return scan.err
+	}
+	return nil
+}
+
 // A SyntaxError is a description of a JSON syntax error.
 type SyntaxError struct {
 	msg    string // description of error
 	Offset int64  // error occurred after reading Offset bytes
+	Line   int    // line of the error, starting at 1, or 0 if unknown
+	Column int    // column of the error in bytes, starting at 1
 }
 
-func (e *SyntaxError) Error() string { return e.msg }
+func (e *SyntaxError) Error() string { return withContext(e.msg, "", e.Line, e.Column) }
+
+// withContext appends to the message of an error the path of the value
+// in the document, and its line and column, when they are known.
+func withContext(msg, path string, line, column int) string {
+	if path != "" {
+		msg += " in " + path
+	}
+	if line == 0 {
+		return msg
+	}
+	return msg + " at line " + strconv.Itoa(line) + ", column " + strconv.Itoa(column)
+}
 
 // A scanner is a JSON scanning state machine.
 // Callers call scan.reset() and then pass bytes in one at a time
@@ -152,7 +221,7 @@ func (s *scanner) eof() int {
 		return scanEnd
 	}
 	if s.err == nil {
-		s.err = &SyntaxError{"unexpected end of JSON input", s.bytes}
+		s.err = &SyntaxError{msg: "unexpected end of JSON input", Offset: s.bytes}
 	}
 	return scanError
 }
@@ -208,12 +277,24 @@ func stateBeginValue(s *scanner, c byte) int {
 	case '"':
 		s.step = stateInString
 		return scanBeginLiteral
+	case '`':
+		s.step = stateInBacktick
+		return scanBeginLiteral
+	case '\'':
+		s.step = stateInSingleQuote
+		return scanBeginLiteral
 	case '-':
 		s.step = stateNeg
 		return scanBeginLiteral
+	case '+':
+		s.step = statePlus
+		return scanBeginLiteral
 	case '0': // beginning of 0.123
 		s.step = state0
 		return scanBeginLiteral
+	case '.': // beginning of .5
+		s.step = stateLeadingDot
+		return scanBeginLiteral
 	case 'n':
 		s.step = stateNew0
 		return scanBeginName
@@ -255,8 +336,12 @@ func stateBeginString(s *scanner, c byte) int {
 		s.step = stateInString
 		return scanBeginLiteral
 	}
+	if c == '\'' {
+		s.step = stateInSingleQuote
+		return scanBeginLiteral
+	}
 	if isName(c) {
-		s.step = stateName
+		s.step = stateKeyName
 		return scanBeginName
 	}
 	return s.error(c, "looking for beginning of object key string")
@@ -348,6 +433,8 @@ func stateInString(s *scanner, c byte) int {
 }
 
 // stateInStringEsc is the state after reading `"\` during a quoted string.
+// JavaScript escapes, like `\x41` or `\v`, are accepted here and checked
+// by the decoder, as well as a backslash at the end of a line.
 func stateInStringEsc(s *scanner, c byte) int {
 	switch c {
 	case 'b', 'f', 'n', 'r', 't', '\\', '/', '"':
@@ -357,6 +444,10 @@ func stateInStringEsc(s *scanner, c byte) int {
 		s.step = stateInStringEscU
 		return scanContinue
 	}
+	if c >= 0x20 || c == '\n' || c == '\r' {
+		s.step = stateInString
+		return scanContinue
+	}
 	return s.error(c, "in string escape code")
 }
 
@@ -366,10 +457,27 @@ func stateInStringEscU(s *scanner, c byte) int {
 		s.step = stateInStringEscU1
 		return scanContinue
 	}
+	if c == '{' {
+		s.step = stateInStringEscUBrace
+		return scanContinue
+	}
 	// numbers
 	return s.error(c, "in \\u hexadecimal character escape")
 }
 
+// stateInStringEscUBrace is the state after reading `"\u{` during a quoted
+// string, in a JavaScript code point escape like `\u{1F600}`.
+func stateInStringEscUBrace(s *scanner, c byte) int {
+	if '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' {
+		return scanContinue
+	}
+	if c == '}' {
+		s.step = stateInString
+		return scanContinue
+	}
+	return s.error(c, "in \\u{} code point escape")
+}
+
 // stateInStringEscU1 is the state after reading `"\u1` during a quoted string.
 func stateInStringEscU1(s *scanner, c byte) int {
 	if '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' {
@@ -400,6 +508,60 @@ func stateInStringEscU123(s *scanner, c byte) int {
 	return s.error(c, "in \\u hexadecimal character escape")
 }
 
+// stateInBacktick is the state after reading "`".
+// Template literals may span several lines, but interpolation
+// with `${...}` is not supported.
+func stateInBacktick(s *scanner, c byte) int {
+	switch c {
+	case '`':
+		s.step = stateEndValue
+	case '\\':
+		s.step = stateInBacktickEsc
+	case '$':
+		s.step = stateInBacktickDollar
+	}
+	return scanContinue
+}
+
+// stateInBacktickEsc is the state after reading "`\" during a template literal.
+func stateInBacktickEsc(s *scanner, c byte) int {
+	s.step = stateInBacktick
+	return scanContinue
+}
+
+// stateInBacktickDollar is the state after reading "`$" during a template literal.
+func stateInBacktickDollar(s *scanner, c byte) int {
+	if c == '{' {
+		return s.error(c, "in template literal: interpolation is not supported")
+	}
+	return stateInBacktick(s, c)
+}
+
+// stateInSingleQuote is the state after reading `'` during a string
+// quoted with single quotes. The decoder checks that the extension
+// accepts such strings.
+func stateInSingleQuote(s *scanner, c byte) int {
+	if c == '\'' {
+		s.step = stateEndValue
+		return scanContinue
+	}
+	if c == '\\' {
+		s.step = stateInSingleQuoteEsc
+		return scanContinue
+	}
+	if c < 0x20 {
+		return s.error(c, "in string literal")
+	}
+	return scanContinue
+}
+
+// stateInSingleQuoteEsc is the state after reading `'\` during a string
+// quoted with single quotes.
+func stateInSingleQuoteEsc(s *scanner, c byte) int {
+	s.step = stateInSingleQuote
+	return scanContinue
+}
+
 // stateNeg is the state after reading `-` during a number.
 func stateNeg(s *scanner, c byte) int {
 	if c == '0' {
@@ -410,9 +572,43 @@ func stateNeg(s *scanner, c byte) int {
 		s.step = state1
 		return scanContinue
 	}
+	if c == '.' {
+		s.step = stateLeadingDot
+		return scanContinue
+	}
+	if c == 'I' || c == 'i' || c == 'N' || c == 'n' {
+		s.step = stateSpecialFloat
+		return scanContinue
+	}
 	return s.error(c, "in numeric literal")
 }
 
+// statePlus is the state after reading `+` during a number.
+// The decoder checks that the extension accepts such numbers.
+func statePlus(s *scanner, c byte) int {
+	return stateNeg(s, c)
+}
+
+// stateLeadingDot is the state after reading a decimal point without integer
+// in a number, such as after reading `.` or `-.`.
+func stateLeadingDot(s *scanner, c byte) int {
+	if '0' <= c && c <= '9' {
+		s.step = stateDot0
+		return scanContinue
+	}
+	return s.error(c, "after decimal point in numeric literal")
+}
+
+// stateSpecialFloat is the state after reading `-I`, `+I`, `-N` or `+N`
+// during a signed infinity or NaN literal. The decoder checks the literal
+// itself.
+func stateSpecialFloat(s *scanner, c byte) int {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+		return scanContinue
+	}
+	return stateEndValue(s, c)
+}
+
 // state1 is the state after reading a non-zero integer during a number,
 // such as after reading `1` or `100` but not `0`.
 func state1(s *scanner, c byte) int {
@@ -420,11 +616,42 @@ func state1(s *scanner, c byte) int {
 		s.step = state1
 		return scanContinue
 	}
-	return state0(s, c)
+	return stateInt(s, c)
+}
+
+// stateHex is the state after reading `0x` during a hexadecimal number.
+func stateHex(s *scanner, c byte) int {
+	if isHex(c) {
+		s.step = stateHex0
+		return scanContinue
+	}
+	return s.error(c, "in hexadecimal numeric literal")
+}
+
+// stateHex0 is the state after reading `0x` and at least one digit
+// during a hexadecimal number, such as after reading `0xF`.
+func stateHex0(s *scanner, c byte) int {
+	if isHex(c) {
+		return scanContinue
+	}
+	return stateEndValue(s, c)
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
 }
 
 // state0 is the state after reading `0` during a number.
 func state0(s *scanner, c byte) int {
+	if c == 'x' || c == 'X' {
+		s.step = stateHex
+		return scanContinue
+	}
+	return stateInt(s, c)
+}
+
+// stateInt is the state after reading the integer part of a number.
+func stateInt(s *scanner, c byte) int {
 	if c == '.' {
 		s.step = stateDot
 		return scanContinue
@@ -443,7 +670,12 @@ func stateDot(s *scanner, c byte) int {
 		s.step = stateDot0
 		return scanContinue
 	}
-	return s.error(c, "after decimal point in numeric literal")
+	// a trailing decimal point, as in `1.` or `1.e3`
+	if c == 'e' || c == 'E' {
+		s.step = stateE
+		return scanContinue
+	}
+	return stateEndValue(s, c)
 }
 
 // stateDot0 is the state after reading the integer, decimal point, and subsequent
@@ -518,11 +750,24 @@ func stateNew2(s *scanner, c byte) int {
 	return stateName(s, c)
 }
 
-// stateName is the state while reading an unquoted function name.
+// stateKeyName is the state while reading an unquoted object key.
+func stateKeyName(s *scanner, c byte) int {
+	if isName(c) {
+		return scanContinue
+	}
+	return stateEndValue(s, c)
+}
+
+// stateName is the state while reading an unquoted name, a constant or
+// a function name.
 func stateName(s *scanner, c byte) int {
 	if isName(c) {
 		return scanContinue
 	}
+	if c == '.' {
+		s.step = stateDottedName
+		return scanContinue
+	}
 	if c == '(' {
 		s.step = stateParamOrEmpty
 		s.pushParseState(parseParam)
@@ -531,6 +776,19 @@ func stateName(s *scanner, c byte) int {
 	return stateEndValue(s, c)
 }
 
+// stateDottedName is the state while reading a function name holding
+// dots, like Binary.createFromBase64, which must be followed by its
+// arguments.
+func stateDottedName(s *scanner, c byte) int {
+	if isName(c) || c == '.' {
+		return scanContinue
+	}
+	if c == '(' {
+		return stateName(s, c)
+	}
+	return s.error(c, "in function name")
+}
+
 // stateParamOrEmpty is the state after reading `(`.
 func stateParamOrEmpty(s *scanner, c byte) int {
 	if c <= ' ' && isSpace(c) {
@@ -551,7 +809,7 @@ func stateError(s *scanner, c byte) int {
 // error records an error and switches to the error state.
 func (s *scanner) error(c byte, context string) int {
 	s.step = stateError
-	s.err = &SyntaxError{"invalid character " + quoteChar(c) + " " + context, s.bytes}
+	s.err = &SyntaxError{msg: "invalid character " + quoteChar(c) + " " + context, Offset: s.bytes}
 	return scanError
 }
 
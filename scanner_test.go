@@ -0,0 +1,62 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/feliixx/mongoextjson"
+)
+
+var validTests = []struct {
+	data string
+	ok   bool
+}{
+	{`true`, true},
+	{`}{`, false},
+	{`{}`, true},
+	{`{"foo":"bar"}`, true},
+	{`{"foo":"bar","bar":{"baz":["qux"]}}`, true},
+	{`{_id: ObjectId("5a934e000102030405000000"), d: new Date(10),}`, true},
+	{`{"ts": Timestamp(1, 2), "s": 'single'}`, true},
+	{`{"a": ObjectId("5a934e000102030405000000"}`, false},
+	{`{"a": 1} {"b": 2}`, false},
+	{`[1, 2`, false},
+}
+
+func TestValid(t *testing.T) {
+
+	t.Parallel()
+
+	for _, tt := range validTests {
+		if ok := mongoextjson.Valid([]byte(tt.data)); ok != tt.ok {
+			t.Errorf("Valid(%#q) = %v, want %v", tt.data, ok, tt.ok)
+		}
+	}
+}
+
+func TestValidReader(t *testing.T) {
+
+	t.Parallel()
+
+	for _, tt := range validTests {
+		// read one byte at a time to check values spanning several reads
+		err := mongoextjson.ValidReader(iotest.OneByteReader(strings.NewReader(tt.data)))
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("ValidReader(%#q) = %v, want valid: %v", tt.data, err, tt.ok)
+		}
+		var syntaxErr *mongoextjson.SyntaxError
+		if err != nil && !errors.As(err, &syntaxErr) {
+			t.Errorf("ValidReader(%#q): expected a *SyntaxError, but got %T", tt.data, err)
+		}
+	}
+
+	readErr := errors.New("read failed")
+	err := mongoextjson.ValidReader(iotest.ErrReader(readErr))
+	if err != readErr {
+		t.Errorf("expected read error, but got %v", err)
+	}
+}
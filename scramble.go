@@ -0,0 +1,228 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A Scrambler replaces the values of documents by fake ones so that data
+// can be shared, for example in a bug report, without leaking its content.
+//
+// Scrambling is deterministic for a given secret: the same input value always
+// gives the same output value, so references between documents (an ObjectId
+// used in two collections for instance) are kept. The structure of values is
+// preserved too: strings keep their length and character classes, numbers
+// keep their type, sign and number of digits, and dates are moved by less
+// than a year. Keys, booleans, null and other special values are left as is.
+type Scrambler struct {
+	secret []byte
+}
+
+// NewScrambler returns a Scrambler keyed by secret.
+func NewScrambler(secret []byte) *Scrambler {
+	return &Scrambler{secret: append([]byte(nil), secret...)}
+}
+
+// Scramble returns a scrambled copy of v. Documents and arrays, either
+// maps and slices or their bson counterparts like bson.M, bson.D and
+// bson.A, are walked recursively and keep their type.
+func (s *Scrambler) Scramble(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return s.scrambleMap(v)
+	case primitive.M:
+		return primitive.M(s.scrambleMap(v))
+	case []interface{}:
+		return s.scrambleSlice(v)
+	case primitive.A:
+		return primitive.A(s.scrambleSlice(v))
+	case primitive.D:
+		out := make(primitive.D, len(v))
+		for i, e := range v {
+			out[i] = primitive.E{Key: e.Key, Value: s.Scramble(e.Value)}
+		}
+		return out
+	case primitive.E:
+		return primitive.E{Key: v.Key, Value: s.Scramble(v.Value)}
+	case string:
+		return s.scrambleString(v)
+	case float64:
+		return s.scrambleFloat(v)
+	case int:
+		return int(s.scrambleInt('i', int64(v), math.MaxInt64))
+	case int32:
+		return int32(s.scrambleInt('l', int64(v), math.MaxInt32))
+	case int64:
+		return s.scrambleInt('L', v, math.MaxInt64)
+	case time.Time:
+		return s.scrambleTime(v)
+	case primitive.DateTime:
+		return primitive.NewDateTimeFromTime(s.scrambleTime(v.Time()))
+	case primitive.ObjectID:
+		var id primitive.ObjectID
+		copy(id[:], s.sum('o', v[:], len(id)))
+		return id
+	case primitive.Binary:
+		return primitive.Binary{Subtype: v.Subtype, Data: s.sum('b', v.Data, len(v.Data))}
+	case []byte:
+		return s.sum('b', v, len(v))
+	case primitive.Decimal128:
+		d, err := primitive.ParseDecimal128(s.scrambleDigits('d', v.String()))
+		if err != nil {
+			return v
+		}
+		return d
+	}
+	return v
+}
+
+func (s *Scrambler) scrambleMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, e := range m {
+		out[k] = s.Scramble(e)
+	}
+	return out
+}
+
+func (s *Scrambler) scrambleSlice(a []interface{}) []interface{} {
+	out := make([]interface{}, len(a))
+	for i, e := range a {
+		out[i] = s.Scramble(e)
+	}
+	return out
+}
+
+// ScrambleStream reads the documents from src, in any syntax supported
+// by Unmarshal, and writes their scrambled version with enc, one document
+// per line. The order of the keys is kept, and the output format is the
+// one of enc, for example NewShellEncoder(w) or NewCanonicalV2Encoder(w).
+func (s *Scrambler) ScrambleStream(enc *Encoder, src io.Reader) error {
+	d := NewDecoder(src)
+	d.Extend(&jsonExt)
+	d.UseOrderedDocuments()
+	var b []byte
+	for {
+		var v interface{}
+		err := d.Decode(&v)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b, err = enc.Append(b[:0], s.Scramble(v))
+		if err != nil {
+			return err
+		}
+		if _, err := enc.w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+// sum returns n pseudo-random bytes derived from the secret, the kind
+// of value and its content.
+func (s *Scrambler) sum(kind byte, data []byte, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	var counter [4]byte
+	for i := uint32(0); len(out) < n; i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(counter[:])
+		mac.Write([]byte{kind})
+		mac.Write(data)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+func (s *Scrambler) scrambleString(str string) string {
+	in := []rune(str)
+	rnd := s.sum('s', []byte(str), len(in))
+	out := make([]rune, len(in))
+	for i, r := range in {
+		switch {
+		case 'a' <= r && r <= 'z':
+			out[i] = 'a' + rune(rnd[i]%26)
+		case 'A' <= r && r <= 'Z':
+			out[i] = 'A' + rune(rnd[i]%26)
+		case '0' <= r && r <= '9':
+			out[i] = '0' + rune(rnd[i]%10)
+		default:
+			out[i] = r
+		}
+	}
+	return string(out)
+}
+
+// scrambleDigits replaces every digit of the mantissa of a number
+// formatted as a string, keeping its first digit non-zero.
+func (s *Scrambler) scrambleDigits(kind byte, num string) string {
+	rnd := s.sum(kind, []byte(num), len(num))
+	out := []byte(num)
+	leading := true
+	for i, c := range out {
+		if c == 'e' || c == 'E' {
+			break
+		}
+		if c < '0' || c > '9' {
+			continue
+		}
+		if leading && c == '0' {
+			continue
+		}
+		if leading {
+			out[i] = '1' + rnd[i]%9
+			leading = false
+			continue
+		}
+		out[i] = '0' + rnd[i]%10
+	}
+	return string(out)
+}
+
+func (s *Scrambler) scrambleInt(kind byte, n, max int64) int64 {
+	str := s.scrambleDigits(kind, strconv.FormatInt(n, 10))
+	out, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || out > max || out < -max-1 {
+		// keep the same number of digits, but start with a 1 so that it fits
+		b := []byte(str)
+		if b[0] == '-' {
+			b[1] = '1'
+		} else {
+			b[0] = '1'
+		}
+		out, _ = strconv.ParseInt(string(b), 10, 64)
+	}
+	return out
+}
+
+func (s *Scrambler) scrambleFloat(f float64) float64 {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return f
+	}
+	out, err := strconv.ParseFloat(s.scrambleDigits('f', strconv.FormatFloat(f, 'g', -1, 64)), 64)
+	if err != nil {
+		return f
+	}
+	return out
+}
+
+// scrambleTime moves t by less than a year, keeping a millisecond precision.
+func (s *Scrambler) scrambleTime(t time.Time) time.Time {
+	const year = 365 * 24 * time.Hour
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano()))
+	n := binary.BigEndian.Uint64(s.sum('t', b[:], 8))
+	shift := time.Duration(n%uint64(2*year)) - year
+	return t.Add(shift).Truncate(time.Millisecond)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestScramble(t *testing.T) {
+
+	t.Parallel()
+
+	s := mongoextjson.NewScrambler([]byte("secret"))
+
+	str := s.Scramble("Hello, World 42!").(string)
+	if len(str) != len("Hello, World 42!") || str[5:7] != ", " || str[15] != '!' {
+		t.Errorf("scrambled string doesn't keep the original structure: %q", str)
+	}
+	if str == "Hello, World 42!" {
+		t.Errorf("string was not scrambled")
+	}
+
+	n := s.Scramble(int32(2147483647)).(int32)
+	if n < 1000000000 {
+		t.Errorf("scrambled int32 should have 10 digits, but got %d", n)
+	}
+
+	f := s.Scramble(-12.5).(float64)
+	if f > -10 || f <= -100 {
+		t.Errorf("scrambled float should keep its sign and magnitude, but got %v", f)
+	}
+
+	if a, b := s.Scramble(objectID), s.Scramble(objectID); a != b {
+		t.Errorf("scrambling is not deterministic: %v vs %v", a, b)
+	}
+	other := mongoextjson.NewScrambler([]byte("other secret"))
+	if a, b := s.Scramble(objectID), other.Scramble(objectID); a == b {
+		t.Errorf("different secrets should give different values")
+	}
+
+	bin := s.Scramble(primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}).(primitive.Binary)
+	if bin.Subtype != 4 || len(bin.Data) != 16 {
+		t.Errorf("scrambled binary doesn't keep its subtype and length: %v", bin)
+	}
+}
+
+func TestScrambleStream(t *testing.T) {
+
+	t.Parallel()
+
+	src := strings.NewReader(`{"_id": ObjectId("5a934e000102030405000000"), "name": "john", "ok": true}
+{"user": ObjectId("5a934e000102030405000000"), "n": NumberLong(12)}
+`)
+	var dst bytes.Buffer
+	err := mongoextjson.NewScrambler([]byte("secret")).ScrambleStream(mongoextjson.NewShellEncoder(&dst), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(dst.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 documents, but got %d: %s", len(lines), dst.String())
+	}
+
+	var first, second struct {
+		ID   primitive.ObjectID `json:"_id"`
+		User primitive.ObjectID `json:"user"`
+		Name string             `json:"name"`
+		OK   bool               `json:"ok"`
+	}
+	if err := mongoextjson.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := mongoextjson.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == objectID || first.ID != second.User {
+		t.Errorf("references between documents are not preserved: %v vs %v", first.ID, second.User)
+	}
+	if len(first.Name) != 4 || first.Name == "john" || !first.OK {
+		t.Errorf("unexpected scrambled document: %s", lines[0])
+	}
+	// the order of the keys is kept
+	if !strings.HasPrefix(lines[0], `{"_id":ObjectId(`) || !strings.HasSuffix(lines[0], `,"ok":true}`) {
+		t.Errorf("expected the keys in their original order, but got %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], `{"user":ObjectId(`) || !strings.Contains(lines[1], `,"n":NumberLong(`) {
+		t.Errorf("expected the keys in their original order, but got %s", lines[1])
+	}
+
+	// the output format is the one of the encoder
+	dst.Reset()
+	err = mongoextjson.NewScrambler([]byte("secret")).ScrambleStream(mongoextjson.NewCanonicalV2Encoder(&dst), strings.NewReader(`{"z": NumberLong(12), "a": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dst.String(); !strings.HasPrefix(got, `{"z":{"$numberLong":"`) || !strings.HasSuffix(got, `"},"a":true}`+"\n") {
+		t.Errorf("expected a canonical v2 document, but got %s", got)
+	}
+}
+
+func TestScrambleBSONTypes(t *testing.T) {
+
+	t.Parallel()
+
+	s := mongoextjson.NewScrambler([]byte("secret"))
+
+	tests := []struct {
+		name  string
+		value interface{}
+		get   func(v interface{}) interface{}
+	}{
+		{
+			name:  "bson.M",
+			value: bson.M{"name": "john"},
+			get:   func(v interface{}) interface{} { return v.(bson.M)["name"] },
+		},
+		{
+			name:  "bson.D",
+			value: bson.D{{Key: "name", Value: "john"}},
+			get:   func(v interface{}) interface{} { return v.(bson.D)[0].Value },
+		},
+		{
+			name:  "bson.A",
+			value: bson.A{"john"},
+			get:   func(v interface{}) interface{} { return v.(bson.A)[0] },
+		},
+		{
+			name:  "bson.E",
+			value: bson.E{Key: "name", Value: "john"},
+			get:   func(v interface{}) interface{} { return v.(bson.E).Value },
+		},
+		{
+			name:  "nested",
+			value: bson.M{"a": bson.A{bson.D{{Key: "name", Value: "john"}}}},
+			get:   func(v interface{}) interface{} { return v.(bson.M)["a"].(bson.A)[0].(bson.D)[0].Value },
+		},
+	}
+
+	for _, tt := range tests {
+		got := s.Scramble(tt.value)
+		if reflect.TypeOf(got) != reflect.TypeOf(tt.value) {
+			t.Errorf("%s: expected a %T, but got %T", tt.name, tt.value, got)
+			continue
+		}
+		name, ok := tt.get(got).(string)
+		if !ok || len(name) != 4 || name == "john" {
+			t.Errorf("%s: value was not scrambled: %v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import (
+	"bytes"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UnmarshalAll decodes all the documents of data, like the ones of a seed
+// file, separated by whitespace or semicolons and not wrapped in an
+// array, like
+//
+//	{_id: 1, name: "a"};
+//	{_id: 2, name: "b"};
+//
+// Nested documents and arrays are decoded as bson.M and bson.A values.
+// The errors hold the line and the column of the invalid value.
+func UnmarshalAll(data []byte) ([]primitive.M, error) {
+	docs := []primitive.M{}
+	err := DecodeAll(bytes.NewReader(data), func(doc primitive.M) error {
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// DecodeAll is the streaming variant of UnmarshalAll: it reads the
+// documents from r and calls fn for each of them, so that they don't have
+// to be held in memory at once. An error returned by fn stops the
+// decoding and is returned as is.
+func DecodeAll(r io.Reader, fn func(doc primitive.M) error) error {
+	dec := NewExtendedDecoder(r)
+	dec.UseBSONTypes()
+	dec.AllowSemicolons()
+	for {
+		var doc primitive.M
+		ok, err := dec.DecodeNext(&doc)
+		if !ok || err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUnmarshalAll(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{_id: ObjectId("5a934e000102030405000000"), tags: ["a"]};
+{_id: 2, meta: {n: NumberInt(1)}} ; ;
+{"_id": 3}
+{_id: 4};`
+
+	docs, err := mongoextjson.UnmarshalAll([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bson.M{
+		{"_id": objectID, "tags": bson.A{"a"}},
+		{"_id": 2.0, "meta": bson.M{"n": int32(1)}},
+		{"_id": 3.0},
+		{"_id": 4.0},
+	}
+	if !reflect.DeepEqual(want, docs) {
+		t.Errorf("expected %v, but got %v", want, docs)
+	}
+
+	docs, err = mongoextjson.UnmarshalAll([]byte(" ;\n"))
+	if err != nil || len(docs) != 0 {
+		t.Errorf("expected no document, but got %v, %v", docs, err)
+	}
+}
+
+func TestUnmarshalAllErrors(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{
+			data: "{a: 1};\n{a: }",
+			err:  "invalid character '}' looking for beginning of value at line 2, column 5",
+		},
+		{
+			data: "{a: 1}\n[{a: 2}]",
+			err:  "json: cannot unmarshal array into Go value of type primitive.M at line 2, column 1",
+		},
+		{
+			data: "{a: 1};;\n{a: 1",
+			err:  "unexpected EOF",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := mongoextjson.UnmarshalAll([]byte(tt.data))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: expected error %q, but got %v", tt.data, tt.err, err)
+		}
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+
+	t.Parallel()
+
+	errStop := errors.New("stop")
+	n := 0
+	err := mongoextjson.DecodeAll(strings.NewReader(`{a: 1}; {a: 2}; {a: 3}`), func(doc bson.M) error {
+		n++
+		if doc["a"] == 2.0 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || n != 2 {
+		t.Errorf("expected to stop after 2 documents, but got %d, %v", n, err)
+	}
+}
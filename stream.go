@@ -6,19 +6,38 @@ package mongoextjson
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // A Decoder reads and decodes JSON values from an input stream.
 type Decoder struct {
-	r     io.Reader
-	buf   []byte
-	d     decodeState
-	scanp int // start of unread data in buf
-	scan  scanner
-	err   error
+	r       io.Reader
+	buf     []byte
+	d       decodeState
+	scanp   int   // start of unread data in buf
+	scanned int64 // amount of data already scanned
+	scan    scanner
+	err     error
+
+	// lines and lineStart describe the data already slid out of buf:
+	// its number of newlines, and the offset where its last line starts
+	lines     int
+	lineStart int64
 
 	tokenState int
+	tokenStack []int
+
+	maxDocumentSize int
+	maxTokenLength  int
+
+	semicolons bool
 }
 
 // NewDecoder returns a new decoder that reads from r.
@@ -29,6 +48,174 @@ func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{r: r}
 }
 
+// decoderPool holds the decoders used internally by Unmarshal and by the
+// extensions, so that their buffers and scanners are reused.
+var decoderPool sync.Pool
+
+// maxPooledBuffer is the capacity above which the buffer of a decoder is
+// not kept in decoderPool, so that a single large value doesn't hold
+// memory forever.
+const maxPooledBuffer = 64 << 10
+
+// getDecoder returns a Decoder reading r with the extension ext and no
+// option set, from decoderPool if possible.
+func getDecoder(r io.Reader, ext *Extension) *Decoder {
+	dec, _ := decoderPool.Get().(*Decoder)
+	if dec == nil {
+		dec = new(Decoder)
+	} else {
+		// keep the allocated memory only
+		*dec = Decoder{
+			buf:        dec.buf[:0],
+			scan:       scanner{parseState: dec.scan.parseState[:0]},
+			tokenStack: dec.tokenStack[:0],
+			d: decodeState{
+				scan:     scanner{parseState: dec.d.scan.parseState[:0]},
+				nextscan: scanner{parseState: dec.d.nextscan.parseState[:0]},
+				path:     dec.d.path[:0],
+			},
+		}
+	}
+	dec.r = r
+	dec.d.ext = *ext
+	return dec
+}
+
+// putDecoder puts dec back in decoderPool once it is no longer used. The
+// values it decoded don't refer to its buffer, as it doesn't decode in
+// place.
+func putDecoder(dec *Decoder) {
+	if cap(dec.buf) > maxPooledBuffer {
+		return
+	}
+	dec.r = nil
+	dec.d.data = nil
+	decoderPool.Put(dec)
+}
+
+// Reset discards the buffered data and the state of the decoder, and
+// makes it read from r. The extension and the options of the decoder,
+// as well as its internal buffer, are kept, so that a Decoder can be
+// reused for several inputs.
+func (dec *Decoder) Reset(r io.Reader) {
+	dec.r = r
+	dec.buf = dec.buf[:0]
+	dec.scanp = 0
+	dec.scanned = 0
+	dec.lines = 0
+	dec.lineStart = 0
+	dec.scan.reset()
+	dec.scan.bytes = 0
+	dec.err = nil
+	dec.tokenState = tokenTopValue
+	dec.tokenStack = dec.tokenStack[:0]
+}
+
+// UseNumber causes the Decoder to unmarshal a number into an interface{}
+// as a Number instead of as a float64, so that large integers don't lose
+// precision.
+func (dec *Decoder) UseNumber() { dec.d.useNumber = true }
+
+// UseIntegers causes the Decoder to unmarshal a whole number, like 42,
+// into an interface{} as an int32, or as an int64 if it doesn't fit,
+// instead of as a float64, so that integers above 2^53 are not corrupted
+// and are stored with the type the server gives them. Whole numbers out
+// of the range of int64, and -0, are still decoded as float64. UseNumber
+// takes precedence.
+func (dec *Decoder) UseIntegers() { dec.d.integers = true }
+
+// UseBSONTypes causes the Decoder to unmarshal objects and arrays into an
+// interface{} as bson.M and bson.A instead of map[string]interface{} and
+// []interface{}, so that the decoded values have the types the driver
+// returns, and can be passed to it without conversion.
+func (dec *Decoder) UseBSONTypes() { dec.d.bsonTypes = true }
+
+// AllowSemicolons causes the Decoder to accept semicolons between
+// top-level values, like in {a: 1}; {a: 2}; as found in seed files or in
+// scripts of the mongo shell.
+func (dec *Decoder) AllowSemicolons() { dec.semicolons = true }
+
+// UseOrderedDocuments causes the Decoder to unmarshal objects into an
+// interface{} as bson.D instead of maps, so that the order of the keys is
+// preserved when the decoded values are written back. It takes precedence
+// over UseBSONTypes for objects.
+func (dec *Decoder) UseOrderedDocuments() { dec.d.orderedDocuments = true }
+
+// TimeZonePolicy defines the location of the dates decoded by a Decoder.
+type TimeZonePolicy int
+
+const (
+	// PreserveTimeZone keeps the offset of the dates written with one,
+	// like ISODate("2016-05-15T01:02:03.004+01:00"), in a location with
+	// this fixed offset, so that they are written back unchanged. Dates
+	// written in UTC or as milliseconds are in UTC. This is the default.
+	PreserveTimeZone TimeZonePolicy = iota
+	// NormalizeToUTC converts all the dates to UTC.
+	NormalizeToUTC
+)
+
+// SetTimeZonePolicy defines the location of the decoded dates.
+func (dec *Decoder) SetTimeZonePolicy(p TimeZonePolicy) { dec.d.timeZone = p }
+
+// SetMaxDocumentSize causes the Decoder to return a *LimitError as soon as
+// a value of the stream is larger than n bytes, before reading it whole.
+// A limit of 0, the default, means no limit.
+func (dec *Decoder) SetMaxDocumentSize(n int) { dec.maxDocumentSize = n }
+
+// SetMaxTokenLength causes the Decoder to return a *LimitError as soon as
+// a single string, number or name, like the base64 payload of a BinData,
+// is longer than n bytes. A limit of 0, the default, means no limit.
+func (dec *Decoder) SetMaxTokenLength(n int) { dec.maxTokenLength = n }
+
+// A LimitError is returned by a Decoder when its input exceeds one of
+// the limits set with SetMaxDocumentSize or SetMaxTokenLength.
+type LimitError struct {
+	Limit string // "document size" or "token length"
+	Max   int    // the limit, in bytes
+}
+
+func (e *LimitError) Error() string {
+	return "json: " + e.Limit + " exceeds the limit of " + strconv.Itoa(e.Max) + " bytes"
+}
+
+// SetFieldNameMapper causes the Decoder to match the keys of a document
+// against fn(field name), like SnakeCase, for the struct fields that have
+// no json tag, or a tag without a name, instead of their Go name.
+func (dec *Decoder) SetFieldNameMapper(fn func(string) string) {
+	dec.d.mapper = newNameMapper(fn)
+}
+
+// SetRegistry causes the Decoder to use the custom codecs of r, the
+// codecs that differ from the ones of bson.DefaultRegistry, to decode
+// values of the types they handle: the value is decoded as extended JSON,
+// converted to BSON, and then decoded with r.
+func (dec *Decoder) SetRegistry(r *bsoncodec.Registry) {
+	dec.d.registry = newCodecRegistry(r)
+}
+
+// DecodeDecimalType registers a function converting the Decimal128
+// values, like {"$numberDecimal": "12.50"} or NumberDecimal("12.50"), to
+// the type of sample, like a decimal or money type of the application.
+// It is used when such a value is decoded into a value of that type,
+// instead of its UnmarshalJSON method. The result of convert must be
+// assignable to the type of sample.
+func (dec *Decoder) DecodeDecimalType(sample interface{}, convert func(n primitive.Decimal128) (interface{}, error)) {
+	if dec.d.decimals == nil {
+		dec.d.decimals = make(map[reflect.Type]func(primitive.Decimal128) (interface{}, error))
+	}
+	dec.d.decimals[reflect.TypeOf(sample)] = convert
+}
+
+// DisallowDuplicateKeys causes the Decoder to return a *DuplicateKeyError
+// when a key appears twice in the same document, instead of keeping the
+// last value like MongoDB does.
+func (dec *Decoder) DisallowDuplicateKeys() { dec.d.disallowDuplicateKeys = true }
+
+// UsePrimitiveNull causes the Decoder to decode null as primitive.Null{}
+// instead of nil into an interface{}, so that null values are preserved
+// when the result is marshaled to BSON.
+func (dec *Decoder) UsePrimitiveNull() { dec.d.primitiveNull = true }
+
 // Decode reads the next JSON-encoded value from its
 // input and stores it in the value pointed to by v.
 //
@@ -38,6 +225,7 @@ func (dec *Decoder) Decode(v interface{}) error {
 	if dec.err != nil {
 		return dec.err
 	}
+	dec.skipSemicolons()
 
 	if err := dec.tokenPrepareForDecode(); err != nil {
 		return err
@@ -52,6 +240,7 @@ func (dec *Decoder) Decode(v interface{}) error {
 	if err != nil {
 		return err
 	}
+	start := dec.InputOffset()
 	dec.d.init(dec.buf[dec.scanp : dec.scanp+n])
 	dec.scanp += n
 
@@ -59,6 +248,8 @@ func (dec *Decoder) Decode(v interface{}) error {
 	// the connection is still usable since we read a complete JSON
 	// object from it before the error happened.
 	err = dec.d.unmarshal(v)
+	shiftOffset(err, start)
+	dec.setPosition(err)
 
 	// fixup token streaming state
 	dec.tokenValueEnd()
@@ -66,6 +257,217 @@ func (dec *Decoder) Decode(v interface{}) error {
 	return err
 }
 
+// More reports whether there is another element in the current array
+// or object being parsed, or another top-level value in the stream, like
+// in {...}{...} or in newline separated documents.
+func (dec *Decoder) More() bool {
+	dec.skipSemicolons()
+	c, err := dec.peek()
+	if err != nil || c == ']' || c == '}' {
+		return false
+	}
+	if c == ',' && dec.d.ext.trailingCommas {
+		// a trailing comma is not followed by another element
+		c, err = dec.peekAfter(1)
+		return err == nil && c != ']' && c != '}'
+	}
+	return true
+}
+
+// DecodeNext decodes the next top-level value of the stream into v, and
+// returns true. At the end of the stream, it returns false and a nil
+// error, so that several values can be read with
+//
+//	for {
+//		ok, err := dec.DecodeNext(&v)
+//		if !ok || err != nil {
+//			break
+//		}
+//	}
+func (dec *Decoder) DecodeNext(v interface{}) (bool, error) {
+	if dec.err != nil {
+		return false, dec.err
+	}
+	dec.skipSemicolons()
+	_, err := dec.peek()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, dec.Decode(v)
+}
+
+// ArrayElements consumes the opening bracket of the array at the current
+// position of the stream, and then calls fn once for each element of the
+// array, until the closing bracket is consumed. fn is expected to decode
+// exactly one element with dec.Decode, so that a huge array can be
+// processed with only one element held in memory at a time. fn may itself
+// call ArrayElements to walk a nested array. An error returned by fn
+// stops the iteration and is returned as is.
+func (dec *Decoder) ArrayElements(fn func() error) error {
+	if dec.err != nil {
+		return dec.err
+	}
+	if err := dec.tokenPrepareForDecode(); err != nil {
+		return err
+	}
+	if !dec.tokenValueAllowed() {
+		return &SyntaxError{msg: "not at beginning of value"}
+	}
+	prevState := dec.tokenState
+
+	c, err := dec.peekInValue()
+	if err != nil {
+		return err
+	}
+	if c != '[' {
+		return dec.syntaxError("expected beginning of array, found " + quoteChar(c))
+	}
+	dec.scanp++
+	dec.tokenState = tokenArrayStart
+
+	for {
+		c, err := dec.peekInValue()
+		if err != nil {
+			return err
+		}
+		if dec.tokenState == tokenArrayComma {
+			if c != ']' && c != ',' {
+				return dec.syntaxError("expected comma after array element")
+			}
+			if c == ',' {
+				dec.scanp++
+				dec.tokenState = tokenArrayValue
+				if c, err = dec.peekInValue(); err != nil {
+					return err
+				}
+				if c == ']' && !dec.d.ext.trailingCommas {
+					return dec.syntaxError("invalid character ']' looking for beginning of value")
+				}
+			}
+		}
+		if c == ']' {
+			dec.scanp++
+			break
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		if dec.tokenState != tokenArrayComma {
+			return errors.New("json: ArrayElements callback did not decode an element")
+		}
+	}
+
+	dec.tokenState = prevState
+	dec.tokenValueEnd()
+	return nil
+}
+
+// peekAfter returns the first non-space byte found after skipping n
+// bytes of the input stream, without consuming anything.
+func (dec *Decoder) peekAfter(n int) (byte, error) {
+	var err error
+	for {
+		for i := dec.scanp + n; i < len(dec.buf); i++ {
+			c := dec.buf[i]
+			if isSpace(c) {
+				continue
+			}
+			return c, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = dec.refill()
+	}
+}
+
+// peekInValue is like peek, but reports a premature end of input as
+// io.ErrUnexpectedEOF.
+func (dec *Decoder) peekInValue() (byte, error) {
+	c, err := dec.peek()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return c, err
+}
+
+// shiftOffset adds start to the offset of err, so that it is relative
+// to the beginning of the stream rather than to the decoded value.
+func shiftOffset(err error, start int64) {
+	switch e := err.(type) {
+	case *SyntaxError:
+		e.Offset += start
+	case *UnmarshalTypeError:
+		e.Offset += start
+	case *ExtensionError:
+		e.Offset += start
+	case *DuplicateKeyError:
+		e.Offset += start
+	}
+}
+
+// setPosition fills the line and column of err from its offset in the
+// stream, unless the decoder is used internally to decode a fragment of
+// a value, whose positions would be meaningless to the caller.
+func (dec *Decoder) setPosition(err error) {
+	if dec.d.fragment {
+		return
+	}
+	switch e := err.(type) {
+	case *SyntaxError:
+		e.Line, e.Column = dec.position(e.Offset - 1)
+	case *UnmarshalTypeError:
+		e.Line, e.Column = dec.position(e.Offset - 1)
+	case *ExtensionError:
+		e.Line, e.Column = dec.position(e.Offset)
+	case *DuplicateKeyError:
+		e.Line, e.Column = dec.position(e.Offset)
+	}
+}
+
+// position returns the line and column of the byte at offset off of
+// the stream, which must still be in the buffer.
+func (dec *Decoder) position(off int64) (line, column int) {
+	end := off - dec.scanned
+	if end < 0 {
+		end = 0
+	} else if end > int64(len(dec.buf)) {
+		end = int64(len(dec.buf))
+	}
+	line, start := dec.lines+1, dec.lineStart
+	for i, c := range dec.buf[:end] {
+		if c == '\n' {
+			line++
+			start = dec.scanned + int64(i) + 1
+		}
+	}
+	if off < start {
+		off = start
+	}
+	return line, int(off-start) + 1
+}
+
+// syntaxError returns a SyntaxError about the byte at the current
+// position of the decoder.
+func (dec *Decoder) syntaxError(msg string) *SyntaxError {
+	off := dec.InputOffset()
+	err := &SyntaxError{msg: msg, Offset: off}
+	if !dec.d.fragment {
+		err.Line, err.Column = dec.position(off)
+	}
+	return err
+}
+
+// InputOffset returns the input stream byte offset of the current decoder
+// position. The offset gives the location of the end of the most recently
+// returned token and the beginning of the next token.
+func (dec *Decoder) InputOffset() int64 {
+	return dec.scanned + int64(dec.scanp)
+}
+
 // Buffered returns a reader of the data remaining in the Decoder's
 // buffer. The reader is valid until the next call to Decode.
 func (dec *Decoder) Buffered() io.Reader {
@@ -78,6 +480,7 @@ func (dec *Decoder) readValue() (int, error) {
 	dec.scan.reset()
 
 	scanp := dec.scanp
+	tokenLen := 0
 	var err error
 Input:
 	for {
@@ -85,6 +488,22 @@ Input:
 		for i, c := range dec.buf[scanp:] {
 			dec.scan.bytes++
 			v := dec.scan.step(&dec.scan, c)
+			if dec.maxDocumentSize > 0 && scanp+i-dec.scanp >= dec.maxDocumentSize && v != scanEnd {
+				dec.err = &LimitError{"document size", dec.maxDocumentSize}
+				return 0, dec.err
+			}
+			switch v {
+			case scanContinue:
+				tokenLen++
+			case scanBeginLiteral, scanBeginName:
+				tokenLen = 1
+			default:
+				tokenLen = 0
+			}
+			if dec.maxTokenLength > 0 && tokenLen > dec.maxTokenLength {
+				dec.err = &LimitError{"token length", dec.maxTokenLength}
+				return 0, dec.err
+			}
 			if v == scanEnd {
 				scanp += i
 				break Input
@@ -97,6 +516,10 @@ Input:
 				break Input
 			}
 			if v == scanError {
+				if err, ok := dec.scan.err.(*SyntaxError); ok {
+					err.Offset = dec.scanned + int64(scanp+i+1)
+					dec.setPosition(err)
+				}
 				dec.err = dec.scan.err
 				return 0, dec.scan.err
 			}
@@ -129,6 +552,13 @@ func (dec *Decoder) refill() error {
 	// Make room to read more into the buffer.
 	// First slide down data already consumed.
 	if dec.scanp > 0 {
+		for i, c := range dec.buf[:dec.scanp] {
+			if c == '\n' {
+				dec.lines++
+				dec.lineStart = dec.scanned + int64(i) + 1
+			}
+		}
+		dec.scanned += int64(dec.scanp)
 		n := copy(dec.buf, dec.buf[dec.scanp:])
 		dec.buf = dec.buf[:n]
 		dec.scanp = 0
@@ -163,6 +593,17 @@ type Encoder struct {
 	w          io.Writer
 	err        error
 	escapeHTML bool
+	tojson     bool
+	dialect    Dialect
+	mapper     *nameMapper
+	registry   *codecRegistry
+	sortKeys   bool
+	idFirst    bool
+	subMillis  SubMillisecondPolicy
+	floatPoint bool
+	shellFloat bool
+	uintOver   UintOverflowPolicy
+	intQuoting IntegerQuoting
 
 	ext Extension
 }
@@ -177,14 +618,33 @@ func NewEncoder(w io.Writer) *Encoder {
 //
 // See the documentation for Marshal for details about the
 // conversion of Go values to JSON.
+//
+// Large arrays and documents are written to the stream as they are
+// encoded, so they are not held in memory as a whole. If an error occurs
+// once part of the encoding of v is written, the output can't be
+// completed, so the error is a *PartialWriteError and it is returned
+// again by the next calls. Values whose encoding fails before anything
+// is written, like most small documents, leave the stream untouched.
 func (enc *Encoder) Encode(v interface{}) error {
 	if enc.err != nil {
 		return enc.err
 	}
-	e := newEncodeState()
-	e.ext = enc.ext
+	e := enc.newEncodeState()
+	// the output can be written as it goes unless it has to be
+	// reformatted as a whole
+	if !enc.tojson && enc.dialect != DialectMongosh {
+		e.w = enc.w
+	}
 	err := e.marshal(v, encOpts{escapeHTML: enc.escapeHTML})
 	if err != nil {
+		switch {
+		case e.werr != nil:
+			enc.err = e.werr
+		case e.flushed:
+			err = &PartialWriteError{Err: err}
+			enc.err = err
+		}
+		encodeStatePool.Put(e)
 		return err
 	}
 
@@ -198,13 +658,204 @@ func (enc *Encoder) Encode(v interface{}) error {
 	// no need for this
 	//e.WriteByte('\n')
 
-	if _, err = enc.w.Write(e.Bytes()); err != nil {
+	if _, err = enc.w.Write(enc.reformat(e.Bytes())); err != nil {
 		enc.err = err
 	}
 	encodeStatePool.Put(e)
 	return err
 }
 
+// Append appends the encoding of v to dst, like Encode but without
+// writing to the stream, and returns the extended buffer. It allows to
+// reuse the same output buffer across many calls, so that encoding many
+// small documents doesn't allocate a new buffer for each of them.
+func (enc *Encoder) Append(dst []byte, v interface{}) ([]byte, error) {
+	e := enc.newEncodeState()
+	err := e.marshal(v, encOpts{escapeHTML: enc.escapeHTML})
+	if err == nil {
+		dst = append(dst, enc.reformat(e.Bytes())...)
+	}
+	encodeStatePool.Put(e)
+	return dst, err
+}
+
+// newEncodeState returns an encodeState with the extension and the
+// options of enc.
+func (enc *Encoder) newEncodeState() *encodeState {
+	e := newEncodeState()
+	e.ext = enc.ext
+	e.mapper = enc.mapper
+	e.registry = enc.registry
+	e.sortKeys = enc.sortKeys
+	e.idFirst = enc.idFirst
+	e.subMillis = enc.subMillis
+	e.floatPoint = enc.floatPoint
+	e.shellFloats = enc.shellFloat
+	e.uintOverflow = enc.uintOver
+	e.intQuoting = enc.intQuoting
+	return e
+}
+
+// reformat returns b, the encoding of a value, reformatted for the
+// dialects whose output can't be written as it goes.
+func (enc *Encoder) reformat(b []byte) []byte {
+	if enc.dialect == DialectMongosh {
+		var buf bytes.Buffer
+		mongoshQuote(&buf, b)
+		b = buf.Bytes()
+	}
+	if enc.tojson {
+		var buf bytes.Buffer
+		tojsonIndent(&buf, b)
+		b = buf.Bytes()
+	}
+	return b
+}
+
+// A PartialWriteError is returned by Encoder.Encode when the encoding of
+// a value fails after part of it was written to the stream.
+type PartialWriteError struct {
+	Err error // error of the encoding of the value
+}
+
+func (e *PartialWriteError) Error() string {
+	return e.Err.Error() + " after writing part of the value"
+}
+
+func (e *PartialWriteError) Unwrap() error { return e.Err }
+
+// Reset makes the encoder write to w and clears any previous write
+// error. The extension and the options of the encoder are kept, so
+// that an Encoder can be reused for several outputs.
+func (enc *Encoder) Reset(w io.Writer) {
+	enc.w = w
+	enc.err = nil
+}
+
+// SetFieldNameMapper causes the encoder to name the struct fields that
+// have no json tag, or a tag without a name, with fn(field name), like
+// SnakeCase, instead of the Go name of the field. Fields whose mapped
+// names collide are all written.
+func (enc *Encoder) SetFieldNameMapper(fn func(string) string) {
+	enc.mapper = newNameMapper(fn)
+}
+
+// SetRegistry causes the encoder to use the custom codecs of r, the
+// codecs that differ from the ones of bson.DefaultRegistry, like the
+// codecs registered for custom ID types or enums: values of these types
+// are converted to BSON with r, and the result is encoded as extended
+// JSON, so that the driver and the encoder share the same mapping.
+func (enc *Encoder) SetRegistry(r *bsoncodec.Registry) {
+	enc.registry = newCodecRegistry(r)
+}
+
+// SortDocumentKeys defines whether the keys of bson.D values are written
+// in sorted order, for an output that is stable and diff-friendly, like
+// in golden files, or in the order of the slice, which is the default.
+// The keys of maps are always sorted, as maps have no order.
+func (enc *Encoder) SortDocumentKeys(sort bool) {
+	enc.sortKeys = sort
+}
+
+// SubMillisecondPolicy defines how an Encoder writes the time.Time values
+// finer than the millisecond, the precision of BSON dates.
+type SubMillisecondPolicy int
+
+const (
+	// TruncateSubMilliseconds drops the sub-millisecond part of the
+	// dates. This is the default.
+	TruncateSubMilliseconds SubMillisecondPolicy = iota
+	// RoundSubMilliseconds rounds the dates to the nearest millisecond.
+	RoundSubMilliseconds
+	// RejectSubMilliseconds fails with an *UnsupportedValueError, so
+	// that no precision is silently lost.
+	RejectSubMilliseconds
+)
+
+// SetSubMillisecondPolicy defines how the dates finer than the
+// millisecond are written. It applies to the time.Time values written
+// as extended JSON dates.
+func (enc *Encoder) SetSubMillisecondPolicy(p SubMillisecondPolicy) {
+	enc.subMillis = p
+}
+
+// UintOverflowPolicy defines how an Encoder writes the uint and uint64
+// values above math.MaxInt64, which don't fit in any integer type of BSON.
+type UintOverflowPolicy int
+
+const (
+	// RejectUintOverflow fails with an *UnsupportedValueError. This is
+	// the default.
+	RejectUintOverflow UintOverflowPolicy = iota
+	// DecimalUintOverflow writes the values as a $numberDecimal, so that
+	// they are kept exactly.
+	DecimalUintOverflow
+	// WrapUintOverflow writes the values as the negative int64 with the
+	// same bits, like a conversion int64(n) in Go.
+	WrapUintOverflow
+)
+
+// SetUintOverflowPolicy defines how the unsigned integers above
+// math.MaxInt64 are written. The other unsigned integers are written like
+// the signed ones: uint8, uint16 and uint32 values as int32 if they fit,
+// as int64 otherwise, uint64 values as int64 and uint values as int.
+// It only applies to the encoders using an extension.
+func (enc *Encoder) SetUintOverflowPolicy(p UintOverflowPolicy) {
+	enc.uintOver = p
+}
+
+// IntegerQuoting defines when an Encoder writes integers as quoted
+// $numberInt or $numberLong values, like {"$numberLong": "42"}, instead
+// of plain numbers.
+type IntegerQuoting int
+
+const (
+	// QuoteLargeIntegers writes the int values as plain numbers up to
+	// 2^53, the largest integer a double holds exactly, in 'strict mode',
+	// and the int32 and int64 values as quoted values. This is the
+	// default.
+	QuoteLargeIntegers IntegerQuoting = iota
+	// QuoteAllIntegers writes every integer as a quoted value, like the
+	// extended JSON v2 spec: int, int8 and int16 values are written as
+	// $numberInt if they fit, and as $numberLong otherwise.
+	QuoteAllIntegers
+	// QuoteNoIntegers writes every integer as a plain number, for the
+	// parsers that don't support the quoted values.
+	QuoteNoIntegers
+)
+
+// SetIntegerQuoting defines when the integers are written as quoted
+// values, instead of relying on the implicit threshold of 2^53. It only
+// applies to the 'strict mode' and 'canonical mode' encoders.
+func (enc *Encoder) SetIntegerQuoting(q IntegerQuoting) {
+	enc.intQuoting = q
+}
+
+// KeepFloatDecimalPoint defines whether the floats with an integral value
+// are written with a decimal part, like 3.0 instead of 3, so that they
+// are decoded again as doubles rather than as integers by other tools,
+// like mongoimport. It is set by default by NewCanonicalEncoder.
+func (enc *Encoder) KeepFloatDecimalPoint(keep bool) {
+	enc.floatPoint = keep
+}
+
+// ShellFloatFormat defines whether floats are written like the mongo shell
+// prints them, so that the output can be compared byte for byte with the
+// one of tojson(): without exponent from 1e-6 to 1e21 excluded, like
+// 0.00001 instead of 1e-05, and NaN, Infinity or -Infinity for the special
+// values, instead of an error. It is set by default by
+// NewShellPrettyEncoder.
+func (enc *Encoder) ShellFloatFormat(enable bool) {
+	enc.shellFloat = enable
+}
+
+// WriteIDFirst defines whether the "_id" key of the encoded document is
+// written before the other keys, like in the documents returned by the
+// server. Only the top-level document is affected.
+func (enc *Encoder) WriteIDFirst(first bool) {
+	enc.idFirst = first
+}
+
 // DisableHTMLEscaping causes the encoder not to escape angle brackets
 // ("<" and ">") or ampersands ("&") in JSON strings.
 func (enc *Encoder) DisableHTMLEscaping() {
@@ -219,6 +870,7 @@ func (enc *Encoder) DisableHTMLEscaping() {
 //	Number, for JSON numbers
 //	string, for JSON string literals
 //	nil, for JSON null
+//	the decoded value, for shell constructs like ObjectId("...")
 //
 type Token interface{}
 
@@ -227,6 +879,8 @@ const (
 	tokenArrayStart
 	tokenArrayValue
 	tokenArrayComma
+	tokenObjectStart
+	tokenObjectKey
 	tokenObjectColon
 	tokenObjectValue
 	tokenObjectComma
@@ -244,7 +898,7 @@ func (dec *Decoder) tokenPrepareForDecode() error {
 			return err
 		}
 		if c != ',' {
-			return &SyntaxError{"expected comma after array element", 0}
+			return dec.syntaxError("expected comma after array element")
 		}
 		dec.scanp++
 		dec.tokenState = tokenArrayValue
@@ -254,7 +908,7 @@ func (dec *Decoder) tokenPrepareForDecode() error {
 			return err
 		}
 		if c != ':' {
-			return &SyntaxError{"expected colon after object key", 0}
+			return dec.syntaxError("expected colon after object key")
 		}
 		dec.scanp++
 		dec.tokenState = tokenObjectValue
@@ -297,3 +951,190 @@ func (dec *Decoder) peek() (byte, error) {
 		err = dec.refill()
 	}
 }
+
+// skipSemicolons consumes the semicolons found between top-level values,
+// if the decoder accepts them.
+func (dec *Decoder) skipSemicolons() {
+	if !dec.semicolons || dec.tokenState != tokenTopValue {
+		return
+	}
+	for {
+		c, err := dec.peek()
+		if err != nil || c != ';' {
+			return
+		}
+		dec.scanp++
+	}
+}
+
+// A Delim is a JSON array or object delimiter, one of [ ] { or }.
+type Delim rune
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// Token returns the next JSON token in the input stream.
+// At the end of the input stream, Token returns nil, io.EOF.
+//
+// Token guarantees that the delimiters [ ] { } it returns are
+// properly nested and matched: if Token encounters an unexpected
+// delimiter in the input, it will return an error.
+//
+// The input stream consists of basic JSON values—bool, string,
+// number, and null—along with delimiters [ ] { } of type Delim
+// to mark the start and end of arrays and objects.
+// Commas and colons are elided.
+//
+// Shell constructs, like ObjectId("...") or NumberLong(1), are returned
+// as a single token holding the decoded value, like primitive.ObjectID
+// or int64. Unquoted keys are returned as strings. Keyed documents like
+// {"$oid": "..."} are returned as regular objects.
+func (dec *Decoder) Token() (Token, error) {
+	for {
+		c, err := dec.peek()
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case '[':
+			if !dec.tokenValueAllowed() {
+				return dec.tokenError(c)
+			}
+			dec.scanp++
+			dec.tokenStack = append(dec.tokenStack, dec.tokenState)
+			dec.tokenState = tokenArrayStart
+			return Delim('['), nil
+
+		case ']':
+			if dec.tokenState != tokenArrayStart && dec.tokenState != tokenArrayComma &&
+				!(dec.tokenState == tokenArrayValue && dec.d.ext.trailingCommas) {
+				return dec.tokenError(c)
+			}
+			dec.scanp++
+			dec.tokenState = dec.tokenStack[len(dec.tokenStack)-1]
+			dec.tokenStack = dec.tokenStack[:len(dec.tokenStack)-1]
+			dec.tokenValueEnd()
+			return Delim(']'), nil
+
+		case '{':
+			if !dec.tokenValueAllowed() {
+				return dec.tokenError(c)
+			}
+			dec.scanp++
+			dec.tokenStack = append(dec.tokenStack, dec.tokenState)
+			dec.tokenState = tokenObjectStart
+			return Delim('{'), nil
+
+		case '}':
+			if dec.tokenState != tokenObjectStart && dec.tokenState != tokenObjectComma &&
+				!(dec.tokenState == tokenObjectKey && dec.d.ext.trailingCommas) {
+				return dec.tokenError(c)
+			}
+			dec.scanp++
+			dec.tokenState = dec.tokenStack[len(dec.tokenStack)-1]
+			dec.tokenStack = dec.tokenStack[:len(dec.tokenStack)-1]
+			dec.tokenValueEnd()
+			return Delim('}'), nil
+
+		case ':':
+			if dec.tokenState != tokenObjectColon {
+				return dec.tokenError(c)
+			}
+			dec.scanp++
+			dec.tokenState = tokenObjectValue
+			continue
+
+		case ',':
+			if dec.tokenState == tokenArrayComma {
+				dec.scanp++
+				dec.tokenState = tokenArrayValue
+				continue
+			}
+			if dec.tokenState == tokenObjectComma {
+				dec.scanp++
+				dec.tokenState = tokenObjectKey
+				continue
+			}
+			return dec.tokenError(c)
+		}
+
+		if dec.tokenState == tokenObjectStart || dec.tokenState == tokenObjectKey {
+			return dec.tokenKey(c)
+		}
+		if !dec.tokenValueAllowed() {
+			return dec.tokenError(c)
+		}
+		var x interface{}
+		if err := dec.Decode(&x); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+}
+
+// tokenKey reads the object key starting with c, which may be quoted
+// or not.
+func (dec *Decoder) tokenKey(c byte) (Token, error) {
+	var key string
+	switch {
+	case c == '"' || c == '\'' || c == '`':
+		old := dec.tokenState
+		dec.tokenState = tokenTopValue
+		err := dec.Decode(&key)
+		dec.tokenState = old
+		if err != nil {
+			return nil, err
+		}
+	case isName(c) && dec.d.ext.unquotedKeys:
+		var err error
+		if key, err = dec.readName(); err != nil {
+			return nil, err
+		}
+	default:
+		return dec.tokenError(c)
+	}
+	dec.tokenState = tokenObjectColon
+	return key, nil
+}
+
+// readName reads an unquoted name from the input stream.
+func (dec *Decoder) readName() (string, error) {
+	var name []byte
+	for {
+		for i := dec.scanp; i < len(dec.buf); i++ {
+			if !isName(dec.buf[i]) {
+				name = append(name, dec.buf[dec.scanp:i]...)
+				dec.scanp = i
+				return string(name), nil
+			}
+		}
+		name = append(name, dec.buf[dec.scanp:]...)
+		dec.scanp = len(dec.buf)
+		if err := dec.refill(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	}
+}
+
+func (dec *Decoder) tokenError(c byte) (Token, error) {
+	var context string
+	switch dec.tokenState {
+	case tokenTopValue:
+		context = " looking for beginning of value"
+	case tokenArrayStart, tokenArrayValue, tokenObjectValue:
+		context = " looking for beginning of value"
+	case tokenArrayComma:
+		context = " after array element"
+	case tokenObjectStart, tokenObjectKey:
+		context = " looking for beginning of object key string"
+	case tokenObjectColon:
+		context = " after object key"
+	case tokenObjectComma:
+		context = " after object key:value pair"
+	}
+	return nil, dec.syntaxError("invalid character " + quoteChar(c) + context)
+}
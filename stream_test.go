@@ -0,0 +1,1151 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestEncoderReset(t *testing.T) {
+
+	t.Parallel()
+
+	enc := mongoextjson.NewShellEncoder(failingWriter{})
+	if err := enc.Encode(objectID); err == nil {
+		t.Fatal("expected a write error")
+	}
+
+	var buf bytes.Buffer
+	enc.Reset(&buf)
+	if err := enc.Encode(objectID); err != nil {
+		t.Fatal(err)
+	}
+	// the encoder is still in 'shell mode'
+	if want, got := `ObjectId("5a934e000102030405000000")`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestEncoderAppend(t *testing.T) {
+
+	t.Parallel()
+
+	enc := mongoextjson.NewCanonicalV2Encoder(failingWriter{})
+	enc.WriteIDFirst(true)
+
+	// the writer of the encoder is not used
+	buf := []byte("docs: ")
+	buf, err := enc.Append(buf, bson.M{"n": int32(1), "_id": objectID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err = enc.Append(append(buf, ' '), []int64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `docs: {"_id":{"$oid":"5a934e000102030405000000"},"n":{"$numberInt":"1"}} [{"$numberLong":"1"}]`, string(buf); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	// the buffer is reused
+	reused, err := enc.Append(buf[:0], int64(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"$numberLong":"2"}`, string(reused); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+	if &reused[0] != &buf[0] {
+		t.Error("expected the buffer to be reused")
+	}
+
+	reused, err = enc.Append(reused, make(chan int))
+	if err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+	if want, got := `{"$numberLong":"2"}`, string(reused); want != got {
+		t.Errorf("expected the buffer to be unchanged, but got %s", got)
+	}
+
+	// the dialects reformatting the whole output are supported
+	enc = mongoextjson.NewShellEncoder(nil)
+	enc.SetDialect(mongoextjson.DialectMongosh)
+	out, err := enc.Append(nil, bson.D{{Key: "n", Value: int64(64)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{n:Long('64')}`, string(out); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+
+	t.Parallel()
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(`{"a": 1} {"b": `))
+	dec.UsePrimitiveNull()
+
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&v); err == nil {
+		t.Fatal("expected an error for truncated input")
+	}
+
+	dec.Reset(strings.NewReader(`{"_id": ObjectId("5a934e000102030405000000"), "n": null}`))
+	v = nil
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v["_id"] != objectID {
+		t.Errorf("expected %v, but got %v", objectID, v["_id"])
+	}
+	if v["n"] != (primitive.Null{}) {
+		t.Errorf("decoder options should be kept, but got %v", v["n"])
+	}
+}
+
+type recordingWriter struct {
+	bytes.Buffer
+	writes   int
+	maxWrite int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestEncoderStreaming(t *testing.T) {
+
+	t.Parallel()
+
+	docs := make([]map[string]interface{}, 10000)
+	for i := range docs {
+		docs[i] = map[string]interface{}{"_id": objectID, "s": strings.Repeat("x", 100)}
+	}
+
+	w := &recordingWriter{}
+	if err := mongoextjson.NewShellEncoder(w).Encode(docs); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := mongoextjson.Marshal(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, w.Bytes()) {
+		t.Error("streamed output differs from Marshal output")
+	}
+	if w.writes < 2 {
+		t.Errorf("expected the output to be written in several chunks, got %d write", w.writes)
+	}
+	if w.maxWrite >= len(want)/2 {
+		t.Errorf("expected bounded writes, but got a write of %d bytes out of %d", w.maxWrite, len(want))
+	}
+}
+
+func TestEncoderStreamingWriteError(t *testing.T) {
+
+	t.Parallel()
+
+	docs := make([]string, 10000)
+	for i := range docs {
+		docs[i] = strings.Repeat("x", 100)
+	}
+
+	enc := mongoextjson.NewEncoder(failingWriter{})
+	if err := enc.Encode(docs); err == nil {
+		t.Fatal("expected a write error")
+	}
+	// the error is sticky, as for errors on the final write
+	if err := enc.Encode(1); err == nil {
+		t.Error("expected the write error to be returned again")
+	}
+}
+
+func TestArrayElements(t *testing.T) {
+
+	t.Parallel()
+
+	data := `[
+		{"_id": ObjectId("5a934e000102030405000000"), "n": 1},
+		{"n": NumberLong(2)},
+		[3, [4]],
+		[],
+	] {"after": true}`
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+
+	var got []interface{}
+	err := dec.ArrayElements(func() error {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		got = append(got, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected 4 elements, but got %d: %v", len(got), got)
+	}
+	if doc := got[0].(map[string]interface{}); doc["_id"] != objectID {
+		t.Errorf("expected %v, but got %v", objectID, doc["_id"])
+	}
+	if doc := got[1].(map[string]interface{}); doc["n"] != int64(2) {
+		t.Errorf("expected NumberLong(2), but got %#v", doc["n"])
+	}
+
+	// the stream can be read after the array
+	var after map[string]bool
+	if err := dec.Decode(&after); err != nil || !after["after"] {
+		t.Errorf("expected to decode the next value, but got %v, %v", after, err)
+	}
+}
+
+func TestArrayElementsNested(t *testing.T) {
+
+	t.Parallel()
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(`[[1, 2], [3]]`))
+
+	var sum int
+	err := dec.ArrayElements(func() error {
+		return dec.ArrayElements(func() error {
+			var n int
+			err := dec.Decode(&n)
+			sum += n
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 6 {
+		t.Errorf("expected 6, but got %d", sum)
+	}
+}
+
+func TestArrayElementsErrors(t *testing.T) {
+
+	t.Parallel()
+
+	decodeAll := func(dec *mongoextjson.Decoder) func() error {
+		return func() error {
+			var v interface{}
+			return dec.Decode(&v)
+		}
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "not an array", data: `{"a": 1}`},
+		{name: "truncated", data: `[1, 2`},
+		{name: "missing comma", data: `[1 2]`},
+		{name: "invalid element", data: `[1, }]`},
+	}
+	for _, tt := range tests {
+		dec := mongoextjson.NewExtendedDecoder(strings.NewReader(tt.data))
+		if err := dec.ArrayElements(decodeAll(dec)); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	dec := mongoextjson.NewDecoder(strings.NewReader(`[1,]`))
+	if err := dec.ArrayElements(decodeAll(dec)); err == nil {
+		t.Error("expected an error for trailing comma without extension")
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`[1]`))
+	if err := dec.ArrayElements(func() error { return nil }); err == nil {
+		t.Error("expected an error when no element is decoded")
+	}
+}
+
+func TestDecoderToken(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{_id: ObjectId("5a934e000102030405000000"), "a": [1, 'two', NumberLong(3), null,], ` +
+		"`k`" + `: {"$oid": "5a934e000102030405000000"}, "b": true,}`
+
+	want := []mongoextjson.Token{
+		mongoextjson.Delim('{'),
+		"_id", objectID,
+		"a", mongoextjson.Delim('['), float64(1), "two", int64(3), nil, mongoextjson.Delim(']'),
+		"k", mongoextjson.Delim('{'), "$oid", "5a934e000102030405000000", mongoextjson.Delim('}'),
+		"b", true,
+		mongoextjson.Delim('}'),
+	}
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	for i, w := range want {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("token %d: %v", i, err)
+		}
+		if tok != w {
+			t.Fatalf("token %d: expected %#v, but got %#v", i, w, tok)
+		}
+	}
+	if tok, err := dec.Token(); err != io.EOF {
+		t.Errorf("expected io.EOF, but got %v, %v", tok, err)
+	}
+}
+
+func TestDecoderTokenErrors(t *testing.T) {
+
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		data string
+		ext  bool
+	}{
+		{name: "mismatched delim", data: `[1}`, ext: true},
+		{name: "missing colon", data: `{"a" 1}`, ext: true},
+		{name: "unquoted key", data: `{a: 1}`},
+		{name: "trailing comma", data: `[1,]`},
+	}
+	for _, tt := range tests {
+		dec := mongoextjson.NewDecoder(strings.NewReader(tt.data))
+		if tt.ext {
+			dec = mongoextjson.NewExtendedDecoder(strings.NewReader(tt.data))
+		}
+		var err error
+		for err == nil {
+			_, err = dec.Token()
+		}
+		if err == io.EOF {
+			t.Errorf("%s: expected a syntax error", tt.name)
+		}
+	}
+}
+
+func TestDecoderMore(t *testing.T) {
+
+	t.Parallel()
+
+	data := "{\"n\": 1}{\"n\": NumberLong(2)}\n{n: 3}\n\n"
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	var got []interface{}
+	for dec.More() {
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v["n"])
+	}
+	if want := []interface{}{float64(1), int64(2), float64(3)}; fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("expected %v, but got %v", want, got)
+	}
+
+	// More within arrays, trailing comma included
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`[1, 2,]`))
+	if _, err := dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for dec.More() {
+		var v int
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("expected 2 elements, but got %d", n)
+	}
+	if tok, err := dec.Token(); err != nil || tok != mongoextjson.Delim(']') {
+		t.Errorf("expected end of array, but got %v, %v", tok, err)
+	}
+}
+
+func TestDecodeNext(t *testing.T) {
+
+	t.Parallel()
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader("{\"_id\": ObjectId(\"5a934e000102030405000000\")}\n{\"_id\": 2}\n"))
+
+	var docs []map[string]interface{}
+	for {
+		var v map[string]interface{}
+		ok, err := dec.DecodeNext(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		docs = append(docs, v)
+	}
+	if len(docs) != 2 || docs[0]["_id"] != objectID {
+		t.Errorf("unexpected documents: %v", docs)
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`{"a": 1} {"a": `))
+	var v interface{}
+	if ok, err := dec.DecodeNext(&v); !ok || err != nil {
+		t.Fatalf("expected a first value, but got %v, %v", ok, err)
+	}
+	if _, err := dec.DecodeNext(&v); err == nil {
+		t.Error("expected an error for truncated value")
+	}
+}
+
+func TestDecoderUseNumber(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"big": 9007199254740993, "hex": 0x10, "f": 2.5, "a": [1]}`
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	big, ok := v["big"].(mongoextjson.Number)
+	if !ok {
+		t.Fatalf("expected a Number, but got %T", v["big"])
+	}
+	if n, err := big.Int64(); err != nil || n != 9007199254740993 {
+		t.Errorf("expected 9007199254740993, but got %d, %v", n, err)
+	}
+	if v["hex"] != mongoextjson.Number("16") {
+		t.Errorf("expected 16, but got %#v", v["hex"])
+	}
+	if f, err := v["f"].(mongoextjson.Number).Float64(); err != nil || f != 2.5 {
+		t.Errorf("expected 2.5, but got %v, %v", f, err)
+	}
+	if a := v["a"].([]interface{}); a[0] != mongoextjson.Number("1") {
+		t.Errorf("expected 1, but got %#v", a[0])
+	}
+
+	// the literal is written back as is
+	b, err := mongoextjson.Marshal(v["big"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "9007199254740993" {
+		t.Errorf("expected 9007199254740993, but got %s", b)
+	}
+
+	// Number fields are filled without UseNumber
+	var s struct {
+		N mongoextjson.Number `json:"n"`
+	}
+	if err := mongoextjson.Unmarshal([]byte(`{"n": 123456789012345678}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.N != "123456789012345678" {
+		t.Errorf("expected 123456789012345678, but got %s", s.N)
+	}
+}
+
+func TestDecoderUseIntegers(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"i": 42, "neg": -7, "l": 9007199254740993, "hex": 0x10, "f": 2.0, "e": 1e3, "z": -0, "huge": 1e19, "over": 18446744073709551616, "a": [2147483648]}`
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.UseIntegers()
+
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"i":    int32(42),
+		"neg":  int32(-7),
+		"l":    int64(9007199254740993),
+		"hex":  int32(16),
+		"f":    2.0,
+		"e":    1000.0,
+		"z":    math.Copysign(0, -1),
+		"huge": 1e19,
+		"over": 18446744073709551616.0,
+		"a":    []interface{}{int64(2147483648)},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("expected %#v, but got %#v", want, v)
+	}
+
+	// the types are kept when the values are written back
+	b, err := mongoextjson.MarshalCanonicalV2(bson.D{{Key: "i", Value: v["i"]}, {Key: "l", Value: v["l"]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"i":{"$numberInt":"42"},"l":{"$numberLong":"9007199254740993"}}`, string(b); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestDecoderUseBSONTypes(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"a": {"b": [1, {"c": ObjectId("5a934e000102030405000000")}]}, "d": []}`
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.UseBSONTypes()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{
+		"a": bson.M{"b": bson.A{1.0, bson.M{"c": objectID}}},
+		"d": bson.A{},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("expected %#v, but got %#v", want, v)
+	}
+
+	// the values can be marshaled to BSON as is
+	if _, err := bson.Marshal(v); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecoderUseOrderedDocuments(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"z":1.5,"a":{"y":"s","b":[{"k":true,"c":null}]},"id":{"$oid":"5a934e000102030405000000"}}`
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.UseOrderedDocuments()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.(bson.D); !ok {
+		t.Fatalf("expected a bson.D, but got %T", v)
+	}
+
+	// the keys are written back in their original order
+	b, err := mongoextjson.MarshalCanonical(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != data {
+		t.Errorf("expected %s, but got %s", data, b)
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`{"a": 1, "b": 2, "a": 3} {}`))
+	dec.UseOrderedDocuments()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.D{{Key: "a", Value: 3.0}, {Key: "b", Value: 2.0}}); !reflect.DeepEqual(v, want) {
+		t.Errorf("expected %v, but got %v", want, v)
+	}
+	if err := dec.Decode(&v); err != nil || !reflect.DeepEqual(v, bson.D{}) {
+		t.Errorf("expected an empty bson.D, but got %#v, %v", v, err)
+	}
+}
+
+func TestDecoderDisallowDuplicateKeys(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"a": 1, "b": {"c": 1, c: 2}}`
+
+	var v map[string]interface{}
+	if err := mongoextjson.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("duplicate keys are allowed by default, but got %v", err)
+	}
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.DisallowDuplicateKeys()
+	err := dec.Decode(&v)
+	var dupErr *mongoextjson.DuplicateKeyError
+	if !errors.As(err, &dupErr) {
+		t.Fatalf("expected a *DuplicateKeyError, but got %v", err)
+	}
+	if dupErr.Key != "c" || dupErr.Offset != 23 {
+		t.Errorf("expected key c at offset 23, but got %s at %d", dupErr.Key, dupErr.Offset)
+	}
+
+	// same check when decoding into a struct
+	var s struct {
+		A int `json:"a"`
+	}
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`{"a": 1, "a": 2}`))
+	dec.DisallowDuplicateKeys()
+	if err := dec.Decode(&s); !errors.As(err, &dupErr) || dupErr.Key != "a" {
+		t.Errorf("expected a duplicate key error for key a, but got %v", err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+
+	t.Parallel()
+
+	doc := `{"a": BinData(0, "` + strings.Repeat("A", 1000) + `")}`
+
+	var v interface{}
+	var limitErr *mongoextjson.LimitError
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(doc))
+	dec.SetMaxDocumentSize(len(doc))
+	dec.SetMaxTokenLength(1002)
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("document within limits should be decoded, but got %v", err)
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(doc))
+	dec.SetMaxDocumentSize(len(doc) - 1)
+	if err := dec.Decode(&v); !errors.As(err, &limitErr) || limitErr.Limit != "document size" {
+		t.Errorf("expected a document size error, but got %v", err)
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(doc))
+	dec.SetMaxTokenLength(1001)
+	if err := dec.Decode(&v); !errors.As(err, &limitErr) || limitErr.Limit != "token length" {
+		t.Errorf("expected a token length error, but got %v", err)
+	}
+
+	// the input is not read past the limit
+	r := &countingReader{r: strings.NewReader(`[` + strings.Repeat(`1,`, 100000) + `1]`)}
+	dec = mongoextjson.NewExtendedDecoder(r)
+	dec.SetMaxDocumentSize(1024)
+	if err := dec.Decode(&v); !errors.As(err, &limitErr) {
+		t.Errorf("expected a limit error, but got %v", err)
+	}
+	if r.n > 4096 {
+		t.Errorf("expected the input to be read partially, but %d bytes were read", r.n)
+	}
+}
+
+type countingReader struct {
+	r *strings.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestTypedErrors(t *testing.T) {
+
+	t.Parallel()
+
+	var syntaxErr *mongoextjson.SyntaxError
+	var typeErr *mongoextjson.UnmarshalTypeError
+	var extErr *mongoextjson.ExtensionError
+
+	var v map[string]interface{}
+	err := mongoextjson.Unmarshal([]byte(`{"a": ObjectId("5a934e00")}`), &v)
+	if !errors.As(err, &extErr) {
+		t.Fatalf("expected an *ExtensionError, but got %T: %v", err, err)
+	}
+	if extErr.Name != "ObjectId" || extErr.Offset != 6 || extErr.Value != `ObjectId("5a934e00")` {
+		t.Errorf("unexpected error content: %+v", extErr)
+	}
+
+	err = mongoextjson.Unmarshal([]byte(`{"a": {"$date": "not a date"}}`), &v)
+	if !errors.As(err, &extErr) || extErr.Name != "$date" {
+		t.Errorf("expected an *ExtensionError for $date, but got %v", err)
+	}
+
+	err = mongoextjson.Unmarshal([]byte(`{"a": Unknown(1)}`), &v)
+	if !errors.As(err, &syntaxErr) {
+		t.Errorf("expected a *SyntaxError for an unknown function, but got %T: %v", err, err)
+	}
+
+	var s struct {
+		A int `json:"a"`
+	}
+	err = mongoextjson.Unmarshal([]byte(`{"a": "str"}`), &s)
+	if !errors.As(err, &typeErr) || typeErr.Type.Kind().String() != "int" || typeErr.Value != "string" {
+		t.Errorf("expected an *UnmarshalTypeError, but got %v", err)
+	}
+
+	// offsets are relative to the beginning of the stream
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(`{"a": 1} {"a": ObjectId("5a934e00")} {"a": }`))
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&v); !errors.As(err, &extErr) || extErr.Offset != 15 {
+		t.Errorf("expected an *ExtensionError at offset 15, but got %v", err)
+	}
+	if err := dec.Decode(&v); !errors.As(err, &syntaxErr) || syntaxErr.Offset != 44 {
+		t.Errorf("expected a *SyntaxError at offset 44, but got %v", err)
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+
+	t.Parallel()
+
+	var extErr *mongoextjson.ExtensionError
+	var syntaxErr *mongoextjson.SyntaxError
+
+	input := "{\"a\": 1}\n{\n  \"b\": ObjectId(\"5a934e00\")\n}\n{\"c\":\n  ]}"
+	// read one byte at a time so that the lines are counted across refills
+	dec := mongoextjson.NewExtendedDecoder(iotest.OneByteReader(strings.NewReader(input)))
+
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	err := dec.Decode(&v)
+	if !errors.As(err, &extErr) || extErr.Line != 3 || extErr.Column != 8 {
+		t.Fatalf("expected an *ExtensionError at line 3, column 8, but got %v", err)
+	}
+	if !strings.HasSuffix(err.Error(), " at line 3, column 8") {
+		t.Errorf("expected the position in the error message, but got %q", err.Error())
+	}
+	err = dec.Decode(&v)
+	if !errors.As(err, &syntaxErr) || syntaxErr.Line != 6 || syntaxErr.Column != 3 {
+		t.Errorf("expected a *SyntaxError at line 6, column 3, but got %v", err)
+	}
+
+	var s struct {
+		A int `json:"a"`
+	}
+	err = mongoextjson.UnmarshalNoCopy([]byte("{\n\t\"a\": \"str\"\n}"), &s)
+	if want := "json: cannot unmarshal string into Go value of type int in a at line 2, column 11"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, but got %v", want, err)
+	}
+}
+
+func TestErrorPath(t *testing.T) {
+
+	t.Parallel()
+
+	data := []byte(`{"orders": [{}, {}, {}, {"items": [{"_id": {"$oid": "5a934e"}}]}]}`)
+
+	var extErr *mongoextjson.ExtensionError
+	var m map[string]interface{}
+	err := mongoextjson.Unmarshal(data, &m)
+	if !errors.As(err, &extErr) || extErr.Path != "orders[3].items[0]._id" {
+		t.Errorf("expected an *ExtensionError in orders[3].items[0]._id, but got %v", err)
+	}
+
+	var s struct {
+		Orders []struct {
+			Items []struct {
+				ID primitive.ObjectID `json:"_id"`
+			} `json:"items"`
+		} `json:"orders"`
+	}
+	err = mongoextjson.Unmarshal(data, &s)
+	if !errors.As(err, &extErr) || extErr.Path != "orders[3].items[0]._id" {
+		t.Errorf("expected an *ExtensionError in orders[3].items[0]._id, but got %v", err)
+	}
+	if want := " in orders[3].items[0]._id at line 1, column 44"; err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected error message to end with %q, but got %v", want, err)
+	}
+
+	var typeErr *mongoextjson.UnmarshalTypeError
+	var n struct {
+		A []struct {
+			B int `json:"b"`
+		} `json:"a"`
+	}
+	err = mongoextjson.Unmarshal([]byte(`{"a": [{"b": 1}, {"b": true}]}`), &n)
+	if !errors.As(err, &typeErr) || typeErr.Path != "a[1].b" {
+		t.Errorf("expected an *UnmarshalTypeError in a[1].b, but got %v", err)
+	}
+
+	var dupErr *mongoextjson.DuplicateKeyError
+	dec := mongoextjson.NewDecoder(strings.NewReader(`{"a": {"b": 1, "b": 2}}`))
+	dec.DisallowDuplicateKeys()
+	if err := dec.Decode(&m); !errors.As(err, &dupErr) || dupErr.Path != "a" {
+		t.Errorf("expected a *DuplicateKeyError in a, but got %v", err)
+	}
+}
+
+func TestDecoderTimeZonePolicy(t *testing.T) {
+
+	t.Parallel()
+
+	data := `{"a": ISODate("2016-05-15T01:02:03.004+01:00"), "b": {"$date": "2016-05-15T01:02:03.004-05:30"}, "c": new Date(0)}`
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	var preserved map[string]time.Time
+	if err := dec.Decode(&preserved); err != nil {
+		t.Fatal(err)
+	}
+	for key, offset := range map[string]int{"a": 3600, "b": -19800, "c": 0} {
+		if _, got := preserved[key].Zone(); offset != got {
+			t.Errorf("%s: expected offset %d, but got %d", key, offset, got)
+		}
+	}
+	// the offset is written back
+	b, err := mongoextjson.Marshal(preserved["a"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `ISODate("2016-05-15T01:02:03.004+01:00")`, string(b); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.SetTimeZonePolicy(mongoextjson.NormalizeToUTC)
+	var normalized map[string]interface{}
+	if err := dec.Decode(&normalized); err != nil {
+		t.Fatal(err)
+	}
+	for key, v := range normalized {
+		tm := v.(time.Time)
+		if tm.Location() != time.UTC || !tm.Equal(preserved[key]) {
+			t.Errorf("%s: expected %v in UTC, but got %v", key, preserved[key], tm)
+		}
+	}
+}
+
+func TestEncoderSubMillisecondPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	date := time.Date(2016, 5, 15, 1, 2, 3, 4600000, time.UTC)
+
+	tests := []struct {
+		policy mongoextjson.SubMillisecondPolicy
+		want   string
+		err    string
+	}{
+		{
+			policy: mongoextjson.TruncateSubMilliseconds,
+			want:   `{"d":ISODate("2016-05-15T01:02:03.004Z")}`,
+		},
+		{
+			policy: mongoextjson.RoundSubMilliseconds,
+			want:   `{"d":ISODate("2016-05-15T01:02:03.005Z")}`,
+		},
+		{
+			policy: mongoextjson.RejectSubMilliseconds,
+			err:    "json: unsupported value: date with sub-millisecond precision 2016-05-15T01:02:03.0046Z",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		enc := mongoextjson.NewShellEncoder(&buf)
+		enc.SetSubMillisecondPolicy(tt.policy)
+		err := enc.Encode(bson.M{"d": date})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expected error %q, but got %v", tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); tt.want != got {
+			t.Errorf("expected %s, but got %s", tt.want, got)
+		}
+	}
+
+	// whole milliseconds are always accepted
+	var buf bytes.Buffer
+	enc := mongoextjson.NewCanonicalV2Encoder(&buf)
+	enc.SetSubMillisecondPolicy(mongoextjson.RejectSubMilliseconds)
+	if err := enc.Encode(bson.M{"d": date.Truncate(time.Millisecond)}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncoderKeepFloatDecimalPoint(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.D{
+		{Key: "whole", Value: 3.0},
+		{Key: "f32", Value: float32(-2)},
+		{Key: "frac", Value: 2.5},
+		{Key: "exp", Value: 1e21},
+		{Key: "int", Value: 3},
+	}
+
+	b, err := mongoextjson.MarshalCanonical(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"whole":3.0,"f32":-2.0,"frac":2.5,"exp":1e+21,"int":3}`, string(b); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	var buf bytes.Buffer
+	enc := mongoextjson.NewShellEncoder(&buf)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"whole":3,"f32":-2,"frac":2.5,"exp":1e+21,"int":3}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	buf.Reset()
+	enc.KeepFloatDecimalPoint(true)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"whole":3.0,"f32":-2.0,"frac":2.5,"exp":1e+21,"int":3}`, buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestEncoderShellFloatFormat(t *testing.T) {
+
+	t.Parallel()
+
+	// as printed by the mongo shell
+	tests := []struct {
+		f    float64
+		want string
+	}{
+		{f: 3, want: "3"},
+		{f: -2.5, want: "-2.5"},
+		{f: 0.1, want: "0.1"},
+		{f: math.Copysign(0, -1), want: "0"},
+		{f: 12345.678, want: "12345.678"},
+		{f: 1e20, want: "100000000000000000000"},
+		{f: 1.2345678901234568e20, want: "123456789012345680000"},
+		{f: 1e21, want: "1e+21"},
+		{f: -2.5e30, want: "-2.5e+30"},
+		{f: 1e-5, want: "0.00001"},
+		{f: 1.5e-6, want: "0.0000015"},
+		{f: 1e-7, want: "1e-7"},
+		{f: 1.5e-7, want: "1.5e-7"},
+		{f: 5e-324, want: "5e-324"},
+		{f: math.MaxFloat64, want: "1.7976931348623157e+308"},
+		{f: math.NaN(), want: "NaN"},
+		{f: math.Inf(1), want: "Infinity"},
+		{f: math.Inf(-1), want: "-Infinity"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		enc := mongoextjson.NewShellEncoder(&buf)
+		enc.ShellFloatFormat(true)
+		if err := enc.Encode(tt.f); err != nil {
+			t.Fatalf("%v: %v", tt.f, err)
+		}
+		if got := buf.String(); tt.want != got {
+			t.Errorf("%v: expected %s, but got %s", tt.f, tt.want, got)
+		}
+	}
+
+	// enabled by default to match tojson()
+	b, err := mongoextjson.MarshalShellPretty(bson.D{{Key: "f", Value: 1e-5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "{\n\t\"f\" : 0.00001\n}", string(b); want != got {
+		t.Errorf("expected %q, but got %q", want, got)
+	}
+}
+
+func TestEncoderUintOverflowPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	small := bson.D{
+		{Key: "a", Value: uint8(1)},
+		{Key: "b", Value: uint32(math.MaxInt32)},
+		{Key: "c", Value: uint32(math.MaxUint32)},
+		{Key: "d", Value: uint64(2)},
+		{Key: "e", Value: uint(3)},
+	}
+	var buf bytes.Buffer
+	enc := mongoextjson.NewCanonicalV2Encoder(&buf)
+	if err := enc.Encode(small); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":{"$numberInt":"1"},"b":{"$numberInt":"2147483647"},"c":{"$numberLong":"4294967295"},"d":{"$numberLong":"2"},"e":{"$numberInt":"3"}}`
+	if got := buf.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+
+	tests := []struct {
+		policy mongoextjson.UintOverflowPolicy
+		want   string
+		err    string
+	}{
+		{
+			policy: mongoextjson.RejectUintOverflow,
+			err:    "json: unsupported value: unsigned integer overflowing int64 18446744073709551615",
+		},
+		{
+			policy: mongoextjson.DecimalUintOverflow,
+			want:   `{"n":NumberDecimal("18446744073709551615")}`,
+		},
+		{
+			policy: mongoextjson.WrapUintOverflow,
+			want:   `{"n":NumberLong(-1)}`,
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		enc := mongoextjson.NewShellEncoder(&buf)
+		enc.SetUintOverflowPolicy(tt.policy)
+		err := enc.Encode(bson.M{"n": uint64(math.MaxUint64)})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expected error %q, but got %v", tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); tt.want != got {
+			t.Errorf("expected %s, but got %s", tt.want, got)
+		}
+	}
+}
+
+type money struct {
+	Cents int64
+}
+
+func TestDecoderDecodeDecimalType(t *testing.T) {
+
+	t.Parallel()
+
+	toMoney := func(n primitive.Decimal128) (interface{}, error) {
+		f, err := strconv.ParseFloat(n.String(), 64)
+		if err != nil {
+			return nil, err
+		}
+		if f != math.Trunc(f*100)/100 {
+			return nil, fmt.Errorf("%s has more than 2 decimals", n)
+		}
+		return money{Cents: int64(math.Round(f * 100))}, nil
+	}
+
+	type order struct {
+		Price    money
+		Discount *money
+		Tax      primitive.Decimal128
+		Raw      interface{}
+	}
+	data := `{"price": {"$numberDecimal": "12.50"}, "discount": NumberDecimal("1.25"), "tax": NumberDecimal("0.5"), "raw": NumberDecimal("2")}`
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(data))
+	dec.DecodeDecimalType(money{}, toMoney)
+	var o order
+	if err := dec.Decode(&o); err != nil {
+		t.Fatal(err)
+	}
+	if want := (money{Cents: 1250}); want != o.Price {
+		t.Errorf("expected %v, but got %v", want, o.Price)
+	}
+	if want := (money{Cents: 125}); o.Discount == nil || want != *o.Discount {
+		t.Errorf("expected %v, but got %v", want, o.Discount)
+	}
+	if want, got := "0.5", o.Tax.String(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+	if _, ok := o.Raw.(primitive.Decimal128); !ok {
+		t.Errorf("expected a primitive.Decimal128, but got %T", o.Raw)
+	}
+
+	dec = mongoextjson.NewExtendedDecoder(strings.NewReader(`{"price": NumberDecimal("0.125")}`))
+	dec.DecodeDecimalType(money{}, toMoney)
+	err := dec.Decode(&o)
+	var extErr *mongoextjson.ExtensionError
+	if !errors.As(err, &extErr) {
+		t.Fatalf("expected an *ExtensionError, but got %v", err)
+	}
+	if want, got := "NumberDecimal", extErr.Name; want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+	if want, got := `0.125 has more than 2 decimals in price at line 1, column 11`, err.Error(); want != got {
+		t.Errorf("expected %s, but got %s", want, got)
+	}
+}
+
+func TestEncoderSetIntegerQuoting(t *testing.T) {
+
+	t.Parallel()
+
+	doc := bson.D{
+		{Key: "int", Value: 42},
+		{Key: "big", Value: 1<<53 + 1},
+		{Key: "int8", Value: int8(-3)},
+		{Key: "int32", Value: int32(7)},
+		{Key: "int64", Value: int64(8)},
+		{Key: "float", Value: 2.5},
+	}
+
+	tests := []struct {
+		quoting mongoextjson.IntegerQuoting
+		newEnc  func(io.Writer) *mongoextjson.Encoder
+		want    string
+	}{
+		{
+			quoting: mongoextjson.QuoteLargeIntegers,
+			newEnc:  mongoextjson.NewCanonicalEncoder,
+			want:    `{"int":42,"big":{"$numberLong":"9007199254740993"},"int8":-3,"int32":{"$numberInt":"7"},"int64":{"$numberLong":"8"},"float":2.5}`,
+		},
+		{
+			quoting: mongoextjson.QuoteAllIntegers,
+			newEnc:  mongoextjson.NewCanonicalEncoder,
+			want:    `{"int":{"$numberInt":"42"},"big":{"$numberLong":"9007199254740993"},"int8":{"$numberInt":"-3"},"int32":{"$numberInt":"7"},"int64":{"$numberLong":"8"},"float":2.5}`,
+		},
+		{
+			quoting: mongoextjson.QuoteNoIntegers,
+			newEnc:  mongoextjson.NewCanonicalEncoder,
+			want:    `{"int":42,"big":9007199254740993,"int8":-3,"int32":7,"int64":8,"float":2.5}`,
+		},
+		{
+			quoting: mongoextjson.QuoteNoIntegers,
+			newEnc:  mongoextjson.NewCanonicalV2Encoder,
+			want:    `{"int":42,"big":9007199254740993,"int8":-3,"int32":7,"int64":8,"float":{"$numberDouble":"2.5"}}`,
+		},
+		{
+			quoting: mongoextjson.QuoteAllIntegers,
+			newEnc:  mongoextjson.NewShellEncoder,
+			want:    `{"int":42,"big":{"$numberLong":"9007199254740993"},"int8":-3,"int32":7,"int64":NumberLong(8),"float":2.5}`,
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		enc := tt.newEnc(&buf)
+		enc.SetIntegerQuoting(tt.quoting)
+		if err := enc.Encode(doc); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); tt.want != got {
+			t.Errorf("expected %s, but got %s", tt.want, got)
+		}
+	}
+}
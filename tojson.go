@@ -0,0 +1,91 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+import "bytes"
+
+// tojsonIndent appends to dst the compact 'shell mode' encoding src,
+// indented the same way than the tojson() function of the mongo shell:
+// one key per line, tab indentation and " : " between keys and values.
+//
+// Arguments of shell constructors like DBRef("coll",ObjectId("...")) are
+// left untouched. A parenthesis only opens such a call when it follows the
+// name of the constructor, so the ones found in strings or in regular
+// expression literals like /a(b/ are written as is.
+func tojsonIndent(dst *bytes.Buffer, src []byte) {
+	depth := 0
+	calls := 0
+	var quote byte // the delimiter of the current string or regex, if any
+
+	newline := func() {
+		dst.WriteByte('\n')
+		for i := 0; i < depth; i++ {
+			dst.WriteByte('\t')
+		}
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if quote != 0 {
+			dst.WriteByte(c)
+			switch c {
+			case '\\':
+				if i+1 < len(src) {
+					i++
+					dst.WriteByte(src[i])
+				}
+			case quote:
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '/':
+			quote = c
+			dst.WriteByte(c)
+			continue
+		case '(':
+			if i > 0 && isConstructorChar(src[i-1]) {
+				calls++
+			}
+		case ')':
+			if calls > 0 {
+				calls--
+			}
+		}
+		if calls > 0 || c == ')' {
+			dst.WriteByte(c)
+			continue
+		}
+		switch c {
+		case '{', '[':
+			if i+1 < len(src) && (src[i+1] == '}' || src[i+1] == ']') {
+				dst.WriteByte(c)
+				dst.WriteByte(' ')
+				dst.WriteByte(src[i+1])
+				i++
+				continue
+			}
+			dst.WriteByte(c)
+			depth++
+			newline()
+		case '}', ']':
+			depth--
+			newline()
+			dst.WriteByte(c)
+		case ',':
+			dst.WriteByte(c)
+			newline()
+		case ':':
+			dst.WriteString(" : ")
+		default:
+			dst.WriteByte(c)
+		}
+	}
+}
+
+// isConstructorChar reports whether c can end the name of a shell
+// constructor, like ObjectId or NumberLong.
+func isConstructorChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '$'
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson
+
+// UnmarshalTyped is like Unmarshal, but returns the decoded value of
+// type T instead of storing it in a value passed by pointer:
+//
+//	doc, err := mongoextjson.UnmarshalTyped[bson.M](data)
+func UnmarshalTyped[T any](data []byte) (T, error) {
+	var v T
+	err := Unmarshal(data, &v)
+	return v, err
+}
+
+// Decode reads the next value of dec, like Decoder.Decode, and returns it
+// as a value of type T.
+func Decode[T any](dec *Decoder) (T, error) {
+	var v T
+	err := dec.Decode(&v)
+	return v, err
+}
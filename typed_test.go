@@ -0,0 +1,53 @@
+// Copyright (c) 2020 - Adrien Petel
+
+package mongoextjson_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUnmarshalTyped(t *testing.T) {
+
+	t.Parallel()
+
+	type doc struct {
+		ID primitive.ObjectID `json:"_id"`
+		N  int64              `json:"n"`
+	}
+	d, err := mongoextjson.UnmarshalTyped[doc]([]byte(`{_id: ObjectId("5a934e000102030405000000"), n: NumberLong(2)}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ID != objectID || d.N != 2 {
+		t.Errorf("unexpected value %+v", d)
+	}
+
+	if _, err := mongoextjson.UnmarshalTyped[bson.M]([]byte(`[1]`)); err == nil {
+		t.Error("expected an error for an array decoded in a bson.M")
+	}
+}
+
+func TestDecodeTyped(t *testing.T) {
+
+	t.Parallel()
+
+	dec := mongoextjson.NewExtendedDecoder(strings.NewReader(`{a: 1} {a: 2}`))
+	for _, want := range []float64{1, 2} {
+		m, err := mongoextjson.Decode[bson.M](dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m["a"] != want {
+			t.Errorf("expected %v, but got %v", want, m["a"])
+		}
+	}
+	if _, err := mongoextjson.Decode[bson.M](dec); err != io.EOF {
+		t.Errorf("expected io.EOF, but got %v", err)
+	}
+}